@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"math"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	AttributeString  = "string"
+	AttributeNumber  = "number"
+	AttributeInteger = "integer"
+	AttributeBoolean = "boolean"
+	AttributeEnum    = "enum"
+)
+
+var attributeTypes = []string{AttributeString, AttributeNumber, AttributeInteger, AttributeBoolean, AttributeEnum}
+
+var attributeNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,49}$`)
+
+//////////////////////
+// CATEGORY ATTRIBUTES
+// Every category can define the custom attributes of its products (ex. the cargo tonnage of freighters).
+// The schemas are stored as json in a hash keyed by category id and cached along with the categories.
+//////////////////////
+type AttributeDefinition struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Unit     string   `json:"unit,omitempty"`
+	Required bool     `json:"required"`
+	Values   []string `json:"values,omitempty"` // the allowed values of enum attributes
+}
+
+type CategoryDetails struct {
+	Category
+	Attributes []AttributeDefinition `json:"attributes"`
+}
+
+// Returns a list of validation errors, or an empty list if the schema is valid
+func validateAttributeSchema(schema []AttributeDefinition) []string {
+	errs := make([]string, 0)
+	names := make([]string, 0, len(schema))
+	for _, definition := range schema {
+		if !attributeNamePattern.MatchString(definition.Name) {
+			errs = append(errs, fmt.Sprintf("%q isn't a valid attribute name (lower case letters, digits and underscores)", definition.Name))
+		}
+		if stringInSlice(definition.Name, names) {
+			errs = append(errs, fmt.Sprintf("The attribute %s is defined twice", definition.Name))
+		}
+		names = append(names, definition.Name)
+
+		if !stringInSlice(definition.Type, attributeTypes) {
+			errs = append(errs, fmt.Sprintf("The type of %s needs to be one of %s", definition.Name, strings.Join(attributeTypes, ", ")))
+		}
+		if definition.Type == AttributeEnum && len(definition.Values) == 0 {
+			errs = append(errs, fmt.Sprintf("The enum attribute %s needs a list of values", definition.Name))
+		}
+		if definition.Type != AttributeEnum && len(definition.Values) > 0 {
+			errs = append(errs, fmt.Sprintf("Only enum attributes can have a list of values (%s)", definition.Name))
+		}
+	}
+	return errs
+}
+
+// Checks the values against the schema, returning an error for every invalid field
+func validateAttributes(values map[string]interface{}, schema []AttributeDefinition) map[string]string {
+	errs := make(map[string]string)
+
+	for _, definition := range schema {
+		value, ok := values[definition.Name]
+		if !ok || value == nil {
+			if definition.Required {
+				errs[definition.Name] = "This attribute is required"
+			}
+			delete(values, definition.Name)
+			continue
+		}
+
+		switch definition.Type {
+		case AttributeString:
+			if _, ok := value.(string); !ok {
+				errs[definition.Name] = "Needs to be a string"
+			}
+		case AttributeNumber:
+			if _, ok := value.(float64); !ok {
+				errs[definition.Name] = "Needs to be a number"
+			}
+		case AttributeInteger:
+			number, ok := value.(float64)
+			if !ok || number != math.Trunc(number) {
+				errs[definition.Name] = "Needs to be a whole number"
+			}
+		case AttributeBoolean:
+			if _, ok := value.(bool); !ok {
+				errs[definition.Name] = "Needs to be true or false"
+			}
+		case AttributeEnum:
+			if s, ok := value.(string); !ok || !stringInSlice(s, definition.Values) {
+				errs[definition.Name] = fmt.Sprintf("Needs to be one of %s", strings.Join(definition.Values, ", "))
+			}
+		}
+	}
+
+	for name := range values {
+		if getAttributeDefinition(name, schema) == nil {
+			errs[name] = "The category doesn't have this attribute"
+		}
+	}
+	return errs
+}
+
+func getAttributeDefinition(name string, schema []AttributeDefinition) *AttributeDefinition {
+	for i := range schema {
+		if schema[i].Name == name {
+			return &schema[i]
+		}
+	}
+	return nil
+}
+
+// Validates the attributes sent by the API consumer against the schema of the product's category
+func (product *Product) setAttributesFromInput(redisConn redis.Conn) map[string]string {
+	if product.Attributes == nil {
+		product.Attributes = make(map[string]interface{})
+	}
+	errs := validateAttributes(product.Attributes, categoryCache.getAttributeSchema(product.MainCategoryId, redisConn))
+	product.setAttributesJson()
+	return errs
+}
+
+func (product *Product) setAttributesJson() {
+	product.AttributesJson = ""
+	if len(product.Attributes) > 0 {
+		encoded, _ := json.Marshal(product.Attributes)
+		product.AttributesJson = string(encoded)
+	}
+}
+
+func (product *Product) setAttributes() {
+	product.Attributes = nil
+	if product.AttributesJson != "" {
+		_ = json.Unmarshal([]byte(product.AttributesJson), &product.Attributes)
+	}
+}
+
+func loadAttributeSchemas(redisConn redis.Conn) (map[int][]AttributeDefinition, error) {
+	schemas := make(map[int][]AttributeDefinition)
+	values, err := getHashAsStringMap(config.KeyCategoryAttributes, redisConn)
+	if err != nil {
+		return schemas, err
+	}
+	for categoryId, encoded := range values {
+		id, _ := strconv.Atoi(categoryId)
+		schema := make([]AttributeDefinition, 0)
+		if err := json.Unmarshal([]byte(encoded), &schema); err != nil {
+			logger.Warn("Invalid attribute schema", Fields{"category_id": id, "error": err})
+			continue
+		}
+		schemas[id] = schema
+	}
+	return schemas, nil
+}
+
+// Saves the schema and lets all instances know they need to reload the categories
+func saveAttributeSchema(categoryId int, schema []AttributeDefinition, redisConn redis.Conn) error {
+	encoded, err := json.Marshal(schema)
+	if err != nil {
+		return err
+	}
+	_, err = redisConn.Do("HSET", config.KeyCategoryAttributes, categoryId, encoded)
+	if err != nil {
+		return err
+	}
+	categoryCache.invalidate(getKeyPrefix(redisConn))
+	return publishCategoriesChanged(redisConn)
+}
+
+//////////////////////
+// ATTRIBUTE INDEXES
+// Numeric attributes are indexed in a sorted set per attribute, scored by the value.
+// Other attributes have a sorted set (with a score of 0) per attribute value.
+// Both hold product lex names, so they can be intersected with the product listings.
+//////////////////////
+type attributeIndexEntry struct {
+	key   string
+	score float64
+}
+
+func getAttributeIndexEntries(attributes map[string]interface{}) []attributeIndexEntry {
+	entries := make([]attributeIndexEntry, 0, len(attributes))
+	for name, value := range attributes {
+		switch v := value.(type) {
+		case float64:
+			entries = append(entries, attributeIndexEntry{getProductsByAttributeKeyName(name), v})
+		case string, bool:
+			entries = append(entries, attributeIndexEntry{getProductsByAttributeValueKeyName(name, fmt.Sprint(v)), 0})
+		}
+	}
+	return entries
+}
+
+func sendAttributeIndexAdd(product *Product, redisConn redis.Conn) {
+	for _, entry := range getAttributeIndexEntries(product.Attributes) {
+		_ = redisConn.Send("ZADD", entry.key, entry.score, product.getLexName())
+	}
+}
+
+func sendAttributeIndexRemove(product *Product, redisConn redis.Conn) {
+	for _, entry := range getAttributeIndexEntries(product.Attributes) {
+		_ = redisConn.Send("ZREM", entry.key, product.getLexName())
+	}
+}
+
+// Builds the listing filters from the query. `attr.<name>=<value>` matches a value exactly,
+// `attr.<name>.min=<number>` and `attr.<name>.max=<number>` match a range of a numeric attribute.
+func getAttributeFilters(query url.Values) ([]IndexFilter, error) {
+	filters := make([]IndexFilter, 0)
+	ranges := make(map[string]*ScoreRange)
+	rangeNames := make([]string, 0)
+
+	// Sort the parameters, so the filters are always built in the same order
+	params := make([]string, 0, len(query))
+	for param := range query {
+		params = append(params, param)
+	}
+	sort.Strings(params)
+
+	for _, param := range params {
+		if !strings.HasPrefix(param, "attr.") {
+			continue
+		}
+		name := strings.TrimPrefix(param, "attr.")
+		value := query.Get(param)
+
+		bound := ""
+		if strings.HasSuffix(name, ".min") || strings.HasSuffix(name, ".max") {
+			bound = name[len(name)-3:]
+			name = name[:len(name)-4]
+		}
+		if !attributeNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("%q isn't a valid attribute name", name)
+		}
+
+		if bound == "" {
+			filter := IndexFilter{Ranges: []ScoreRange{
+				{Key: getProductsByAttributeValueKeyName(name, value), Min: "-inf", Max: "+inf"},
+			}}
+			// Numeric attributes are matched by value, since 12 and 12.0 are the same
+			if number, err := strconv.ParseFloat(value, 64); err == nil {
+				filter.Ranges = append(filter.Ranges, ScoreRange{Key: getProductsByAttributeKeyName(name), Min: formatScore(number), Max: formatScore(number)})
+			}
+			filters = append(filters, filter)
+			continue
+		}
+
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("the %s of %s needs to be a number", bound, name)
+		}
+		scoreRange, ok := ranges[name]
+		if !ok {
+			scoreRange = &ScoreRange{Key: getProductsByAttributeKeyName(name), Min: "-inf", Max: "+inf"}
+			ranges[name] = scoreRange
+			rangeNames = append(rangeNames, name)
+		}
+		if bound == "min" {
+			scoreRange.Min = formatScore(number)
+		} else {
+			scoreRange.Max = formatScore(number)
+		}
+	}
+
+	for _, name := range rangeNames {
+		filters = append(filters, IndexFilter{Ranges: []ScoreRange{*ranges[name]}})
+	}
+	return filters, nil
+}
+
+func formatScore(score float64) string {
+	return strconv.FormatFloat(score, 'f', -1, 64)
+}
+
+// Helper functions
+func getProductsByAttributeKeyName(name string) string {
+	return fmt.Sprintf(config.KeyProductsByAttribute, name)
+}
+func getProductsByAttributeValueKeyName(name string, value string) string {
+	return fmt.Sprintf(config.KeyProductsByAttributeValue, name, strings.ToLower(value))
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"github.com/rafaeljusto/redigomock"
+	"gotest.tools/assert"
+	"net/url"
+	"testing"
+	"time"
+)
+
+var freighterSchema = []AttributeDefinition{
+	{Name: "cargo_tonnage", Type: AttributeNumber, Unit: "t", Required: true},
+	{Name: "crew_capacity", Type: AttributeInteger},
+	{Name: "hull", Type: AttributeEnum, Values: []string{"light", "heavy"}},
+	{Name: "refurbished", Type: AttributeBoolean},
+	{Name: "shipyard", Type: AttributeString},
+}
+
+func TestValidateAttributeSchema(t *testing.T) {
+	assert.Equal(t, 0, len(validateAttributeSchema(freighterSchema)))
+
+	errs := validateAttributeSchema([]AttributeDefinition{
+		{Name: "Cargo Tonnage", Type: AttributeNumber},
+		{Name: "hull", Type: AttributeEnum},
+		{Name: "hull", Type: "colour"},
+		{Name: "crew", Type: AttributeInteger, Values: []string{"1"}},
+	})
+	assert.Equal(t, 5, len(errs))
+}
+
+func TestValidateAttributes(t *testing.T) {
+	values := map[string]interface{}{
+		"cargo_tonnage": 1200.5,
+		"crew_capacity": float64(12),
+		"hull":          "heavy",
+		"refurbished":   false,
+		"shipyard":      nil,
+	}
+	assert.Equal(t, 0, len(validateAttributes(values, freighterSchema)))
+	_, hasShipyard := values["shipyard"]
+	assert.Assert(t, !hasShipyard, "Empty attributes shouldn't be stored")
+
+	errs := validateAttributes(map[string]interface{}{
+		"crew_capacity": 12.5,
+		"hull":          "medium",
+		"refurbished":   "yes",
+		"shipyard":      3.0,
+		"lab_count":     float64(2),
+	}, freighterSchema)
+	assert.DeepEqual(t, map[string]string{
+		"cargo_tonnage": "This attribute is required",
+		"crew_capacity": "Needs to be a whole number",
+		"hull":          "Needs to be one of light, heavy",
+		"refurbished":   "Needs to be true or false",
+		"shipyard":      "Needs to be a string",
+		"lab_count":     "The category doesn't have this attribute",
+	}, errs)
+}
+
+func TestProduct_setAttributesFromInput(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("HGETALL", config.KeyCategories).ExpectMap(map[string]string{"3": "Freighters"})
+	conn.Command("HGETALL", config.KeyCategoryAttributes).ExpectMap(map[string]string{
+		"3": `[{"name":"cargo_tonnage","type":"number","required":true}]`,
+	})
+	categoryCache = newCategoryCaches(time.Minute)
+	defer func() { categoryCache = newCategoryCaches(time.Minute) }()
+
+	product := Product{MainCategoryId: 3, Attributes: map[string]interface{}{"cargo_tonnage": float64(1200)}}
+	assert.Equal(t, 0, len(product.setAttributesFromInput(conn)))
+	assert.Equal(t, `{"cargo_tonnage":1200}`, product.AttributesJson)
+
+	product = Product{MainCategoryId: 3}
+	assert.DeepEqual(t, map[string]string{"cargo_tonnage": "This attribute is required"}, product.setAttributesFromInput(conn))
+}
+
+func TestGetAttributeIndexEntries(t *testing.T) {
+	entries := getAttributeIndexEntries(map[string]interface{}{"cargo_tonnage": 1200.5})
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, attributeIndexEntry{"products:attr:cargo_tonnage", 1200.5}, entries[0])
+
+	entries = getAttributeIndexEntries(map[string]interface{}{"hull": "Heavy"})
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, attributeIndexEntry{"products:attr:hull:heavy", 0}, entries[0])
+}
+
+func TestGetAttributeFilters(t *testing.T) {
+	query := url.Values{}
+	query.Set("attr.hull", "heavy")
+	query.Set("attr.cargo_tonnage.min", "1000")
+	query.Set("attr.cargo_tonnage.max", "5000")
+	query.Set("search", "roci")
+
+	filters, err := getAttributeFilters(query)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []IndexFilter{
+		{Ranges: []ScoreRange{{Key: "products:attr:hull:heavy", Min: "-inf", Max: "+inf"}}},
+		{Ranges: []ScoreRange{{Key: "products:attr:cargo_tonnage", Min: "1000", Max: "5000"}}},
+	}, filters)
+
+	// Numbers match numeric attributes as well as string ones
+	query = url.Values{}
+	query.Set("attr.crew_capacity", "12")
+	filters, err = getAttributeFilters(query)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []IndexFilter{{Ranges: []ScoreRange{
+		{Key: "products:attr:crew_capacity:12", Min: "-inf", Max: "+inf"},
+		{Key: "products:attr:crew_capacity", Min: "12", Max: "12"},
+	}}}, filters)
+
+	query = url.Values{}
+	query.Set("attr.cargo_tonnage.min", "lots")
+	_, err = getAttributeFilters(query)
+	assert.ErrorContains(t, err, "needs to be a number")
+}
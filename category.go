@@ -1,7 +1,6 @@
 package main
 
 import (
-	"fmt"
 	"github.com/gomodule/redigo/redis"
 	"strconv"
 )
@@ -12,10 +11,18 @@ type Category struct {
 }
 
 func getCategoriesMap(redisConn redis.Conn) map[int]Category {
+	categories, e := loadCategories(redisConn)
+	if e != nil {
+		logger.Error("Unable to fetch categories", Fields{"error": e})
+	}
+	return categories
+}
+
+func loadCategories(redisConn redis.Conn) (map[int]Category, error) {
 	categories := make(map[int]Category, 0)
 	values, e := getHashAsStringMap(config.KeyCategories, redisConn)
 	if e != nil {
-		fmt.Println(e)
+		return categories, e
 	}
 
 	for categoryId, categoryName := range values {
@@ -27,14 +34,14 @@ func getCategoriesMap(redisConn redis.Conn) map[int]Category {
 		categories[categoryId] = category
 	}
 
-	return categories
+	return categories, nil
 }
 
 
 func getCategoryNameById(id int, redisConn redis.Conn) (string, error) {
-	categoryName, err := redis.String(redisConn.Do("HGET", config.KeyCategories, id))
-	if err != nil {
-		return "", err
+	category, ok := categoryCache.get(id, redisConn)
+	if !ok {
+		return "", redis.ErrNil
 	}
-	return categoryName, nil
+	return category.Name, nil
 }
\ No newline at end of file
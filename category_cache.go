@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"github.com/gomodule/redigo/redis"
+	"sync"
+	"time"
+)
+
+//////////////////////
+// CATEGORY CACHE
+// Categories almost never change, so we keep them in memory instead of reading the hash on every request.
+// The cache is refreshed when its TTL runs out, and cleared on every instance as soon as a
+// notification is published on the categories channel (see `publishCategoriesChanged`).
+//////////////////////
+type CategoryCache struct {
+	mu         sync.RWMutex
+	categories map[int]Category
+	schemas    map[int][]AttributeDefinition
+	loadedAt   time.Time
+	ttl        time.Duration
+}
+
+var categoryCache = newCategoryCaches(5 * time.Minute)
+
+var categoryCacheLookups = newCounterVec("category_cache_lookups_total", "Number of category cache lookups.", "result")
+
+func newCategoryCache(ttl time.Duration) *CategoryCache {
+	return &CategoryCache{ttl: ttl}
+}
+
+// Returns all categories. The map is shared, so it must not be modified.
+func (cache *CategoryCache) all(redisConn redis.Conn) map[int]Category {
+	cache.mu.RLock()
+	categories, fresh := cache.categories, cache.isFresh()
+	cache.mu.RUnlock()
+
+	if fresh {
+		categoryCacheLookups.inc("hit")
+		return categories
+	}
+	categoryCacheLookups.inc("miss")
+	return cache.refresh(redisConn)
+}
+
+func (cache *CategoryCache) get(id int, redisConn redis.Conn) (Category, bool) {
+	category, ok := cache.all(redisConn)[id]
+	if ok {
+		return category, true
+	}
+
+	// The category could've been added after the last refresh. We only reload for unknown ids
+	// once a second, so requests with made up ids can't send all the traffic to Redis.
+	cache.mu.RLock()
+	recentlyLoaded := time.Since(cache.loadedAt) < time.Second
+	cache.mu.RUnlock()
+	if recentlyLoaded {
+		return Category{}, false
+	}
+
+	category, ok = cache.refresh(redisConn)[id]
+	return category, ok
+}
+
+func (cache *CategoryCache) refresh(redisConn redis.Conn) map[int]Category {
+	categories, err := loadCategories(redisConn)
+	var schemas map[int][]AttributeDefinition
+	if err == nil {
+		schemas, err = loadAttributeSchemas(redisConn)
+	}
+	if err != nil {
+		logger.Error("Unable to load categories", Fields{"error": err})
+
+		// Keep serving the stale categories rather than none at all
+		cache.mu.RLock()
+		defer cache.mu.RUnlock()
+		if cache.categories != nil {
+			return cache.categories
+		}
+		return categories
+	}
+
+	cache.mu.Lock()
+	cache.categories = categories
+	cache.schemas = schemas
+	cache.loadedAt = time.Now()
+	cache.mu.Unlock()
+
+	return categories
+}
+
+// Returns the attribute schema of the category, or an empty schema if it doesn't have one
+func (cache *CategoryCache) getAttributeSchema(categoryId int, redisConn redis.Conn) []AttributeDefinition {
+	// Makes sure the cache is fresh
+	cache.all(redisConn)
+
+	cache.mu.RLock()
+	defer cache.mu.RUnlock()
+	schema, ok := cache.schemas[categoryId]
+	if !ok {
+		return make([]AttributeDefinition, 0)
+	}
+	return schema
+}
+
+// Needs to be called with the read lock held
+func (cache *CategoryCache) isFresh() bool {
+	return cache.categories != nil && time.Since(cache.loadedAt) < cache.ttl
+}
+
+// Every tenant has its own categories, so there's one cache per namespace
+type CategoryCaches struct {
+	mu     sync.Mutex
+	ttl    time.Duration
+	caches map[string]*CategoryCache
+}
+
+func newCategoryCaches(ttl time.Duration) *CategoryCaches {
+	return &CategoryCaches{ttl: ttl, caches: make(map[string]*CategoryCache)}
+}
+
+// Returns the cache of the connection's namespace
+func (caches *CategoryCaches) of(redisConn redis.Conn) *CategoryCache {
+	return caches.forNamespace(getKeyPrefix(redisConn))
+}
+
+func (caches *CategoryCaches) forNamespace(namespace string) *CategoryCache {
+	caches.mu.Lock()
+	defer caches.mu.Unlock()
+
+	cache, ok := caches.caches[namespace]
+	if !ok {
+		cache = newCategoryCache(caches.ttl)
+		caches.caches[namespace] = cache
+	}
+	return cache
+}
+
+func (caches *CategoryCaches) all(redisConn redis.Conn) map[int]Category {
+	return caches.of(redisConn).all(redisConn)
+}
+
+func (caches *CategoryCaches) get(id int, redisConn redis.Conn) (Category, bool) {
+	return caches.of(redisConn).get(id, redisConn)
+}
+
+func (caches *CategoryCaches) getAttributeSchema(categoryId int, redisConn redis.Conn) []AttributeDefinition {
+	return caches.of(redisConn).getAttributeSchema(categoryId, redisConn)
+}
+
+// Drops the cache of the namespace, deleted tenants don't leave their categories behind
+func (caches *CategoryCaches) invalidate(namespace string) {
+	caches.mu.Lock()
+	defer caches.mu.Unlock()
+	delete(caches.caches, namespace)
+}
+
+func (caches *CategoryCaches) invalidateAll() {
+	caches.mu.Lock()
+	defer caches.mu.Unlock()
+	caches.caches = make(map[string]*CategoryCache)
+}
+
+// Lets every instance know it needs to reload the categories
+func publishCategoriesChanged(redisConn redis.Conn) error {
+	_, err := redisConn.Do("PUBLISH", config.CategoriesChannel, "changed")
+	return err
+}
+
+func runCategoryCacheInvalidator(ctx context.Context) {
+	runSubscriber(ctx, config.CategoriesChannel, func() error {
+		// We could've missed a notification while we weren't subscribed
+		categoryCache.invalidateAll()
+		return nil
+	}, func(message redis.Message) error {
+		namespace := getChannelNamespace(message, config.CategoriesChannel)
+		categoryCache.invalidate(namespace)
+		logger.Debug("Category cache invalidated", Fields{"namespace": namespace})
+		return nil
+	})
+}
+
+func categoryCacheHitRatio() float64 {
+	hits := categoryCacheLookups.get("hit")
+	misses := categoryCacheLookups.get("miss")
+	if hits+misses == 0 {
+		return 0
+	}
+	return hits / (hits + misses)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"github.com/rafaeljusto/redigomock"
+	"gotest.tools/assert"
+	"testing"
+	"time"
+)
+
+func TestCategoryCache_all(t *testing.T) {
+	conn := redigomock.NewConn()
+	cmd := conn.Command("HGETALL", config.KeyCategories).ExpectMap(map[string]string{
+		"1": "Science vessels",
+		"2": "Warships",
+	})
+	conn.Command("HGETALL", config.KeyCategoryAttributes).ExpectMap(map[string]string{})
+
+	caches := newCategoryCaches(time.Minute)
+	assert.Equal(t, "Warships", caches.all(conn)[2].Name)
+	assert.Equal(t, "Science vessels", caches.all(conn)[1].Name)
+	assert.Equal(t, 1, conn.Stats(cmd), "The second lookup should be served from memory")
+
+	caches.invalidate("")
+	caches.all(conn)
+	assert.Equal(t, 2, conn.Stats(cmd), "The categories should be reloaded after an invalidation")
+}
+
+func TestCategoryCache_expires(t *testing.T) {
+	conn := redigomock.NewConn()
+	cmd := conn.Command("HGETALL", config.KeyCategories).ExpectMap(map[string]string{"1": "Science vessels"})
+	conn.Command("HGETALL", config.KeyCategoryAttributes).ExpectMap(map[string]string{})
+
+	cache := newCategoryCache(time.Minute)
+	cache.all(conn)
+	cache.loadedAt = time.Now().Add(-2 * time.Minute)
+	cache.all(conn)
+
+	assert.Equal(t, 2, conn.Stats(cmd))
+}
+
+func TestCategoryCache_get(t *testing.T) {
+	conn := redigomock.NewConn()
+	cmd := conn.Command("HGETALL", config.KeyCategories).ExpectMap(map[string]string{"1": "Science vessels"})
+	conn.Command("HGETALL", config.KeyCategoryAttributes).ExpectMap(map[string]string{})
+
+	cache := newCategoryCache(time.Minute)
+	category, ok := cache.get(1, conn)
+	assert.Assert(t, ok)
+	assert.Equal(t, Category{Id: 1, Name: "Science vessels"}, category)
+
+	// Unknown ids don't trigger a reload right after the categories were loaded
+	_, ok = cache.get(99, conn)
+	assert.Assert(t, !ok)
+	assert.Equal(t, 1, conn.Stats(cmd))
+
+	// But they do a bit later, in case the category was just added
+	cache.loadedAt = time.Now().Add(-2 * time.Second)
+	_, ok = cache.get(99, conn)
+	assert.Assert(t, !ok)
+	assert.Equal(t, 2, conn.Stats(cmd))
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"strings"
+	"time"
+)
+
+const (
+	maxCollectionNameLength        = 200
+	maxCollectionDescriptionLength = 5000
+	maxCollectionProducts          = 500
+)
+
+//////////////////////
+// COLLECTION MODEL
+// Collections are hand-picked lists of products (ex. "Summer Fleet Sale"), independent of the categories.
+// The products of a collection are kept in a sorted set of product ids scored by their position, and every product
+// has a set of the collections it's in, so it can be taken out of them when it's deleted.
+// A collection can be scheduled, so it's only active between its start and end time.
+//////////////////////
+type Collection struct {
+	Id           int    `redis:"id" json:"id"`
+	Name         string `redis:"name" json:"name"`
+	Description  string `redis:"description" json:"description"`
+	StartsAt     int64  `redis:"starts_at" json:"starts_at,omitempty"` // unix timestamp, 0 if the collection is active right away
+	EndsAt       int64  `redis:"ends_at" json:"ends_at,omitempty"`     // unix timestamp, 0 if the collection doesn't end
+	CreatedAt    int64  `redis:"created_at" json:"created_at"`
+	UpdatedAt    int64  `redis:"updated_at" json:"updated_at"`
+	Active       bool   `redis:"-" json:"active"`
+	ProductCount int    `redis:"-" json:"product_count"`
+}
+
+// The products to add to a collection, inserted at `position` (0 is the top), or at the end if there's no position
+type CollectionProductsInput struct {
+	ProductIds []int `json:"product_ids"`
+	Position   *int  `json:"position"`
+}
+
+// KEYS: collection products, then the collections set of every product that's added.
+// ARGV: collection id, position (-1 for the end), max products, then the product ids.
+// Products that are already in the collection are moved to the position. Returns -1 if the collection would be too big.
+var insertCollectionProductsScript = redis.NewScript(-1, `
+local inserted = {}
+for i = 4, #ARGV do
+	inserted[ARGV[i]] = true
+end
+local kept = {}
+for _, id in ipairs(redis.call('ZRANGE', KEYS[1], 0, -1)) do
+	if not inserted[id] then
+		table.insert(kept, id)
+	end
+end
+if #kept + #ARGV - 3 > tonumber(ARGV[3]) then
+	return -1
+end
+local position = tonumber(ARGV[2])
+if position < 0 or position > #kept then
+	position = #kept
+end
+local ordered = {}
+for i = 1, position do
+	table.insert(ordered, kept[i])
+end
+for i = 4, #ARGV do
+	table.insert(ordered, ARGV[i])
+end
+for i = position + 1, #kept do
+	table.insert(ordered, kept[i])
+end
+redis.call('DEL', KEYS[1])
+for i, id in ipairs(ordered) do
+	redis.call('ZADD', KEYS[1], i - 1, id)
+end
+for i = 2, #KEYS do
+	redis.call('SADD', KEYS[i], ARGV[1])
+end
+return #ordered
+`)
+
+// KEYS: collection products. ARGV: all the product ids of the collection in their new order.
+// Returns 0 if the ids aren't exactly the products of the collection.
+var reorderCollectionProductsScript = redis.NewScript(1, `
+if redis.call('ZCARD', KEYS[1]) ~= #ARGV then
+	return 0
+end
+for _, id in ipairs(ARGV) do
+	if not redis.call('ZSCORE', KEYS[1], id) then
+		return 0
+	end
+end
+for i, id in ipairs(ARGV) do
+	redis.call('ZADD', KEYS[1], i - 1, id)
+end
+return 1
+`)
+
+// Returns a list of validation errors, or an empty list if the collection is valid
+func (collection *Collection) validate() []string {
+	errs := make([]string, 0)
+	if strings.TrimSpace(collection.Name) == "" {
+		errs = append(errs, "The name field is required")
+	}
+	if len([]rune(collection.Name)) > maxCollectionNameLength {
+		errs = append(errs, fmt.Sprintf("The name can't be longer than %v characters", maxCollectionNameLength))
+	}
+	if len([]rune(collection.Description)) > maxCollectionDescriptionLength {
+		errs = append(errs, fmt.Sprintf("The description can't be longer than %v characters", maxCollectionDescriptionLength))
+	}
+	if collection.StartsAt < 0 || collection.EndsAt < 0 {
+		errs = append(errs, "The schedule needs to be made of unix timestamps")
+	}
+	if collection.StartsAt > 0 && collection.EndsAt > 0 && collection.EndsAt <= collection.StartsAt {
+		errs = append(errs, "The collection needs to end after it starts")
+	}
+	return errs
+}
+
+// Returns a list of validation errors, or an empty list if the products can be added to the collection
+func (input *CollectionProductsInput) validate(redisConn redis.Conn) []string {
+	errs := make([]string, 0)
+	if len(input.ProductIds) == 0 {
+		errs = append(errs, "At least one product id is needed")
+	}
+	if input.Position != nil && *input.Position < 0 {
+		errs = append(errs, "The position can't be negative")
+	}
+	errs = append(errs, validateCollectionProductIds(input.ProductIds, redisConn)...)
+	return errs
+}
+
+func validateCollectionProductIds(productIds []int, redisConn redis.Conn) []string {
+	errs := make([]string, 0)
+	if len(productIds) > maxCollectionProducts {
+		errs = append(errs, fmt.Sprintf("A collection can't have more than %v products", maxCollectionProducts))
+	}
+	seen := make([]int, 0, len(productIds))
+	for _, productId := range productIds {
+		if intInSlice(productId, seen) {
+			errs = append(errs, fmt.Sprintf("The product %v is listed twice", productId))
+		} else if !productExists(productId, redisConn) {
+			errs = append(errs, fmt.Sprintf("The product %v doesn't exist", productId))
+		}
+		seen = append(seen, productId)
+	}
+	return errs
+}
+
+func (collection *Collection) isActiveAt(t time.Time) bool {
+	now := t.Unix()
+	return (collection.StartsAt == 0 || collection.StartsAt <= now) && (collection.EndsAt == 0 || now < collection.EndsAt)
+}
+
+func saveNewCollection(collection *Collection, redisConn redis.Conn) error {
+	id, err := redis.Int(redisConn.Do("INCR", config.KeyCollectionCounter))
+	if err != nil {
+		return err
+	}
+	collection.Id = id
+	collection.CreatedAt = time.Now().Unix()
+	collection.UpdatedAt = collection.CreatedAt
+	collection.Active = collection.isActiveAt(time.Now())
+
+	_, err = redisConn.Do("MULTI")
+	if err != nil {
+		return err
+	}
+	_ = redisConn.Send("HSET", redis.Args{getCollectionKeyName(collection.Id)}.AddFlat(collection)...)
+	_ = redisConn.Send("ZADD", config.KeyCollections, collection.Id, collection.Id)
+	_, err = redisConn.Do("EXEC")
+	return err
+}
+
+// Saves the name, description and schedule of an existing collection
+func updateCollection(collection *Collection, oldCollection *Collection, redisConn redis.Conn) error {
+	collection.Id = oldCollection.Id
+	collection.CreatedAt = oldCollection.CreatedAt
+	collection.UpdatedAt = time.Now().Unix()
+	collection.ProductCount = oldCollection.ProductCount
+	collection.Active = collection.isActiveAt(time.Now())
+
+	_, err := redisConn.Do("HSET", redis.Args{getCollectionKeyName(collection.Id)}.AddFlat(collection)...)
+	return err
+}
+
+func getCollectionById(id int, redisConn redis.Conn) (Collection, error) {
+	collection := Collection{}
+	values, err := redis.Values(redisConn.Do("HGETALL", getCollectionKeyName(id)))
+	if err != nil {
+		return collection, err
+	}
+	if len(values) == 0 {
+		return collection, &notFoundError
+	}
+	err = redis.ScanStruct(values, &collection)
+	if err != nil {
+		return collection, err
+	}
+
+	collection.ProductCount, err = redis.Int(redisConn.Do("ZCARD", getCollectionProductsKeyName(id)))
+	if err != nil {
+		return collection, err
+	}
+	collection.Active = collection.isActiveAt(time.Now())
+	return collection, nil
+}
+
+// All collections, oldest first. With `activeOnly` the collections that aren't scheduled for now are left out.
+func getCollections(activeOnly bool, redisConn redis.Conn) ([]Collection, error) {
+	collections := make([]Collection, 0)
+	ids, err := redis.Ints(redisConn.Do("ZRANGE", config.KeyCollections, 0, -1))
+	if err != nil {
+		return collections, err
+	}
+	for _, id := range ids {
+		collection, err := getCollectionById(id, redisConn)
+		if err == &notFoundError {
+			continue
+		}
+		if err != nil {
+			return collections, err
+		}
+		if activeOnly && !collection.Active {
+			continue
+		}
+		collections = append(collections, collection)
+	}
+	return collections, nil
+}
+
+func deleteCollection(id int, redisConn redis.Conn) error {
+	productIds, err := redis.Ints(redisConn.Do("ZRANGE", getCollectionProductsKeyName(id), 0, -1))
+	if err != nil {
+		return err
+	}
+
+	_, err = redisConn.Do("MULTI")
+	if err != nil {
+		return err
+	}
+	_ = redisConn.Send("ZREM", config.KeyCollections, id)
+	_ = redisConn.Send("DEL", getCollectionKeyName(id), getCollectionProductsKeyName(id))
+	for _, productId := range productIds {
+		_ = redisConn.Send("SREM", getProductCollectionsKeyName(productId), id)
+	}
+	replies, err := redis.Values(redisConn.Do("EXEC"))
+	if err != nil {
+		return err
+	}
+	if removed, _ := redis.Int(replies[0], nil); removed == 0 {
+		return &notFoundError
+	}
+	return nil
+}
+
+// The products of a collection in their curated order.
+// Products that aren't published can be curated ahead of time, but they're left out until they're published.
+// Returns a page of the collection's published products. Drafts, and products that no longer exist, are
+// skipped before paging, so every page but the last is full. Collections are small enough to read from the top.
+func getCollectionProducts(collectionId int, page int, categories map[int]Category, redisConn redis.Conn) ([]Product, error) {
+	products := make([]Product, 0, config.ResultsPerPage)
+	toSkip := (page - 1) * config.ResultsPerPage
+
+	for start := 0; len(products) < config.ResultsPerPage; start += config.ResultsPerPage {
+		productIds, err := redis.Ints(redisConn.Do("ZRANGE", getCollectionProductsKeyName(collectionId), start, start+config.ResultsPerPage-1))
+		if err != nil {
+			return products, err
+		}
+		batch, err := getProductsByIds(productIds, categories, redisConn)
+		if err != nil {
+			return products, err
+		}
+
+		for _, product := range batch {
+			if product.Id == 0 || product.DeletedAt != 0 || !product.isPublished() {
+				continue
+			}
+			if toSkip > 0 {
+				toSkip--
+				continue
+			}
+			if len(products) < config.ResultsPerPage {
+				products = append(products, product)
+			}
+		}
+		if len(productIds) < config.ResultsPerPage {
+			break
+		}
+	}
+	return products, nil
+}
+
+// Inserts the products at the position (0 is the top, -1 the end), moving the ones that are already in the collection
+func addCollectionProducts(collection *Collection, productIds []int, position int, redisConn redis.Conn) error {
+	args := redis.Args{1 + len(productIds), getCollectionProductsKeyName(collection.Id)}
+	for _, productId := range productIds {
+		args = args.Add(getProductCollectionsKeyName(productId))
+	}
+	args = args.Add(collection.Id, position, maxCollectionProducts).AddFlat(productIds)
+
+	count, err := redis.Int(insertCollectionProductsScript.Do(redisConn, args...))
+	if err != nil {
+		return err
+	}
+	if count < 0 {
+		return &ApiError{HttpStatus: 422, Title: "Validation errors", Description: fmt.Sprintf("A collection can't have more than %v products", maxCollectionProducts)}
+	}
+	collection.ProductCount = count
+	return touchCollection(collection, redisConn)
+}
+
+// Puts the products of the collection in a new order. All of the collection's products need to be listed.
+func reorderCollectionProducts(collection *Collection, productIds []int, redisConn redis.Conn) error {
+	reordered, err := redis.Int(reorderCollectionProductsScript.Do(redisConn,
+		redis.Args{getCollectionProductsKeyName(collection.Id)}.AddFlat(productIds)...,
+	))
+	if err != nil {
+		return err
+	}
+	if reordered == 0 {
+		return &ApiError{HttpStatus: 422, Title: "Validation errors", Description: "The product ids need to be exactly the products of the collection, in their new order"}
+	}
+	return touchCollection(collection, redisConn)
+}
+
+func removeCollectionProduct(collection *Collection, productId int, redisConn redis.Conn) error {
+	_, err := redisConn.Do("MULTI")
+	if err != nil {
+		return err
+	}
+	_ = redisConn.Send("ZREM", getCollectionProductsKeyName(collection.Id), productId)
+	_ = redisConn.Send("SREM", getProductCollectionsKeyName(productId), collection.Id)
+	replies, err := redis.Values(redisConn.Do("EXEC"))
+	if err != nil {
+		return err
+	}
+	if removed, _ := redis.Int(replies[0], nil); removed == 0 {
+		return &notFoundError
+	}
+	collection.ProductCount--
+	return touchCollection(collection, redisConn)
+}
+
+func touchCollection(collection *Collection, redisConn redis.Conn) error {
+	collection.UpdatedAt = time.Now().Unix()
+	_, err := redisConn.Do("HSET", getCollectionKeyName(collection.Id), "updated_at", collection.UpdatedAt)
+	return err
+}
+
+// Queues the removal of a deleted product from all the collections it's in, in the caller's transaction
+func sendCollectionMembershipsRemove(productId int, collectionIds []int, redisConn redis.Conn) {
+	for _, collectionId := range collectionIds {
+		_ = redisConn.Send("ZREM", getCollectionProductsKeyName(collectionId), productId)
+	}
+	_ = redisConn.Send("DEL", getProductCollectionsKeyName(productId))
+}
+
+func getProductCollectionIds(productId int, redisConn redis.Conn) ([]int, error) {
+	return redis.Ints(redisConn.Do("SMEMBERS", getProductCollectionsKeyName(productId)))
+}
+
+// Helper functions
+func getCollectionKeyName(id int) string {
+	return fmt.Sprintf(config.KeyCollection, id)
+}
+func getCollectionProductsKeyName(id int) string {
+	return fmt.Sprintf(config.KeyCollectionProducts, id)
+}
+func getProductCollectionsKeyName(productId int) string {
+	return fmt.Sprintf(config.KeyProductCollections, productId)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"github.com/rafaeljusto/redigomock"
+	"gotest.tools/assert"
+	"testing"
+	"time"
+)
+
+func TestCollection_validate(t *testing.T) {
+	collection := Collection{Name: "Summer Fleet Sale", StartsAt: 1567332000, EndsAt: 1569924000}
+	assert.Equal(t, 0, len(collection.validate()))
+
+	collection = Collection{Name: " ", StartsAt: 1569924000, EndsAt: 1567332000}
+	assert.Equal(t, 2, len(collection.validate()))
+}
+
+func TestCollection_isActiveAt(t *testing.T) {
+	now := time.Date(2019, 9, 1, 10, 0, 0, 0, time.UTC)
+
+	assert.Assert(t, (&Collection{}).isActiveAt(now))
+	assert.Assert(t, (&Collection{StartsAt: now.Unix(), EndsAt: now.Unix() + 3600}).isActiveAt(now))
+	assert.Assert(t, !(&Collection{StartsAt: now.Unix() + 1}).isActiveAt(now), "Collections shouldn't be active before they start")
+	assert.Assert(t, !(&Collection{EndsAt: now.Unix()}).isActiveAt(now), "Collections shouldn't be active once they end")
+}
+
+func TestAddCollectionProducts(t *testing.T) {
+	collection := Collection{Id: 3}
+
+	conn := redigomock.NewConn()
+	insert := conn.GenericCommand("EVALSHA").Expect(int64(4))
+	conn.Command("HSET", getCollectionKeyName(3), "updated_at", redigomock.NewAnyInt()).Expect(int64(0))
+	assert.NilError(t, addCollectionProducts(&collection, []int{7, 8}, 0, conn))
+	assert.Equal(t, 4, collection.ProductCount)
+	assert.Equal(t, 1, conn.Stats(insert))
+
+	conn = redigomock.NewConn()
+	conn.GenericCommand("EVALSHA").Expect(int64(-1))
+	err := addCollectionProducts(&collection, []int{9}, -1, conn)
+	assert.ErrorContains(t, err, "can't have more than")
+}
+
+func TestGetCollectionProducts_skipsHiddenProductsBeforePaging(t *testing.T) {
+	defaultResultsPerPage := config.ResultsPerPage
+	defer func() { config.ResultsPerPage = defaultResultsPerPage }()
+	config.ResultsPerPage = 2
+
+	conn := redigomock.NewConn()
+	conn.Command("ZRANGE", getCollectionProductsKeyName(3), 0, 1).Expect([]interface{}{[]byte("7"), []byte("8")})
+	conn.Command("ZRANGE", getCollectionProductsKeyName(3), 2, 3).Expect([]interface{}{[]byte("9"), []byte("10")})
+	conn.Command("ZRANGE", getCollectionProductsKeyName(3), 4, 5).Expect([]interface{}{[]byte("11")})
+	conn.Command("HGETALL", getProductNameById(7)).ExpectMap(map[string]string{"id": "7", "name": "Rocinante"})
+	conn.Command("HGETALL", getProductNameById(8)).ExpectMap(map[string]string{"id": "8", "name": "Pella", "status": ProductDraft})
+	// Product 9 no longer exists
+	conn.Command("HGETALL", getProductNameById(9)).ExpectMap(map[string]string{})
+	conn.Command("HGETALL", getProductNameById(10)).ExpectMap(map[string]string{"id": "10", "name": "Tachi"})
+	conn.Command("HGETALL", getProductNameById(11)).ExpectMap(map[string]string{"id": "11", "name": "Canterbury"})
+
+	products, err := getCollectionProducts(3, 1, map[int]Category{}, conn)
+	assert.NilError(t, err)
+	assert.Equal(t, 2, len(products))
+	assert.Equal(t, 7, products[0].Id)
+	assert.Equal(t, 10, products[1].Id)
+
+	products, err = getCollectionProducts(3, 2, map[int]Category{}, conn)
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(products))
+	assert.Equal(t, 11, products[0].Id)
+}
+
+func TestRemoveCollectionProduct_notInCollection(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("MULTI").Expect("OK")
+	conn.Command("ZREM", getCollectionProductsKeyName(3), 7).Expect(int64(0))
+	conn.Command("SREM", getProductCollectionsKeyName(7), 3).Expect(int64(0))
+	conn.Command("EXEC").Expect([]interface{}{int64(0), int64(0)})
+
+	err := removeCollectionProduct(&Collection{Id: 3}, 7, conn)
+	assert.Equal(t, err, &notFoundError)
+}
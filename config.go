@@ -2,7 +2,6 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
 	"os"
 )
 
@@ -22,9 +21,114 @@ type Config struct {
 	KeyProductImages      string `json:"key_product_images"`
 	KeyAllProducts        string `json:"key_all_products"`
 	KeyProductsInCategory string `json:"key_products_in_category"`
+	KeyProductVersions    string `json:"key_product_versions"`
+	KeyPriceMigration     string `json:"key_price_migration"`
+	KeyTrashedProducts    string `json:"key_trashed_products"`
+	KeyEventStream        string `json:"key_event_stream"`
+	EventsChannel         string `json:"events_channel"`
+	CategoriesChannel     string `json:"categories_channel"`
 
-	ResultsPerPage int    `json:"results_per_page"`
-	BugsnagKey     string `json:"bugsnag_key"`
+	KeyExchangeRates       string `json:"key_exchange_rates"`
+	KeyExchangeRatesBase   string `json:"key_exchange_rates_base"`
+	KeyProductsByPrice     string `json:"key_products_by_price"`
+	KeyPriceIndexMigration string `json:"key_price_index_migration"`
+	KeyTemporary           string `json:"key_temporary"`
+	KeyVariant             string `json:"key_variant"`
+	KeyVariantCounter      string `json:"key_variant_counter"`
+	KeyProductVariants     string `json:"key_product_variants"`
+	KeySkus                string `json:"key_skus"`
+	KeyStock               string `json:"key_stock"`
+	KeyInStockProducts     string `json:"key_in_stock_products"`
+	KeyReservation         string `json:"key_reservation"`
+	KeyReservationExpiries string `json:"key_reservation_expiries"`
+
+	KeyCategoryAttributes       string `json:"key_category_attributes"`
+	KeyProductsByAttribute      string `json:"key_products_by_attribute"`
+	KeyProductsByAttributeValue string `json:"key_products_by_attribute_value"`
+
+	KeyProductTranslations string `json:"key_product_translations"`
+	KeyProductsInLocale    string `json:"key_products_in_locale"`
+
+	KeySlugs         string `json:"key_slugs"`
+	KeyProductSlugs  string `json:"key_product_slugs"`
+	KeySlugMigration string `json:"key_slug_migration"`
+
+	KeyProductRelations         string `json:"key_product_relations"`
+	KeyProductsByVendor         string `json:"key_products_by_vendor"`
+	KeyProductsByToken          string `json:"key_products_by_token"`
+	KeySimilarityIndexMigration string `json:"key_similarity_index_migration"`
+
+	KeyTags          string `json:"key_tags"`
+	KeyProductsByTag string `json:"key_products_by_tag"`
+
+	KeyReview           string `json:"key_review"`
+	KeyReviewCounter    string `json:"key_review_counter"`
+	KeyProductReviews   string `json:"key_product_reviews"`
+	KeyProductsByRating string `json:"key_products_by_rating"`
+
+	KeyProductsByStatus  string `json:"key_products_by_status"`
+	KeyPublishSchedule   string `json:"key_publish_schedule"`
+	KeyUnpublishSchedule string `json:"key_unpublish_schedule"`
+
+	KeyCollection         string `json:"key_collection"`
+	KeyCollectionCounter  string `json:"key_collection_counter"`
+	KeyCollections        string `json:"key_collections"`
+	KeyCollectionProducts string `json:"key_collection_products"`
+	KeyProductCollections string `json:"key_product_collections"`
+
+	KeyWebhook                string `json:"key_webhook"`
+	KeyWebhooks               string `json:"key_webhooks"`
+	KeyWebhookCounter         string `json:"key_webhook_counter"`
+	KeyWebhookDelivery        string `json:"key_webhook_delivery"`
+	KeyWebhookDeliveries      string `json:"key_webhook_deliveries"`
+	KeyWebhookDeliveryCounter string `json:"key_webhook_delivery_counter"`
+	KeyWebhookEventDeliveries string `json:"key_webhook_event_deliveries"`
+	KeyWebhookRetries         string `json:"key_webhook_retries"`
+	KeyWebhookDeadLetter      string `json:"key_webhook_dead_letter"`
+
+	KeyTenants       string `json:"key_tenants"`
+	KeyTenant        string `json:"key_tenant"`
+	KeyTenantApiKeys string `json:"key_tenant_api_keys"`
+	KeyTenantPrefix  string `json:"key_tenant_prefix"` // prepended to all the keys of the tenant's catalogue
+
+	EventStreamMaxLength int `json:"event_stream_max_length"` // 0 for no limit
+	TemporaryKeyTtl      int `json:"temporary_key_ttl"`       // in seconds
+
+	PriceRounding string `json:"price_rounding"` // half_up, half_even, down or up
+
+	DefaultLocale string   `json:"default_locale"` // the locale of the product names and descriptions
+	Locales       []string `json:"locales"`        // the locales products can be translated to, any locale if empty
+
+	ResultsPerPage       int `json:"results_per_page"`
+	SimilarProductsLimit int `json:"similar_products_limit"` // how many computed similar products are shown
+
+	ErrorReporter   string `json:"error_reporter"` // bugsnag, sentry, log or none
+	BugsnagKey      string `json:"bugsnag_key"`
+	SentryDsn       string `json:"sentry_dsn"`
+	ShutdownTimeout int    `json:"shutdown_timeout"` // in seconds
+	LogLevel        string `json:"log_level"`        // debug, info, warn or error
+
+	CategoryCacheTtl int `json:"category_cache_ttl"` // in seconds
+
+	TrashPurgeAfter    int `json:"trash_purge_after"`    // in hours
+	TrashSweepInterval int `json:"trash_sweep_interval"` // in seconds
+
+	PublishingSweepInterval int `json:"publishing_sweep_interval"` // in seconds
+
+	ReservationTtl           int `json:"reservation_ttl"`            // in seconds, used when the reservation doesn't set one
+	ReservationMaxTtl        int `json:"reservation_max_ttl"`        // in seconds
+	ReservationSweepInterval int `json:"reservation_sweep_interval"` // in seconds
+
+	WebhookConsumerGroup     string `json:"webhook_consumer_group"`
+	WebhookMaxAttempts       int    `json:"webhook_max_attempts"`
+	WebhookRetryBaseDelay    int    `json:"webhook_retry_base_delay"`   // in seconds, doubled after every failed attempt
+	WebhookTimeout           int    `json:"webhook_timeout"`            // in seconds
+	WebhookConcurrency       int    `json:"webhook_concurrency"`        // deliveries attempted in parallel
+	WebhookDeliveryRetention int    `json:"webhook_delivery_retention"` // in hours
+
+	TenantResolution []string `json:"tenant_resolution"`  // api_key, header or subdomain, in the order they're tried. Single catalogue if empty.
+	TenantBaseDomain string   `json:"tenant_base_domain"` // the domain tenant subdomains are under (ex. catalogue.example.com)
+	TenantAdminKey   string   `json:"tenant_admin_key"`   // needed to provision tenants, provisioning is disabled if empty
 }
 
 func getConfiguration() Config {
@@ -32,14 +136,14 @@ func getConfiguration() Config {
 	configFile, _ := os.Open("conf.json")
 	defer configFile.Close()
 
+	// Start from the default values, so settings missing from the json file keep a sensible value
 	decoder := json.NewDecoder(configFile)
-	config := Config{}
+	config := getDefaultConfiguration()
 	err := decoder.Decode(&config)
 
 	// If there's an error in the json config file we resort to default values
 	if err != nil {
-		fmt.Println("❌ Config file error: ", err)
-		fmt.Println("Reading default configuration.")
+		logger.Warn("Config file error, reading default configuration", Fields{"error": err})
 		config = getDefaultConfiguration()
 	}
 
@@ -63,8 +167,113 @@ func getDefaultConfiguration() Config {
 		KeyProductImages:      "product:%v:images",
 		KeyAllProducts:        "products",
 		KeyProductsInCategory: "products:cat:%v",
+		KeyProductVersions:    "product:%v:versions",
+		KeyPriceMigration:     "migrations:price_minor_units",
+		KeyTrashedProducts:    "products:trash",
+		KeyEventStream:        "catalogue:events",
+		EventsChannel:         "catalogue:events:notifications",
+		CategoriesChannel:     "catalogue:categories:notifications",
+
+		KeyExchangeRates:       "exchange_rates",
+		KeyExchangeRatesBase:   "exchange_rates:base",
+		KeyProductsByPrice:     "products:price:%v",
+		KeyPriceIndexMigration: "migrations:price_index",
+		KeyTemporary:           "tmp:%v",
+		KeyVariant:             "variant:%v",
+		KeyVariantCounter:      "variant_counter",
+		KeyProductVariants:     "product:%v:variants",
+		KeySkus:                "skus",
+		KeyStock:               "stock:%v",
+		KeyInStockProducts:     "products:in_stock",
+		KeyReservation:         "reservation:%v",
+		KeyReservationExpiries: "reservations:expiries",
+
+		KeyCategoryAttributes:       "category_attributes",
+		KeyProductsByAttribute:      "products:attr:%v",
+		KeyProductsByAttributeValue: "products:attr:%v:%v",
+
+		KeyProductTranslations: "product:%v:translations",
+		KeyProductsInLocale:    "products:locale:%v",
+
+		KeySlugs:         "slugs",
+		KeyProductSlugs:  "product:%v:slugs",
+		KeySlugMigration: "migrations:product_slugs",
+
+		KeyProductRelations:         "product:%v:related",
+		KeyProductsByVendor:         "products:vendor:%v",
+		KeyProductsByToken:          "products:token:%v",
+		KeySimilarityIndexMigration: "migrations:similarity_index",
+
+		KeyTags:          "tags",
+		KeyProductsByTag: "products:tag:%v",
+
+		KeyReview:           "review:%v",
+		KeyReviewCounter:    "review_counter",
+		KeyProductReviews:   "product:%v:reviews:%v",
+		KeyProductsByRating: "products:rating",
+
+		KeyProductsByStatus:  "products:status:%v",
+		KeyPublishSchedule:   "products:publish_at",
+		KeyUnpublishSchedule: "products:unpublish_at",
+
+		KeyCollection:         "collection:%v",
+		KeyCollectionCounter:  "collection_counter",
+		KeyCollections:        "collections",
+		KeyCollectionProducts: "collection:%v:products",
+		KeyProductCollections: "product:%v:collections",
+
+		KeyWebhook:                "webhook:%v",
+		KeyWebhooks:               "webhooks",
+		KeyWebhookCounter:         "webhook_counter",
+		KeyWebhookDelivery:        "webhook_delivery:%v",
+		KeyWebhookDeliveries:      "webhook:%v:deliveries",
+		KeyWebhookDeliveryCounter: "webhook_delivery_counter",
+		KeyWebhookEventDeliveries: "webhook_event:%v:deliveries",
+		KeyWebhookRetries:         "webhooks:retries",
+		KeyWebhookDeadLetter:      "webhooks:dead_letter",
+
+		KeyTenants:       "tenants",
+		KeyTenant:        "tenants:%v",
+		KeyTenantApiKeys: "tenants:api_keys",
+		KeyTenantPrefix:  "tenant:%v:",
+
+		EventStreamMaxLength: 100000,
+		TemporaryKeyTtl:      60,
+
+		PriceRounding: RoundHalfUp,
+
+		DefaultLocale: "en",
+		Locales:       []string{},
+
+		ResultsPerPage:       20,
+		SimilarProductsLimit: 6,
+
+		ErrorReporter:   "",
+		BugsnagKey:      "",
+		SentryDsn:       "",
+		ShutdownTimeout: 10,
+		LogLevel:        "info",
+
+		CategoryCacheTtl: 300,
+
+		TrashPurgeAfter:    30 * 24,
+		TrashSweepInterval: 3600,
+
+		PublishingSweepInterval: 60,
+
+		ReservationTtl:           900,
+		ReservationMaxTtl:        86400,
+		ReservationSweepInterval: 60,
+
+		WebhookConsumerGroup:     "webhooks",
+		WebhookMaxAttempts:       8,
+		WebhookRetryBaseDelay:    30,
+		WebhookTimeout:           10,
+		WebhookConcurrency:       10,
+		WebhookDeliveryRetention: 7 * 24,
 
-		ResultsPerPage: 20,
-		BugsnagKey:     "",
+		TenantResolution: []string{},
+		TenantBaseDomain: "",
+		TenantAdminKey:   "",
 	}
 }
@@ -1,9 +1,11 @@
 package main
 
 type ApiError struct {
-	HttpStatus  int    `json:"-"`
-	Title       string `json:"title"`
-	Description string `json:"description"`
+	HttpStatus  int               `json:"-"`
+	Title       string            `json:"title"`
+	Description string            `json:"description"`
+	RequestId   string            `json:"request_id,omitempty"` // only set on server errors, so they can be traced in the logs
+	Fields      map[string]string `json:"fields,omitempty"`     // validation errors of specific fields, keyed by field name
 }
 
 // Make our struct implement the error interface
@@ -29,6 +31,12 @@ var urlParamError = ApiError{
 	Description: "The id in the url needs to be a valid number",
 }
 
+var localeParamError = ApiError{
+	HttpStatus:  400,
+	Title:       "Wrong parameters",
+	Description: "The locale in the url needs to be a language tag (ex. de or de-AT) of one of the locales products can be translated to",
+}
+
 var notFoundError = ApiError{
 	HttpStatus:  404,
 	Title:       "Not found",
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gomodule/redigo/redis"
+	"strconv"
+	"time"
+)
+
+const (
+	EventProductCreated  = "product.created"
+	EventProductUpdated  = "product.updated"
+	EventProductDeleted  = "product.deleted"
+	EventProductRestored = "product.restored"
+	EventProductPurged   = "product.purged"
+	EventImageAdded      = "image.added"
+	EventImageDeleted    = "image.deleted"
+	EventVariantCreated  = "variant.created"
+	EventVariantUpdated  = "variant.updated"
+	EventVariantDeleted  = "variant.deleted"
+
+	EventTranslationUpdated = "translation.updated"
+	EventTranslationDeleted = "translation.deleted"
+)
+
+//////////////////////
+// CATALOGUE EVENTS
+// Every change is appended to a Redis Stream inside the same transaction as the change itself,
+// so downstream systems never see an event for a change that didn't happen (or miss one that did).
+//////////////////////
+type CatalogueEvent struct {
+	Id         string      `json:"id,omitempty"`
+	Type       string      `json:"type"`
+	ProductId  int         `json:"product_id"`
+	ImageId    int         `json:"image_id,omitempty"`
+	CategoryId int         `json:"main_category_id,omitempty"`
+	Actor      string      `json:"actor,omitempty"`
+	Timestamp  time.Time   `json:"timestamp"`
+	Data       interface{} `json:"data,omitempty"`
+}
+
+// Queues the XADD on the connection, so it's executed as a part of the caller's transaction
+func sendEvent(event CatalogueEvent, redisConn redis.Conn) error {
+	event.Timestamp = time.Now().UTC()
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		return err
+	}
+
+	args := redis.Args{config.KeyEventStream}
+	if config.EventStreamMaxLength > 0 {
+		// Approximate trimming is much cheaper for Redis than trimming to the exact length
+		args = args.Add("MAXLEN", "~", config.EventStreamMaxLength)
+	}
+	args = args.Add("*",
+		"type", event.Type,
+		"product_id", event.ProductId,
+		"image_id", event.ImageId,
+		"main_category_id", event.CategoryId,
+		"actor", event.Actor,
+		"timestamp", event.Timestamp.Format(time.RFC3339Nano),
+		"data", data,
+	)
+	err = redisConn.Send("XADD", args...)
+	if err != nil {
+		return err
+	}
+
+	// Let the live event streams of all instances know there's something new in the stream
+	return redisConn.Send("PUBLISH", config.EventsChannel, event.Type)
+}
+
+func sendProductEvent(eventType string, product *Product, actor string, redisConn redis.Conn) error {
+	return sendEvent(CatalogueEvent{
+		Type:       eventType,
+		ProductId:  product.Id,
+		CategoryId: product.MainCategoryId,
+		Actor:      actor,
+		Data:       getProductSnapshot(product),
+	}, redisConn)
+}
+
+func sendImageEvent(eventType string, image *Image, redisConn redis.Conn) error {
+	return sendEvent(CatalogueEvent{
+		Type:      eventType,
+		ProductId: image.ProductId,
+		ImageId:   image.Id,
+		Data:      image,
+	}, redisConn)
+}
+
+// Parses a stream entry (as returned by XRANGE or XREAD) back into an event
+func parseStreamEntry(entry []interface{}) (CatalogueEvent, error) {
+	event := CatalogueEvent{}
+	if len(entry) != 2 {
+		return event, errInvalidStreamEntry
+	}
+	id, err := redis.String(entry[0], nil)
+	if err != nil {
+		return event, err
+	}
+	fields, err := redis.StringMap(entry[1], nil)
+	if err != nil {
+		return event, err
+	}
+
+	event.Id = id
+	event.Type = fields["type"]
+	event.ProductId, _ = strconv.Atoi(fields["product_id"])
+	event.ImageId, _ = strconv.Atoi(fields["image_id"])
+	event.CategoryId, _ = strconv.Atoi(fields["main_category_id"])
+	event.Actor = fields["actor"]
+	event.Timestamp, _ = time.Parse(time.RFC3339Nano, fields["timestamp"])
+
+	var data interface{}
+	if err := json.Unmarshal([]byte(fields["data"]), &data); err == nil {
+		event.Data = data
+	}
+	return event, nil
+}
+
+var errInvalidStreamEntry = redis.Error("invalid stream entry")
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"github.com/rafaeljusto/redigomock"
+	"gotest.tools/assert"
+	"testing"
+)
+
+func TestSendEvent(t *testing.T) {
+	conn := redigomock.NewConn()
+	cmd := conn.GenericCommand("XADD").Expect("1567332000000-0")
+	notification := conn.Command("PUBLISH", config.EventsChannel, EventProductCreated).Expect(int64(1))
+
+	err := sendEvent(CatalogueEvent{Type: EventProductCreated, ProductId: 7, Actor: "naomi"}, conn)
+	assert.NilError(t, err)
+	_, err = conn.Do("")
+	assert.NilError(t, err)
+
+	assert.Equal(t, 1, conn.Stats(cmd))
+	assert.Equal(t, 1, conn.Stats(notification))
+}
+
+func TestParseStreamEntry(t *testing.T) {
+	entry := []interface{}{
+		[]byte("1567332000000-0"),
+		[]interface{}{
+			[]byte("type"), []byte("product.updated"),
+			[]byte("product_id"), []byte("7"),
+			[]byte("image_id"), []byte("0"),
+			[]byte("actor"), []byte("naomi"),
+			[]byte("timestamp"), []byte("2019-09-01T10:00:00Z"),
+			[]byte("data"), []byte(`{"changes":[]}`),
+		},
+	}
+
+	event, err := parseStreamEntry(entry)
+	assert.NilError(t, err)
+	assert.Equal(t, "1567332000000-0", event.Id)
+	assert.Equal(t, EventProductUpdated, event.Type)
+	assert.Equal(t, 7, event.ProductId)
+	assert.Equal(t, "naomi", event.Actor)
+	assert.Equal(t, 2019, event.Timestamp.Year())
+	assert.DeepEqual(t, event.Data, map[string]interface{}{"changes": []interface{}{}})
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"math/big"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Rounding modes for converted prices
+const (
+	RoundHalfUp   = "half_up" // half away from zero
+	RoundHalfEven = "half_even"
+	RoundDown     = "down" // towards zero
+	RoundUp       = "up"   // away from zero
+)
+
+//////////////////////
+// EXCHANGE RATES
+// The rates are stored in a hash as exact decimal strings: the amount of each currency
+// you get for one unit of the base currency (so the base itself has a rate of 1).
+//////////////////////
+type ExchangeRates struct {
+	Base  string            `json:"base"`
+	Rates map[string]string `json:"rates"`
+}
+
+// Plain decimals only, big.Rat would also take fractions ("1/3") and exponents ("1e400")
+var ratePattern = regexp.MustCompile(`^[0-9]{1,12}(\.[0-9]{1,12})?$`)
+
+// Parses a rate, which has to be a positive plain decimal with at most 12 digits on both sides of the point
+func parseRate(rate string) (*big.Rat, bool) {
+	if !ratePattern.MatchString(rate) {
+		return nil, false
+	}
+	r, ok := new(big.Rat).SetString(rate)
+	if !ok || r.Sign() <= 0 {
+		return nil, false
+	}
+	return r, true
+}
+
+func (rates *ExchangeRates) validate() error {
+	rates.Base = strings.ToUpper(rates.Base)
+	if !isValidCurrency(rates.Base) {
+		return fmt.Errorf("%q isn't an ISO 4217 currency code", rates.Base)
+	}
+
+	normalised := make(map[string]string, len(rates.Rates)+1)
+	for currency, rate := range rates.Rates {
+		currency = strings.ToUpper(currency)
+		if !isValidCurrency(currency) {
+			return fmt.Errorf("%q isn't an ISO 4217 currency code", currency)
+		}
+		if _, ok := parseRate(rate); !ok {
+			return fmt.Errorf("the rate of %s needs to be a positive decimal number", currency)
+		}
+		normalised[currency] = rate
+	}
+	normalised[rates.Base] = "1"
+	rates.Rates = normalised
+	return nil
+}
+
+// Returns the currencies with a rate, in alphabetical order
+func (rates *ExchangeRates) getCurrencies() []string {
+	currencies := make([]string, 0, len(rates.Rates))
+	for currency := range rates.Rates {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+	return currencies
+}
+
+func (rates *ExchangeRates) getRate(currency string) (*big.Rat, error) {
+	rate, ok := rates.Rates[currency]
+	if !ok {
+		return nil, fmt.Errorf("there's no exchange rate for %s", currency)
+	}
+	r, ok := parseRate(rate)
+	if !ok {
+		return nil, fmt.Errorf("the exchange rate for %s is invalid", currency)
+	}
+	return r, nil
+}
+
+// Converts an amount in minor units of one currency to the exact amount in minor units of another
+func (rates *ExchangeRates) convert(minorUnits int64, from string, to string) (*big.Rat, error) {
+	amount := new(big.Rat).SetFrac(big.NewInt(minorUnits), pow10(getCurrencyExponent(from)))
+	if from != to {
+		fromRate, err := rates.getRate(from)
+		if err != nil {
+			return nil, err
+		}
+		toRate, err := rates.getRate(to)
+		if err != nil {
+			return nil, err
+		}
+		amount.Quo(amount, fromRate).Mul(amount, toRate)
+	}
+	return amount.Mul(amount, new(big.Rat).SetInt(pow10(getCurrencyExponent(to)))), nil
+}
+
+func (rates *ExchangeRates) convertPrice(minorUnits int64, from string, to string, rounding string) (Price, error) {
+	amount, err := rates.convert(minorUnits, from, to)
+	if err != nil {
+		return Price{}, err
+	}
+	return Price{
+		Amount:   formatMinorUnits(roundRat(amount, rounding), getCurrencyExponent(to)),
+		Currency: to,
+	}, nil
+}
+
+// Sets the price of the product in the display currency. Products without a price, or with a price
+// in a currency we have no rate for, are left without a converted price rather than failing the whole page.
+func (product *Product) setConvertedPrice(currency string, rates ExchangeRates) {
+	price, err := rates.convertPrice(product.PriceMinor, product.Currency, currency, config.PriceRounding)
+	if err != nil {
+		return
+	}
+	product.ConvertedPrice = &price
+}
+
+func saveExchangeRates(rates *ExchangeRates, redisConn redis.Conn) error {
+	_, err := redisConn.Do("MULTI")
+	if err != nil {
+		return err
+	}
+	// Replace the whole table, so removed currencies don't linger
+	_ = redisConn.Send("DEL", config.KeyExchangeRates)
+	_ = redisConn.Send("HSET", redis.Args{config.KeyExchangeRates}.AddFlat(rates.Rates)...)
+	_ = redisConn.Send("SET", config.KeyExchangeRatesBase, rates.Base)
+	_, err = redisConn.Do("EXEC")
+	return err
+}
+
+func getExchangeRates(redisConn redis.Conn) (ExchangeRates, error) {
+	rates := ExchangeRates{Rates: map[string]string{}}
+
+	_ = redisConn.Send("GET", config.KeyExchangeRatesBase)
+	_ = redisConn.Send("HGETALL", config.KeyExchangeRates)
+	_ = redisConn.Flush()
+
+	base, err := redis.String(redisConn.Receive())
+	if err != nil && err != redis.ErrNil {
+		return rates, err
+	}
+	values, err := redis.StringMap(redisConn.Receive())
+	if err != nil {
+		return rates, err
+	}
+	rates.Base = base
+	rates.Rates = values
+	return rates, nil
+}
+
+func roundRat(r *big.Rat, rounding string) int64 {
+	quotient, remainder := new(big.Int).QuoRem(r.Num(), r.Denom(), new(big.Int))
+	if remainder.Sign() == 0 {
+		return quotient.Int64()
+	}
+
+	away := big.NewInt(int64(r.Sign()))
+	// Compare twice the remainder with the denominator to know if we're below, at or above the half
+	half := new(big.Int).Mul(new(big.Int).Abs(remainder), big.NewInt(2)).Cmp(r.Denom())
+
+	switch rounding {
+	case RoundDown:
+	case RoundUp:
+		quotient.Add(quotient, away)
+	case RoundHalfEven:
+		if half > 0 || (half == 0 && quotient.Bit(0) == 1) {
+			quotient.Add(quotient, away)
+		}
+	default:
+		if half >= 0 {
+			quotient.Add(quotient, away)
+		}
+	}
+	return quotient.Int64()
+}
+
+func pow10(exponent int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(exponent)), nil)
+}
+
+//////////////////////
+// PRICE INDEX
+// Every currency has a sorted set of the lex names of the products priced in it, scored by the price in minor units.
+// The scores don't depend on the exchange rates, so changing the rates doesn't require re-indexing anything.
+//////////////////////
+func getProductsByPriceKeyName(currency string) string {
+	return fmt.Sprintf(config.KeyProductsByPrice, currency)
+}
+
+func sendPriceIndexAdd(product *Product, redisConn redis.Conn) {
+	_ = redisConn.Send("ZADD", getProductsByPriceKeyName(product.Currency), product.PriceMinor, product.getLexName())
+}
+
+func sendPriceIndexRemove(product *Product, redisConn redis.Conn) {
+	_ = redisConn.Send("ZREM", getProductsByPriceKeyName(product.Currency), product.getLexName())
+}
+
+// Builds a filter for the products with a price between `min` and `max` (decimal strings, either can be empty)
+// in the given currency. Products priced in other currencies are converted with the exchange rates.
+func getPriceRangeFilter(min string, max string, currency string, rates ExchangeRates) (IndexFilter, error) {
+	var minorMin, minorMax int64
+	var err error
+	exponent := getCurrencyExponent(currency)
+	if min != "" {
+		minorMin, err = parseMinorUnits(min, exponent)
+		if err != nil {
+			return IndexFilter{}, err
+		}
+	}
+	if max != "" {
+		minorMax, err = parseMinorUnits(max, exponent)
+		if err != nil {
+			return IndexFilter{}, err
+		}
+	}
+
+	currencies := rates.getCurrencies()
+	if _, ok := rates.Rates[currency]; !ok {
+		currencies = []string{currency}
+	}
+
+	filter := IndexFilter{}
+	for _, productCurrency := range currencies {
+		scoreRange := ScoreRange{Key: getProductsByPriceKeyName(productCurrency), Min: "-inf", Max: "+inf"}
+		// A price matches if it's at least the smallest amount that converts to `min`, and at most the largest one below `max`
+		if min != "" {
+			amount, err := rates.convert(minorMin, currency, productCurrency)
+			if err != nil {
+				return IndexFilter{}, err
+			}
+			scoreRange.Min = fmt.Sprint(roundRat(amount, RoundUp))
+		}
+		if max != "" {
+			amount, err := rates.convert(minorMax, currency, productCurrency)
+			if err != nil {
+				return IndexFilter{}, err
+			}
+			scoreRange.Max = fmt.Sprint(roundRat(amount, RoundDown))
+		}
+		filter.Ranges = append(filter.Ranges, scoreRange)
+	}
+	return filter, nil
+}
+
+//////////////////////
+// MIGRATION
+// Products saved before the price index existed are added to it once, at startup.
+//////////////////////
+func migratePriceIndex(redisConn redis.Conn) (int, error) {
+	done, err := redis.Bool(redisConn.Do("EXISTS", config.KeyPriceIndexMigration))
+	if err != nil || done {
+		return 0, err
+	}
+
+	lexNames, err := redis.Strings(redisConn.Do("ZRANGE", config.KeyAllProducts, 0, -1))
+	if err != nil {
+		return 0, err
+	}
+
+	indexed := 0
+	for _, lexName := range lexNames {
+		product := Product{Id: getIdFromLexName(lexName)}
+		values, err := redis.Strings(redisConn.Do("HMGET", product.getKeyName(), "price_minor", "currency"))
+		if err != nil {
+			return indexed, err
+		}
+		product.PriceMinor, _ = parseMinorUnits(values[0], 0)
+		product.Currency = values[1]
+
+		_, err = redisConn.Do("ZADD", getProductsByPriceKeyName(product.Currency), product.PriceMinor, lexName)
+		if err != nil {
+			return indexed, err
+		}
+		indexed++
+	}
+
+	_, err = redisConn.Do("SET", config.KeyPriceIndexMigration, 1)
+	return indexed, err
+}
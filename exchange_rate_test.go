@@ -0,0 +1,141 @@
+package main
+
+import (
+	"github.com/rafaeljusto/redigomock"
+	"gotest.tools/assert"
+	"math/big"
+	"testing"
+)
+
+var testRates = ExchangeRates{
+	Base:  "EUR",
+	Rates: map[string]string{"EUR": "1", "USD": "1.1", "CNY": "7.8", "JPY": "120"},
+}
+
+func TestExchangeRates_convertPrice(t *testing.T) {
+	testCases := []struct {
+		minorUnits int64
+		from       string
+		to         string
+		rounding   string
+		want       string
+	}{
+		{1999, "EUR", "EUR", RoundHalfUp, "19.99"},
+		{1000, "EUR", "USD", RoundHalfUp, "11.00"},
+		{1000, "USD", "EUR", RoundHalfUp, "9.09"},
+		{1000, "USD", "EUR", RoundUp, "9.10"},
+		{1999, "EUR", "JPY", RoundHalfUp, "2399"},
+		{1000, "JPY", "EUR", RoundHalfUp, "8.33"},
+		// 0.25 EUR is exactly 0.275 USD
+		{25, "EUR", "USD", RoundHalfUp, "0.28"},
+		{25, "EUR", "USD", RoundHalfEven, "0.28"},
+		{25, "EUR", "USD", RoundDown, "0.27"},
+	}
+
+	for _, tc := range testCases {
+		got, err := testRates.convertPrice(tc.minorUnits, tc.from, tc.to, tc.rounding)
+		assert.NilError(t, err)
+		assert.Equal(t, tc.want, got.Amount, "%v %s to %s", tc.minorUnits, tc.from, tc.to)
+		assert.Equal(t, tc.to, got.Currency)
+	}
+
+	_, err := testRates.convertPrice(1000, "EUR", "GBP", RoundHalfUp)
+	assert.ErrorContains(t, err, "GBP")
+}
+
+func TestProduct_setConvertedPrice(t *testing.T) {
+	products := []Product{
+		{Id: 1, PriceMinor: 1000, Currency: "EUR"},
+		{Id: 2},
+		{Id: 3, PriceMinor: 1000, Currency: "GBP"},
+	}
+	for i := range products {
+		products[i].setConvertedPrice("USD", testRates)
+	}
+
+	assert.DeepEqual(t, &Price{Amount: "11.00", Currency: "USD"}, products[0].ConvertedPrice)
+	// Products we can't convert are shown without a converted price
+	assert.Assert(t, products[1].ConvertedPrice == nil)
+	assert.Assert(t, products[2].ConvertedPrice == nil)
+}
+
+func TestRoundRat(t *testing.T) {
+	half := func(n int64) *big.Rat { return big.NewRat(n, 2) }
+
+	assert.Equal(t, int64(3), roundRat(half(5), RoundHalfUp))
+	assert.Equal(t, int64(-3), roundRat(half(-5), RoundHalfUp))
+	assert.Equal(t, int64(2), roundRat(half(5), RoundHalfEven))
+	assert.Equal(t, int64(4), roundRat(half(7), RoundHalfEven))
+	assert.Equal(t, int64(2), roundRat(half(5), RoundDown))
+	assert.Equal(t, int64(3), roundRat(half(5), RoundUp))
+	assert.Equal(t, int64(3), roundRat(big.NewRat(21, 10), RoundUp))
+	assert.Equal(t, int64(2), roundRat(big.NewRat(21, 10), RoundHalfEven))
+	assert.Equal(t, int64(4), roundRat(big.NewRat(4, 1), RoundUp))
+}
+
+func TestExchangeRates_validate(t *testing.T) {
+	rates := ExchangeRates{Base: "eur", Rates: map[string]string{"usd": "1.1"}}
+	assert.NilError(t, rates.validate())
+	assert.Equal(t, "EUR", rates.Base)
+	assert.DeepEqual(t, map[string]string{"EUR": "1", "USD": "1.1"}, rates.Rates)
+
+	rates = ExchangeRates{Base: "EUR", Rates: map[string]string{"XYZ": "1.1"}}
+	assert.ErrorContains(t, rates.validate(), "XYZ")
+
+	rates = ExchangeRates{Base: "EUR", Rates: map[string]string{"USD": "-1"}}
+	assert.ErrorContains(t, rates.validate(), "positive")
+
+	for _, rate := range []string{"0", "1/3", "1e400", "1.5E2", " 1.1", "1.", "1234567890123", "0.0000000000001"} {
+		rates = ExchangeRates{Base: "EUR", Rates: map[string]string{"USD": rate}}
+		assert.ErrorContains(t, rates.validate(), "positive", rate)
+	}
+
+	rates = ExchangeRates{Base: "", Rates: map[string]string{"USD": "1.1"}}
+	assert.Assert(t, rates.validate() != nil)
+}
+
+func TestGetPriceRangeFilter(t *testing.T) {
+	filter, err := getPriceRangeFilter("10", "20", "USD", testRates)
+	assert.NilError(t, err)
+
+	ranges := map[string]ScoreRange{}
+	for _, scoreRange := range filter.Ranges {
+		ranges[scoreRange.Key] = scoreRange
+	}
+	assert.Equal(t, 4, len(ranges))
+	// 10 USD is 9.0909... EUR, so 9.09 EUR is below the range and 9.10 EUR is in it
+	assert.DeepEqual(t, ScoreRange{Key: getProductsByPriceKeyName("EUR"), Min: "910", Max: "1818"}, ranges[getProductsByPriceKeyName("EUR")])
+	assert.DeepEqual(t, ScoreRange{Key: getProductsByPriceKeyName("USD"), Min: "1000", Max: "2000"}, ranges[getProductsByPriceKeyName("USD")])
+	assert.DeepEqual(t, ScoreRange{Key: getProductsByPriceKeyName("JPY"), Min: "1091", Max: "2181"}, ranges[getProductsByPriceKeyName("JPY")])
+
+	// An open range
+	filter, err = getPriceRangeFilter("", "20", "EUR", testRates)
+	assert.NilError(t, err)
+	assert.Equal(t, "-inf", filter.Ranges[0].Min)
+
+	// Without an exchange rate we can only match the products priced in the requested currency
+	filter, err = getPriceRangeFilter("10", "", "GBP", testRates)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []ScoreRange{{Key: getProductsByPriceKeyName("GBP"), Min: "1000", Max: "+inf"}}, filter.Ranges)
+
+	_, err = getPriceRangeFilter("10.001", "", "EUR", testRates)
+	assert.Assert(t, err != nil)
+}
+
+func TestMigratePriceIndex(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("EXISTS", config.KeyPriceIndexMigration).Expect(int64(0))
+	conn.Command("ZRANGE", config.KeyAllProducts, 0, -1).Expect([]interface{}{[]byte("rocinante::7"), []byte("canterbury::8")})
+	conn.Command("HMGET", getProductNameById(7), "price_minor", "currency").Expect([]interface{}{[]byte("1999"), []byte("EUR")})
+	conn.Command("HMGET", getProductNameById(8), "price_minor", "currency").Expect([]interface{}{[]byte("500"), []byte("JPY")})
+	eur := conn.Command("ZADD", getProductsByPriceKeyName("EUR"), int64(1999), "rocinante::7").Expect(int64(1))
+	jpy := conn.Command("ZADD", getProductsByPriceKeyName("JPY"), int64(500), "canterbury::8").Expect(int64(1))
+	done := conn.Command("SET", config.KeyPriceIndexMigration, 1).Expect("OK")
+
+	indexed, err := migratePriceIndex(conn)
+	assert.NilError(t, err)
+	assert.Equal(t, 2, indexed)
+	assert.Equal(t, 1, conn.Stats(eur))
+	assert.Equal(t, 1, conn.Stats(jpy))
+	assert.Equal(t, 1, conn.Stats(done))
+}
@@ -10,10 +10,11 @@ require (
 	github.com/gofrs/uuid v3.2.0+incompatible // indirect
 	github.com/gomodule/redigo v2.0.0+incompatible
 	github.com/google/go-cmp v0.3.1 // indirect
+	github.com/graphql-go/graphql v0.8.1
 	github.com/kardianos/osext v0.0.0-20190222173326-2bc1f35cddc0 // indirect
 	github.com/kr/pretty v0.1.0 // indirect
 	github.com/labstack/echo v3.3.10+incompatible
-	github.com/labstack/gommon v0.3.0
+	github.com/labstack/gommon v0.3.0 // indirect
 	github.com/pkg/errors v0.8.1 // indirect
 	github.com/rafaeljusto/redigomock v0.0.0-20190202135759-257e089e14a1
 	golang.org/x/crypto v0.0.0-20190829043050-9756ffdc2472 // indirect
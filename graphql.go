@@ -0,0 +1,709 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/labstack/echo"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//////////////////////
+// GRAPHQL API
+// Exposes products, categories and images through a single endpoint, so clients fetch exactly the fields they need.
+// The resolvers reuse the model functions of the REST API. Nested fields (images, the products of a category or the
+// product of an image) are resolved through batch loaders: each resolver only queues the id it needs and returns a
+// thunk. The first thunk that's called loads all the queued ids with one Redis pipeline, so a list of products
+// with their images costs two round trips, instead of one per product.
+//////////////////////
+
+type graphqlContextKeyType struct{}
+
+var graphqlContextKey = graphqlContextKeyType{}
+
+type GraphqlRequest struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+}
+
+// The state of a single GraphQL request, shared by all its resolvers
+type graphqlContext struct {
+	c          echo.Context
+	redisConn  redis.Conn
+	categories map[int]Category
+
+	products         *batchLoader
+	productImages    *batchLoader
+	imageProducts    *batchLoader
+	categoryProducts map[int]*batchLoader // by page
+}
+
+func newGraphqlContext(c echo.Context, redisConn redis.Conn) *graphqlContext {
+	gc := &graphqlContext{
+		c:                c,
+		redisConn:        redisConn,
+		categories:       categoryCache.all(redisConn),
+		categoryProducts: make(map[int]*batchLoader),
+	}
+	gc.products = newBatchLoader(gc.loadProducts)
+	gc.productImages = newBatchLoader(gc.loadProductImages)
+	gc.imageProducts = newBatchLoader(gc.loadImageProducts)
+	return gc
+}
+
+func getGraphqlContext(ctx context.Context) *graphqlContext {
+	return ctx.Value(graphqlContextKey).(*graphqlContext)
+}
+
+//////////////////////
+// BATCH LOADERS
+//////////////////////
+type batchLoader struct {
+	fetch   func(keys []int) (map[int]interface{}, error)
+	queued  []int
+	results map[int]interface{}
+	errors  map[int]error
+}
+
+func newBatchLoader(fetch func(keys []int) (map[int]interface{}, error)) *batchLoader {
+	return &batchLoader{fetch: fetch, results: make(map[int]interface{}), errors: make(map[int]error)}
+}
+
+// Queues the key and returns a thunk that resolves to its value, or to nil if there's nothing under the key
+func (loader *batchLoader) load(key int) func() (interface{}, error) {
+	_, loaded := loader.results[key]
+	_, failed := loader.errors[key]
+	if !loaded && !failed && !intInSlice(key, loader.queued) {
+		loader.queued = append(loader.queued, key)
+	}
+
+	return func() (interface{}, error) {
+		loader.flush()
+		return loader.results[key], loader.errors[key]
+	}
+}
+
+// Fetches all the queued keys at once
+func (loader *batchLoader) flush() {
+	if len(loader.queued) == 0 {
+		return
+	}
+	keys := loader.queued
+	loader.queued = nil
+
+	results, err := loader.fetch(keys)
+	for _, key := range keys {
+		if err != nil {
+			loader.errors[key] = err
+			continue
+		}
+		loader.results[key] = results[key]
+	}
+}
+
+// Products by id. Missing and trashed products are left out.
+func (gc *graphqlContext) loadProducts(ids []int) (map[int]interface{}, error) {
+	products, err := getProductsByIds(ids, gc.categories, gc.redisConn)
+	if err != nil {
+		return nil, gc.error(err)
+	}
+
+	results := make(map[int]interface{}, len(products))
+	for i := range products {
+		if products[i].Id == 0 || products[i].DeletedAt != 0 {
+			continue
+		}
+		results[products[i].Id] = withLoadedImages(&products[i])
+	}
+	return results, nil
+}
+
+// The images of the products, by product id
+func (gc *graphqlContext) loadProductImages(productIds []int) (map[int]interface{}, error) {
+	for _, productId := range productIds {
+		_ = gc.redisConn.Send("SMEMBERS", getProductImagesKeyName(productId))
+	}
+	replies, err := redis.Values(gc.redisConn.Do(""))
+	if err != nil {
+		return nil, gc.error(err)
+	}
+
+	results := make(map[int]interface{}, len(productIds))
+	for i, productId := range productIds {
+		imageIds, _ := redis.Ints(replies[i], nil)
+		sort.Ints(imageIds)
+		images := make([]Image, 0, len(imageIds))
+		for _, imageId := range imageIds {
+			image := Image{Id: imageId, ProductId: productId}
+			image.setUrl()
+			images = append(images, image)
+		}
+		results[productId] = images
+	}
+	return results, nil
+}
+
+// The product ids of the images, by image id. Missing images are left out.
+func (gc *graphqlContext) loadImageProducts(imageIds []int) (map[int]interface{}, error) {
+	productIds, err := redis.Ints(gc.redisConn.Do("HMGET", redis.Args{config.KeyImages}.AddFlat(imageIds)...))
+	if err != nil {
+		return nil, gc.error(err)
+	}
+
+	results := make(map[int]interface{}, len(imageIds))
+	for i, imageId := range imageIds {
+		if productIds[i] != 0 {
+			results[imageId] = productIds[i]
+		}
+	}
+	return results, nil
+}
+
+// A page of the products in every category, by category id
+func (gc *graphqlContext) categoryProductsLoader(page int) *batchLoader {
+	loader, ok := gc.categoryProducts[page]
+	if ok {
+		return loader
+	}
+
+	loader = newBatchLoader(func(categoryIds []int) (map[int]interface{}, error) {
+		fromPosition := (page - 1) * config.ResultsPerPage
+		toPosition := fromPosition + config.ResultsPerPage - 1
+		for _, categoryId := range categoryIds {
+			_ = gc.redisConn.Send("ZRANGE", getProductsInCategoryKeyName(categoryId), fromPosition, toPosition)
+		}
+		replies, err := redis.Values(gc.redisConn.Do(""))
+		if err != nil {
+			return nil, gc.error(err)
+		}
+
+		// The products of all the categories are fetched with a single pipeline as well
+		pageIds := make(map[int][]int, len(categoryIds))
+		allIds := make([]int, 0)
+		for i, categoryId := range categoryIds {
+			lexNames, _ := redis.Strings(replies[i], nil)
+			for _, lexName := range lexNames {
+				pageIds[categoryId] = append(pageIds[categoryId], getIdFromLexName(lexName))
+			}
+			allIds = append(allIds, pageIds[categoryId]...)
+		}
+		products, err := gc.loadProducts(allIds)
+		if err != nil {
+			return nil, err
+		}
+
+		results := make(map[int]interface{}, len(categoryIds))
+		for _, categoryId := range categoryIds {
+			productPage := PaginatedProductCollection{CurrentPage: page, ResultsPerPage: config.ResultsPerPage, Data: make([]Product, 0)}
+			for _, id := range pageIds[categoryId] {
+				if product, ok := products[id]; ok {
+					productPage.Data = append(productPage.Data, *product.(*Product))
+				}
+			}
+			results[categoryId] = productPage
+		}
+		return results, nil
+	})
+	gc.categoryProducts[page] = loader
+	return loader
+}
+
+// Products loaded with `getProductsByIds` come with their images, so they don't need to go through the loader
+func withLoadedImages(product *Product) *Product {
+	if product.Images == nil {
+		product.Images = make([]Image, 0)
+	}
+	return product
+}
+
+//////////////////////
+// SCHEMA
+//////////////////////
+var graphqlSchema = newGraphqlSchema()
+
+// Free-form values, used for the product attributes
+var jsonScalar = graphql.NewScalar(graphql.ScalarConfig{
+	Name:        "JSON",
+	Description: "Any json value",
+	Serialize: func(value interface{}) interface{} {
+		return value
+	},
+	ParseValue: func(value interface{}) interface{} {
+		return value
+	},
+	ParseLiteral: parseJsonLiteral,
+})
+
+// Numbers are parsed as float64, like the ones decoded from json request bodies
+func parseJsonLiteral(valueAST ast.Value) interface{} {
+	switch value := valueAST.(type) {
+	case *ast.StringValue:
+		return value.Value
+	case *ast.BooleanValue:
+		return value.Value
+	case *ast.IntValue, *ast.FloatValue:
+		number, _ := strconv.ParseFloat(value.GetValue().(string), 64)
+		return number
+	case *ast.ObjectValue:
+		object := make(map[string]interface{}, len(value.Fields))
+		for _, field := range value.Fields {
+			object[field.Name.Value] = parseJsonLiteral(field.Value)
+		}
+		return object
+	case *ast.ListValue:
+		list := make([]interface{}, 0, len(value.Values))
+		for _, item := range value.Values {
+			list = append(list, parseJsonLiteral(item))
+		}
+		return list
+	}
+	return nil
+}
+
+func newGraphqlSchema() graphql.Schema {
+	priceType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Price",
+		Fields: graphql.Fields{
+			"amount":   &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"currency": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		},
+	})
+
+	var productType, productPageType *graphql.Object
+
+	categoryType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Category",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			return graphql.Fields{
+				"id":   &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+				"name": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+				"products": &graphql.Field{
+					Type:        graphql.NewNonNull(productPageType),
+					Description: "The published products in the category, sorted by name",
+					Args: graphql.FieldConfigArgument{
+						"page": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 1},
+					},
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						gc := getGraphqlContext(p.Context)
+						page := getPageArg(p.Args)
+						return gc.categoryProductsLoader(page).load(p.Source.(Category).Id), nil
+					},
+				},
+			}
+		}),
+	})
+
+	imageType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Image",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			return graphql.Fields{
+				"id":        &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+				"url":       &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+				"productId": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+				"product": &graphql.Field{
+					Type: productType,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						gc := getGraphqlContext(p.Context)
+						return gc.products.load(p.Source.(Image).ProductId), nil
+					},
+				},
+			}
+		}),
+	})
+
+	productType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "Product",
+		Fields: graphql.Fields{
+			"id":          &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"name":        &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"slug":        &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"description": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"vendor":      &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"price":       &graphql.Field{Type: priceType},
+			"status":      &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"tags":        &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String)))},
+			"attributes":  &graphql.Field{Type: jsonScalar},
+			"publishAt":   &graphql.Field{Type: graphql.Int},
+			"unpublishAt": &graphql.Field{Type: graphql.Int},
+			"mainCategory": &graphql.Field{
+				Type: categoryType,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					product := p.Source.(*Product)
+					if product.MainCategory.Id != 0 {
+						return product.MainCategory, nil
+					}
+					// Categories are cached in memory, so there's nothing to batch
+					category, ok := getGraphqlContext(p.Context).categories[product.MainCategoryId]
+					if !ok {
+						return nil, nil
+					}
+					return category, nil
+				},
+			},
+			"images": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(imageType))),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					product := p.Source.(*Product)
+					if product.Images != nil {
+						return product.Images, nil
+					}
+					return getGraphqlContext(p.Context).productImages.load(product.Id), nil
+				},
+			},
+		},
+	})
+
+	productPageType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "ProductPage",
+		Fields: graphql.Fields{
+			"data": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(productType))),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					products := p.Source.(PaginatedProductCollection).Data
+					data := make([]*Product, len(products))
+					for i := range products {
+						data[i] = withLoadedImages(&products[i])
+					}
+					return data, nil
+				},
+			},
+			"currentPage": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"perPage": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.Int),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(PaginatedProductCollection).ResultsPerPage, nil
+				},
+			},
+		},
+	})
+
+	productInputType := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "ProductInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"name":           &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+			"description":    &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"vendor":         &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"price":          &graphql.InputObjectFieldConfig{Type: graphql.String, Description: "A decimal string, ex. 1999.99"},
+			"currency":       &graphql.InputObjectFieldConfig{Type: graphql.String, Description: "ISO 4217 currency code, required with a price"},
+			"mainCategoryId": &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.Int)},
+			"tags":           &graphql.InputObjectFieldConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+			"attributes":     &graphql.InputObjectFieldConfig{Type: jsonScalar},
+			"status":         &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"publishAt":      &graphql.InputObjectFieldConfig{Type: graphql.Int},
+			"unpublishAt":    &graphql.InputObjectFieldConfig{Type: graphql.Int},
+		},
+	})
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"product": &graphql.Field{
+				Type:        productType,
+				Description: "A product by id or slug",
+				Args: graphql.FieldConfigArgument{
+					"id":   &graphql.ArgumentConfig{Type: graphql.Int},
+					"slug": &graphql.ArgumentConfig{Type: graphql.String},
+				},
+				Resolve: resolveProduct,
+			},
+			"products": &graphql.Field{
+				Type:        graphql.NewNonNull(productPageType),
+				Description: "The published products, sorted by name",
+				Args: graphql.FieldConfigArgument{
+					"page":           &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 1},
+					"search":         &graphql.ArgumentConfig{Type: graphql.String, Description: "Searches the beginning of the product names"},
+					"mainCategoryId": &graphql.ArgumentConfig{Type: graphql.Int},
+					"tags":           &graphql.ArgumentConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+					"tagsMatch":      &graphql.ArgumentConfig{Type: graphql.String, DefaultValue: TagsMatchAll, Description: "all or any"},
+					"inStock":        &graphql.ArgumentConfig{Type: graphql.Boolean, DefaultValue: false},
+					"minRating":      &graphql.ArgumentConfig{Type: graphql.Float},
+				},
+				Resolve: resolveProducts,
+			},
+			"category": &graphql.Field{
+				Type: categoryType,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					category, ok := getGraphqlContext(p.Context).categories[p.Args["id"].(int)]
+					if !ok {
+						return nil, nil
+					}
+					return category, nil
+				},
+			},
+			"categories": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(categoryType))),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					categories := make([]Category, 0)
+					for _, category := range getGraphqlContext(p.Context).categories {
+						categories = append(categories, category)
+					}
+					sort.Slice(categories, func(i, j int) bool { return categories[i].Id < categories[j].Id })
+					return categories, nil
+				},
+			},
+			"image": &graphql.Field{
+				Type: imageType,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					id := p.Args["id"].(int)
+					productId := getGraphqlContext(p.Context).imageProducts.load(id)
+					return func() (interface{}, error) {
+						value, err := productId()
+						if err != nil || value == nil {
+							return nil, err
+						}
+						image := Image{Id: id, ProductId: value.(int)}
+						image.setUrl()
+						return image, nil
+					}, nil
+				},
+			},
+		},
+	})
+
+	mutation := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"createProduct": &graphql.Field{
+				Type: graphql.NewNonNull(productType),
+				Args: graphql.FieldConfigArgument{
+					"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(productInputType)},
+				},
+				Resolve: resolveCreateProduct,
+			},
+			"createImage": &graphql.Field{
+				Type:        graphql.NewNonNull(imageType),
+				Description: "Adds an image to the product. The image data is base64 encoded.",
+				Args: graphql.FieldConfigArgument{
+					"productId": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+					"data":      &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: resolveCreateImage,
+			},
+		},
+	})
+
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{Query: query, Mutation: mutation})
+	if err != nil {
+		panic(err)
+	}
+	return schema
+}
+
+//////////////////////
+// RESOLVERS
+//////////////////////
+func resolveProduct(p graphql.ResolveParams) (interface{}, error) {
+	gc := getGraphqlContext(p.Context)
+
+	id, _ := p.Args["id"].(int)
+	if slug, ok := p.Args["slug"].(string); ok {
+		productId, err := getProductIdBySlug(slug, gc.redisConn)
+		if err == &notFoundError {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, gc.error(err)
+		}
+		id = productId
+	}
+
+	product, err := getProductById(id, gc.redisConn)
+	if err == &notFoundError {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, gc.error(err)
+	}
+	return &product, nil
+}
+
+func resolveProducts(p graphql.ResolveParams) (interface{}, error) {
+	gc := getGraphqlContext(p.Context)
+	redisConn := gc.redisConn
+
+	keyName := config.KeyAllProducts
+	if categoryId, ok := p.Args["mainCategoryId"].(int); ok {
+		if _, ok := gc.categories[categoryId]; ok {
+			keyName = getProductsInCategoryKeyName(categoryId)
+		}
+	}
+
+	filters := []IndexFilter{}
+	if p.Args["inStock"] == true {
+		filters = append(filters, IndexFilter{Key: config.KeyInStockProducts})
+	}
+	if tags, ok := p.Args["tags"].([]interface{}); ok && len(tags) > 0 {
+		tagsParam := make([]string, len(tags))
+		for i, tag := range tags {
+			tagsParam[i] = tag.(string)
+		}
+		filter, err := getTagFilter(strings.Join(tagsParam, ","), p.Args["tagsMatch"].(string), redisConn)
+		if err != nil {
+			return nil, gc.error(err)
+		}
+		filters = append(filters, filter)
+	}
+	if minRating, ok := p.Args["minRating"].(float64); ok {
+		if minRating < minReviewRating || minRating > maxReviewRating {
+			return nil, gc.error(&ApiError{HttpStatus: http.StatusUnprocessableEntity, Title: "Invalid rating filter", Description: fmt.Sprintf("The minimum rating needs to be a number between %v and %v", minReviewRating, maxReviewRating)})
+		}
+		filters = append(filters, getMinRatingFilter(minRating))
+	}
+	keyName, err := filterProductIndex(keyName, filters, redisConn)
+	if err != nil {
+		return nil, gc.error(err)
+	}
+
+	page := getPageArg(p.Args)
+	fromPosition := (page - 1) * config.ResultsPerPage
+	toPosition := fromPosition + config.ResultsPerPage - 1
+
+	command := "ZRANGE"
+	args := redis.Args{keyName, fromPosition, toPosition}
+	if search, ok := p.Args["search"].(string); ok && search != "" {
+		searchString := normaliseSearchString(search)
+		command = "ZRANGEBYLEX"
+		args = redis.Args{keyName, "[" + searchString, "[" + searchString + "\xff", "LIMIT", fromPosition, config.ResultsPerPage}
+	}
+
+	products, err := getProducts(command, args, gc.categories, redisConn)
+	if err != nil {
+		return nil, gc.error(err)
+	}
+	return PaginatedProductCollection{CurrentPage: page, ResultsPerPage: config.ResultsPerPage, Data: products}, nil
+}
+
+func resolveCreateProduct(p graphql.ResolveParams) (interface{}, error) {
+	gc := getGraphqlContext(p.Context)
+	input := p.Args["input"].(map[string]interface{})
+
+	product := Product{}
+	product.Name, _ = input["name"].(string)
+	product.Description, _ = input["description"].(string)
+	product.Vendor, _ = input["vendor"].(string)
+	product.Price.Amount, _ = input["price"].(string)
+	product.Currency, _ = input["currency"].(string)
+	product.MainCategoryId, _ = input["mainCategoryId"].(int)
+	product.Status, _ = input["status"].(string)
+	if publishAt, ok := input["publishAt"].(int); ok {
+		product.PublishAt = int64(publishAt)
+	}
+	if unpublishAt, ok := input["unpublishAt"].(int); ok {
+		product.UnpublishAt = int64(unpublishAt)
+	}
+	if tags, ok := input["tags"].([]interface{}); ok {
+		for _, tag := range tags {
+			product.Tags = append(product.Tags, tag.(string))
+		}
+	}
+	if attributes, ok := input["attributes"].(map[string]interface{}); ok {
+		product.Attributes = attributes
+	}
+
+	if apiError := validateProduct(&product, nil, gc.redisConn); apiError != nil {
+		return nil, gc.error(apiError)
+	}
+	err := saveNewProduct(&product, getActor(gc.c), gc.redisConn)
+	if err != nil {
+		return nil, gc.error(err)
+	}
+	return &product, nil
+}
+
+func resolveCreateImage(p graphql.ResolveParams) (interface{}, error) {
+	gc := getGraphqlContext(p.Context)
+	productId := p.Args["productId"].(int)
+
+	data, err := base64.StdEncoding.DecodeString(p.Args["data"].(string))
+	if err != nil {
+		return nil, gc.error(&ApiError{HttpStatus: http.StatusUnprocessableEntity, Title: "Invalid image", Description: "The image data needs to be base64 encoded"})
+	}
+	if !productExists(productId, gc.redisConn) {
+		return nil, gc.error(&notFoundError)
+	}
+
+	image, err := saveNewImage(productId, data, gc.redisConn)
+	if err != nil {
+		return nil, gc.error(err)
+	}
+	return image, nil
+}
+
+func getPageArg(args map[string]interface{}) int {
+	page, _ := args["page"].(int)
+	if page < 1 {
+		return 1
+	}
+	return page
+}
+
+// API errors are shown to the client with their title and fields, server errors are logged and reported
+// like in the REST API, and only shown as a generic error
+func (gc *graphqlContext) error(err error) error {
+	if _, ok := err.(graphqlError); ok {
+		return err
+	}
+	apiError, ok := err.(*ApiError)
+	if !ok {
+		requestLogger(gc.c).Error("Server error", Fields{"error": err})
+		reportError(newErrorReport(gc.c, err))
+
+		response := serverError
+		response.RequestId = getRequestId(gc.c)
+		apiError = &response
+	}
+	return graphqlError{apiError}
+}
+
+type graphqlError struct {
+	*ApiError
+}
+
+func (e graphqlError) Extensions() map[string]interface{} {
+	extensions := map[string]interface{}{"title": e.Title, "status": e.HttpStatus}
+	if e.RequestId != "" {
+		extensions["request_id"] = e.RequestId
+	}
+	if len(e.Fields) > 0 {
+		extensions["fields"] = e.Fields
+	}
+	return extensions
+}
+
+//////////////////////
+// HANDLER
+//////////////////////
+func graphqlQuery(c echo.Context) error {
+	redisConn := getRedisConn(c)
+
+	request := GraphqlRequest{}
+	if err := c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, ApiError{Title: "Invalid GraphQL request", Description: "The request body needs to be a json object with a query, and optionally variables and an operationName"})
+	}
+	if request.Query == "" {
+		return c.JSON(http.StatusBadRequest, ApiError{Title: "Invalid GraphQL request", Description: "The query is missing"})
+	}
+
+	ctx := context.WithValue(c.Request().Context(), graphqlContextKey, newGraphqlContext(c, redisConn))
+	result := graphql.Do(graphql.Params{
+		Schema:         graphqlSchema,
+		RequestString:  request.Query,
+		VariableValues: request.Variables,
+		OperationName:  request.OperationName,
+		Context:        ctx,
+	})
+	return c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/labstack/echo"
+	"github.com/rafaeljusto/redigomock"
+	"gotest.tools/assert"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBatchLoader_load(t *testing.T) {
+	batches := make([][]int, 0)
+	loader := newBatchLoader(func(keys []int) (map[int]interface{}, error) {
+		batches = append(batches, keys)
+		results := make(map[int]interface{})
+		for _, key := range keys {
+			if key != 9 {
+				results[key] = key * 10
+			}
+		}
+		return results, nil
+	})
+
+	first := loader.load(7)
+	second := loader.load(8)
+	duplicate := loader.load(7)
+	missing := loader.load(9)
+
+	value, err := second()
+	assert.NilError(t, err)
+	assert.Equal(t, 80, value)
+	value, _ = first()
+	assert.Equal(t, 70, value)
+	value, _ = duplicate()
+	assert.Equal(t, 70, value)
+	value, _ = missing()
+	assert.Equal(t, nil, value)
+
+	// Loaded keys aren't fetched again
+	value, _ = loader.load(8)()
+	assert.Equal(t, 80, value)
+	assert.DeepEqual(t, [][]int{{7, 8, 9}}, batches)
+}
+
+func TestParseJsonLiteral(t *testing.T) {
+	value, err := parser.ParseValue(parser.ParseParams{Source: `{cargo_tonnage: 1200, refitted: true, decks: ["a", "b"], shipyard: "Tycho"}`})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, map[string]interface{}{
+		"cargo_tonnage": float64(1200),
+		"refitted":      true,
+		"decks":         []interface{}{"a", "b"},
+		"shipyard":      "Tycho",
+	}, parseJsonLiteral(value))
+}
+
+func TestGraphqlQuery_batchesNestedFields(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("HGETALL", config.KeyCategories).ExpectMap(map[string]string{"2": "Warships"})
+	conn.Command("HGETALL", config.KeyCategoryAttributes).ExpectMap(map[string]string{})
+	conn.Command("HGETALL", getProductNameById(7)).ExpectMap(map[string]string{"id": "7", "name": "Rocinante", "main_category_id": "2"})
+	conn.Command("HGETALL", getProductNameById(8)).ExpectMap(map[string]string{"id": "8", "name": "Tachi", "main_category_id": "2"})
+	conn.Command("SMEMBERS", getProductImagesKeyName(7)).Expect([]interface{}{[]byte("3"), []byte("1")})
+	conn.Command("SMEMBERS", getProductImagesKeyName(8)).Expect([]interface{}{})
+
+	categoryCache = newCategoryCaches(time.Minute)
+	defer func() { categoryCache = newCategoryCaches(time.Minute) }()
+
+	recorder := &pipelineRecorder{Conn: conn}
+	rec := postGraphqlQuery(t, recorder, `{
+		rocinante: product(id: 7) { name mainCategory { name } images { id } }
+		tachi: product(id: 8) { name images { id } }
+	}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t,
+		`{"data":{"rocinante":{"images":[{"id":1},{"id":3}],"mainCategory":{"name":"Warships"},"name":"Rocinante"},"tachi":{"images":[],"name":"Tachi"}}}`,
+		strings.TrimSpace(rec.Body.String()))
+
+	// The images of both products are queued by the loader and fetched in one round trip
+	imagePipelines := make([][]string, 0)
+	for _, pipeline := range recorder.pipelines {
+		for _, command := range pipeline {
+			if strings.HasPrefix(command, "SMEMBERS ") {
+				// The resolvers queue the products in no particular order
+				sort.Strings(pipeline)
+				imagePipelines = append(imagePipelines, pipeline)
+				break
+			}
+		}
+	}
+	assert.DeepEqual(t, [][]string{{
+		"SMEMBERS " + getProductImagesKeyName(7),
+		"SMEMBERS " + getProductImagesKeyName(8),
+	}}, imagePipelines)
+}
+
+func TestGraphqlQuery_validationErrors(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("HGETALL", config.KeyCategories).ExpectMap(map[string]string{"2": "Warships"})
+	conn.Command("HGETALL", config.KeyCategoryAttributes).ExpectMap(map[string]string{})
+
+	categoryCache = newCategoryCaches(time.Minute)
+	defer func() { categoryCache = newCategoryCaches(time.Minute) }()
+
+	rec := postGraphqlQuery(t, conn, `mutation { createProduct(input: {name: "Rocinante", price: "12.50", mainCategoryId: 2}) { id } }`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var response struct {
+		Errors []struct {
+			Message    string                 `json:"message"`
+			Extensions map[string]interface{} `json:"extensions"`
+		} `json:"errors"`
+	}
+	assert.NilError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	assert.Equal(t, 1, len(response.Errors))
+	assert.Equal(t, "please provide the currency of the price", response.Errors[0].Message)
+	assert.Equal(t, "Invalid price", response.Errors[0].Extensions["title"])
+}
+
+// Records the commands of every round trip to Redis, since redigomock counts commands the same way
+// whether they were pipelined or not
+type pipelineRecorder struct {
+	*redigomock.Conn
+	pending   []string
+	pipelines [][]string
+}
+
+func (conn *pipelineRecorder) Send(command string, args ...interface{}) error {
+	conn.record(command, args)
+	return conn.Conn.Send(command, args...)
+}
+
+func (conn *pipelineRecorder) Flush() error {
+	conn.endPipeline()
+	return conn.Conn.Flush()
+}
+
+func (conn *pipelineRecorder) Do(command string, args ...interface{}) (interface{}, error) {
+	if command != "" {
+		conn.record(command, args)
+	}
+	conn.endPipeline()
+	return conn.Conn.Do(command, args...)
+}
+
+func (conn *pipelineRecorder) record(command string, args []interface{}) {
+	words := []string{command}
+	for _, arg := range args {
+		words = append(words, fmt.Sprint(arg))
+	}
+	conn.pending = append(conn.pending, strings.Join(words, " "))
+}
+
+func (conn *pipelineRecorder) endPipeline() {
+	if len(conn.pending) > 0 {
+		conn.pipelines = append(conn.pipelines, conn.pending)
+		conn.pending = nil
+	}
+}
+
+func postGraphqlQuery(t *testing.T, conn redis.Conn, query string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(GraphqlRequest{Query: query})
+	req := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(string(body)))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	c.Set(redisConnContextKey, conn)
+	assert.NilError(t, graphqlQuery(c))
+	return rec
+}
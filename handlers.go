@@ -2,16 +2,19 @@ package main
 
 import (
 	"fmt"
-	"github.com/bugsnag/bugsnag-go"
 	"github.com/gomodule/redigo/redis"
 	"github.com/labstack/echo"
-	"github.com/labstack/gommon/log"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
 func productsCreate(c echo.Context) error {
+	redisConn := getRedisConn(c)
 	product := Product{}
 
 	//////////////////////////////////////////
@@ -21,13 +24,38 @@ func productsCreate(c echo.Context) error {
 	if err := c.Bind(&product); err != nil {
 		return c.JSON(http.StatusUnprocessableEntity, validationError)
 	}
+	// Products only go in and out of the trash through the delete and restore endpoints
+	product.DeletedAt = 0
 
+	if apiError := validateProduct(&product, nil, redisConn); apiError != nil {
+		return c.JSON(apiError.HttpStatus, apiError)
+	}
+
+	err := saveNewProduct(&product, getActor(c), redisConn)
+	if err != nil {
+		return serverErrorResponse(c, err)
+	}
+
+	product.setCategory(redisConn)
+	return c.JSON(http.StatusCreated, product)
+}
+
+// Checks the product sent by the API consumer and sets the fields derived from the input (price, category name, attributes...).
+// The old product is nil for new products.
+func validateProduct(product *Product, oldProduct *Product, redisConn redis.Conn) *ApiError {
 	//////////////////////////////////////////
 	// Check presence of required fields
 	// TODO Confirm this is the only required field
 	//////////////////////////////////////////
 	if product.Name == "" {
-		return c.JSON(http.StatusUnprocessableEntity, ApiError{Title: "The name field is required", Description: "Please provide a product name"})
+		return &ApiError{HttpStatus: http.StatusUnprocessableEntity, Title: "The name field is required", Description: "Please provide a product name"}
+	}
+
+	//////////////////////////////////////////
+	// Check the price and currency
+	//////////////////////////////////////////
+	if err := product.setPriceFromInput(); err != nil {
+		return &ApiError{HttpStatus: http.StatusUnprocessableEntity, Title: "Invalid price", Description: err.Error()}
 	}
 
 	//////////////////////////////////////////
@@ -35,25 +63,43 @@ func productsCreate(c echo.Context) error {
 	//////////////////////////////////////////
 	categoryName, err := getCategoryNameById(product.MainCategoryId, redisConn)
 	if err != nil {
-		return c.JSON(http.StatusUnprocessableEntity, ApiError{Title: "Category doesn't exist", Description: "That category id doesn't exist in our system"})
+		return &ApiError{HttpStatus: http.StatusUnprocessableEntity, Title: "Category doesn't exist", Description: "That category id doesn't exist in our system"}
 	}
 	product.MainCategoryName = categoryName
 
-	err = saveNewProduct(&product, redisConn)
-	if err != nil {
-		return serverErrorResponse(c, err)
+	//////////////////////////////////////////
+	// Check the attributes against the category's schema
+	//////////////////////////////////////////
+	if errs := product.setAttributesFromInput(redisConn); len(errs) > 0 {
+		apiError := attributesError(errs)
+		apiError.HttpStatus = http.StatusUnprocessableEntity
+		return &apiError
 	}
 
-	product.setCategory(redisConn)
-	return c.JSON(http.StatusCreated, product)
+	//////////////////////////////////////////
+	// Check the tags
+	//////////////////////////////////////////
+	if errs := product.setTagsFromInput(); len(errs) > 0 {
+		return &ApiError{HttpStatus: http.StatusUnprocessableEntity, Title: "Invalid tags", Description: strings.Join(errs, ". ")}
+	}
+
+	//////////////////////////////////////////
+	// Check the status and the publishing schedule
+	//////////////////////////////////////////
+	if errs := product.setStatusFromInput(oldProduct, time.Now()); len(errs) > 0 {
+		return &ApiError{HttpStatus: http.StatusUnprocessableEntity, Title: "Invalid status", Description: strings.Join(errs, ". ")}
+	}
+
+	return nil
 }
 
 func productsIndex(c echo.Context) error {
+	redisConn := getRedisConn(c)
 
 	var command string
 	args:= redis.Args{}
 	keyName := config.KeyAllProducts
-	categories := getCategoriesMap(redisConn)
+	categories := categoryCache.all(redisConn)
 
 	////////////////////////////////////////////////////
 	// Check if we need to show all products or only products in a certain category
@@ -69,6 +115,82 @@ func productsIndex(c echo.Context) error {
 		}
 	}
 
+	////////////////////////////////////////////////////
+	// Check if we need to convert the prices or filter by price
+	////////////////////////////////////////////////////
+	currency, rates, err := getDisplayCurrency(c)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	filters := []IndexFilter{}
+	if c.QueryParam("min_price") != "" || c.QueryParam("max_price") != "" {
+		// The price range is in the requested currency, or in the base currency of the exchange rates
+		filterCurrency := currency
+		if filterCurrency == "" {
+			filterCurrency = rates.Base
+		}
+		if filterCurrency == "" {
+			return c.JSON(http.StatusUnprocessableEntity, ApiError{Title: "Invalid price range", Description: "A currency is needed to filter by price"})
+		}
+		filter, err := getPriceRangeFilter(c.QueryParam("min_price"), c.QueryParam("max_price"), filterCurrency, rates)
+		if err != nil {
+			return c.JSON(http.StatusUnprocessableEntity, ApiError{Title: "Invalid price range", Description: err.Error()})
+		}
+		filters = append(filters, filter)
+	}
+	if c.QueryParam("in_stock") == "true" || c.QueryParam("in_stock") == "1" {
+		filters = append(filters, IndexFilter{Key: config.KeyInStockProducts})
+	}
+	attributeFilters, err := getAttributeFilters(c.QueryParams())
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, ApiError{Title: "Invalid attribute filter", Description: err.Error()})
+	}
+	filters = append(filters, attributeFilters...)
+	if c.QueryParam("tags") != "" {
+		match := c.QueryParam("tags_match")
+		if match == "" {
+			match = TagsMatchAll
+		}
+		filter, err := getTagFilter(c.QueryParam("tags"), match, redisConn)
+		if err != nil {
+			return errorResponse(c, err)
+		}
+		filters = append(filters, filter)
+	}
+	if c.QueryParam("min_rating") != "" {
+		minRating, err := strconv.ParseFloat(c.QueryParam("min_rating"), 64)
+		if err != nil || minRating < minReviewRating || minRating > maxReviewRating {
+			return c.JSON(http.StatusUnprocessableEntity, ApiError{Title: "Invalid rating filter", Description: fmt.Sprintf("The minimum rating needs to be a number between %v and %v", minReviewRating, maxReviewRating)})
+		}
+		filters = append(filters, getMinRatingFilter(minRating))
+	}
+	keyName, err = filterProductIndex(keyName, filters, redisConn)
+	if err != nil {
+		return serverErrorResponse(c, err)
+	}
+
+	////////////////////////////////////////////////////
+	// Check if we need to sort by rating instead of name
+	////////////////////////////////////////////////////
+	sortByRating := false
+	switch c.QueryParam("sort") {
+	case "", "name":
+	case "rating":
+		// Prefix searching needs the listing to be sorted by name
+		if c.QueryParam("search") != "" {
+			return c.JSON(http.StatusUnprocessableEntity, ApiError{Title: "Invalid sort", Description: "Search results can't be sorted by rating"})
+		}
+		sortByRating = true
+	default:
+		return c.JSON(http.StatusUnprocessableEntity, ApiError{Title: "Invalid sort", Description: "The products can be sorted by name or rating"})
+	}
+	if sortByRating {
+		keyName, err = sortProductIndexByRating(keyName, redisConn)
+		if err != nil {
+			return serverErrorResponse(c, err)
+		}
+	}
+
 	////////////////////////////////////////////////////
 	// Get pagination positions
 	////////////////////////////////////////////////////
@@ -93,11 +215,38 @@ func productsIndex(c echo.Context) error {
 		args = args.Add(keyName).Add(fromPosition).Add(toPosition)
 	}
 
-	products, err := getProducts(command, args, categories, redisConn)
-	if err != nil {
+	////////////////////////////////////////////////////
+	// Products shown in another locale are searched by their translated names as well
+	////////////////////////////////////////////////////
+	locales := getRequestedLocales(c)
+	c.Response().Header().Add("Vary", "Accept-Language")
+
+	var products []Product
+	if c.QueryParam("search") != "" && len(locales) > 0 {
+		productIds, err := searchLocalisedProducts(c.QueryParam("search"), locales, keyName, pageNumber, redisConn)
+		if err != nil {
+			return serverErrorResponse(c, err)
+		}
+		products, err = getProductsByIds(productIds, categories, redisConn)
+		if err != nil {
+			return serverErrorResponse(c, err)
+		}
+	} else {
+		products, err = getProducts(command, args, categories, redisConn)
+		if err != nil {
+			return serverErrorResponse(c, err)
+		}
+	}
+	if err := localiseProducts(products, locales, redisConn); err != nil {
 		return serverErrorResponse(c, err)
 	}
 
+	if currency != "" {
+		for i := range products {
+			products[i].setConvertedPrice(currency, rates)
+		}
+	}
+
 	response := PaginatedProductCollection{
 		CurrentPage:    pageNumber,
 		ResultsPerPage: config.ResultsPerPage,
@@ -107,6 +256,7 @@ func productsIndex(c echo.Context) error {
 }
 
 func productsShow(c echo.Context) error {
+	redisConn := getRedisConn(c)
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
 		return c.JSON(urlParamError.HttpStatus, urlParamError)
@@ -121,13 +271,155 @@ func productsShow(c echo.Context) error {
 			return serverErrorResponse(c, err)
 		}
 	}
+
+	return showProduct(c, product)
+}
+
+func productsShowBySlug(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	slug, err := url.PathUnescape(c.Param("slug"))
+	if err != nil {
+		return c.JSON(notFoundError.HttpStatus, notFoundError)
+	}
+
+	productId, err := getProductIdBySlug(slug, redisConn)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	product, err := getProductById(productId, redisConn)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	// Old slugs of renamed products redirect to the current one
+	if product.Slug != slug {
+		location := "/api/products/by-slug/" + url.PathEscape(product.Slug)
+		if c.QueryString() != "" {
+			location += "?" + c.QueryString()
+		}
+		return c.Redirect(http.StatusMovedPermanently, location)
+	}
+
+	return showProduct(c, product)
+}
+
+// Responds with the product and everything shown along with it (images, variants, availability...)
+func showProduct(c echo.Context, product Product) error {
+	redisConn := getRedisConn(c)
+	// The related products are found by the untranslated name and the category id, so they're loaded first
+	var related *RelatedProducts
+	if isIncluded(c, "related") {
+		relatedProducts, err := getDisplayedRelatedProducts(c, &product)
+		if err != nil {
+			return errorResponse(c, err)
+		}
+		related = &relatedProducts
+	}
+
 	product.setCategory(redisConn)
 	product.setImages(redisConn)
 
+	product.setAvailability(redisConn)
+
+	translations, err := getProductTranslations(product.Id, redisConn)
+	if err != nil {
+		return serverErrorResponse(c, err)
+	}
+	product.localise(translations, getRequestedLocales(c))
+	c.Response().Header().Add("Vary", "Accept-Language")
+	if product.Locale != "" {
+		c.Response().Header().Set("Content-Language", product.Locale)
+	} else {
+		c.Response().Header().Set("Content-Language", config.DefaultLocale)
+	}
+
+	variants, err := getProductVariants(product.Id, redisConn)
+	if err != nil {
+		return serverErrorResponse(c, err)
+	}
+	if len(variants) > 0 {
+		prepareVariants(variants, &product, redisConn)
+		product.Variants = variants
+		product.OptionAxes = getOptionAxes(variants)
+	}
+
+	currency, rates, err := getDisplayCurrency(c)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	if currency != "" {
+		product.setConvertedPrice(currency, rates)
+		for i := range product.Variants {
+			product.Variants[i].setConvertedPrice(currency, rates)
+		}
+	}
+	product.Related = related
+
 	return c.JSON(http.StatusOK, product)
 }
 
+// Whether the `include` query parameter (a comma separated list) asks for the given part of the response
+func isIncluded(c echo.Context, name string) bool {
+	for _, include := range strings.Split(c.QueryParam("include"), ",") {
+		if strings.TrimSpace(include) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Loads the related products, shown in the requested locale and currency
+func getDisplayedRelatedProducts(c echo.Context, product *Product) (RelatedProducts, error) {
+	redisConn := getRedisConn(c)
+	related, err := getRelatedProducts(product, categoryCache.all(redisConn), redisConn)
+	if err != nil {
+		return related, err
+	}
+
+	currency, rates, err := getDisplayCurrency(c)
+	if err != nil {
+		return related, err
+	}
+	locales := getRequestedLocales(c)
+	for _, products := range related.all() {
+		if err := prepareDisplayedProducts(products, locales, currency, rates, redisConn); err != nil {
+			return related, err
+		}
+	}
+	return related, nil
+}
+
+// Translates the products to the requested locales and converts their prices to the display currency, if there's one
+func prepareDisplayedProducts(products []Product, locales []string, currency string, rates ExchangeRates, redisConn redis.Conn) error {
+	if err := localiseProducts(products, locales, redisConn); err != nil {
+		return err
+	}
+	if currency == "" {
+		return nil
+	}
+	for i := range products {
+		products[i].setConvertedPrice(currency, rates)
+	}
+	return nil
+}
+
+// Reads the `currency` query parameter, along with the exchange rates to convert prices to it
+func getDisplayCurrency(c echo.Context) (string, ExchangeRates, error) {
+	redisConn := getRedisConn(c)
+	currency := strings.ToUpper(c.QueryParam("currency"))
+	if currency != "" && !isValidCurrency(currency) {
+		return "", ExchangeRates{}, &ApiError{HttpStatus: http.StatusUnprocessableEntity, Title: "Invalid currency", Description: fmt.Sprintf("%q isn't an ISO 4217 currency code", currency)}
+	}
+	if currency == "" && c.QueryParam("min_price") == "" && c.QueryParam("max_price") == "" {
+		return "", ExchangeRates{}, nil
+	}
+
+	rates, err := getExchangeRates(redisConn)
+	return currency, rates, err
+}
+
 func productsUpdate(c echo.Context) error {
+	redisConn := getRedisConn(c)
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
 		return c.JSON(urlParamError.HttpStatus, urlParamError)
@@ -153,26 +445,14 @@ func productsUpdate(c echo.Context) error {
 	if err := c.Bind(&product); err != nil {
 		return c.JSON(http.StatusUnprocessableEntity, validationError)
 	}
+	// Products only go in and out of the trash through the delete and restore endpoints
+	product.DeletedAt = 0
 
-	//////////////////////////////////////////
-	// Check presence of required fields
-	// TODO Confirm this is the only required field
-	//////////////////////////////////////////
-	if product.Name == "" {
-		return c.JSON(http.StatusUnprocessableEntity, ApiError{Title: "The name field is required", Description: "Please provide a product name"})
-	}
-
-	//////////////////////////////////////////
-	// Get category name
-	//////////////////////////////////////////
-	categoryName, err := getCategoryNameById(product.MainCategoryId, redisConn)
-	product.MainCategoryName = categoryName
-	if err != nil {
-		return c.JSON(http.StatusUnprocessableEntity, ApiError{Title: "Category doesn't exist", Description: "That category id doesn't exist in our system"})
+	if apiError := validateProduct(&product, &oldProduct, redisConn); apiError != nil {
+		return c.JSON(apiError.HttpStatus, apiError)
 	}
 
-
-	err = updateProduct(&product, &oldProduct, redisConn)
+	err = updateProduct(&product, &oldProduct, getActor(c), redisConn)
 	if err != nil {
 		return serverErrorResponse(c, err)
 	}
@@ -184,6 +464,7 @@ func productsUpdate(c echo.Context) error {
 }
 
 func productsDelete(c echo.Context) error {
+	redisConn := getRedisConn(c)
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
 		return c.JSON(urlParamError.HttpStatus, urlParamError)
@@ -193,7 +474,7 @@ func productsDelete(c echo.Context) error {
 		Id: id,
 	}
 
-	err = product.delete(redisConn)
+	err = product.trash(getActor(c), redisConn)
 	if err != nil {
 		switch e := err.(type) {
 		case *ApiError:
@@ -206,7 +487,75 @@ func productsDelete(c echo.Context) error {
 	return c.NoContent(http.StatusNoContent)
 }
 
+func productsRestore(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(urlParamError.HttpStatus, urlParamError)
+	}
+
+	product, err := restoreFromTrash(id, getActor(c), redisConn)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	product.setCategory(redisConn)
+	product.setImages(redisConn)
+
+	return c.JSON(http.StatusOK, product)
+}
+
+func trashIndex(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	pageNumber, _ := strconv.Atoi(c.QueryParam("page"))
+	if pageNumber < 1 {
+		pageNumber = 1
+	}
+
+	products, err := getTrashedProducts(pageNumber, categoryCache.all(redisConn), redisConn)
+	if err != nil {
+		return serverErrorResponse(c, err)
+	}
+
+	response := PaginatedProductCollection{
+		CurrentPage:    pageNumber,
+		ResultsPerPage: config.ResultsPerPage,
+		Data:           products,
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// Lists the products that aren't published, drafts by default
+func draftsIndex(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	status := c.QueryParam("status")
+	if status == "" {
+		status = ProductDraft
+	}
+	if status != ProductDraft && status != ProductArchived {
+		return c.JSON(http.StatusUnprocessableEntity, ApiError{Title: "Validation errors", Description: fmt.Sprintf("The status needs to be %s or %s", ProductDraft, ProductArchived)})
+	}
+
+	pageNumber, _ := strconv.Atoi(c.QueryParam("page"))
+	if pageNumber < 1 {
+		pageNumber = 1
+	}
+
+	products, err := getProductsByStatus(status, pageNumber, categoryCache.all(redisConn), redisConn)
+	if err != nil {
+		return serverErrorResponse(c, err)
+	}
+
+	response := PaginatedProductCollection{
+		CurrentPage:    pageNumber,
+		ResultsPerPage: config.ResultsPerPage,
+		Data:           products,
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
 func imagesShow(c echo.Context) error {
+	redisConn := getRedisConn(c)
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
 		return c.JSON(http.StatusUnprocessableEntity, urlParamError)
@@ -222,6 +571,7 @@ func imagesShow(c echo.Context) error {
 }
 
 func imagesCreate(c echo.Context) error {
+	redisConn := getRedisConn(c)
 	productId, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
 		return c.JSON(http.StatusUnprocessableEntity, urlParamError)
@@ -243,6 +593,7 @@ func imagesCreate(c echo.Context) error {
 }
 
 func imagesDelete(c echo.Context) error {
+	redisConn := getRedisConn(c)
 	imageId, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
 		return c.JSON(http.StatusUnprocessableEntity, urlParamError)
@@ -266,7 +617,1108 @@ func imagesDelete(c echo.Context) error {
 }
 
 func serverErrorResponse(c echo.Context, err error) error {
-	log.Error(err)
-	_ = bugsnag.Notify(err)
-	return c.JSON(serverError.HttpStatus, serverError)
+	requestId := getRequestId(c)
+	requestLogger(c).Error("Server error", Fields{"error": err})
+	reportError(newErrorReport(c, err))
+
+	response := serverError
+	response.RequestId = requestId
+	return c.JSON(response.HttpStatus, response)
+}
+
+func productVersionsIndex(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(urlParamError.HttpStatus, urlParamError)
+	}
+
+	pageNumber, _ := strconv.Atoi(c.QueryParam("page"))
+	if pageNumber < 1 {
+		pageNumber = 1
+	}
+
+	versions, err := getProductVersions(id, pageNumber, redisConn)
+	if err != nil {
+		return serverErrorResponse(c, err)
+	}
+	// The history is kept after a product is deleted, so we only 404 if there was never such a product
+	if len(versions) == 0 && pageNumber == 1 {
+		return c.JSON(notFoundError.HttpStatus, notFoundError)
+	}
+
+	response := PaginatedVersionCollection{
+		CurrentPage:    pageNumber,
+		ResultsPerPage: config.ResultsPerPage,
+		Data:           versions,
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+func productVersionsShow(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(urlParamError.HttpStatus, urlParamError)
+	}
+	number, err := strconv.Atoi(c.Param("n"))
+	if err != nil {
+		return c.JSON(urlParamError.HttpStatus, urlParamError)
+	}
+
+	version, err := getProductVersion(id, number, redisConn)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, version)
+}
+
+func productVersionsDiff(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(urlParamError.HttpStatus, urlParamError)
+	}
+	from, err := strconv.Atoi(c.QueryParam("from"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ApiError{Title: "Wrong parameters", Description: "The `from` and `to` parameters need to be valid version numbers"})
+	}
+	to, err := strconv.Atoi(c.QueryParam("to"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ApiError{Title: "Wrong parameters", Description: "The `from` and `to` parameters need to be valid version numbers"})
+	}
+
+	fromVersion, err := getProductVersion(id, from, redisConn)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	toVersion, err := getProductVersion(id, to, redisConn)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, diffProductVersions(fromVersion, toVersion))
+}
+
+func productVersionsRestore(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(urlParamError.HttpStatus, urlParamError)
+	}
+	number, err := strconv.Atoi(c.Param("n"))
+	if err != nil {
+		return c.JSON(urlParamError.HttpStatus, urlParamError)
+	}
+
+	product, err := restoreProductVersion(id, number, getActor(c), redisConn)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	product.setCategory(redisConn)
+	product.setImages(redisConn)
+
+	return c.JSON(http.StatusOK, product)
+}
+
+// Responds with the error itself if it's one of our API errors, or with a generic server error otherwise
+func errorResponse(c echo.Context, err error) error {
+	switch e := err.(type) {
+	case *ApiError:
+		return c.JSON(e.HttpStatus, e)
+	default:
+		return serverErrorResponse(c, err)
+	}
+}
+
+// There's no authentication yet, so API consumers identify themselves with the X-Actor header
+func getActor(c echo.Context) string {
+	actor := c.Request().Header.Get("X-Actor")
+	if actor == "" {
+		return "anonymous"
+	}
+	return actor
+}
+
+func webhooksCreate(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	webhook := Webhook{}
+	if err := c.Bind(&webhook); err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, validationError)
+	}
+
+	if errs := webhook.validate(); len(errs) > 0 {
+		return c.JSON(http.StatusUnprocessableEntity, ApiError{Title: "Validation errors", Description: strings.Join(errs, ". ")})
+	}
+
+	err := saveNewWebhook(&webhook, redisConn)
+	if err != nil {
+		return serverErrorResponse(c, err)
+	}
+
+	// This is the only time the secret is shown
+	return c.JSON(http.StatusCreated, webhook)
+}
+
+func webhooksIndex(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	webhooks, err := getWebhooks(redisConn)
+	if err != nil {
+		return serverErrorResponse(c, err)
+	}
+	for i := range webhooks {
+		webhooks[i].Secret = ""
+	}
+
+	return c.JSON(http.StatusOK, webhooks)
+}
+
+func webhooksShow(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(urlParamError.HttpStatus, urlParamError)
+	}
+
+	webhook, err := getWebhookById(id, redisConn)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	webhook.Secret = ""
+
+	return c.JSON(http.StatusOK, webhook)
+}
+
+func webhooksDelete(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(urlParamError.HttpStatus, urlParamError)
+	}
+
+	err = deleteWebhook(id, redisConn)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func webhookDeliveriesIndex(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(urlParamError.HttpStatus, urlParamError)
+	}
+
+	if _, err := getWebhookById(id, redisConn); err != nil {
+		return errorResponse(c, err)
+	}
+
+	deliveries, err := getWebhookDeliveries(id, redisConn)
+	if err != nil {
+		return serverErrorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, deliveries)
+}
+
+func webhooksDeadLetterIndex(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	deliveries, err := getDeadLetterDeliveries(redisConn)
+	if err != nil {
+		return serverErrorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, deliveries)
+}
+
+func exchangeRatesShow(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	rates, err := getExchangeRates(redisConn)
+	if err != nil {
+		return serverErrorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, rates)
+}
+
+func exchangeRatesUpdate(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	rates := ExchangeRates{}
+	if err := c.Bind(&rates); err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, validationError)
+	}
+
+	if err := rates.validate(); err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, ApiError{Title: "Invalid exchange rates", Description: err.Error()})
+	}
+
+	err := saveExchangeRates(&rates, redisConn)
+	if err != nil {
+		return serverErrorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, rates)
+}
+
+func variantsIndex(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	product, err := getUrlProduct(c)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	variants, err := getProductVariants(product.Id, redisConn)
+	if err != nil {
+		return serverErrorResponse(c, err)
+	}
+	prepareVariants(variants, &product, redisConn)
+
+	return c.JSON(http.StatusOK, VariantCollection{
+		OptionAxes: getOptionAxes(variants),
+		Data:       variants,
+	})
+}
+
+func variantsCreate(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	product, err := getUrlProduct(c)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	variant := Variant{}
+	if err := c.Bind(&variant); err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, validationError)
+	}
+	variant.ProductId = product.Id
+
+	if err := variant.setPriceFromInput(product.Currency); err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, ApiError{Title: "Invalid price", Description: err.Error()})
+	}
+	errs, err := validateVariant(&variant, &product, redisConn)
+	if err != nil {
+		return serverErrorResponse(c, err)
+	}
+	if len(errs) > 0 {
+		return c.JSON(http.StatusUnprocessableEntity, ApiError{Title: "Validation errors", Description: strings.Join(errs, ". ")})
+	}
+
+	err = saveNewVariant(&variant, getActor(c), redisConn)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	variant.setPrice(&product)
+	variant.setImages(variant.ImageIds)
+	return c.JSON(http.StatusCreated, variant)
+}
+
+func variantsShow(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	product, err := getUrlProduct(c)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	variantId, err := strconv.Atoi(c.Param("variantId"))
+	if err != nil {
+		return c.JSON(urlParamError.HttpStatus, urlParamError)
+	}
+	variant, err := getVariantById(product.Id, variantId, redisConn)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	variants := []Variant{variant}
+	prepareVariants(variants, &product, redisConn)
+	return c.JSON(http.StatusOK, variants[0])
+}
+
+func variantsUpdate(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	product, err := getUrlProduct(c)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	variantId, err := strconv.Atoi(c.Param("variantId"))
+	if err != nil {
+		return c.JSON(urlParamError.HttpStatus, urlParamError)
+	}
+	oldVariant, err := getVariantById(product.Id, variantId, redisConn)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	variant := Variant{}
+	if err := c.Bind(&variant); err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, validationError)
+	}
+	variant.Id = oldVariant.Id
+	variant.ProductId = product.Id
+
+	if err := variant.setPriceFromInput(product.Currency); err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, ApiError{Title: "Invalid price", Description: err.Error()})
+	}
+	errs, err := validateVariant(&variant, &product, redisConn)
+	if err != nil {
+		return serverErrorResponse(c, err)
+	}
+	if len(errs) > 0 {
+		return c.JSON(http.StatusUnprocessableEntity, ApiError{Title: "Validation errors", Description: strings.Join(errs, ". ")})
+	}
+
+	err = updateVariant(&variant, &oldVariant, getActor(c), redisConn)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	variant.setPrice(&product)
+	variant.setImages(variant.ImageIds)
+	return c.JSON(http.StatusOK, variant)
+}
+
+func variantsDelete(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	product, err := getUrlProduct(c)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	variantId, err := strconv.Atoi(c.Param("variantId"))
+	if err != nil {
+		return c.JSON(urlParamError.HttpStatus, urlParamError)
+	}
+	variant, err := getVariantById(product.Id, variantId, redisConn)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	err = variant.delete(&product, getActor(c), redisConn)
+	if err != nil {
+		return serverErrorResponse(c, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func skusShow(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	variantId, err := getVariantIdBySku(c.Param("sku"), redisConn)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	values, err := redis.Values(redisConn.Do("HGETALL", getVariantKeyName(variantId)))
+	if err != nil {
+		return serverErrorResponse(c, err)
+	}
+	if len(values) == 0 {
+		return c.JSON(notFoundError.HttpStatus, notFoundError)
+	}
+	variant := Variant{}
+	if err := scanVariant(values, &variant); err != nil {
+		return serverErrorResponse(c, err)
+	}
+
+	// Skus of products in the trash can't be looked up
+	product, err := getProductById(variant.ProductId, redisConn)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	variants := []Variant{variant}
+	prepareVariants(variants, &product, redisConn)
+	product.setCategory(redisConn)
+	product.setImages(redisConn)
+
+	return c.JSON(http.StatusOK, SkuLookup{
+		Sku:     variant.Sku,
+		Variant: variants[0],
+		Product: product,
+	})
+}
+
+// Loads the product in the url of the product sub-resources (variants, translations, relations, reviews...)
+func getUrlProduct(c echo.Context) (Product, error) {
+	redisConn := getRedisConn(c)
+	productId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return Product{}, &urlParamError
+	}
+	return getProductById(productId, redisConn)
+}
+
+// Validates the variant against the other variants and the images of its product
+func validateVariant(variant *Variant, product *Product, redisConn redis.Conn) ([]string, error) {
+	siblings, err := getProductVariants(product.Id, redisConn)
+	if err != nil {
+		return nil, err
+	}
+	productImageIds, err := redis.Ints(redisConn.Do("SMEMBERS", getProductImagesKeyName(product.Id)))
+	if err != nil {
+		return nil, err
+	}
+	return variant.validate(siblings, productImageIds), nil
+}
+
+func stockShow(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	product, err := getUrlProduct(c)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	stock, err := getStock(product.Id, redisConn)
+	if err != nil {
+		return serverErrorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, stock)
+}
+
+func stockUpdate(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	product, err := getUrlProduct(c)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	input := struct {
+		VariantId int  `json:"variant_id"`
+		OnHand    *int `json:"on_hand"`
+	}{}
+	if err := c.Bind(&input); err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, validationError)
+	}
+	if input.OnHand == nil || *input.OnHand < 0 {
+		return c.JSON(http.StatusUnprocessableEntity, ApiError{Title: "Validation errors", Description: "The quantity on hand needs to be a number of 0 or more"})
+	}
+	if input.VariantId != 0 {
+		if _, err := getVariantById(product.Id, input.VariantId, redisConn); err != nil {
+			return errorResponse(c, err)
+		}
+	}
+
+	err = setStock(&product, input.VariantId, *input.OnHand, redisConn)
+	if err != nil {
+		return serverErrorResponse(c, err)
+	}
+
+	stock, err := getStock(product.Id, redisConn)
+	if err != nil {
+		return serverErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, stock)
+}
+
+func stockReserve(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	product, err := getUrlProduct(c)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	input := struct {
+		VariantId int `json:"variant_id"`
+		Quantity  int `json:"quantity"`
+		Ttl       int `json:"ttl"` // in seconds
+	}{}
+	if err := c.Bind(&input); err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, validationError)
+	}
+	if input.Quantity < 1 {
+		return c.JSON(http.StatusUnprocessableEntity, ApiError{Title: "Validation errors", Description: "The quantity needs to be at least 1"})
+	}
+	if input.Ttl == 0 {
+		input.Ttl = config.ReservationTtl
+	}
+	if input.Ttl < 0 || input.Ttl > config.ReservationMaxTtl {
+		return c.JSON(http.StatusUnprocessableEntity, ApiError{Title: "Validation errors", Description: fmt.Sprintf("The ttl needs to be between 1 and %v seconds", config.ReservationMaxTtl)})
+	}
+
+	reservation := Reservation{
+		VariantId: input.VariantId,
+		Quantity:  input.Quantity,
+		ExpiresAt: time.Now().Add(time.Duration(input.Ttl) * time.Second).Unix(),
+	}
+	err = reserveStock(&product, &reservation, redisConn)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusCreated, reservation)
+}
+
+func stockRelease(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	product, err := getUrlProduct(c)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	input := struct {
+		ReservationId string `json:"reservation_id"`
+	}{}
+	if err := c.Bind(&input); err != nil || input.ReservationId == "" {
+		return c.JSON(http.StatusUnprocessableEntity, validationError)
+	}
+
+	released, err := releaseStock(&product, input.ReservationId, redisConn)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"reservation_id": input.ReservationId,
+		"released":       released,
+	})
+}
+
+func productTranslationsIndex(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	product, err := getUrlProduct(c)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	translations, err := getProductTranslations(product.Id, redisConn)
+	if err != nil {
+		return serverErrorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, translations)
+}
+
+func productTranslationsUpdate(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	product, err := getUrlProduct(c)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	locale := normaliseLocale(c.Param("locale"))
+	if !isValidLocale(locale) {
+		return c.JSON(localeParamError.HttpStatus, localeParamError)
+	}
+
+	translation := Translation{}
+	if err := c.Bind(&translation); err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, validationError)
+	}
+	if errs := translation.validate(); len(errs) > 0 {
+		return c.JSON(http.StatusUnprocessableEntity, ApiError{Title: "Validation errors", Description: strings.Join(errs, ". ")})
+	}
+
+	err = saveProductTranslation(&product, locale, translation, getActor(c), redisConn)
+	if err != nil {
+		return serverErrorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, translation)
+}
+
+func productTranslationsDelete(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	product, err := getUrlProduct(c)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	locale := normaliseLocale(c.Param("locale"))
+	if !isValidLocale(locale) {
+		return c.JSON(localeParamError.HttpStatus, localeParamError)
+	}
+
+	err = deleteProductTranslation(&product, locale, getActor(c), redisConn)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func productRelatedIndex(c echo.Context) error {
+	product, err := getUrlProduct(c)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	related, err := getDisplayedRelatedProducts(c, &product)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, related)
+}
+
+func productRelatedUpdate(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	product, err := getUrlProduct(c)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	relations := Relations{}
+	if err := c.Bind(&relations); err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, validationError)
+	}
+	if errs := relations.validate(product.Id, redisConn); len(errs) > 0 {
+		return c.JSON(http.StatusUnprocessableEntity, ApiError{Title: "Validation errors", Description: strings.Join(errs, ". ")})
+	}
+
+	err = saveProductRelations(product.Id, relations, redisConn)
+	if err != nil {
+		return serverErrorResponse(c, err)
+	}
+
+	related, err := getDisplayedRelatedProducts(c, &product)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, related)
+}
+
+func reviewsIndex(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	product, err := getUrlProduct(c)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	status := c.QueryParam("status")
+	if status == "" {
+		status = ReviewApproved
+	}
+	if !stringInSlice(status, reviewStatuses) {
+		return c.JSON(http.StatusUnprocessableEntity, ApiError{Title: "Validation errors", Description: fmt.Sprintf("The status needs to be one of %s", strings.Join(reviewStatuses, ", "))})
+	}
+
+	pageNumber, _ := strconv.Atoi(c.QueryParam("page"))
+	if pageNumber < 1 {
+		pageNumber = 1
+	}
+
+	reviews, err := getProductReviews(product.Id, status, pageNumber, redisConn)
+	if err != nil {
+		return serverErrorResponse(c, err)
+	}
+
+	response := PaginatedReviewCollection{
+		CurrentPage:    pageNumber,
+		ResultsPerPage: config.ResultsPerPage,
+		Data:           reviews,
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+func reviewsCreate(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	product, err := getUrlProduct(c)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	review := Review{}
+	if err := c.Bind(&review); err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, validationError)
+	}
+	review.ProductId = product.Id
+
+	if errs := review.validate(); len(errs) > 0 {
+		return c.JSON(http.StatusUnprocessableEntity, ApiError{Title: "Validation errors", Description: strings.Join(errs, ". ")})
+	}
+
+	err = saveNewReview(&review, redisConn)
+	if err != nil {
+		return serverErrorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusCreated, review)
+}
+
+func reviewsApprove(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	product, err := getUrlProduct(c)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	reviewId, err := strconv.Atoi(c.Param("reviewId"))
+	if err != nil {
+		return c.JSON(urlParamError.HttpStatus, urlParamError)
+	}
+	review, err := getReviewById(product.Id, reviewId, redisConn)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	err = approveReview(&product, &review, redisConn)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, review)
+}
+
+func reviewsDelete(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	product, err := getUrlProduct(c)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	reviewId, err := strconv.Atoi(c.Param("reviewId"))
+	if err != nil {
+		return c.JSON(urlParamError.HttpStatus, urlParamError)
+	}
+	if _, err := getReviewById(product.Id, reviewId, redisConn); err != nil {
+		return errorResponse(c, err)
+	}
+
+	err = deleteReview(&product, reviewId, redisConn)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func collectionsCreate(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	collection := Collection{}
+	if err := c.Bind(&collection); err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, validationError)
+	}
+
+	if errs := collection.validate(); len(errs) > 0 {
+		return c.JSON(http.StatusUnprocessableEntity, ApiError{Title: "Validation errors", Description: strings.Join(errs, ". ")})
+	}
+
+	err := saveNewCollection(&collection, redisConn)
+	if err != nil {
+		return serverErrorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusCreated, collection)
+}
+
+func collectionsIndex(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	collections, err := getCollections(c.QueryParam("active") == "true", redisConn)
+	if err != nil {
+		return serverErrorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, collections)
+}
+
+func collectionsShow(c echo.Context) error {
+	collection, err := getUrlCollection(c)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, collection)
+}
+
+func collectionsUpdate(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	oldCollection, err := getUrlCollection(c)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	collection := Collection{}
+	if err := c.Bind(&collection); err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, validationError)
+	}
+
+	if errs := collection.validate(); len(errs) > 0 {
+		return c.JSON(http.StatusUnprocessableEntity, ApiError{Title: "Validation errors", Description: strings.Join(errs, ". ")})
+	}
+
+	err = updateCollection(&collection, &oldCollection, redisConn)
+	if err != nil {
+		return serverErrorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, collection)
+}
+
+func collectionsDelete(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(urlParamError.HttpStatus, urlParamError)
+	}
+
+	err = deleteCollection(id, redisConn)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func collectionProductsIndex(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	collection, err := getUrlCollection(c)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	// Scheduled collections aren't shown before they start or after they end
+	if !collection.isActiveAt(time.Now()) {
+		return c.JSON(notFoundError.HttpStatus, notFoundError)
+	}
+
+	pageNumber, _ := strconv.Atoi(c.QueryParam("page"))
+	if pageNumber < 1 {
+		pageNumber = 1
+	}
+
+	currency, rates, err := getDisplayCurrency(c)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	locales := getRequestedLocales(c)
+	c.Response().Header().Add("Vary", "Accept-Language")
+
+	products, err := getCollectionProducts(collection.Id, pageNumber, categoryCache.all(redisConn), redisConn)
+	if err != nil {
+		return serverErrorResponse(c, err)
+	}
+	if err := prepareDisplayedProducts(products, locales, currency, rates, redisConn); err != nil {
+		return errorResponse(c, err)
+	}
+
+	response := PaginatedProductCollection{
+		CurrentPage:    pageNumber,
+		ResultsPerPage: config.ResultsPerPage,
+		Data:           products,
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+func collectionProductsAdd(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	collection, err := getUrlCollection(c)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	input := CollectionProductsInput{}
+	if err := c.Bind(&input); err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, validationError)
+	}
+	if errs := input.validate(redisConn); len(errs) > 0 {
+		return c.JSON(http.StatusUnprocessableEntity, ApiError{Title: "Validation errors", Description: strings.Join(errs, ". ")})
+	}
+
+	position := -1
+	if input.Position != nil {
+		position = *input.Position
+	}
+	err = addCollectionProducts(&collection, input.ProductIds, position, redisConn)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, collection)
+}
+
+func collectionProductsReorder(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	collection, err := getUrlCollection(c)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	input := CollectionProductsInput{}
+	if err := c.Bind(&input); err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, validationError)
+	}
+	if errs := validateCollectionProductIds(input.ProductIds, redisConn); len(errs) > 0 {
+		return c.JSON(http.StatusUnprocessableEntity, ApiError{Title: "Validation errors", Description: strings.Join(errs, ". ")})
+	}
+
+	err = reorderCollectionProducts(&collection, input.ProductIds, redisConn)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, collection)
+}
+
+func collectionProductsRemove(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	collection, err := getUrlCollection(c)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	productId, err := strconv.Atoi(c.Param("productId"))
+	if err != nil {
+		return c.JSON(urlParamError.HttpStatus, urlParamError)
+	}
+
+	err = removeCollectionProduct(&collection, productId, redisConn)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Loads the collection from the `id` url parameter
+func getUrlCollection(c echo.Context) (Collection, error) {
+	redisConn := getRedisConn(c)
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return Collection{}, &urlParamError
+	}
+	return getCollectionById(id, redisConn)
+}
+
+func tagsIndex(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	counts, err := getTagCounts(redisConn)
+	if err != nil {
+		return serverErrorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, counts)
+}
+
+func categoriesIndex(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	categories := categoryCache.all(redisConn)
+
+	response := make([]CategoryDetails, 0, len(categories))
+	for _, category := range categories {
+		response = append(response, CategoryDetails{
+			Category:   category,
+			Attributes: categoryCache.getAttributeSchema(category.Id, redisConn),
+		})
+	}
+	sort.Slice(response, func(i, j int) bool { return response[i].Id < response[j].Id })
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func categoriesShow(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(urlParamError.HttpStatus, urlParamError)
+	}
+
+	category, ok := categoryCache.get(id, redisConn)
+	if !ok {
+		return c.JSON(notFoundError.HttpStatus, notFoundError)
+	}
+
+	return c.JSON(http.StatusOK, CategoryDetails{
+		Category:   category,
+		Attributes: categoryCache.getAttributeSchema(id, redisConn),
+	})
+}
+
+func categoryAttributesUpdate(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(urlParamError.HttpStatus, urlParamError)
+	}
+
+	category, ok := categoryCache.get(id, redisConn)
+	if !ok {
+		return c.JSON(notFoundError.HttpStatus, notFoundError)
+	}
+
+	schema := make([]AttributeDefinition, 0)
+	if err := c.Bind(&schema); err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, validationError)
+	}
+	if errs := validateAttributeSchema(schema); len(errs) > 0 {
+		return c.JSON(http.StatusUnprocessableEntity, ApiError{Title: "Validation errors", Description: strings.Join(errs, ". ")})
+	}
+
+	err = saveAttributeSchema(id, schema, redisConn)
+	if err != nil {
+		return serverErrorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, CategoryDetails{
+		Category:   category,
+		Attributes: schema,
+	})
+}
+
+func attributesError(errs map[string]string) ApiError {
+	fields := make(map[string]string, len(errs))
+	for name, message := range errs {
+		fields["attributes."+name] = message
+	}
+	return ApiError{
+		Title:       "Invalid attributes",
+		Description: "Some attributes don't match the schema of the category",
+		Fields:      fields,
+	}
+}
+
+func tenantsCreate(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	tenant := Tenant{}
+	if err := c.Bind(&tenant); err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, validationError)
+	}
+
+	if errs := tenant.validate(); len(errs) > 0 {
+		return c.JSON(http.StatusUnprocessableEntity, ApiError{Title: "Validation errors", Description: strings.Join(errs, ". ")})
+	}
+
+	err := provisionTenant(&tenant, redisConn)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	// This is the only time the api key is shown
+	return c.JSON(http.StatusCreated, tenant)
+}
+
+func tenantsIndex(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	tenants, err := getTenants(redisConn)
+	if err != nil {
+		return serverErrorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, tenants)
+}
+
+func tenantsShow(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	tenant, err := getTenantById(c.Param("tenantId"), redisConn)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	tenant.ApiKey = ""
+
+	return c.JSON(http.StatusOK, tenant)
+}
+
+func tenantsDelete(c echo.Context) error {
+	redisConn := getRedisConn(c)
+	err := deleteTenant(c.Param("tenantId"), redisConn)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"github.com/labstack/echo"
+	"net/http"
+	"time"
+)
+
+type HealthCheck struct {
+	Name      string  `json:"name"`
+	Healthy   bool    `json:"healthy"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type HealthReport struct {
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks,omitempty"`
+}
+
+// Liveness probe: if we're able to respond at all, the process is alive
+func healthz(c echo.Context) error {
+	return c.JSON(http.StatusOK, HealthReport{Status: "ok"})
+}
+
+// Readiness probe: we're only ready to take traffic if Redis is reachable and seeded
+func readyz(c echo.Context) error {
+	// Use a fresh connection from the pool, so we're actually testing that we can connect
+	conn := pool.Get()
+	defer conn.Close()
+
+	report := runReadinessChecks(conn)
+	if report.Status != "ok" {
+		return c.JSON(http.StatusServiceUnavailable, report)
+	}
+	return c.JSON(http.StatusOK, report)
+}
+
+func runReadinessChecks(conn redis.Conn) HealthReport {
+	report := HealthReport{Status: "ok"}
+
+	report.Checks = append(report.Checks, runHealthCheck("redis", func() error {
+		_, err := redis.String(conn.Do("PING"))
+		return err
+	}))
+	// Every tenant's catalogue needs to be seeded, not only the default one
+	report.Checks = append(report.Checks, runHealthCheck("categories", func() error {
+		return forEachNamespace(conn, func(conn redis.Conn) error {
+			count, err := redis.Int(conn.Do("HLEN", config.KeyCategories))
+			if err != nil {
+				return err
+			}
+			if count == 0 && getKeyPrefix(conn) != "" {
+				return fmt.Errorf("the categories hash of %q hasn't been seeded", getKeyPrefix(conn))
+			}
+			if count == 0 {
+				return errors.New("the categories hash hasn't been seeded")
+			}
+			return nil
+		})
+	}))
+
+	for _, check := range report.Checks {
+		if !check.Healthy {
+			report.Status = "unavailable"
+		}
+	}
+	return report
+}
+
+func runHealthCheck(name string, check func() error) HealthCheck {
+	start := time.Now()
+	err := check()
+
+	result := HealthCheck{
+		Name:      name,
+		Healthy:   err == nil,
+		LatencyMs: float64(time.Since(start)) / float64(time.Millisecond),
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"github.com/rafaeljusto/redigomock"
+	"gotest.tools/assert"
+	"testing"
+)
+
+func TestRunReadinessChecks(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("PING").Expect("PONG")
+	conn.Command("SMEMBERS", config.KeyTenants).Expect([]interface{}{})
+	conn.Command("HLEN", config.KeyCategories).Expect(int64(4))
+
+	report := runReadinessChecks(conn)
+
+	assert.Equal(t, "ok", report.Status)
+	assert.Equal(t, 2, len(report.Checks))
+	for _, check := range report.Checks {
+		assert.Assert(t, check.Healthy, check.Name)
+	}
+}
+
+func TestRunReadinessChecks_failing(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("PING").ExpectError(errors.New("connection refused"))
+	conn.Command("SMEMBERS", config.KeyTenants).Expect([]interface{}{})
+	conn.Command("HLEN", config.KeyCategories).Expect(int64(0))
+
+	report := runReadinessChecks(conn)
+
+	assert.Equal(t, "unavailable", report.Status)
+	assert.Equal(t, "connection refused", report.Checks[0].Error)
+	assert.Equal(t, "the categories hash hasn't been seeded", report.Checks[1].Error)
+}
+
+func TestRunReadinessChecks_checksEveryTenant(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("PING").Expect("PONG")
+	conn.Command("SMEMBERS", config.KeyTenants).Expect([]interface{}{[]byte("acme")})
+	conn.Command("HLEN", config.KeyCategories).Expect(int64(4))
+	conn.Command("HLEN", "tenant:acme:"+config.KeyCategories).Expect(int64(0))
+
+	report := runReadinessChecks(conn)
+
+	assert.Equal(t, "unavailable", report.Status)
+	assert.Equal(t, `the categories hash of "tenant:acme:" hasn't been seeded`, report.Checks[1].Error)
+}
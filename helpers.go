@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"github.com/gomodule/redigo/redis"
 	"strings"
+	"time"
 )
 
 func normaliseSearchString(s string) string {
@@ -11,4 +13,85 @@ func normaliseSearchString(s string) string {
 
 func getHashAsStringMap (keyName string, redisConn redis.Conn) (map[string]string, error) {
 	return redis.StringMap(redisConn.Do("HGETALL", keyName))
-}
\ No newline at end of file
+}
+
+// Converts a string map to the reply format `redis.ScanStruct` expects (alternating bulk string keys and values)
+func stringMapToValues(m map[string]string) []interface{} {
+	values := make([]interface{}, 0, len(m)*2)
+	for k, v := range m {
+		values = append(values, []byte(k), []byte(v))
+	}
+	return values
+}
+
+func stringInSlice(s string, slice []string) bool {
+	for _, item := range slice {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func intInSlice(i int, slice []int) bool {
+	for _, item := range slice {
+		if item == i {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscribes to a Pub/Sub channel of every namespace and calls `onMessage` for every message until the context is
+// cancelled. Reconnects if the connection is lost, calling `onSubscribed` every time the subscription is (re)established.
+func runSubscriber(ctx context.Context, channel string, onSubscribed func() error, onMessage func(message redis.Message) error) {
+	for {
+		err := subscribe(ctx, channel, onSubscribed, onMessage)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+			logger.Error("Lost the connection to a Pub/Sub channel, reconnecting", Fields{"channel": channel, "error": err})
+		}
+	}
+}
+
+// Returns the key prefix of the namespace the message was published in
+func getChannelNamespace(message redis.Message, channel string) string {
+	return strings.TrimSuffix(message.Channel, channel)
+}
+
+func subscribe(ctx context.Context, channel string, onSubscribed func() error, onMessage func(message redis.Message) error) error {
+	psc := redis.PubSubConn{Conn: pool.Get()}
+	defer psc.Close()
+
+	// A blocked Receive only returns once the connection is closed
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = psc.Close()
+		case <-done:
+		}
+	}()
+
+	// Tenants publish on their namespaced channels, including the ones provisioned after we've subscribed
+	if err := psc.PSubscribe(channel, getTenantKeyPrefix("*")+channel); err != nil {
+		return err
+	}
+	if err := onSubscribed(); err != nil {
+		return err
+	}
+
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			if err := onMessage(v); err != nil {
+				return err
+			}
+		case error:
+			return v
+		}
+	}
+}
@@ -32,6 +32,7 @@ func (image *Image) delete(redisConn redis.Conn) error {
 	_ = redisConn.Send("SREM", getProductImagesKeyName(image.ProductId), image.Id)
 	_ = redisConn.Send("HDEL", config.KeyImages, image.Id)
 	_ = redisConn.Send("DEL", getImageNameById(image.Id))
+	_ = sendImageEvent(EventImageDeleted, image, redisConn)
 
 	_, err = redisConn.Do("EXEC")
 	if err != nil {
@@ -72,6 +73,8 @@ func saveNewImage(productId int, data []byte, redisConn redis.Conn) (Image, erro
 	productImagesKeyName := getProductImagesKeyName(productId)
 	_ = redisConn.Send("SADD", productImagesKeyName, image.Id)
 
+	_ = sendImageEvent(EventImageAdded, &image, redisConn)
+
 	_, err = redisConn.Do("EXEC")
 	if err != nil {
 		return Image{}, err
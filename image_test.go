@@ -44,6 +44,8 @@ func TestImage_delete(t *testing.T) {
 	cmd2 := conn.Command("HDEL", config.KeyImages, image.Id)
 	cmd4 := conn.Command("DEL", getImageNameById(image.Id))
 	cmd5 := conn.Command("EXEC")
+	event := conn.GenericCommand("XADD")
+	conn.GenericCommand("PUBLISH").Expect(int64(0))
 
 	err := image.delete(conn)
 	if err != nil {
@@ -53,6 +55,9 @@ func TestImage_delete(t *testing.T) {
 	if conn.Stats(cmd1) + conn.Stats(cmd2) + conn.Stats(cmd3) + conn.Stats(cmd4) + conn.Stats(cmd5) != 5 {
 		t.Error("Some keys weren't deleted properly")
 	}
+	if conn.Stats(event) != 1 {
+		t.Error("The image.deleted event wasn't published")
+	}
 }
 
 func TestSaveNewImage(t *testing.T) {
@@ -63,10 +68,14 @@ func TestSaveNewImage(t *testing.T) {
 
 	conn := redigomock.NewConn()
 	_ = conn.Command("INCR", config.KeyImageCounter).Expect(int64(imageId))
+	_ = conn.Command("MULTI").Expect("OK")
+	_ = conn.Command("EXEC").Expect([]interface{}{})
 
 	_ = conn.Command("SET", getImageNameById(imageId), imageData).Expect("OK")
 	_ = conn.Command("HSET", config.KeyImages, imageId, productId).Expect("OK")
 	_ = conn.Command("SADD", fmt.Sprintf(config.KeyProductImages, "2"), imageId,).Expect("OK")
+	event := conn.GenericCommand("XADD").Expect("1567332000000-0")
+	_ = conn.GenericCommand("PUBLISH").Expect(int64(0))
 
 
 	image, err := saveNewImage(productId, imageData, conn)
@@ -79,6 +88,9 @@ func TestSaveNewImage(t *testing.T) {
 		ProductId: productId,
 		Url:       config.BaseUri + "/images/1",
 	})
+	if conn.Stats(event) != 1 {
+		t.Error("The image.added event wasn't published")
+	}
 }
 
 func TestGetImageNameById(t *testing.T){
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	AvailabilityInStock    = "in_stock"
+	AvailabilityOutOfStock = "out_of_stock"
+	AvailabilityUntracked  = "untracked" // no stock has ever been set for the product
+)
+
+//////////////////////
+// INVENTORY
+// The stock of a product and all its variants lives in a single hash, so the Lua scripts below can change it atomically.
+// Every stock unit (the product itself, or one of its variants) has an `on_hand` and a `reserved` field,
+// prefixed with "variant:<id>:" for variants. The `available` field is the sum of what can still be reserved.
+// Products with available stock are also in a sorted set of lex names, used by the `in_stock` listing filter.
+//////////////////////
+type Stock struct {
+	ProductId int         `json:"product_id"`
+	OnHand    int         `json:"on_hand"`
+	Reserved  int         `json:"reserved"`
+	Available int         `json:"available"`
+	Tracked   bool        `json:"tracked"`
+	Variants  []StockUnit `json:"variants"`
+}
+
+type StockUnit struct {
+	VariantId int `json:"variant_id"`
+	OnHand    int `json:"on_hand"`
+	Reserved  int `json:"reserved"`
+	Available int `json:"available"`
+}
+
+type Availability struct {
+	Status    string `json:"status"`
+	Available int    `json:"available"`
+}
+
+type Reservation struct {
+	Id        string `redis:"id" json:"id"`
+	ProductId int    `redis:"product_id" json:"product_id"`
+	VariantId int    `redis:"variant_id" json:"variant_id,omitempty"`
+	Quantity  int    `redis:"quantity" json:"quantity"`
+	ExpiresAt int64  `redis:"expires_at" json:"expires_at"`
+}
+
+// Shared by the scripts: recalculates the `available` field of the stock hash and the product's place in the in stock index
+const recalculateAvailabilityLua = `
+local function recalculate(stockKey, inStockKey, lexName)
+	local fields = redis.call('HGETALL', stockKey)
+	local values = {}
+	for i = 1, #fields, 2 do
+		values[fields[i]] = tonumber(fields[i + 1])
+	end
+	local available = 0
+	for field, onHand in pairs(values) do
+		local unit = string.match(field, '^(.*)on_hand$')
+		if unit then
+			available = available + math.max(0, onHand - (values[unit .. 'reserved'] or 0))
+		end
+	end
+	redis.call('HSET', stockKey, 'available', available)
+	if available > 0 then
+		redis.call('ZADD', inStockKey, 0, lexName)
+	else
+		redis.call('ZREM', inStockKey, lexName)
+	end
+	return available
+end
+`
+
+// KEYS: stock hash, in stock index. ARGV: unit prefix, quantity on hand, product lex name
+var setStockScript = redis.NewScript(2, recalculateAvailabilityLua+`
+redis.call('HSET', KEYS[1], ARGV[1] .. 'on_hand', ARGV[2])
+redis.call('HSETNX', KEYS[1], ARGV[1] .. 'reserved', 0)
+return recalculate(KEYS[1], KEYS[2], ARGV[3])
+`)
+
+// KEYS: stock hash, in stock index, reservation hash, reservation expiries.
+// ARGV: unit prefix, quantity, product lex name, reservation id, product id, variant id, expiry timestamp.
+// Returns what's left of the unit, -1 if there isn't enough stock, or -2 if the unit's stock isn't tracked.
+var reserveStockScript = redis.NewScript(4, recalculateAvailabilityLua+`
+local onHand = tonumber(redis.call('HGET', KEYS[1], ARGV[1] .. 'on_hand'))
+if not onHand then
+	return -2
+end
+local reserved = tonumber(redis.call('HGET', KEYS[1], ARGV[1] .. 'reserved')) or 0
+local quantity = tonumber(ARGV[2])
+if onHand - reserved < quantity then
+	return -1
+end
+redis.call('HINCRBY', KEYS[1], ARGV[1] .. 'reserved', quantity)
+redis.call('HSET', KEYS[3], 'id', ARGV[4], 'product_id', ARGV[5], 'variant_id', ARGV[6], 'quantity', quantity, 'expires_at', ARGV[7])
+redis.call('ZADD', KEYS[4], ARGV[7], ARGV[4])
+recalculate(KEYS[1], KEYS[2], ARGV[3])
+return onHand - reserved - quantity
+`)
+
+// KEYS: stock hash, in stock index, reservation hash, reservation expiries.
+// ARGV: product lex name, reservation id, product id.
+// Returns the released quantity, or -1 if there's no such reservation for the product.
+var releaseStockScript = redis.NewScript(4, recalculateAvailabilityLua+`
+local reservation = redis.call('HMGET', KEYS[3], 'product_id', 'variant_id', 'quantity')
+if not reservation[1] or reservation[1] ~= ARGV[3] then
+	return -1
+end
+local unit = ''
+if reservation[2] and reservation[2] ~= '0' then
+	unit = 'variant:' .. reservation[2] .. ':'
+end
+local quantity = tonumber(reservation[3])
+local reserved = tonumber(redis.call('HGET', KEYS[1], unit .. 'reserved'))
+if reserved then
+	redis.call('HSET', KEYS[1], unit .. 'reserved', math.max(0, reserved - quantity))
+	recalculate(KEYS[1], KEYS[2], ARGV[1])
+end
+redis.call('DEL', KEYS[3])
+redis.call('ZREM', KEYS[4], ARGV[2])
+return quantity
+`)
+
+// KEYS: stock hash, in stock index. ARGV: unit prefix, product lex name
+var removeStockUnitScript = redis.NewScript(2, recalculateAvailabilityLua+`
+redis.call('HDEL', KEYS[1], ARGV[1] .. 'on_hand', ARGV[1] .. 'reserved')
+return recalculate(KEYS[1], KEYS[2], ARGV[2])
+`)
+
+// KEYS: in stock index. ARGV: old lex name, new lex name
+var renameInStockScript = redis.NewScript(1, `
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 1 then
+	redis.call('ZADD', KEYS[1], 0, ARGV[2])
+end
+return 1
+`)
+
+func setStock(product *Product, variantId int, onHand int, redisConn redis.Conn) error {
+	_, err := setStockScript.Do(redisConn, getStockKeyName(product.Id), config.KeyInStockProducts, getStockUnitPrefix(variantId), onHand, product.getLexName())
+	return err
+}
+
+func reserveStock(product *Product, reservation *Reservation, redisConn redis.Conn) error {
+	reservation.Id = generateRequestId()
+	reservation.ProductId = product.Id
+
+	left, err := redis.Int(reserveStockScript.Do(redisConn,
+		getStockKeyName(product.Id), config.KeyInStockProducts, getReservationKeyName(reservation.Id), config.KeyReservationExpiries,
+		getStockUnitPrefix(reservation.VariantId), reservation.Quantity, product.getLexName(),
+		reservation.Id, reservation.ProductId, reservation.VariantId, reservation.ExpiresAt,
+	))
+	if err != nil {
+		return err
+	}
+
+	switch left {
+	case -1:
+		return &ApiError{HttpStatus: 409, Title: "Insufficient stock", Description: "There isn't enough stock left to reserve this quantity"}
+	case -2:
+		return &ApiError{HttpStatus: 422, Title: "Stock not tracked", Description: "No stock has been set for this product or variant"}
+	}
+	return nil
+}
+
+// Releases a reservation, returning the quantity that went back to the stock
+func releaseStock(product *Product, reservationId string, redisConn redis.Conn) (int, error) {
+	released, err := redis.Int(releaseStockScript.Do(redisConn,
+		getStockKeyName(product.Id), config.KeyInStockProducts, getReservationKeyName(reservationId), config.KeyReservationExpiries,
+		product.getLexName(), reservationId, product.Id,
+	))
+	if err != nil {
+		return 0, err
+	}
+	if released < 0 {
+		return 0, &notFoundError
+	}
+	return released, nil
+}
+
+func getStock(productId int, redisConn redis.Conn) (Stock, error) {
+	values, err := redis.StringMap(redisConn.Do("HGETALL", getStockKeyName(productId)))
+	if err != nil {
+		return Stock{}, err
+	}
+	return parseStock(productId, values), nil
+}
+
+func parseStock(productId int, values map[string]string) Stock {
+	stock := Stock{
+		ProductId: productId,
+		Variants:  make([]StockUnit, 0),
+	}
+	for field, value := range values {
+		if !strings.HasSuffix(field, "on_hand") {
+			continue
+		}
+		unit := strings.TrimSuffix(field, "on_hand")
+		onHand, _ := strconv.Atoi(value)
+		reserved, _ := strconv.Atoi(values[unit+"reserved"])
+		available := onHand - reserved
+		if available < 0 {
+			available = 0
+		}
+
+		if unit == "" {
+			stock.Tracked = true
+			stock.OnHand, stock.Reserved, stock.Available = onHand, reserved, available
+			continue
+		}
+		variantId, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(unit, "variant:"), ":"))
+		stock.Variants = append(stock.Variants, StockUnit{
+			VariantId: variantId,
+			OnHand:    onHand,
+			Reserved:  reserved,
+			Available: available,
+		})
+	}
+	if len(stock.Variants) > 0 {
+		stock.Tracked = true
+	}
+	return stock
+}
+
+func (stock *Stock) getAvailability() Availability {
+	if !stock.Tracked {
+		return Availability{Status: AvailabilityUntracked}
+	}
+	available := stock.Available
+	for _, variant := range stock.Variants {
+		available += variant.Available
+	}
+	if available > 0 {
+		return Availability{Status: AvailabilityInStock, Available: available}
+	}
+	return Availability{Status: AvailabilityOutOfStock}
+}
+
+func (product *Product) setAvailability(redisConn redis.Conn) {
+	stock, _ := getStock(product.Id, redisConn)
+	availability := stock.getAvailability()
+	product.Availability = &availability
+}
+
+// Queues the commands deleting the stock of a product in the caller's transaction.
+// Its reservations are left to expire.
+func sendStockDelete(product *Product, redisConn redis.Conn) {
+	_ = redisConn.Send("DEL", getStockKeyName(product.Id))
+	_ = redisConn.Send("ZREM", config.KeyInStockProducts, product.getLexName())
+}
+
+//////////////////////
+// RESERVATION SWEEPER
+// Reservations that weren't released (ex. an abandoned checkout) give their stock back once they expire
+//////////////////////
+func releaseExpiredReservations(now time.Time, redisConn redis.Conn) (int, error) {
+	reservationIds, err := redis.Strings(redisConn.Do("ZRANGEBYSCORE", config.KeyReservationExpiries, "-inf", now.Unix()))
+	if err != nil {
+		return 0, err
+	}
+
+	released := 0
+	for _, reservationId := range reservationIds {
+		productId, err := redis.Int(redisConn.Do("HGET", getReservationKeyName(reservationId), "product_id"))
+		if err != nil && err != redis.ErrNil {
+			return released, err
+		}
+
+		name, err := redis.String(redisConn.Do("HGET", getProductNameById(productId), "name"))
+		if err == redis.ErrNil {
+			// The reservation or its product doesn't exist anymore, so there's no stock to give back
+			_, _ = redisConn.Do("DEL", getReservationKeyName(reservationId))
+			_, _ = redisConn.Do("ZREM", config.KeyReservationExpiries, reservationId)
+			continue
+		}
+		if err != nil {
+			return released, err
+		}
+
+		product := Product{Id: productId, Name: name}
+		_, err = releaseStock(&product, reservationId, redisConn)
+		if err != nil && err != &notFoundError {
+			return released, err
+		}
+		released++
+	}
+	return released, nil
+}
+
+func runReservationSweeper(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(config.ReservationSweepInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			conn := pool.Get()
+			err := forEachNamespace(conn, func(namespacedConn redis.Conn) error {
+				released, err := releaseExpiredReservations(time.Now(), namespacedConn)
+				if err != nil {
+					logger.Error("Unable to release expired reservations", Fields{"error": err, "namespace": getKeyPrefix(namespacedConn)})
+				} else if released > 0 {
+					logger.Info("Released expired reservations", Fields{"count": released, "namespace": getKeyPrefix(namespacedConn)})
+				}
+				// One tenant's failure shouldn't hold back the others
+				return nil
+			})
+			_ = conn.Close()
+
+			if err != nil {
+				logger.Error("Unable to list the tenants", Fields{"error": err})
+			}
+		}
+	}
+}
+
+// Helper functions
+func getStockKeyName(productId int) string {
+	return fmt.Sprintf(config.KeyStock, productId)
+}
+func getReservationKeyName(id string) string {
+	return fmt.Sprintf(config.KeyReservation, id)
+}
+func getStockUnitPrefix(variantId int) string {
+	if variantId == 0 {
+		return ""
+	}
+	return fmt.Sprintf("variant:%v:", variantId)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+	"gotest.tools/assert"
+	"testing"
+	"time"
+)
+
+func TestParseStock(t *testing.T) {
+	stock := parseStock(7, map[string]string{
+		"on_hand":            "5",
+		"reserved":           "2",
+		"variant:3:on_hand":  "1",
+		"variant:3:reserved": "3",
+		"available":          "3",
+	})
+
+	assert.Assert(t, stock.Tracked)
+	assert.Equal(t, 5, stock.OnHand)
+	assert.Equal(t, 3, stock.Available)
+	assert.DeepEqual(t, []StockUnit{{VariantId: 3, OnHand: 1, Reserved: 3, Available: 0}}, stock.Variants)
+	assert.Equal(t, Availability{Status: AvailabilityInStock, Available: 3}, stock.getAvailability())
+
+	stock = parseStock(7, map[string]string{"variant:3:on_hand": "0", "variant:3:reserved": "0"})
+	assert.Equal(t, Availability{Status: AvailabilityOutOfStock}, stock.getAvailability())
+
+	stock = parseStock(7, map[string]string{})
+	assert.Equal(t, Availability{Status: AvailabilityUntracked}, stock.getAvailability())
+}
+
+func TestReserveStock(t *testing.T) {
+	product := Product{Id: 7, Name: "Rocinante"}
+
+	conn := redigomock.NewConn()
+	script := conn.GenericCommand("EVALSHA").Expect(int64(4))
+	reservation := Reservation{VariantId: 3, Quantity: 1, ExpiresAt: time.Now().Unix()}
+	assert.NilError(t, reserveStock(&product, &reservation, conn))
+	assert.Equal(t, 32, len(reservation.Id))
+	assert.Equal(t, 7, reservation.ProductId)
+	assert.Equal(t, 1, conn.Stats(script))
+
+	conn = redigomock.NewConn()
+	conn.GenericCommand("EVALSHA").Expect(int64(-1))
+	err := reserveStock(&product, &Reservation{Quantity: 10}, conn)
+	assert.Equal(t, 409, err.(*ApiError).HttpStatus)
+
+	conn = redigomock.NewConn()
+	conn.GenericCommand("EVALSHA").Expect(int64(-2))
+	err = reserveStock(&product, &Reservation{Quantity: 1}, conn)
+	assert.Equal(t, 422, err.(*ApiError).HttpStatus)
+}
+
+func TestReleaseStock(t *testing.T) {
+	product := Product{Id: 7, Name: "Rocinante"}
+
+	conn := redigomock.NewConn()
+	conn.GenericCommand("EVALSHA").Expect(int64(2))
+	released, err := releaseStock(&product, "abc", conn)
+	assert.NilError(t, err)
+	assert.Equal(t, 2, released)
+
+	conn = redigomock.NewConn()
+	conn.GenericCommand("EVALSHA").Expect(int64(-1))
+	_, err = releaseStock(&product, "abc", conn)
+	assert.Equal(t, err, &notFoundError)
+}
+
+func TestReleaseExpiredReservations(t *testing.T) {
+	now := time.Unix(1567332000, 0)
+
+	conn := redigomock.NewConn()
+	conn.Command("ZRANGEBYSCORE", config.KeyReservationExpiries, "-inf", now.Unix()).Expect([]interface{}{[]byte("abc"), []byte("def")})
+	conn.Command("HGET", getReservationKeyName("abc"), "product_id").Expect([]byte("7"))
+	conn.Command("HGET", getProductNameById(7), "name").Expect([]byte("Rocinante"))
+	release := conn.GenericCommand("EVALSHA").Expect(int64(1))
+
+	// The product of the second reservation was deleted
+	conn.Command("HGET", getReservationKeyName("def"), "product_id").Expect([]byte("8"))
+	conn.Command("HGET", getProductNameById(8), "name").ExpectError(redis.ErrNil)
+	cleanup := conn.Command("DEL", getReservationKeyName("def")).Expect(int64(1))
+	conn.Command("ZREM", config.KeyReservationExpiries, "def").Expect(int64(1))
+
+	released, err := releaseExpiredReservations(now, conn)
+	assert.NilError(t, err)
+	assert.Equal(t, 1, released)
+	assert.Equal(t, 1, conn.Stats(release))
+	assert.Equal(t, 1, conn.Stats(cleanup))
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/labstack/echo"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+	LevelFatal
+)
+
+var logLevelNames = map[LogLevel]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+	LevelFatal: "fatal",
+}
+
+func parseLogLevel(s string) LogLevel {
+	for level, name := range logLevelNames {
+		if strings.ToLower(s) == name {
+			return level
+		}
+	}
+	return LevelInfo
+}
+
+type Fields map[string]interface{}
+
+// Writes one json object per line, so the logs can be parsed by any log aggregator
+type Logger struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	level  LogLevel
+	fields Fields
+}
+
+var logger = newLogger(os.Stdout, LevelInfo)
+
+func newLogger(out io.Writer, level LogLevel) *Logger {
+	return &Logger{
+		mu:     &sync.Mutex{},
+		out:    out,
+		level:  level,
+		fields: Fields{},
+	}
+}
+
+// Returns a child logger that adds the given fields to every log line
+func (l *Logger) With(fields Fields) *Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &Logger{mu: l.mu, out: l.out, level: l.level, fields: merged}
+}
+
+func (l *Logger) Debug(msg string, fields ...Fields) { l.log(LevelDebug, msg, fields) }
+func (l *Logger) Info(msg string, fields ...Fields)  { l.log(LevelInfo, msg, fields) }
+func (l *Logger) Warn(msg string, fields ...Fields)  { l.log(LevelWarn, msg, fields) }
+func (l *Logger) Error(msg string, fields ...Fields) { l.log(LevelError, msg, fields) }
+func (l *Logger) Fatal(msg string, fields ...Fields) {
+	l.log(LevelFatal, msg, fields)
+	os.Exit(1)
+}
+
+func (l *Logger) log(level LogLevel, msg string, extraFields []Fields) {
+	if level < l.level {
+		return
+	}
+
+	line := make(Fields, len(l.fields)+3)
+	for k, v := range l.fields {
+		line[k] = v
+	}
+	for _, fields := range extraFields {
+		for k, v := range fields {
+			// Errors don't serialise to json on their own
+			if err, ok := v.(error); ok {
+				v = err.Error()
+			}
+			line[k] = v
+		}
+	}
+	line["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	line["level"] = logLevelNames[level]
+	line["msg"] = msg
+
+	encoded, err := json.Marshal(line)
+	if err != nil {
+		encoded, _ = json.Marshal(Fields{"level": "error", "msg": "Unable to encode log line", "error": err.Error()})
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.out.Write(append(encoded, '\n'))
+}
+
+//////////////////////
+// REQUEST IDS
+//////////////////////
+const requestIdContextKey = "request_id"
+const loggerContextKey = "logger"
+
+// Propagates the X-Request-ID header if the client (or a proxy) sent one, or generates a new id.
+// The id is sent back in the response and attached to every log line written for the request.
+func requestIdMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		requestId := c.Request().Header.Get(echo.HeaderXRequestID)
+		if requestId == "" {
+			requestId = generateRequestId()
+		}
+		c.Response().Header().Set(echo.HeaderXRequestID, requestId)
+		c.Set(requestIdContextKey, requestId)
+		c.Set(loggerContextKey, logger.With(Fields{"request_id": requestId}))
+
+		return next(c)
+	}
+}
+
+// Writes one log line per request, after the response has been sent
+func requestLoggerMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) (err error) {
+		start := time.Now()
+		if err = next(c); err != nil {
+			c.Error(err)
+		}
+
+		requestLogger(c).Info("Request handled", Fields{
+			"method":     c.Request().Method,
+			"uri":        c.Request().RequestURI,
+			"route":      c.Path(),
+			"status":     c.Response().Status,
+			"latency_ms": float64(time.Since(start)) / float64(time.Millisecond),
+			"remote_ip":  c.RealIP(),
+		})
+		return
+	}
+}
+
+func getRequestId(c echo.Context) string {
+	requestId, _ := c.Get(requestIdContextKey).(string)
+	return requestId
+}
+
+func requestLogger(c echo.Context) *Logger {
+	if l, ok := c.Get(loggerContextKey).(*Logger); ok {
+		return l
+	}
+	return logger
+}
+
+func generateRequestId() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/labstack/echo"
+	"gotest.tools/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLogger_writesJsonLines(t *testing.T) {
+	var buf bytes.Buffer
+	l := newLogger(&buf, LevelInfo).With(Fields{"request_id": "abc"})
+
+	l.Debug("Not written")
+	l.Error("Something failed", Fields{"error": errors.New("boom")})
+
+	var line map[string]interface{}
+	err := json.Unmarshal(buf.Bytes(), &line)
+	assert.NilError(t, err)
+	assert.Equal(t, "error", line["level"])
+	assert.Equal(t, "Something failed", line["msg"])
+	assert.Equal(t, "boom", line["error"])
+	assert.Equal(t, "abc", line["request_id"])
+}
+
+func TestParseLogLevel(t *testing.T) {
+	assert.Equal(t, LevelDebug, parseLogLevel("DEBUG"))
+	assert.Equal(t, LevelWarn, parseLogLevel("warn"))
+	assert.Equal(t, LevelInfo, parseLogLevel("unknown"))
+}
+
+func TestRequestIdMiddleware(t *testing.T) {
+	e := echo.New()
+	handler := requestIdMiddleware(func(c echo.Context) error {
+		return c.String(http.StatusOK, getRequestId(c))
+	})
+
+	// An incoming id is propagated
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(echo.HeaderXRequestID, "incoming-id")
+	rec := httptest.NewRecorder()
+	assert.NilError(t, handler(e.NewContext(req, rec)))
+	assert.Equal(t, "incoming-id", rec.Header().Get(echo.HeaderXRequestID))
+	assert.Equal(t, "incoming-id", rec.Body.String())
+
+	// A missing id is generated
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	rec = httptest.NewRecorder()
+	assert.NilError(t, handler(e.NewContext(req, rec)))
+	assert.Equal(t, 32, len(rec.Header().Get(echo.HeaderXRequestID)))
+}
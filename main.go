@@ -2,9 +2,11 @@ package main
 
 import (
 	"fmt"
-	"github.com/bugsnag/bugsnag-go"
 	"github.com/gomodule/redigo/redis"
 	"github.com/labstack/echo"
+	"net/http"
+	"os"
+	"time"
 )
 
 var (
@@ -15,67 +17,206 @@ var (
 
 func main() {
 	config = getConfiguration()
+	logger = newLogger(os.Stdout, parseLogLevel(config.LogLevel))
+	categoryCache = newCategoryCaches(time.Duration(config.CategoryCacheTtl) * time.Second)
 	pool      = newPool()
 	redisConn = pool.Get()
-	bugsnag.Configure(bugsnag.Configuration{
-		APIKey:          config.BugsnagKey,
-		// The import paths for the Go packages containing the source files
-		ProjectPackages: []string{"main", "github.com/elena-kolevska/redis-product-catalogue-service"},
-	})
 
-	defer redisConn.Close()
+	reporter, err := newErrorReporter(config)
+	if err != nil {
+		logger.Fatal("Unable to set up error reporting", Fields{"error": err})
+	}
+	errorReporter = reporter
 
-	// Authenticate with Redis if a password was provided in the conf file
+	// Make sure we can talk to Redis (connections authenticate on dial if a password was provided in the conf file)
+	_, err = redisConn.Do("PING")
+	if err != nil {
+		logger.Fatal("Unable to connect to the Redis database. Please check your settings in the config.json file", Fields{"error": err})
+	}
 	if len(config.RedisPassword) > 0 {
-		_, err := redisConn.Do("AUTH", config.RedisPassword)
-		if err != nil {
-			fmt.Println("❌ Unable to authenticate with the Redis database. Please check your settings in the config.json file")
-			panic(err)
-		}
-		fmt.Println("🔑️ Authenticated with Redis...")
+		logger.Info("Authenticated with Redis")
 	}
 	seedDatabase()
+	migrateDatabase()
 
 
 	e := echo.New()
 	e.HideBanner = true
+	e.HidePort = true
+	e.Use(requestIdMiddleware)
+	e.Use(requestLoggerMiddleware)
+	e.Use(metricsMiddleware)
+	e.Use(recoverMiddleware)
+	e.Use(tenantMiddleware)
 
 	// Register routes
 	e.POST("/api/products", productsCreate)
 	e.GET("/api/products", productsIndex)
 	e.GET("/api/products/:id", productsShow)
+	e.GET("/api/products/by-slug/:slug", productsShowBySlug)
 	e.PUT("/api/products/:id", productsUpdate)
 	e.DELETE("/api/products/:id", productsDelete)
+	e.POST("/api/products/:id/restore", productsRestore)
+	e.GET("/api/trash/products", trashIndex)
+	e.GET("/api/drafts/products", draftsIndex)
+
+	e.POST("/api/webhooks", webhooksCreate)
+	e.GET("/api/webhooks", webhooksIndex)
+	e.GET("/api/webhooks/dead-letter", webhooksDeadLetterIndex)
+	e.GET("/api/webhooks/:id", webhooksShow)
+	e.DELETE("/api/webhooks/:id", webhooksDelete)
+	e.GET("/api/webhooks/:id/deliveries", webhookDeliveriesIndex)
+
+	e.GET("/api/events", eventsStream)
+
+	e.GET("/api/products/:id/variants", variantsIndex)
+	e.POST("/api/products/:id/variants", variantsCreate)
+	e.GET("/api/products/:id/variants/:variantId", variantsShow)
+	e.PUT("/api/products/:id/variants/:variantId", variantsUpdate)
+	e.DELETE("/api/products/:id/variants/:variantId", variantsDelete)
+	e.GET("/api/skus/:sku", skusShow)
+
+	e.GET("/api/products/:id/reviews", reviewsIndex)
+	e.POST("/api/products/:id/reviews", reviewsCreate)
+	e.POST("/api/products/:id/reviews/:reviewId/approve", reviewsApprove)
+	e.DELETE("/api/products/:id/reviews/:reviewId", reviewsDelete)
+
+	e.GET("/api/products/:id/related", productRelatedIndex)
+	e.PUT("/api/products/:id/related", productRelatedUpdate)
+
+	e.GET("/api/products/:id/translations", productTranslationsIndex)
+	e.PUT("/api/products/:id/translations/:locale", productTranslationsUpdate)
+	e.DELETE("/api/products/:id/translations/:locale", productTranslationsDelete)
+
+	e.GET("/api/categories", categoriesIndex)
+	e.GET("/api/categories/:id", categoriesShow)
+	e.PUT("/api/categories/:id/attributes", categoryAttributesUpdate)
+
+	e.GET("/api/tags", tagsIndex)
+
+	e.POST("/api/collections", collectionsCreate)
+	e.GET("/api/collections", collectionsIndex)
+	e.GET("/api/collections/:id", collectionsShow)
+	e.PUT("/api/collections/:id", collectionsUpdate)
+	e.DELETE("/api/collections/:id", collectionsDelete)
+	e.GET("/api/collections/:id/products", collectionProductsIndex)
+	e.POST("/api/collections/:id/products", collectionProductsAdd)
+	e.PUT("/api/collections/:id/products", collectionProductsReorder)
+	e.DELETE("/api/collections/:id/products/:productId", collectionProductsRemove)
+
+	e.GET("/api/products/:id/stock", stockShow)
+	e.PUT("/api/products/:id/stock", stockUpdate)
+	e.POST("/api/products/:id/stock/reserve", stockReserve)
+	e.POST("/api/products/:id/stock/release", stockRelease)
+
+	e.POST("/graphql", graphqlQuery)
+
+	e.GET("/api/exchange-rates", exchangeRatesShow)
+	e.PUT("/api/exchange-rates", exchangeRatesUpdate)
+
+	e.GET("/api/products/:id/versions", productVersionsIndex)
+	e.GET("/api/products/:id/versions/diff", productVersionsDiff)
+	e.GET("/api/products/:id/versions/:n", productVersionsShow)
+	e.POST("/api/products/:id/versions/:n/restore", productVersionsRestore)
 
 	e.POST("/api/products/:id/images", imagesCreate)
 	e.GET("/api/images/:id", imagesShow)
 	e.DELETE("/api/images/:id", imagesDelete)
 
+	e.POST("/api/tenants", tenantsCreate, tenantAdminMiddleware)
+	e.GET("/api/tenants", tenantsIndex, tenantAdminMiddleware)
+	e.GET("/api/tenants/:tenantId", tenantsShow, tenantAdminMiddleware)
+	e.DELETE("/api/tenants/:tenantId", tenantsDelete, tenantAdminMiddleware)
+
 	e.File("/documentation", "docs/index.html")
 
+	e.GET("/healthz", healthz)
+	e.GET("/readyz", readyz)
+	e.GET("/metrics", metricsShow)
+
+	startWorker("trash-sweeper", runTrashSweeper)
+	startWorker("publishing-scheduler", runPublishingScheduler)
+	startWorker("reservation-sweeper", runReservationSweeper)
+	startWorker("webhook-dispatcher", runWebhookDispatcher)
+	startWorker("event-hub", runEventHub)
+	startWorker("category-cache-invalidator", runCategoryCacheInvalidator)
+
+	// Live event streams never finish on their own, so we close them as soon as the shutdown starts
+	e.Server.RegisterOnShutdown(eventHub.close)
+
 	// Start the server
-	e.Logger.Fatal(e.Start(fmt.Sprintf(":%d", config.WebServerPort)))
+	go func() {
+		logger.Info("Starting the web server", Fields{"port": config.WebServerPort})
+		if err := e.Start(fmt.Sprintf(":%d", config.WebServerPort)); err != nil && err != http.ErrServerClosed {
+			logger.Fatal("Unable to start the web server", Fields{"error": err})
+		}
+	}()
+
+	waitForShutdown(e)
 }
 
 func newPool() *redis.Pool {
-	fmt.Println("❤️  Connecting to Redis...")
+	logger.Info("Connecting to Redis", Fields{"endpoint": config.RedisEndpoint})
 	return &redis.Pool{
 		MaxIdle:   20,
 		MaxActive: 1000, // max number of connections
 		Dial: func() (redis.Conn, error) {
-			c, err := redis.Dial("tcp", config.RedisEndpoint, )
+			// Every connection in the pool needs to be authenticated, not just the first one
+			c, err := redis.Dial("tcp", config.RedisEndpoint, redis.DialPassword(config.RedisPassword))
 			if err != nil {
-				panic(err.Error())
+				return nil, err
 			}
-			return c, err
+			return instrumentedConn{c}, nil
 		},
 	}
 }
 
 
+func migrateDatabase() {
+	migrated, err := migratePricesToMinorUnits(redisConn)
+	if err != nil {
+		logger.Fatal("Unable to migrate product prices to minor units", Fields{"error": err})
+	}
+	if migrated > 0 {
+		logger.Info("Migrated product prices to minor units", Fields{"count": migrated})
+	}
+
+	indexed, err := migratePriceIndex(redisConn)
+	if err != nil {
+		logger.Fatal("Unable to build the product price index", Fields{"error": err})
+	}
+	if indexed > 0 {
+		logger.Info("Added products to the price index", Fields{"count": indexed})
+	}
+
+	slugged, err := migrateProductSlugs(redisConn)
+	if err != nil {
+		logger.Fatal("Unable to generate the product slugs", Fields{"error": err})
+	}
+	if slugged > 0 {
+		logger.Info("Generated product slugs", Fields{"count": slugged})
+	}
+
+	indexed, err = migrateSimilarityIndex(redisConn)
+	if err != nil {
+		logger.Fatal("Unable to build the product similarity index", Fields{"error": err})
+	}
+	if indexed > 0 {
+		logger.Info("Added products to the similarity index", Fields{"count": indexed})
+	}
+}
+
 func seedDatabase() {
 	// In our exercise the API consumer is not able to manage categories
 	// so to keep things simple we will use hardcoded category ids
 	// instead of counter id generators
-	_, _ = redisConn.Do("HSET", "categories", "1", "Science vessels", "2", "Warships", "3", "Freighters", "4", "Colony Ships")
+	_ = seedCategories(redisConn)
+}
+
+func seedCategories(redisConn redis.Conn) error {
+	_, err := redisConn.Do("HSET", config.KeyCategories, "1", "Science vessels", "2", "Warships", "3", "Freighters", "4", "Colony Ships")
+	if err != nil {
+		return err
+	}
+	return publishCategoriesChanged(redisConn)
 }
\ No newline at end of file
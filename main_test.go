@@ -1,11 +1,13 @@
 package main
 
 import (
+	"io/ioutil"
 	"os"
 	"testing"
 )
 
 func TestMain(m *testing.M) {
 	config = getDefaultConfiguration()
+	logger = newLogger(ioutil.Discard, LevelInfo)
 	os.Exit(m.Run())
 }
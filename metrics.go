@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"github.com/labstack/echo"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//////////////////////
+// A minimal implementation of the Prometheus text exposition format.
+// We only need counters, gauges and histograms, so there's no need to pull in the whole client library.
+//////////////////////
+
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type counterVec struct {
+	name       string
+	help       string
+	labelNames []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name string, help string, labelNames ...string) *counterVec {
+	return &counterVec{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		values:     make(map[string]float64),
+	}
+}
+
+func (counter *counterVec) inc(labelValues ...string) {
+	counter.add(1, labelValues...)
+}
+
+func (counter *counterVec) add(value float64, labelValues ...string) {
+	key := formatLabels(counter.labelNames, labelValues)
+	counter.mu.Lock()
+	counter.values[key] += value
+	counter.mu.Unlock()
+}
+
+func (counter *counterVec) get(labelValues ...string) float64 {
+	key := formatLabels(counter.labelNames, labelValues)
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+	return counter.values[key]
+}
+
+func (counter *counterVec) write(w io.Writer) {
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+
+	writeHeader(w, counter.name, counter.help, "counter")
+	for _, labels := range sortedKeys(counter.values) {
+		fmt.Fprintf(w, "%s%s %s\n", counter.name, labels, formatFloat(counter.values[labels]))
+	}
+}
+
+type histogram struct {
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+type histogramVec struct {
+	name       string
+	help       string
+	labelNames []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	values map[string]*histogram
+}
+
+func newHistogramVec(name string, help string, labelNames ...string) *histogramVec {
+	return &histogramVec{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		buckets:    defaultBuckets,
+		values:     make(map[string]*histogram),
+	}
+}
+
+func (vec *histogramVec) observe(value float64, labelValues ...string) {
+	key := formatLabels(vec.labelNames, labelValues)
+
+	vec.mu.Lock()
+	defer vec.mu.Unlock()
+
+	h, ok := vec.values[key]
+	if !ok {
+		h = &histogram{buckets: make([]uint64, len(vec.buckets))}
+		vec.values[key] = h
+	}
+	for i, upperBound := range vec.buckets {
+		if value <= upperBound {
+			h.buckets[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func (vec *histogramVec) write(w io.Writer) {
+	vec.mu.Lock()
+	defer vec.mu.Unlock()
+
+	keys := make([]string, 0, len(vec.values))
+	for key := range vec.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	writeHeader(w, vec.name, vec.help, "histogram")
+	for _, labels := range keys {
+		h := vec.values[labels]
+		for i, upperBound := range vec.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", vec.name, addLabel(labels, "le", formatFloat(upperBound)), h.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", vec.name, addLabel(labels, "le", "+Inf"), h.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", vec.name, labels, formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", vec.name, labels, h.count)
+	}
+}
+
+func writeGauge(w io.Writer, name string, help string, value float64) {
+	writeHeader(w, name, help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(value))
+}
+
+func writeHeader(w io.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+// Renders label pairs as `{name="value",...}`
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, escapeLabelValue(value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func addLabel(labels string, name string, value string) string {
+	pair := fmt.Sprintf(`%s="%s"`, name, value)
+	if labels == "" {
+		return "{" + pair + "}"
+	}
+	return strings.TrimSuffix(labels, "}") + "," + pair + "}"
+}
+
+func escapeLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//////////////////////
+// APPLICATION METRICS
+//////////////////////
+var (
+	httpRequestsTotal   = newCounterVec("http_requests_total", "Number of HTTP requests handled.", "route", "method", "status")
+	httpRequestDuration = newHistogramVec("http_request_duration_seconds", "HTTP request latency.", "route", "method", "status")
+
+	redisCommandsTotal   = newCounterVec("redis_commands_total", "Number of Redis commands executed.", "command")
+	redisCommandErrors   = newCounterVec("redis_command_errors_total", "Number of Redis commands that returned an error.", "command")
+	redisCommandDuration = newHistogramVec("redis_command_duration_seconds", "Redis command latency.", "command")
+)
+
+// Records a count and latency for every request, labelled by the route path (not the actual url, to keep cardinality low)
+func metricsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) (err error) {
+		start := time.Now()
+		if err = next(c); err != nil {
+			c.Error(err)
+		}
+
+		route := c.Path()
+		if route == "" {
+			route = "unmatched"
+		}
+		method := c.Request().Method
+		status := strconv.Itoa(c.Response().Status)
+
+		httpRequestsTotal.inc(route, method, status)
+		httpRequestDuration.observe(time.Since(start).Seconds(), route, method, status)
+		return
+	}
+}
+
+// Wraps a redis connection and records the latency of every command sent through `Do`.
+// Pipelined commands (`Send`) are only counted, since their latency can't be attributed to a single command.
+type instrumentedConn struct {
+	redis.Conn
+}
+
+func (conn instrumentedConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	// redigo uses an empty command to flush the pipeline and read all pending replies
+	if commandName == "" {
+		return conn.Conn.Do(commandName, args...)
+	}
+
+	start := time.Now()
+	reply, err := conn.Conn.Do(commandName, args...)
+	command := strings.ToUpper(commandName)
+
+	redisCommandsTotal.inc(command)
+	redisCommandDuration.observe(time.Since(start).Seconds(), command)
+	if err != nil && err != redis.ErrNil {
+		redisCommandErrors.inc(command)
+	}
+	return reply, err
+}
+
+func (conn instrumentedConn) Send(commandName string, args ...interface{}) error {
+	command := strings.ToUpper(commandName)
+	redisCommandsTotal.inc(command)
+
+	err := conn.Conn.Send(commandName, args...)
+	if err != nil {
+		redisCommandErrors.inc(command)
+	}
+	return err
+}
+
+func metricsShow(c echo.Context) error {
+	var buf bytes.Buffer
+
+	httpRequestsTotal.write(&buf)
+	httpRequestDuration.write(&buf)
+	redisCommandsTotal.write(&buf)
+	redisCommandErrors.write(&buf)
+	redisCommandDuration.write(&buf)
+	categoryCacheLookups.write(&buf)
+	writeGauge(&buf, "category_cache_hit_ratio", "Share of category lookups served from memory.", categoryCacheHitRatio())
+
+	stats := pool.Stats()
+	writeGauge(&buf, "redis_pool_active_connections", "Number of connections in the pool, including idle ones.", float64(stats.ActiveCount))
+	writeGauge(&buf, "redis_pool_idle_connections", "Number of idle connections in the pool.", float64(stats.IdleCount))
+
+	conn := pool.Get()
+	defer conn.Close()
+	writeBusinessMetrics(&buf, conn)
+
+	return c.Blob(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", buf.Bytes())
+}
+
+// The gauges add up the catalogues of all tenants
+func writeBusinessMetrics(w io.Writer, conn redis.Conn) {
+	var productCount, imageCount, categoryCount int
+	err := forEachNamespace(conn, func(conn redis.Conn) error {
+		products, err := redis.Int(conn.Do("ZCARD", config.KeyAllProducts))
+		if err != nil {
+			return err
+		}
+		images, err := redis.Int(conn.Do("HLEN", config.KeyImages))
+		if err != nil {
+			return err
+		}
+		categories, err := redis.Int(conn.Do("HLEN", config.KeyCategories))
+		if err != nil {
+			return err
+		}
+		productCount += products
+		imageCount += images
+		categoryCount += categories
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	writeGauge(w, "catalogue_products", "Number of products in the catalogue.", float64(productCount))
+	writeGauge(w, "catalogue_images", "Number of product images in the catalogue.", float64(imageCount))
+	writeGauge(w, "catalogue_categories", "Number of product categories.", float64(categoryCount))
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"github.com/rafaeljusto/redigomock"
+	"gotest.tools/assert"
+	"strings"
+	"testing"
+)
+
+func TestCounterVec_write(t *testing.T) {
+	counter := newCounterVec("requests_total", "Requests.", "route", "status")
+	counter.inc("/api/products", "200")
+	counter.inc("/api/products", "200")
+	counter.inc("/api/products/:id", "404")
+
+	var buf bytes.Buffer
+	counter.write(&buf)
+
+	assert.Equal(t, `# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{route="/api/products",status="200"} 2
+requests_total{route="/api/products/:id",status="404"} 1
+`, buf.String())
+	assert.Equal(t, float64(2), counter.get("/api/products", "200"))
+	assert.Equal(t, float64(0), counter.get("/api/products", "500"))
+}
+
+func TestHistogramVec_write(t *testing.T) {
+	h := newHistogramVec("latency_seconds", "Latency.", "command")
+	h.buckets = []float64{0.1, 1}
+	h.observe(0.05, "GET")
+	h.observe(0.5, "GET")
+
+	var buf bytes.Buffer
+	h.write(&buf)
+
+	assert.Equal(t, `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{command="GET",le="0.1"} 1
+latency_seconds_bucket{command="GET",le="1"} 2
+latency_seconds_bucket{command="GET",le="+Inf"} 2
+latency_seconds_sum{command="GET"} 0.55
+latency_seconds_count{command="GET"} 2
+`, buf.String())
+}
+
+func TestFormatLabels_escapesValues(t *testing.T) {
+	assert.Equal(t, `{name="a \"quoted\" \\ value"}`, formatLabels([]string{"name"}, []string{`a "quoted" \ value`}))
+	assert.Equal(t, "", formatLabels(nil, nil))
+}
+
+func TestWriteBusinessMetrics(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("SMEMBERS", config.KeyTenants).Expect([]interface{}{[]byte("acme")})
+	conn.Command("ZCARD", config.KeyAllProducts).Expect(int64(12))
+	conn.Command("HLEN", config.KeyImages).Expect(int64(30))
+	conn.Command("HLEN", config.KeyCategories).Expect(int64(4))
+	conn.Command("ZCARD", "tenant:acme:"+config.KeyAllProducts).Expect(int64(3))
+	conn.Command("HLEN", "tenant:acme:"+config.KeyImages).Expect(int64(5))
+	conn.Command("HLEN", "tenant:acme:"+config.KeyCategories).Expect(int64(2))
+
+	var buf bytes.Buffer
+	writeBusinessMetrics(&buf, conn)
+
+	// The tenants' catalogues are counted along with the default one
+	assert.Assert(t, strings.Contains(buf.String(), "catalogue_products 15\n"))
+	assert.Assert(t, strings.Contains(buf.String(), "catalogue_images 35\n"))
+	assert.Assert(t, strings.Contains(buf.String(), "catalogue_categories 6\n"))
+}
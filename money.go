@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// The number of digits after the decimal separator (the minor unit exponent) of every active ISO 4217 currency
+var currencyExponents = map[string]int{
+	"AED": 2, "AFN": 2, "ALL": 2, "AMD": 2, "ANG": 2, "AOA": 2, "ARS": 2, "AUD": 2, "AWG": 2, "AZN": 2,
+	"BAM": 2, "BBD": 2, "BDT": 2, "BGN": 2, "BHD": 3, "BIF": 0, "BMD": 2, "BND": 2, "BOB": 2, "BOV": 2,
+	"BRL": 2, "BSD": 2, "BTN": 2, "BWP": 2, "BYN": 2, "BZD": 2, "CAD": 2, "CDF": 2, "CHE": 2, "CHF": 2,
+	"CHW": 2, "CLF": 4, "CLP": 0, "CNY": 2, "COP": 2, "COU": 2, "CRC": 2, "CUC": 2, "CUP": 2, "CVE": 2,
+	"CZK": 2, "DJF": 0, "DKK": 2, "DOP": 2, "DZD": 2, "EGP": 2, "ERN": 2, "ETB": 2, "EUR": 2, "FJD": 2,
+	"FKP": 2, "GBP": 2, "GEL": 2, "GHS": 2, "GIP": 2, "GMD": 2, "GNF": 0, "GTQ": 2, "GYD": 2, "HKD": 2,
+	"HNL": 2, "HRK": 2, "HTG": 2, "HUF": 2, "IDR": 2, "ILS": 2, "INR": 2, "IQD": 3, "IRR": 2, "ISK": 0,
+	"JMD": 2, "JOD": 3, "JPY": 0, "KES": 2, "KGS": 2, "KHR": 2, "KMF": 0, "KPW": 2, "KRW": 0, "KWD": 3,
+	"KYD": 2, "KZT": 2, "LAK": 2, "LBP": 2, "LKR": 2, "LRD": 2, "LSL": 2, "LYD": 3, "MAD": 2, "MDL": 2,
+	"MGA": 2, "MKD": 2, "MMK": 2, "MNT": 2, "MOP": 2, "MRU": 2, "MUR": 2, "MVR": 2, "MWK": 2, "MXN": 2,
+	"MXV": 2, "MYR": 2, "MZN": 2, "NAD": 2, "NGN": 2, "NIO": 2, "NOK": 2, "NPR": 2, "NZD": 2, "OMR": 3,
+	"PAB": 2, "PEN": 2, "PGK": 2, "PHP": 2, "PKR": 2, "PLN": 2, "PYG": 0, "QAR": 2, "RON": 2, "RSD": 2,
+	"RUB": 2, "RWF": 0, "SAR": 2, "SBD": 2, "SCR": 2, "SDG": 2, "SEK": 2, "SGD": 2, "SHP": 2, "SLL": 2,
+	"SOS": 2, "SRD": 2, "SSP": 2, "STN": 2, "SVC": 2, "SYP": 2, "SZL": 2, "THB": 2, "TJS": 2, "TMT": 2,
+	"TND": 3, "TOP": 2, "TRY": 2, "TTD": 2, "TWD": 2, "TZS": 2, "UAH": 2, "UGX": 0, "USD": 2, "USN": 2,
+	"UYI": 0, "UYU": 2, "UYW": 4, "UZS": 2, "VES": 2, "VND": 0, "VUV": 0, "WST": 2, "XAF": 0, "XCD": 2,
+	"XOF": 0, "XPF": 0, "YER": 2, "ZAR": 2, "ZMW": 2, "ZWL": 2,
+}
+
+func isValidCurrency(code string) bool {
+	_, ok := currencyExponents[code]
+	return ok
+}
+
+//////////////////////
+// PRICE
+// Prices are stored as an integer number of minor units (ex. cents) and
+// only ever converted to and from decimal strings, never to floats.
+//////////////////////
+type Price struct {
+	Amount   string `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// Accepts a decimal string ("19.99"), a json number (19.99) or an object ({"amount": "19.99", "currency": "EUR"})
+func (price *Price) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+
+	switch data[0] {
+	case '"':
+		return json.Unmarshal(data, &price.Amount)
+	case '{':
+		var object struct {
+			Amount   json.RawMessage `json:"amount"`
+			Currency string          `json:"currency"`
+		}
+		if err := json.Unmarshal(data, &object); err != nil {
+			return err
+		}
+		price.Currency = object.Currency
+		if len(object.Amount) == 0 {
+			return nil
+		}
+		amount := Price{}
+		if err := amount.UnmarshalJSON(object.Amount); err != nil {
+			return err
+		}
+		price.Amount = amount.Amount
+		return nil
+	}
+
+	// A json number. We keep its literal text, so nothing is lost to floating point.
+	var number json.Number
+	if err := json.Unmarshal(data, &number); err != nil {
+		return errors.New("the price needs to be a decimal string, a number or an {amount, currency} object")
+	}
+	price.Amount = number.String()
+	return nil
+}
+
+// Validates a price sent by the API consumer and returns it in minor units, along with its currency.
+// The currency can be sent on its own or as a part of the price object.
+func parsePriceInput(price Price, currency string) (int64, string, error) {
+	if price.Currency != "" {
+		currency = price.Currency
+	}
+	currency = strings.ToUpper(currency)
+
+	if currency != "" && !isValidCurrency(currency) {
+		return 0, "", fmt.Errorf("%q isn't an ISO 4217 currency code", currency)
+	}
+	if price.Amount == "" {
+		return 0, currency, nil
+	}
+	if currency == "" {
+		return 0, "", errors.New("please provide the currency of the price")
+	}
+
+	minorUnits, err := parseMinorUnits(price.Amount, getCurrencyExponent(currency))
+	if err != nil {
+		return 0, "", err
+	}
+	if minorUnits < 0 {
+		return 0, "", errors.New("the price can't be negative")
+	}
+	return minorUnits, currency, nil
+}
+
+// Converts a decimal string to minor units. Amounts with more decimals than the currency allows are rejected.
+func parseMinorUnits(amount string, exponent int) (int64, error) {
+	amount = strings.TrimSpace(amount)
+	invalid := fmt.Errorf("%q isn't a valid amount", amount)
+
+	negative := strings.HasPrefix(amount, "-")
+	amount = strings.TrimPrefix(amount, "-")
+
+	parts := strings.SplitN(amount, ".", 2)
+	whole, fraction := parts[0], ""
+	if len(parts) == 2 {
+		fraction = parts[1]
+	}
+	if whole == "" || !isDigits(whole) || !isDigits(fraction) {
+		return 0, invalid
+	}
+	fraction = strings.TrimRight(fraction, "0")
+	if len(fraction) > exponent {
+		return 0, fmt.Errorf("%q has more decimals than the currency allows (%d)", amount, exponent)
+	}
+	fraction += strings.Repeat("0", exponent-len(fraction))
+
+	minorUnits, err := strconv.ParseInt(whole+fraction, 10, 64)
+	if err != nil {
+		return 0, invalid
+	}
+	if negative {
+		minorUnits = -minorUnits
+	}
+	return minorUnits, nil
+}
+
+func formatMinorUnits(minorUnits int64, exponent int) string {
+	sign := ""
+	if minorUnits < 0 {
+		sign = "-"
+		minorUnits = -minorUnits
+	}
+	digits := strconv.FormatInt(minorUnits, 10)
+	if exponent == 0 {
+		return sign + digits
+	}
+	if len(digits) <= exponent {
+		digits = strings.Repeat("0", exponent-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-exponent] + "." + digits[len(digits)-exponent:]
+}
+
+// Converts any decimal representation (including the ones with too many decimals, like
+// the float32 prices we used to store) to minor units, rounding half away from zero
+func roundToMinorUnits(amount string, exponent int) (int64, error) {
+	rat, ok := new(big.Rat).SetString(strings.TrimSpace(amount))
+	if !ok {
+		return 0, fmt.Errorf("%q isn't a valid amount", amount)
+	}
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(exponent)), nil)
+	rat.Mul(rat, new(big.Rat).SetInt(scale))
+
+	quotient, remainder := new(big.Int).QuoRem(rat.Num(), rat.Denom(), new(big.Int))
+	// Round half away from zero
+	if new(big.Int).Mul(new(big.Int).Abs(remainder), big.NewInt(2)).Cmp(rat.Denom()) >= 0 {
+		if rat.Sign() < 0 {
+			quotient.Sub(quotient, big.NewInt(1))
+		} else {
+			quotient.Add(quotient, big.NewInt(1))
+		}
+	}
+	if !quotient.IsInt64() {
+		return 0, fmt.Errorf("%q is too large", amount)
+	}
+	return quotient.Int64(), nil
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Currencies we don't know (only possible in data stored before we validated them) are treated as having cents
+func getCurrencyExponent(currency string) int {
+	exponent, ok := currencyExponents[currency]
+	if !ok {
+		return 2
+	}
+	return exponent
+}
+
+//////////////////////
+// MIGRATION
+// Products used to store the price as a float32 in the `price` field.
+// We convert them to minor units in `price_minor` once, at startup.
+//////////////////////
+func migratePricesToMinorUnits(redisConn redis.Conn) (int, error) {
+	// The migration is idempotent, so it doesn't matter if two instances run it at the same time
+	done, err := redis.Bool(redisConn.Do("EXISTS", config.KeyPriceMigration))
+	if err != nil || done {
+		return 0, err
+	}
+
+	lastId, err := redis.Int(redisConn.Do("GET", config.KeyProductCounter))
+	if err != nil && err != redis.ErrNil {
+		return 0, err
+	}
+
+	migrated := 0
+	for id := 1; id <= lastId; id++ {
+		values, err := redis.Strings(redisConn.Do("HMGET", getProductNameById(id), "price", "price_minor", "currency"))
+		if err != nil {
+			return migrated, err
+		}
+		legacyPrice, priceMinor, currency := values[0], values[1], values[2]
+		if legacyPrice == "" || priceMinor != "" {
+			continue
+		}
+
+		minorUnits, err := roundToMinorUnits(legacyPrice, getCurrencyExponent(currency))
+		if err != nil {
+			logger.Warn("Unable to migrate product price", Fields{"product_id": id, "price": legacyPrice, "error": err})
+			continue
+		}
+
+		_, err = redisConn.Do("MULTI")
+		if err != nil {
+			return migrated, err
+		}
+		_ = redisConn.Send("HSET", getProductNameById(id), "price_minor", minorUnits)
+		_ = redisConn.Send("HDEL", getProductNameById(id), "price")
+		_, err = redisConn.Do("EXEC")
+		if err != nil {
+			return migrated, err
+		}
+		migrated++
+	}
+
+	_, err = redisConn.Do("SET", config.KeyPriceMigration, 1)
+	return migrated, err
+}
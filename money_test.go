@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/rafaeljusto/redigomock"
+	"gotest.tools/assert"
+	"testing"
+)
+
+func TestParseMinorUnits(t *testing.T) {
+	testCases := []struct {
+		amount   string
+		exponent int
+		want     int64
+		wantErr  bool
+	}{
+		{"19.99", 2, 1999, false},
+		{"19.9", 2, 1990, false},
+		{"19", 2, 1900, false},
+		{"19.990", 2, 1999, false},
+		{"0.05", 2, 5, false},
+		{"500", 0, 500, false},
+		{"1.234", 3, 1234, false},
+		{"123456789012345.67", 2, 12345678901234567, false},
+		{"19.999", 2, 0, true},
+		{"500.5", 0, 0, true},
+		{"19,99", 2, 0, true},
+		{"", 2, 0, true},
+		{"1e3", 2, 0, true},
+	}
+
+	for _, tc := range testCases {
+		got, err := parseMinorUnits(tc.amount, tc.exponent)
+		if tc.wantErr {
+			assert.Assert(t, err != nil, "'%s' should be rejected", tc.amount)
+			continue
+		}
+		assert.NilError(t, err)
+		assert.Equal(t, tc.want, got, tc.amount)
+	}
+}
+
+func TestFormatMinorUnits(t *testing.T) {
+	assert.Equal(t, "19.99", formatMinorUnits(1999, 2))
+	assert.Equal(t, "0.05", formatMinorUnits(5, 2))
+	assert.Equal(t, "0.00", formatMinorUnits(0, 2))
+	assert.Equal(t, "500", formatMinorUnits(500, 0))
+	assert.Equal(t, "1.234", formatMinorUnits(1234, 3))
+	assert.Equal(t, "-0.50", formatMinorUnits(-50, 2))
+}
+
+func TestRoundToMinorUnits(t *testing.T) {
+	// The way float32 prices used to be stored
+	got, err := roundToMinorUnits("19.9899997", 2)
+	assert.NilError(t, err)
+	assert.Equal(t, int64(1999), got)
+
+	got, err = roundToMinorUnits("2.5", 0)
+	assert.NilError(t, err)
+	assert.Equal(t, int64(3), got)
+
+	got, err = roundToMinorUnits("1e+06", 2)
+	assert.NilError(t, err)
+	assert.Equal(t, int64(100000000), got)
+}
+
+func TestPrice_UnmarshalJSON(t *testing.T) {
+	testCases := []struct {
+		json string
+		want Price
+	}{
+		{`"19.99"`, Price{Amount: "19.99"}},
+		{`19.99`, Price{Amount: "19.99"}},
+		{`{"amount": "19.99", "currency": "EUR"}`, Price{Amount: "19.99", Currency: "EUR"}},
+		{`{"amount": 500, "currency": "JPY"}`, Price{Amount: "500", Currency: "JPY"}},
+		{`null`, Price{}},
+	}
+
+	for _, tc := range testCases {
+		var price Price
+		err := json.Unmarshal([]byte(tc.json), &price)
+		assert.NilError(t, err, tc.json)
+		assert.Equal(t, tc.want, price, tc.json)
+	}
+
+	var price Price
+	assert.Assert(t, json.Unmarshal([]byte(`true`), &price) != nil)
+}
+
+func TestProduct_setPriceFromInput(t *testing.T) {
+	product := Product{Price: Price{Amount: "19.99"}, Currency: "eur"}
+	assert.NilError(t, product.setPriceFromInput())
+	assert.Equal(t, int64(1999), product.PriceMinor)
+	assert.Equal(t, "EUR", product.Currency)
+	assert.Equal(t, Price{Amount: "19.99", Currency: "EUR"}, product.Price)
+
+	product = Product{Price: Price{Amount: "500", Currency: "JPY"}}
+	assert.NilError(t, product.setPriceFromInput())
+	assert.Equal(t, int64(500), product.PriceMinor)
+	assert.Equal(t, "JPY", product.Currency)
+
+	product = Product{Price: Price{Amount: "500.50"}, Currency: "JPY"}
+	assert.ErrorContains(t, product.setPriceFromInput(), "more decimals")
+
+	product = Product{Price: Price{Amount: "10"}, Currency: "XYZ"}
+	assert.ErrorContains(t, product.setPriceFromInput(), "ISO 4217")
+
+	product = Product{Price: Price{Amount: "10"}}
+	assert.ErrorContains(t, product.setPriceFromInput(), "currency")
+}
+
+func TestMigratePricesToMinorUnits(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("EXISTS", config.KeyPriceMigration).Expect(int64(0))
+	conn.Command("GET", config.KeyProductCounter).Expect([]byte("3"))
+	conn.Command("HMGET", getProductNameById(1), "price", "price_minor", "currency").Expect([]interface{}{[]byte("19.99"), nil, []byte("EUR")})
+	conn.Command("HMGET", getProductNameById(2), "price", "price_minor", "currency").Expect([]interface{}{nil, []byte("500"), []byte("JPY")})
+	conn.Command("HMGET", getProductNameById(3), "price", "price_minor", "currency").Expect([]interface{}{nil, nil, nil})
+	conn.Command("MULTI").Expect("OK")
+	migrate := conn.Command("HSET", getProductNameById(1), "price_minor", int64(1999)).Expect(int64(1))
+	conn.Command("HDEL", getProductNameById(1), "price").Expect(int64(1))
+	conn.Command("EXEC").Expect([]interface{}{})
+	done := conn.Command("SET", config.KeyPriceMigration, 1).Expect("OK")
+
+	migrated, err := migratePricesToMinorUnits(conn)
+	assert.NilError(t, err)
+	assert.Equal(t, 1, migrated)
+	assert.Equal(t, 1, conn.Stats(migrate))
+	assert.Equal(t, 1, conn.Stats(done))
+}
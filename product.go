@@ -3,7 +3,6 @@ package main
 import (
 	"fmt"
 	"github.com/gomodule/redigo/redis"
-	"github.com/labstack/gommon/log"
 	"strconv"
 	"strings"
 )
@@ -11,17 +10,37 @@ import (
 //////////////////////
 // PRODUCT MODEL
 //////////////////////
+
+
+
 type Product struct {
-	Id               int      `redis:"id" json:"id"`
-	Name             string   `redis:"name" json:"name"`
-	Description      string   `redis:"description" json:"description"`
-	Vendor           string   `redis:"vendor" json:"vendor"`
-	Price            float32  `redis:"price" json:"price"`
-	Currency         string   `redis:"currency" json:"currency"`
-	MainCategoryId   int      `redis:"main_category_id" json:"main_category_id,omitempty"`
-	MainCategoryName string   `redis:"-" json:"-"`
-	MainCategory     Category `redis:"-" json:"main_category"`
-	Images           []Image  `redis:"-" json:"images" `
+	Id               int                    `redis:"id" json:"id"`
+	Name             string                 `redis:"name" json:"name"`
+	Slug             string                 `redis:"slug" json:"slug"`
+	Description      string                 `redis:"description" json:"description"`
+	Locale           string                 `redis:"-" json:"locale,omitempty"` // only set when the name and description are translated
+	Vendor           string                 `redis:"vendor" json:"vendor"`
+	Price            Price                  `redis:"-" json:"price"`
+	PriceMinor       int64                  `redis:"price_minor" json:"-"` // the price in the currency's minor units (ex. cents)
+	Currency         string                 `redis:"currency" json:"currency"`
+	ConvertedPrice   *Price                 `redis:"-" json:"converted_price,omitempty"` // only set when a display currency is requested
+	MainCategoryId   int                    `redis:"main_category_id" json:"main_category_id,omitempty"`
+	MainCategoryName string                 `redis:"-" json:"-"`
+	MainCategory     Category               `redis:"-" json:"main_category"`
+	Images           []Image                `redis:"-" json:"images" `
+	Variants         []Variant              `redis:"-" json:"variants,omitempty"`
+	OptionAxes       map[string][]string    `redis:"-" json:"option_axes,omitempty"`
+	Availability     *Availability          `redis:"-" json:"availability,omitempty"`
+	Rating           *ProductRating         `redis:"-" json:"rating,omitempty"` // the aggregates of the approved reviews, kept in the hash by the review scripts
+	Attributes       map[string]interface{} `redis:"-" json:"attributes,omitempty"`
+	AttributesJson   string                 `redis:"attributes" json:"-"`                    // the attributes are stored in the hash as json
+	Tags             []string               `redis:"-" json:"tags"`
+	TagsList         string                 `redis:"tags" json:"-"` // the tags are stored in the hash as a comma separated list
+	Status           string                 `redis:"status" json:"status"`                       // draft, published or archived
+	PublishAt        int64                  `redis:"publish_at" json:"publish_at,omitempty"`     // unix timestamp, when a draft gets published
+	UnpublishAt      int64                  `redis:"unpublish_at" json:"unpublish_at,omitempty"` // unix timestamp, when the product gets archived
+	DeletedAt        int64                  `redis:"deleted_at" json:"deleted_at,omitempty"` // unix timestamp, set while the product is in the trash
+	Related          *RelatedProducts       `redis:"-" json:"related,omitempty"`             // only set with `include=related`
 }
 
 func (product *Product) setId(redisConn redis.Conn) {
@@ -41,8 +60,8 @@ func (product *Product) getNormalisedName() string {
 
 func (product *Product) setCategory(redisConn redis.Conn) {
 	if product.MainCategoryName == "" {
-		categoryName, _ := redis.String(redisConn.Do("HGET", config.KeyCategories, product.MainCategoryId))
-		product.MainCategoryName = categoryName
+		category, _ := categoryCache.get(product.MainCategoryId, redisConn)
+		product.MainCategoryName = category.Name
 	}
 	product.MainCategory = Category{
 		Id:   product.MainCategoryId,
@@ -51,6 +70,26 @@ func (product *Product) setCategory(redisConn redis.Conn) {
 	product.MainCategoryId = 0 //We don't want to show this field directly on the product object, but as a part of its category
 }
 
+// Validates the price sent by the API consumer and converts it to minor units
+func (product *Product) setPriceFromInput() error {
+	minorUnits, currency, err := parsePriceInput(product.Price, product.Currency)
+	if err != nil {
+		return err
+	}
+	product.PriceMinor = minorUnits
+	product.Currency = currency
+	product.setPrice()
+	return nil
+}
+
+// Sets the decimal price shown to API consumers from the stored minor units
+func (product *Product) setPrice() {
+	product.Price = Price{
+		Amount:   formatMinorUnits(product.PriceMinor, getCurrencyExponent(product.Currency)),
+		Currency: product.Currency,
+	}
+}
+
 func (product *Product) setImages(redisConn redis.Conn) {
 	imageIds, _ := redis.Ints(redisConn.Do("SMEMBERS", getProductImagesKeyName(product.Id)))
 	for _, imageId := range imageIds {
@@ -73,32 +112,49 @@ func (product *Product) setImagesFromStringMap(imageIds []int) {
 	}
 }
 
-func (product *Product) delete(redisConn redis.Conn) error {
+// Permanently deletes the product and its images. Products deleted through the API go to the trash first (see `trash`).
+func (product *Product) delete(actor string, redisConn redis.Conn) error {
 
 	productValues, err := redis.Values(redisConn.Do("HGETALL", product.getKeyName()))
 	if err != nil {
-		log.Error(err)
 		return err
 	}
 	if len(productValues) == 0 {
-		log.Error(err)
 		return &notFoundError
 	}
-	err = redis.ScanStruct(productValues, product)
+	err = scanProduct(productValues, product)
 	if err != nil {
-		log.Error(err)
 		return err
 	}
 
 	productImagesKeyName := getProductImagesKeyName(product.Id)
-	imageValues, _ := getHashAsStringMap(productImagesKeyName, redisConn)
+	imageIds, _ := redis.Ints(redisConn.Do("SMEMBERS", productImagesKeyName))
+
+	variants, err := getProductVariants(product.Id, redisConn)
+	if err != nil {
+		return err
+	}
+
+	translations, err := getProductTranslations(product.Id, redisConn)
+	if err != nil {
+		return err
+	}
+
+	slugs, err := redis.Strings(redisConn.Do("SMEMBERS", getProductSlugsKeyName(product.Id)))
+	if err != nil {
+		return err
+	}
+
+	reviewIds, err := getAllProductReviewIds(product.Id, redisConn)
+	if err != nil {
+		return err
+	}
 
 	// Start a transaction and send all commands in a pipeline
 	_, _ = redisConn.Do("MULTI")
 
 	// Delete all product images
-	for imageId, _ := range imageValues {
-		imageId, _ := strconv.Atoi(imageId)
+	for _, imageId := range imageIds {
 		_ = redisConn.Send("DEL", getImageNameById(imageId))
 		// Delete from "all images" hash
 		_ = redisConn.Send("HDEL", config.KeyImages, imageId)
@@ -107,13 +163,43 @@ func (product *Product) delete(redisConn redis.Conn) error {
 	// Delete the product images hash
 	_ = redisConn.Send("DEL", productImagesKeyName)
 
+	// Delete the variants and free their skus
+	sendProductVariantsDelete(product.Id, variants, redisConn)
+
+	// Delete the stock
+	sendStockDelete(product, redisConn)
+
+	// Delete from the attribute and similarity indexes
+	sendAttributeIndexRemove(product, redisConn)
+	sendSimilarityIndexRemove(product, redisConn)
+	sendTagIndexRemove(product, redisConn)
+
+	// Delete the curated relations. Relations of other products to this one are skipped when they're shown.
+	_ = redisConn.Send("DEL", getProductRelationsKeyName(product.Id))
+
+	// Delete the translations and remove them from the locale indexes
+	sendTranslationIndexRemove(product.Id, translations, redisConn)
+	_ = redisConn.Send("DEL", getProductTranslationsKeyName(product.Id))
+
+	// Free the slugs, including the ones old URLs were redirected from
+	sendProductSlugsDelete(product.Id, slugs, redisConn)
+
+	// Delete the reviews and take the product out of the rating index
+	sendProductReviewsDelete(product, reviewIds, redisConn)
+
 	// Delete from the all_products and "products_by_cat" hashes
 	_ = redisConn.Send("ZREM", config.KeyAllProducts, product.getLexName())
 	_ = redisConn.Send("ZREM", getProductsInCategoryKeyName(product.MainCategoryId), product.getLexName())
+	_ = redisConn.Send("ZREM", config.KeyTrashedProducts, product.Id)
+	sendPriceIndexRemove(product, redisConn)
 
 	// Delete the product key
 	_ = redisConn.Send("DEL", product.getKeyName())
 
+	// Keep the last state of the product in its history
+	_ = sendProductVersion(product, ProductPurged, actor, redisConn)
+	_ = sendProductEvent(EventProductPurged, product, actor, redisConn)
+
 	// Execute transaction
 	_, err = redisConn.Do("EXEC")
 	if err != nil {
@@ -143,24 +229,59 @@ func getProductById(id int, redisConn redis.Conn) (Product, error) {
 	//////////////////////////////////////////
 	// Populate the Product struct from the hash
 	//////////////////////////////////////////
-	err = redis.ScanStruct(values, &product)
+	err = scanProduct(values, &product)
 	if err != nil {
 		return Product{}, err
 	}
 
+	// Products in the trash aren't a part of the catalogue anymore
+	if product.DeletedAt != 0 {
+		return Product{}, &notFoundError
+	}
+
 	return product, nil
 }
+// Populates the Product struct from the hash values and sets the fields derived from them
+func scanProduct(values []interface{}, product *Product) error {
+	err := redis.ScanStruct(values, product)
+	if err != nil {
+		return err
+	}
+	product.setPrice()
+	product.setAttributes()
+	product.setTags()
+	if product.Status == "" {
+		product.Status = ProductPublished
+	}
+	return product.setRating(values)
+}
+
 func productExists(id int, redisConn redis.Conn) bool {
-	exists, _ := redis.Bool(redisConn.Do("EXISTS", getProductNameById(id)))
-	return exists
+	values, _ := redis.Strings(redisConn.Do("HMGET", getProductNameById(id), "id", "deleted_at"))
+	return len(values) == 2 && values[0] != "" && (values[1] == "" || values[1] == "0")
 }
-func saveNewProduct(product *Product, redisConn redis.Conn) error {
+func saveNewProduct(product *Product, actor string, redisConn redis.Conn) error {
 	//////////////////////////////////////////
 	// Get a product id from the id counter
 	// and assign it to the product struct
 	//////////////////////////////////////////
 	product.setId(redisConn)
 
+	err := product.updateSlug("", redisConn)
+	if err != nil {
+		return err
+	}
+
+	err = insertProduct(product, ProductCreated, actor, redisConn)
+	if err != nil {
+		// The product was never saved, so nothing else would ever free its slug
+		_ = releaseSlug(product.Slug, product.Id, redisConn)
+	}
+	return err
+}
+
+// Saves the product hash under the product's id and adds it to the indexes
+func insertProduct(product *Product, action string, actor string, redisConn redis.Conn) error {
 	// Start a transaction and send all commands in a pipeline
 	_, err := redisConn.Do("MULTI")
 	if err != nil {
@@ -172,11 +293,23 @@ func saveNewProduct(product *Product, redisConn redis.Conn) error {
 	/////////////////////
 	_ = redisConn.Send("HSET", redis.Args{product.getKeyName()}.AddFlat(product)...)
 
-	// Add product to sorted set of all products
-	_ = redisConn.Send("ZADD", config.KeyAllProducts, 0, product.getLexName())
+	// Add published products to the sorted sets of all products and of products in the category,
+	// and to the price, similarity and tag indexes. Drafts are only listed for the admins.
+	sendListingIndexAdd(product, nil, redisConn)
+	sendPublishingScheduleUpdate(product, redisConn)
+
+	// Add product to the attribute indexes
+	sendAttributeIndexAdd(product, redisConn)
 
-	// Add product to sorted set of products in category
-	_ = redisConn.Send("ZADD", getProductsInCategoryKeyName(product.MainCategoryId), 0, product.getLexName())
+	// If we're recreating a product that was in the trash, it shouldn't be purged anymore
+	_ = redisConn.Send("ZREM", config.KeyTrashedProducts, product.Id)
+
+	_ = sendProductVersion(product, action, actor, redisConn)
+	eventType := EventProductCreated
+	if action == ProductRestored {
+		eventType = EventProductRestored
+	}
+	_ = sendProductEvent(eventType, product, actor, redisConn)
 
 	_, err = redisConn.Do("EXEC")
 	if err != nil {
@@ -186,32 +319,87 @@ func saveNewProduct(product *Product, redisConn redis.Conn) error {
 	return nil
 }
 
-func updateProduct(product *Product, oldProduct *Product, redisConn redis.Conn) error {
-	/////////////////////
-	// Save hash to Redis
-	/////////////////////
-	_, err := redisConn.Do("HSET", redis.Args{product.getKeyName()}.AddFlat(product)...)
+func updateProduct(product *Product, oldProduct *Product, actor string, redisConn redis.Conn) error {
+	// A renamed product gets a new slug, the old one keeps pointing to it
+	err := product.updateSlug(oldProduct.Slug, redisConn)
 	if err != nil {
 		return err
 	}
+	return saveProductChanges(product, oldProduct, ProductUpdated, actor, redisConn)
+}
 
-	//////////////////////////////////////////
-	// If the category has been updated remove the product from
-	// the old categorised product list and add it to the new one
-	//////////////////////////////////////////
-	if oldProduct.MainCategoryId != product.MainCategoryId {
-		_, err = redisConn.Do("MULTI")
+func saveProductChanges(product *Product, oldProduct *Product, action string, actor string, redisConn redis.Conn) error {
+	// Products that are published or unpublished move in or out of the locale indexes along with the others
+	var translations map[string]Translation
+	if oldProduct.Status != product.Status {
+		var err error
+		translations, err = getProductTranslations(product.Id, redisConn)
 		if err != nil {
 			return err
 		}
+	}
+
+	// Start a transaction and send all commands in a pipeline
+	_, err := redisConn.Do("MULTI")
+	if err != nil {
+		return err
+	}
 
-		_ = redisConn.Send("ZREM", getProductsInCategoryKeyName(oldProduct.MainCategoryId), oldProduct.getLexName())
-		_ = redisConn.Send("ZADD", getProductsInCategoryKeyName(product.MainCategoryId), 0, product.getLexName())
+	/////////////////////
+	// Save hash to Redis
+	/////////////////////
+	_ = redisConn.Send("HSET", redis.Args{product.getKeyName()}.AddFlat(product)...)
 
-		_, err = redisConn.Do("EXEC")
-		if err != nil {
-			return err
+	if oldProduct.getLexName() != product.getLexName() {
+		_ = renameInStockScript.Send(redisConn, config.KeyInStockProducts, oldProduct.getLexName(), product.getLexName())
+		_ = renameRatingScript.Send(redisConn, config.KeyProductsByRating, oldProduct.getLexName(), product.getLexName())
+	}
+
+	if oldProduct.Status != product.Status {
+		// The product moves between the public listing indexes and the listings of drafts and archived products
+		sendListingIndexRemove(oldProduct, translations, redisConn)
+		sendListingIndexAdd(product, translations, redisConn)
+	} else if product.isPublished() {
+		//////////////////////////////////////////
+		// If the name or the category have been updated remove the product from
+		// the old product lists and add it to the new ones
+		//////////////////////////////////////////
+		if oldProduct.getLexName() != product.getLexName() {
+			_ = redisConn.Send("ZREM", config.KeyAllProducts, oldProduct.getLexName())
+			_ = redisConn.Send("ZADD", config.KeyAllProducts, 0, product.getLexName())
+		}
+		if oldProduct.MainCategoryId != product.MainCategoryId || oldProduct.getLexName() != product.getLexName() {
+			_ = redisConn.Send("ZREM", getProductsInCategoryKeyName(oldProduct.MainCategoryId), oldProduct.getLexName())
+			_ = redisConn.Send("ZADD", getProductsInCategoryKeyName(product.MainCategoryId), 0, product.getLexName())
 		}
+		if oldProduct.Currency != product.Currency || oldProduct.getLexName() != product.getLexName() {
+			sendPriceIndexRemove(oldProduct, redisConn)
+		}
+		sendPriceIndexAdd(product, redisConn)
+		sendSimilarityIndexRemove(oldProduct, redisConn)
+		sendSimilarityIndexAdd(product, redisConn)
+		sendTagIndexRemove(oldProduct, redisConn)
+		sendTagIndexAdd(product, redisConn)
+	}
+	sendPublishingScheduleUpdate(product, redisConn)
+	sendAttributeIndexRemove(oldProduct, redisConn)
+	sendAttributeIndexAdd(product, redisConn)
+
+	_ = sendProductVersion(product, action, actor, redisConn)
+	_ = sendEvent(CatalogueEvent{
+		Type:       EventProductUpdated,
+		ProductId:  product.Id,
+		CategoryId: product.MainCategoryId,
+		Actor:      actor,
+		Data: map[string]interface{}{
+			"product": getProductSnapshot(product),
+			"changes": diffSnapshots(getProductSnapshot(oldProduct), getProductSnapshot(product)),
+		},
+	}, redisConn)
+
+	_, err = redisConn.Do("EXEC")
+	if err != nil {
+		return err
 	}
 
 	return nil
@@ -227,6 +415,10 @@ func getProductImagesKeyName(id int) string {
 func getProductsInCategoryKeyName(categoryId int) string {
 	return fmt.Sprintf(config.KeyProductsInCategory, categoryId)
 }
+func getIdFromLexName(lexName string) int {
+	id, _ := strconv.Atoi(lexName[strings.LastIndex(lexName, "::")+2:])
+	return id
+}
 
 type PaginatedProductCollection struct {
 	Data           []Product `json:"data"`
@@ -234,28 +426,50 @@ type PaginatedProductCollection struct {
 	ResultsPerPage int       `json:"per_page"`
 }
 
+// Runs a command that returns a list of lex names (ex. a ZRANGE on one of the product indexes) and fetches those products
 func getProducts(command string, args redis.Args, categories map[int]Category, redisConn redis.Conn) ([]Product,error) {
 
-	products := make([]Product, 0)
-
 	results, err := redis.Strings(redisConn.Do(command, args...))
 	if err != nil {
-		return products, err
+		return make([]Product, 0), err
+	}
+
+	productIds := make([]int, 0, len(results))
+	for _, lexName := range results {
+		productIds = append(productIds, getIdFromLexName(lexName))
+	}
+
+	return getProductsByIds(productIds, categories, redisConn)
+}
+
+// Fetches the products along with their images and stock. Products in the trash are left out.
+func getProductsByIds(productIds []int, categories map[int]Category, redisConn redis.Conn) ([]Product, error) {
+	products, err := fetchProductsByIds(productIds, categories, redisConn)
+	live := make([]Product, 0, len(products))
+	for _, product := range products {
+		if product.DeletedAt == 0 {
+			live = append(live, product)
+		}
 	}
+	return live, err
+}
+
+// Like getProductsByIds, including the products in the trash
+func fetchProductsByIds(productIds []int, categories map[int]Category, redisConn redis.Conn) ([]Product, error) {
+
+	products := make([]Product, 0)
+
 	////////////////////////////////////////////////////
 	// If no results - respond with an empty json array
 	////////////////////////////////////////////////////
-	if len(results) == 0 {
+	if len(productIds) == 0 {
 		return products, nil
 	}
 
 	////////////////////////////////////////////////////
 	// Send all the HGETALL commands in a pipeline, so we don't need to make too many requests to the database
 	////////////////////////////////////////////////////
-	for _, product := range results {
-		temp := strings.Split(product, "::")
-		productId, _ := strconv.Atoi(temp[1])
-
+	for _, productId := range productIds {
 		// Get the product data
 		err := redisConn.Send("HGETALL", getProductNameById(productId))
 		if err != nil {
@@ -266,6 +480,11 @@ func getProducts(command string, args redis.Args, categories map[int]Category, r
 		if err != nil {
 			return products, nil
 		}
+		// Get the product stock
+		err = redisConn.Send("HGETALL", getStockKeyName(productId))
+		if err != nil {
+			return products, nil
+		}
 	}
 
 	_ = redisConn.Flush()
@@ -274,11 +493,11 @@ func getProducts(command string, args redis.Args, categories map[int]Category, r
 	// Call "Receive" on the client for every hash in the collection,
 	// scan it into a struct and append it into the resulting collection
 	////////////////////////////////////////////////////
-	for _, _ = range results {
+	for _, _ = range productIds {
 		values, _ := redis.Values(redisConn.Receive())
 
 		var product Product
-		_ = redis.ScanStruct(values, &product)
+		_ = scanProduct(values, &product)
 		product.MainCategory = categories[product.MainCategoryId]
 		product.MainCategoryId = 0
 
@@ -286,6 +505,12 @@ func getProducts(command string, args redis.Args, categories map[int]Category, r
 		imageIds, _ := redis.Ints(redisConn.Receive())
 		product.setImagesFromStringMap(imageIds)
 
+		// And the stock
+		stockValues, _ := redis.StringMap(redisConn.Receive())
+		stock := parseStock(product.Id, stockValues)
+		availability := stock.getAvailability()
+		product.Availability = &availability
+
 		products = append(products, product)
 	}
 
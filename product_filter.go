@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+)
+
+//////////////////////
+// PRODUCT INDEX FILTERS
+// The product listings are sorted sets of lex names ("name::id"), all with a score of 0, so they can
+// be paged through and prefix searched with ZRANGEBYLEX. To filter a listing we intersect it with
+// other sets of lex names into a short lived key, keeping the score of 0, and list that key instead.
+//////////////////////
+type IndexFilter struct {
+	// A set or sorted set of lex names
+	Key string
+
+	// Instead of a key, the members of sorted sets with a score in a range (a product matches if it's in any of them)
+	Ranges []ScoreRange
+}
+
+// Uses the ZRANGEBYSCORE syntax for the bounds ("-inf", "(10"...)
+type ScoreRange struct {
+	Key string
+	Min string
+	Max string
+}
+
+// Copies the members of sorted sets with a score in the given ranges into a new sorted set, with a score of 0.
+// KEYS[1] is the destination, the other keys the sorted sets. ARGV holds the ttl followed by the min/max pairs.
+var copyScoreRangesScript = redis.NewScript(-1, `
+redis.call('DEL', KEYS[1])
+local count = 0
+for k = 2, #KEYS do
+	local members = redis.call('ZRANGEBYSCORE', KEYS[k], ARGV[2 * k - 2], ARGV[2 * k - 1])
+	for i = 1, #members, 1000 do
+		local args = {}
+		for j = i, math.min(i + 999, #members) do
+			table.insert(args, 0)
+			table.insert(args, members[j])
+		end
+		count = count + redis.call('ZADD', KEYS[1], unpack(args))
+	end
+end
+redis.call('EXPIRE', KEYS[1], ARGV[1])
+return count
+`)
+
+// Returns the name of a key holding the members of `keyName` that pass all the filters
+func filterProductIndex(keyName string, filters []IndexFilter, redisConn redis.Conn) (string, error) {
+	if len(filters) == 0 {
+		return keyName, nil
+	}
+
+	keys := redis.Args{keyName}
+	weights := redis.Args{1}
+	for _, filter := range filters {
+		filterKey := filter.Key
+		if len(filter.Ranges) > 0 {
+			filterKey = getTemporaryKeyName()
+			err := copyScoreRanges(filterKey, filter.Ranges, redisConn)
+			if err != nil {
+				return "", err
+			}
+		}
+		keys = keys.Add(filterKey)
+		// The filters don't add to the score, so the result keeps the lex order of the listing
+		weights = weights.Add(0)
+	}
+
+	destination := getTemporaryKeyName()
+	_, err := redisConn.Do("MULTI")
+	if err != nil {
+		return "", err
+	}
+	_ = redisConn.Send("ZINTERSTORE", redis.Args{destination, len(keys)}.Add(keys...).Add("WEIGHTS").Add(weights...)...)
+	_ = redisConn.Send("EXPIRE", destination, config.TemporaryKeyTtl)
+	_, err = redisConn.Do("EXEC")
+	if err != nil {
+		return "", err
+	}
+
+	return destination, nil
+}
+
+func copyScoreRanges(destination string, ranges []ScoreRange, redisConn redis.Conn) error {
+	keys := redis.Args{destination}
+	args := redis.Args{config.TemporaryKeyTtl}
+	for _, scoreRange := range ranges {
+		keys = keys.Add(scoreRange.Key)
+		args = args.Add(scoreRange.Min, scoreRange.Max)
+	}
+	_, err := copyScoreRangesScript.Do(redisConn, redis.Args{len(keys)}.Add(keys...).Add(args...)...)
+	return err
+}
+
+func getTemporaryKeyName() string {
+	return fmt.Sprintf(config.KeyTemporary, generateRequestId())
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"github.com/rafaeljusto/redigomock"
+	"gotest.tools/assert"
+	"strings"
+	"testing"
+)
+
+func TestFilterProductIndex(t *testing.T) {
+	conn := redigomock.NewConn()
+
+	// Without filters the listing is used as it is
+	keyName, err := filterProductIndex(config.KeyAllProducts, nil, conn)
+	assert.NilError(t, err)
+	assert.Equal(t, config.KeyAllProducts, keyName)
+
+	script := conn.GenericCommand("EVALSHA").Expect(int64(3))
+	conn.Command("MULTI").Expect("OK")
+	intersect := conn.GenericCommand("ZINTERSTORE").Expect(int64(2))
+	expire := conn.GenericCommand("EXPIRE").Expect(int64(1))
+	conn.Command("EXEC").Expect([]interface{}{int64(2), int64(1)})
+
+	filters := []IndexFilter{{
+		Ranges: []ScoreRange{{Key: getProductsByPriceKeyName("EUR"), Min: "1000", Max: "+inf"}},
+	}}
+	keyName, err = filterProductIndex(config.KeyAllProducts, filters, conn)
+	assert.NilError(t, err)
+	assert.Assert(t, strings.HasPrefix(keyName, "tmp:"))
+	assert.Equal(t, 1, conn.Stats(script))
+	assert.Equal(t, 1, conn.Stats(intersect))
+	assert.Equal(t, 1, conn.Stats(expire))
+}
@@ -54,3 +54,19 @@ func TestNormaliseSearchString(t *testing.T) {
 func TestGetProductById(t *testing.T) {
 
 }
+
+func TestGetProductsByIds_skipsTrashedProducts(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("HGETALL", getProductNameById(7)).ExpectMap(map[string]string{"id": "7", "name": "Rocinante"})
+	conn.Command("HGETALL", getProductNameById(8)).ExpectMap(map[string]string{"id": "8", "name": "Tachi", "deleted_at": "1567332000"})
+
+	products, err := getProductsByIds([]int{7, 8}, map[int]Category{}, conn)
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(products))
+	assert.Equal(t, 7, products[0].Id)
+
+	// The trash listing still gets them
+	products, err = fetchProductsByIds([]int{7, 8}, map[int]Category{}, conn)
+	assert.NilError(t, err)
+	assert.Equal(t, 2, len(products))
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"strings"
+	"time"
+)
+
+const (
+	ProductDraft     = "draft"
+	ProductPublished = "published"
+	ProductArchived  = "archived"
+)
+
+var productStatuses = []string{ProductDraft, ProductPublished, ProductArchived}
+
+//////////////////////
+// PUBLISHING
+// Only published products are in the public listing indexes. Drafts and archived products are kept in a sorted set
+// per status instead, scored by the time they got the status, so they can be listed for the catalogue admins.
+// Products can be scheduled to be published (`publish_at`) and archived (`unpublish_at`). The due times are kept in
+// two sorted sets of product ids, which the publishing scheduler checks periodically.
+//////////////////////
+
+// Products saved before statuses existed don't have one, they're published
+func (product *Product) isPublished() bool {
+	return product.Status == ProductPublished || product.Status == ""
+}
+
+// Validates the status and the schedule sent by the API consumer. Products without a status keep their current one,
+// new products are published right away, unless they're scheduled to be published later.
+func (product *Product) setStatusFromInput(oldProduct *Product, now time.Time) []string {
+	errs := make([]string, 0)
+	if product.Status == "" {
+		switch {
+		case oldProduct != nil:
+			product.Status = oldProduct.Status
+		case product.PublishAt > now.Unix():
+			product.Status = ProductDraft
+		default:
+			product.Status = ProductPublished
+		}
+	}
+
+	if !stringInSlice(product.Status, productStatuses) {
+		errs = append(errs, fmt.Sprintf("The status needs to be one of %s", strings.Join(productStatuses, ", ")))
+	}
+	if product.PublishAt < 0 || product.UnpublishAt < 0 {
+		errs = append(errs, "The publishing schedule needs to be made of unix timestamps")
+	}
+	if product.PublishAt > 0 && product.UnpublishAt > 0 && product.UnpublishAt <= product.PublishAt {
+		errs = append(errs, "The product needs to be unpublished after it's published")
+	}
+	if product.Status == ProductPublished && product.PublishAt > now.Unix() {
+		errs = append(errs, "A product that's published later needs to be a draft until then")
+	}
+	return errs
+}
+
+// Adds the product to the public listing indexes if it's published, or to the listing of its status otherwise
+func sendListingIndexAdd(product *Product, translations map[string]Translation, redisConn redis.Conn) {
+	if !product.isPublished() {
+		_ = redisConn.Send("ZADD", getProductsByStatusKeyName(product.Status), "NX", time.Now().Unix(), product.Id)
+		return
+	}
+	_ = redisConn.Send("ZADD", config.KeyAllProducts, 0, product.getLexName())
+	_ = redisConn.Send("ZADD", getProductsInCategoryKeyName(product.MainCategoryId), 0, product.getLexName())
+	sendPriceIndexAdd(product, redisConn)
+	sendSimilarityIndexAdd(product, redisConn)
+	sendTagIndexAdd(product, redisConn)
+	sendTranslationIndexAdd(product.Id, translations, redisConn)
+}
+
+func sendListingIndexRemove(product *Product, translations map[string]Translation, redisConn redis.Conn) {
+	if !product.isPublished() {
+		_ = redisConn.Send("ZREM", getProductsByStatusKeyName(product.Status), product.Id)
+		return
+	}
+	_ = redisConn.Send("ZREM", config.KeyAllProducts, product.getLexName())
+	_ = redisConn.Send("ZREM", getProductsInCategoryKeyName(product.MainCategoryId), product.getLexName())
+	sendPriceIndexRemove(product, redisConn)
+	sendSimilarityIndexRemove(product, redisConn)
+	sendTagIndexRemove(product, redisConn)
+	sendTranslationIndexRemove(product.Id, translations, redisConn)
+}
+
+// Keeps the due times of the product's schedule in sync with its status
+func sendPublishingScheduleUpdate(product *Product, redisConn redis.Conn) {
+	if product.Status == ProductDraft && product.PublishAt > 0 {
+		_ = redisConn.Send("ZADD", config.KeyPublishSchedule, product.PublishAt, product.Id)
+	} else {
+		_ = redisConn.Send("ZREM", config.KeyPublishSchedule, product.Id)
+	}
+	if product.Status != ProductArchived && product.UnpublishAt > 0 {
+		_ = redisConn.Send("ZADD", config.KeyUnpublishSchedule, product.UnpublishAt, product.Id)
+	} else {
+		_ = redisConn.Send("ZREM", config.KeyUnpublishSchedule, product.Id)
+	}
+}
+
+func sendPublishingScheduleDelete(productId int, redisConn redis.Conn) {
+	_ = redisConn.Send("ZREM", config.KeyPublishSchedule, productId)
+	_ = redisConn.Send("ZREM", config.KeyUnpublishSchedule, productId)
+}
+
+// Drafts or archived products, the most recent first
+func getProductsByStatus(status string, page int, categories map[int]Category, redisConn redis.Conn) ([]Product, error) {
+	fromPosition := (page - 1) * config.ResultsPerPage
+	toPosition := fromPosition + config.ResultsPerPage - 1
+
+	productIds, err := redis.Ints(redisConn.Do("ZREVRANGE", getProductsByStatusKeyName(status), fromPosition, toPosition))
+	if err != nil {
+		return make([]Product, 0), err
+	}
+	return getProductsByIds(productIds, categories, redisConn)
+}
+
+// Publishes the drafts and archives the products whose scheduled time has come.
+// Returns the number of products that changed status.
+func applyDueSchedules(now time.Time, redisConn redis.Conn) (int, error) {
+	changed := 0
+	schedules := []struct {
+		key    string
+		status string
+		isDue  func(product *Product) bool
+	}{
+		{config.KeyPublishSchedule, ProductPublished, func(product *Product) bool {
+			return product.Status == ProductDraft && product.PublishAt > 0 && product.PublishAt <= now.Unix()
+		}},
+		{config.KeyUnpublishSchedule, ProductArchived, func(product *Product) bool {
+			return product.Status != ProductArchived && product.UnpublishAt > 0 && product.UnpublishAt <= now.Unix()
+		}},
+	}
+
+	for _, schedule := range schedules {
+		productIds, err := redis.Ints(redisConn.Do("ZRANGEBYSCORE", schedule.key, "-inf", now.Unix()))
+		if err != nil {
+			return changed, err
+		}
+
+		for _, productId := range productIds {
+			// The product could have been deleted or rescheduled since we read the schedule
+			oldProduct, err := getProductById(productId, redisConn)
+			if err != nil && err != &notFoundError {
+				return changed, err
+			}
+			if err == &notFoundError || !schedule.isDue(&oldProduct) {
+				_, _ = redisConn.Do("ZREM", schedule.key, productId)
+				continue
+			}
+
+			product := oldProduct
+			product.Status = schedule.status
+			err = saveProductChanges(&product, &oldProduct, ProductUpdated, "publishing-scheduler", redisConn)
+			if err != nil {
+				return changed, err
+			}
+			changed++
+		}
+	}
+	return changed, nil
+}
+
+func runPublishingScheduler(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(config.PublishingSweepInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			conn := pool.Get()
+			err := forEachNamespace(conn, func(namespacedConn redis.Conn) error {
+				changed, err := applyDueSchedules(time.Now(), namespacedConn)
+				if err != nil {
+					logger.Error("Unable to apply the publishing schedules", Fields{"error": err, "namespace": getKeyPrefix(namespacedConn)})
+				} else if changed > 0 {
+					logger.Info("Published or archived scheduled products", Fields{"count": changed, "namespace": getKeyPrefix(namespacedConn)})
+				}
+				// One tenant's failure shouldn't hold back the others
+				return nil
+			})
+			_ = conn.Close()
+
+			if err != nil {
+				logger.Error("Unable to list the tenants", Fields{"error": err})
+			}
+		}
+	}
+}
+
+// Helper functions
+func getProductsByStatusKeyName(status string) string {
+	return fmt.Sprintf(config.KeyProductsByStatus, status)
+}
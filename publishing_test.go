@@ -0,0 +1,69 @@
+package main
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+	"gotest.tools/assert"
+	"testing"
+	"time"
+)
+
+func TestProduct_setStatusFromInput(t *testing.T) {
+	now := time.Date(2019, 9, 1, 10, 0, 0, 0, time.UTC)
+
+	product := Product{}
+	assert.Equal(t, 0, len(product.setStatusFromInput(nil, now)))
+	assert.Equal(t, ProductPublished, product.Status)
+
+	// Products scheduled to be published later are drafts until then
+	product = Product{PublishAt: now.Unix() + 3600}
+	assert.Equal(t, 0, len(product.setStatusFromInput(nil, now)))
+	assert.Equal(t, ProductDraft, product.Status)
+
+	product = Product{}
+	assert.Equal(t, 0, len(product.setStatusFromInput(&Product{Status: ProductArchived}, now)))
+	assert.Equal(t, ProductArchived, product.Status, "Products should keep their status if none is sent")
+
+	product = Product{Status: "hidden", PublishAt: now.Unix() + 3600, UnpublishAt: now.Unix()}
+	assert.Equal(t, 2, len(product.setStatusFromInput(nil, now)))
+
+	product = Product{Status: ProductPublished, PublishAt: now.Unix() + 3600}
+	assert.Equal(t, 1, len(product.setStatusFromInput(nil, now)))
+}
+
+func TestSendListingIndexAdd_draft(t *testing.T) {
+	conn := redigomock.NewConn()
+	zadd := conn.Command("ZADD", getProductsByStatusKeyName(ProductDraft), "NX", redigomock.NewAnyInt(), 7).Expect(int64(1))
+
+	product := Product{Id: 7, Name: "Rocinante", Status: ProductDraft, Currency: "EUR"}
+	sendListingIndexAdd(&product, nil, conn)
+
+	// Drafts stay out of the public listing indexes, the mock fails on any other command
+	replies, err := redis.Values(conn.Do(""))
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(replies))
+	assert.Equal(t, 1, conn.Stats(zadd))
+}
+
+func TestApplyDueSchedules_skipsStaleEntries(t *testing.T) {
+	now := time.Date(2019, 9, 1, 10, 0, 0, 0, time.UTC)
+
+	conn := redigomock.NewConn()
+	conn.Command("ZRANGEBYSCORE", config.KeyPublishSchedule, "-inf", now.Unix()).Expect([]interface{}{[]byte("7"), []byte("8")})
+	conn.Command("ZRANGEBYSCORE", config.KeyUnpublishSchedule, "-inf", now.Unix()).Expect([]interface{}{})
+	// Product 7 was published by hand since it was scheduled, product 8 was deleted
+	conn.Command("HGETALL", getProductNameById(7)).ExpectMap(map[string]string{
+		"id":         "7",
+		"status":     ProductPublished,
+		"publish_at": "1567332000",
+	})
+	conn.Command("HGETALL", getProductNameById(8)).ExpectMap(map[string]string{})
+	zrem7 := conn.Command("ZREM", config.KeyPublishSchedule, 7).Expect(int64(1))
+	zrem8 := conn.Command("ZREM", config.KeyPublishSchedule, 8).Expect(int64(1))
+
+	changed, err := applyDueSchedules(now, conn)
+	assert.NilError(t, err)
+	assert.Equal(t, 0, changed)
+	assert.Equal(t, 1, conn.Stats(zrem7))
+	assert.Equal(t, 1, conn.Stats(zrem8))
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	RelationAccessory   = "accessory"
+	RelationReplacement = "replacement"
+	RelationSimilar     = "similar"
+)
+
+var relationTypes = []string{RelationAccessory, RelationReplacement, RelationSimilar}
+
+const maxRelatedProducts = 50
+
+// How much every thing two products have in common counts towards their similarity
+const (
+	similarityCategoryWeight = 1
+	similarityVendorWeight   = 2
+	similarityTokenWeight    = 1
+	similarityMinTokenLength = 3
+)
+
+//////////////////////
+// RELATED PRODUCTS
+// Relations are curated per product and stored in a hash keyed by relation type, holding a json list of product ids.
+// The "similar" list is topped up with products that have a lot in common with the product (category, vendor and
+// name tokens). To find them, products are indexed in sets of lex names per vendor and per name token.
+//////////////////////
+type Relations map[string][]int
+
+type RelatedProducts struct {
+	Accessory   []Product `json:"accessory"`
+	Replacement []Product `json:"replacement"`
+	Similar     []Product `json:"similar"` // the curated similar products first, then the computed ones
+}
+
+// Returns a list of validation errors, or an empty list if the relations are valid
+func (relations Relations) validate(productId int, redisConn redis.Conn) []string {
+	errs := make([]string, 0)
+	for relationType, productIds := range relations {
+		if !stringInSlice(relationType, relationTypes) {
+			errs = append(errs, fmt.Sprintf("The relation type %q needs to be one of %s", relationType, strings.Join(relationTypes, ", ")))
+			continue
+		}
+		if len(productIds) > maxRelatedProducts {
+			errs = append(errs, fmt.Sprintf("A product can't have more than %v %s products", maxRelatedProducts, relationType))
+		}
+		seen := make([]int, 0, len(productIds))
+		for _, relatedId := range productIds {
+			if relatedId == productId {
+				errs = append(errs, "A product can't be related to itself")
+			} else if intInSlice(relatedId, seen) {
+				errs = append(errs, fmt.Sprintf("The product %v is listed twice as %s", relatedId, relationType))
+			} else if !productExists(relatedId, redisConn) {
+				errs = append(errs, fmt.Sprintf("The product %v doesn't exist", relatedId))
+			}
+			seen = append(seen, relatedId)
+		}
+	}
+	return errs
+}
+
+func getProductRelations(productId int, redisConn redis.Conn) (Relations, error) {
+	relations := make(Relations)
+	values, err := getHashAsStringMap(getProductRelationsKeyName(productId), redisConn)
+	if err != nil {
+		return relations, err
+	}
+	for relationType, encoded := range values {
+		productIds := make([]int, 0)
+		if err := json.Unmarshal([]byte(encoded), &productIds); err != nil {
+			return relations, err
+		}
+		relations[relationType] = productIds
+	}
+	return relations, nil
+}
+
+// Replaces all the curated relations of the product
+func saveProductRelations(productId int, relations Relations, redisConn redis.Conn) error {
+	_, err := redisConn.Do("MULTI")
+	if err != nil {
+		return err
+	}
+
+	_ = redisConn.Send("DEL", getProductRelationsKeyName(productId))
+	for relationType, productIds := range relations {
+		if len(productIds) == 0 {
+			continue
+		}
+		encoded, _ := json.Marshal(productIds)
+		_ = redisConn.Send("HSET", getProductRelationsKeyName(productId), relationType, encoded)
+	}
+
+	_, err = redisConn.Do("EXEC")
+	return err
+}
+
+// Loads the curated related products along with the computed similar ones.
+// Products that were deleted or unpublished since they were related to this one are left out.
+func getRelatedProducts(product *Product, categories map[int]Category, redisConn redis.Conn) (RelatedProducts, error) {
+	related := RelatedProducts{
+		Accessory:   make([]Product, 0),
+		Replacement: make([]Product, 0),
+		Similar:     make([]Product, 0),
+	}
+
+	relations, err := getProductRelations(product.Id, redisConn)
+	if err != nil {
+		return related, err
+	}
+
+	exclude := append([]int{product.Id}, relations[RelationSimilar]...)
+	similarIds, err := getSimilarProductIds(product, exclude, config.SimilarProductsLimit, redisConn)
+	if err != nil {
+		return related, err
+	}
+
+	lists := []struct {
+		products   *[]Product
+		productIds []int
+	}{
+		{&related.Accessory, relations[RelationAccessory]},
+		{&related.Replacement, relations[RelationReplacement]},
+		{&related.Similar, append(relations[RelationSimilar], similarIds...)},
+	}
+	for _, list := range lists {
+		products, err := getProductsByIds(list.productIds, categories, redisConn)
+		if err != nil {
+			return related, err
+		}
+		for _, relatedProduct := range products {
+			if relatedProduct.Id != 0 && relatedProduct.DeletedAt == 0 && relatedProduct.isPublished() {
+				*list.products = append(*list.products, relatedProduct)
+			}
+		}
+	}
+	return related, nil
+}
+
+// All the related products in one list, so they can be localised or converted at once
+func (related *RelatedProducts) all() [][]Product {
+	return [][]Product{related.Accessory, related.Replacement, related.Similar}
+}
+
+type similarityCandidate struct {
+	lexName string
+	score   int
+}
+
+// Finds the products that have the most in common with the given product, leaving out the excluded ids.
+// Candidates share the vendor or a name token with the product, or are in the same category.
+func getSimilarProductIds(product *Product, exclude []int, limit int, redisConn redis.Conn) ([]int, error) {
+	productIds := make([]int, 0, limit)
+	if limit <= 0 {
+		return productIds, nil
+	}
+
+	type weightedKey struct {
+		key    string
+		weight int
+	}
+	keys := make([]weightedKey, 0)
+	if product.Vendor != "" {
+		keys = append(keys, weightedKey{getProductsByVendorKeyName(product.Vendor), similarityVendorWeight})
+	}
+	for _, token := range getNameTokens(product.Name) {
+		keys = append(keys, weightedKey{getProductsByTokenKeyName(token), similarityTokenWeight})
+	}
+
+	for _, k := range keys {
+		err := redisConn.Send("SMEMBERS", k.key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// A few products of the category are enough to fill the list if nothing else matches
+	categoryKey := getProductsInCategoryKeyName(product.MainCategoryId)
+	err := redisConn.Send("ZRANGE", categoryKey, 0, limit*2)
+	if err != nil {
+		return nil, err
+	}
+	err = redisConn.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	scores := make(map[string]int)
+	for _, k := range keys {
+		lexNames, err := redis.Strings(redisConn.Receive())
+		if err != nil {
+			return nil, err
+		}
+		for _, lexName := range lexNames {
+			scores[lexName] += k.weight
+		}
+	}
+	categoryLexNames, err := redis.Strings(redisConn.Receive())
+	if err != nil {
+		return nil, err
+	}
+	for _, lexName := range categoryLexNames {
+		if _, ok := scores[lexName]; !ok {
+			scores[lexName] = 0
+		}
+	}
+
+	candidates := make([]similarityCandidate, 0, len(scores))
+	for lexName, score := range scores {
+		if !intInSlice(getIdFromLexName(lexName), exclude) {
+			candidates = append(candidates, similarityCandidate{lexName, score})
+		}
+	}
+
+	// The candidates in the same category get a bonus
+	for _, candidate := range candidates {
+		err := redisConn.Send("ZSCORE", categoryKey, candidate.lexName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = redisConn.Flush()
+	if err != nil {
+		return nil, err
+	}
+	for i := range candidates {
+		score, err := redisConn.Receive()
+		if err != nil {
+			return nil, err
+		}
+		if score != nil {
+			candidates[i].score += similarityCategoryWeight
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].score != candidates[j].score {
+			return candidates[i].score > candidates[j].score
+		}
+		return candidates[i].lexName < candidates[j].lexName
+	})
+	for i := 0; i < len(candidates) && i < limit; i++ {
+		productIds = append(productIds, getIdFromLexName(candidates[i].lexName))
+	}
+	return productIds, nil
+}
+
+// The distinct words of the name the similarity is computed from. Short words (ex. "of") are left out.
+func getNameTokens(name string) []string {
+	tokens := make([]string, 0)
+	words := strings.FieldsFunc(normaliseSearchString(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, word := range words {
+		if len([]rune(word)) >= similarityMinTokenLength && !stringInSlice(word, tokens) {
+			tokens = append(tokens, word)
+		}
+	}
+	return tokens
+}
+
+func getSimilarityIndexKeys(product *Product) []string {
+	keys := make([]string, 0)
+	if product.Vendor != "" {
+		keys = append(keys, getProductsByVendorKeyName(product.Vendor))
+	}
+	for _, token := range getNameTokens(product.Name) {
+		keys = append(keys, getProductsByTokenKeyName(token))
+	}
+	return keys
+}
+
+func sendSimilarityIndexAdd(product *Product, redisConn redis.Conn) {
+	for _, key := range getSimilarityIndexKeys(product) {
+		_ = redisConn.Send("SADD", key, product.getLexName())
+	}
+}
+
+func sendSimilarityIndexRemove(product *Product, redisConn redis.Conn) {
+	for _, key := range getSimilarityIndexKeys(product) {
+		_ = redisConn.Send("SREM", key, product.getLexName())
+	}
+}
+
+// Adds the products created before the similarity index existed to it
+func migrateSimilarityIndex(redisConn redis.Conn) (int, error) {
+	done, err := redis.Bool(redisConn.Do("EXISTS", config.KeySimilarityIndexMigration))
+	if err != nil || done {
+		return 0, err
+	}
+
+	lexNames, err := redis.Strings(redisConn.Do("ZRANGE", config.KeyAllProducts, 0, -1))
+	if err != nil {
+		return 0, err
+	}
+
+	indexed := 0
+	for _, lexName := range lexNames {
+		product := Product{Id: getIdFromLexName(lexName)}
+		values, err := redis.Strings(redisConn.Do("HMGET", product.getKeyName(), "name", "vendor"))
+		if err != nil {
+			return indexed, err
+		}
+		product.Name = values[0]
+		product.Vendor = values[1]
+
+		for _, key := range getSimilarityIndexKeys(&product) {
+			_, err = redisConn.Do("SADD", key, lexName)
+			if err != nil {
+				return indexed, err
+			}
+		}
+		indexed++
+	}
+
+	_, err = redisConn.Do("SET", config.KeySimilarityIndexMigration, 1)
+	return indexed, err
+}
+
+// Helper functions
+func getProductRelationsKeyName(productId int) string {
+	return fmt.Sprintf(config.KeyProductRelations, productId)
+}
+func getProductsByVendorKeyName(vendor string) string {
+	return fmt.Sprintf(config.KeyProductsByVendor, normaliseSearchString(vendor))
+}
+func getProductsByTokenKeyName(token string) string {
+	return fmt.Sprintf(config.KeyProductsByToken, token)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"github.com/rafaeljusto/redigomock"
+	"gotest.tools/assert"
+	"testing"
+)
+
+func TestGetNameTokens(t *testing.T) {
+	assert.DeepEqual(t, []string{"mcrn", "donnager", "battleship"}, getNameTokens("MCRN Donnager, a battleship of MCRN"))
+	assert.Equal(t, 0, len(getNameTokens("A b")))
+}
+
+func TestRelations_validate(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("HMGET", getProductNameById(8), "id", "deleted_at").Expect([]interface{}{[]byte("8"), []byte("0")})
+	conn.Command("HMGET", getProductNameById(9), "id", "deleted_at").Expect([]interface{}{nil, nil})
+
+	assert.Equal(t, 0, len(Relations{RelationAccessory: {8}}.validate(7, conn)))
+
+	errs := Relations{
+		RelationAccessory:   {7, 8, 8},
+		RelationReplacement: {9},
+		"sibling":           {8},
+	}.validate(7, conn)
+	assert.Equal(t, 4, len(errs))
+}
+
+func TestGetSimilarProductIds(t *testing.T) {
+	product := Product{Id: 7, Name: "Rocinante Frigate", Vendor: "MCRN", MainCategoryId: 2}
+	categoryKey := getProductsInCategoryKeyName(2)
+
+	conn := redigomock.NewConn()
+	conn.Command("SMEMBERS", getProductsByVendorKeyName("MCRN")).Expect([]interface{}{
+		[]byte("rocinante frigate::7"), []byte("donnager::3"), []byte("tachi frigate::5"),
+	})
+	conn.Command("SMEMBERS", getProductsByTokenKeyName("rocinante")).Expect([]interface{}{
+		[]byte("rocinante frigate::7"),
+	})
+	conn.Command("SMEMBERS", getProductsByTokenKeyName("frigate")).Expect([]interface{}{
+		[]byte("rocinante frigate::7"), []byte("tachi frigate::5"), []byte("knight frigate::4"),
+	})
+	conn.Command("ZRANGE", categoryKey, 0, 6).Expect([]interface{}{
+		[]byte("agatha king::2"), []byte("donnager::3"),
+	})
+	conn.GenericCommand("ZSCORE").Expect(nil)
+	conn.Command("ZSCORE", categoryKey, "agatha king::2").Expect([]byte("0"))
+	conn.Command("ZSCORE", categoryKey, "donnager::3").Expect([]byte("0"))
+
+	// The vendor counts more than the category or a name token, products with the same score are sorted by name
+	productIds, err := getSimilarProductIds(&product, []int{7}, 3, conn)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []int{3, 5, 2}, productIds)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bugsnag/bugsnag-go"
+	"github.com/labstack/echo"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Everything we know about an error at the moment it happened
+type ErrorReport struct {
+	Err       error
+	RequestId string
+	Method    string
+	Route     string
+	Url       string
+	ProductId string
+	Panic     bool
+}
+
+type ErrorReporter interface {
+	Report(report ErrorReport) error
+}
+
+var errorReporter ErrorReporter = noopReporter{}
+
+// Picks the reporter set in the config. When none is set we use Bugsnag if there's a key, or fall back to logging.
+func newErrorReporter(config Config) (ErrorReporter, error) {
+	name := config.ErrorReporter
+	if name == "" {
+		name = "log"
+		if config.BugsnagKey != "" {
+			name = "bugsnag"
+		}
+	}
+
+	switch name {
+	case "bugsnag":
+		return newBugsnagReporter(config.BugsnagKey), nil
+	case "sentry":
+		return newSentryReporter(config.SentryDsn)
+	case "log":
+		return logReporter{}, nil
+	case "none":
+		return noopReporter{}, nil
+	}
+	return nil, fmt.Errorf("unknown error reporter %q", name)
+}
+
+//////////////////////
+// BUGSNAG
+//////////////////////
+type bugsnagReporter struct{}
+
+func newBugsnagReporter(apiKey string) bugsnagReporter {
+	bugsnag.Configure(bugsnag.Configuration{
+		APIKey: apiKey,
+		// The import paths for the Go packages containing the source files
+		ProjectPackages: []string{"main", "github.com/elena-kolevska/redis-product-catalogue-service"},
+	})
+	return bugsnagReporter{}
+}
+
+func (bugsnagReporter) Report(report ErrorReport) error {
+	// Passing `true` makes bugsnag deliver the report synchronously
+	return bugsnag.Notify(report.Err, true, bugsnag.Context{String: report.Route}, bugsnag.MetaData{
+		"request": {
+			"request_id": report.RequestId,
+			"method":     report.Method,
+			"route":      report.Route,
+			"url":        report.Url,
+			"product_id": report.ProductId,
+			"panic":      report.Panic,
+		},
+	})
+}
+
+//////////////////////
+// SENTRY
+// Sends events to Sentry's store endpoint over plain HTTP.
+// The DSN has the format `https://<public_key>@<host>/<project_id>`
+//////////////////////
+type sentryReporter struct {
+	endpoint  string
+	publicKey string
+	client    *http.Client
+}
+
+func newSentryReporter(dsn string) (*sentryReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil || u.User == nil || u.Host == "" {
+		return nil, errors.New("the sentry_dsn setting needs to have the format https://<public_key>@<host>/<project_id>")
+	}
+	projectId := strings.Trim(u.Path, "/")
+
+	return &sentryReporter{
+		endpoint:  fmt.Sprintf("%s://%s/api/%s/store/", u.Scheme, u.Host, projectId),
+		publicKey: u.User.Username(),
+		client:    &http.Client{Timeout: 5 * time.Second},
+	}, nil
+}
+
+func (reporter *sentryReporter) Report(report ErrorReport) error {
+	event := map[string]interface{}{
+		"event_id":    generateRequestId(),
+		"timestamp":   time.Now().UTC().Format("2006-01-02T15:04:05"),
+		"level":       "error",
+		"platform":    "go",
+		"message":     report.Err.Error(),
+		"transaction": report.Route,
+		"exception": []map[string]string{{
+			"type":  fmt.Sprintf("%T", report.Err),
+			"value": report.Err.Error(),
+		}},
+		"request": map[string]string{
+			"method": report.Method,
+			"url":    report.Url,
+		},
+		"tags": map[string]string{
+			"request_id": report.RequestId,
+			"route":      report.Route,
+			"product_id": report.ProductId,
+			"panic":      fmt.Sprintf("%v", report.Panic),
+		},
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, reporter.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", fmt.Sprintf("Sentry sentry_version=7, sentry_client=product-catalogue/1.0, sentry_key=%s", reporter.publicKey))
+
+	res, err := reporter.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("sentry responded with status %d", res.StatusCode)
+	}
+	return nil
+}
+
+//////////////////////
+// LOG ONLY AND NO-OP
+//////////////////////
+type logReporter struct{}
+
+func (logReporter) Report(report ErrorReport) error {
+	logger.Error("Error report", Fields{
+		"error":      report.Err,
+		"request_id": report.RequestId,
+		"method":     report.Method,
+		"route":      report.Route,
+		"product_id": report.ProductId,
+		"panic":      report.Panic,
+	})
+	return nil
+}
+
+type noopReporter struct{}
+
+func (noopReporter) Report(report ErrorReport) error {
+	return nil
+}
+
+//////////////////////
+// DELIVERY
+//////////////////////
+
+// Error reports are sent in the background so they don't slow down the response,
+// but we keep track of them so they can be flushed before the process exits
+var pendingReports sync.WaitGroup
+
+func reportError(report ErrorReport) {
+	reporter := errorReporter
+	pendingReports.Add(1)
+	go func() {
+		defer pendingReports.Done()
+		if err := reporter.Report(report); err != nil {
+			logger.Error("Unable to deliver error report", Fields{"error": err, "request_id": report.RequestId})
+		}
+	}()
+}
+
+// Collects the request details for an error report
+func newErrorReport(c echo.Context, err error) ErrorReport {
+	report := ErrorReport{
+		Err:       err,
+		RequestId: getRequestId(c),
+		Method:    c.Request().Method,
+		Route:     c.Path(),
+		Url:       c.Request().RequestURI,
+	}
+	if strings.HasPrefix(report.Route, "/api/products/:id") {
+		report.ProductId = c.Param("id")
+	}
+	return report
+}
+
+// Wait for all pending error reports to be delivered, but no longer than `timeout`
+func flushErrorReports(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		pendingReports.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Turns a panic in any handler into a report and the standard server error response
+func recoverMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) (err error) {
+		defer func() {
+			r := recover()
+			if r == nil {
+				return
+			}
+			panicErr, ok := r.(error)
+			if !ok {
+				panicErr = fmt.Errorf("%v", r)
+			}
+
+			report := newErrorReport(c, panicErr)
+			report.Panic = true
+			requestLogger(c).Error("Recovered from panic", Fields{"error": panicErr})
+			reportError(report)
+
+			response := serverError
+			response.RequestId = report.RequestId
+			err = c.JSON(response.HttpStatus, response)
+		}()
+
+		return next(c)
+	}
+}
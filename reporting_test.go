@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/labstack/echo"
+	"gotest.tools/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewErrorReporter(t *testing.T) {
+	testCases := []struct {
+		reporter   string
+		bugsnagKey string
+		want       ErrorReporter
+	}{
+		{"", "", logReporter{}},
+		{"log", "", logReporter{}},
+		{"none", "", noopReporter{}},
+		{"none", "some-key", noopReporter{}},
+	}
+
+	for _, tc := range testCases {
+		c := getDefaultConfiguration()
+		c.ErrorReporter = tc.reporter
+		c.BugsnagKey = tc.bugsnagKey
+
+		got, err := newErrorReporter(c)
+		assert.NilError(t, err)
+		assert.Equal(t, tc.want, got)
+	}
+
+	c := getDefaultConfiguration()
+	c.ErrorReporter = "carrier-pigeon"
+	_, err := newErrorReporter(c)
+	assert.ErrorContains(t, err, "unknown error reporter")
+}
+
+func TestSentryReporter_Report(t *testing.T) {
+	var event map[string]interface{}
+	var authHeader string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/42/store/", r.URL.Path)
+		authHeader = r.Header.Get("X-Sentry-Auth")
+		_ = json.NewDecoder(r.Body).Decode(&event)
+	}))
+	defer server.Close()
+
+	dsn := strings.Replace(server.URL, "http://", "http://public-key@", 1) + "/42"
+	reporter, err := newSentryReporter(dsn)
+	assert.NilError(t, err)
+
+	err = reporter.Report(ErrorReport{
+		Err:       errors.New("boom"),
+		RequestId: "abc",
+		Route:     "/api/products/:id",
+		ProductId: "7",
+	})
+	assert.NilError(t, err)
+
+	assert.Assert(t, strings.Contains(authHeader, "sentry_key=public-key"))
+	assert.Equal(t, "boom", event["message"])
+	tags := event["tags"].(map[string]interface{})
+	assert.Equal(t, "abc", tags["request_id"])
+	assert.Equal(t, "7", tags["product_id"])
+}
+
+func TestNewSentryReporter_invalidDsn(t *testing.T) {
+	_, err := newSentryReporter("not a dsn")
+	assert.ErrorContains(t, err, "sentry_dsn")
+}
+
+type recordingReporter struct {
+	reports chan ErrorReport
+}
+
+func (reporter recordingReporter) Report(report ErrorReport) error {
+	reporter.reports <- report
+	return nil
+}
+
+func TestRecoverMiddleware(t *testing.T) {
+	reporter := recordingReporter{reports: make(chan ErrorReport, 1)}
+	errorReporter = reporter
+	defer func() { errorReporter = noopReporter{} }()
+
+	e := echo.New()
+	e.Use(requestIdMiddleware)
+	e.Use(recoverMiddleware)
+	e.GET("/api/products/:id", func(c echo.Context) error {
+		panic("something terrible")
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/products/7", nil)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	var response ApiError
+	assert.NilError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	assert.Equal(t, serverError.Title, response.Title)
+	assert.Equal(t, rec.Header().Get(echo.HeaderXRequestID), response.RequestId)
+
+	select {
+	case report := <-reporter.reports:
+		assert.Assert(t, report.Panic)
+		assert.Equal(t, "7", report.ProductId)
+		assert.Equal(t, "something terrible", report.Err.Error())
+	case <-time.After(time.Second):
+		t.Error("The panic wasn't reported")
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	ReviewPending  = "pending"
+	ReviewApproved = "approved"
+)
+
+var reviewStatuses = []string{ReviewPending, ReviewApproved}
+
+const (
+	minReviewRating      = 1
+	maxReviewRating      = 5
+	maxReviewTitleLength = 200
+	maxReviewBodyLength  = 5000
+)
+
+//////////////////////
+// REVIEW MODEL
+// Reviews are hashes, listed per product and status in sorted sets scored by the creation time.
+// New reviews wait for moderation. Once approved they count towards the rating of the product,
+// which is kept in the product hash as the sum of the ratings and the number of reviews, and in a
+// sorted set of product lex names scored by the average rating, so listings can be filtered and sorted by it.
+//////////////////////
+type Review struct {
+	Id         int    `redis:"id" json:"id"`
+	ProductId  int    `redis:"product_id" json:"product_id"`
+	Author     string `redis:"author" json:"author"`
+	Rating     int    `redis:"rating" json:"rating"`
+	Title      string `redis:"title" json:"title"`
+	Body       string `redis:"body" json:"body"`
+	Status     string `redis:"status" json:"status"`
+	CreatedAt  int64  `redis:"created_at" json:"created_at"`             // unix timestamp
+	ApprovedAt int64  `redis:"approved_at" json:"approved_at,omitempty"` // unix timestamp
+}
+
+type ProductRating struct {
+	Average float64 `json:"average"`
+	Count   int     `json:"count"`
+}
+
+type PaginatedReviewCollection struct {
+	Data           []Review `json:"data"`
+	CurrentPage    int      `json:"current_page"`
+	ResultsPerPage int      `json:"per_page"`
+}
+
+// KEYS: review hash, product hash, rating index, approved reviews, pending reviews.
+// ARGV: product lex name, review id, approval timestamp.
+// Returns 0 if the review isn't pending anymore.
+var approveReviewScript = redis.NewScript(5, `
+local review = redis.call('HMGET', KEYS[1], 'status', 'rating', 'created_at')
+if review[1] ~= 'pending' then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'status', 'approved', 'approved_at', ARGV[3])
+redis.call('ZREM', KEYS[5], ARGV[2])
+redis.call('ZADD', KEYS[4], review[3], ARGV[2])
+local sum = redis.call('HINCRBY', KEYS[2], 'rating_sum', review[2])
+local count = redis.call('HINCRBY', KEYS[2], 'review_count', 1)
+redis.call('ZADD', KEYS[3], sum / count, ARGV[1])
+return 1
+`)
+
+// KEYS: review hash, product hash, rating index, approved reviews, pending reviews.
+// ARGV: product lex name, review id.
+// Returns 0 if there's no such review.
+var deleteReviewScript = redis.NewScript(5, `
+local review = redis.call('HMGET', KEYS[1], 'status', 'rating')
+if not review[1] then
+	return 0
+end
+redis.call('DEL', KEYS[1])
+redis.call('ZREM', KEYS[4], ARGV[2])
+redis.call('ZREM', KEYS[5], ARGV[2])
+if review[1] == 'approved' then
+	local sum = redis.call('HINCRBY', KEYS[2], 'rating_sum', -tonumber(review[2]))
+	local count = redis.call('HINCRBY', KEYS[2], 'review_count', -1)
+	if count > 0 then
+		redis.call('ZADD', KEYS[3], sum / count, ARGV[1])
+	else
+		redis.call('HDEL', KEYS[2], 'rating_sum', 'review_count')
+		redis.call('ZREM', KEYS[3], ARGV[1])
+	end
+end
+return 1
+`)
+
+// KEYS: rating index. ARGV: old lex name, new lex name
+var renameRatingScript = redis.NewScript(1, `
+local score = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if score then
+	redis.call('ZREM', KEYS[1], ARGV[1])
+	redis.call('ZADD', KEYS[1], score, ARGV[2])
+end
+return 1
+`)
+
+// Returns a list of validation errors, or an empty list if the review is valid
+func (review *Review) validate() []string {
+	errs := make([]string, 0)
+	if strings.TrimSpace(review.Author) == "" {
+		errs = append(errs, "The author field is required")
+	}
+	if review.Rating < minReviewRating || review.Rating > maxReviewRating {
+		errs = append(errs, fmt.Sprintf("The rating needs to be between %v and %v", minReviewRating, maxReviewRating))
+	}
+	if len([]rune(review.Title)) > maxReviewTitleLength {
+		errs = append(errs, fmt.Sprintf("The title can't be longer than %v characters", maxReviewTitleLength))
+	}
+	if len([]rune(review.Body)) > maxReviewBodyLength {
+		errs = append(errs, fmt.Sprintf("The review can't be longer than %v characters", maxReviewBodyLength))
+	}
+	return errs
+}
+
+func saveNewReview(review *Review, redisConn redis.Conn) error {
+	id, err := redis.Int(redisConn.Do("INCR", config.KeyReviewCounter))
+	if err != nil {
+		return err
+	}
+	review.Id = id
+	review.Status = ReviewPending
+	review.CreatedAt = time.Now().Unix()
+	review.ApprovedAt = 0
+
+	_, err = redisConn.Do("MULTI")
+	if err != nil {
+		return err
+	}
+	_ = redisConn.Send("HSET", redis.Args{getReviewKeyName(review.Id)}.AddFlat(review)...)
+	_ = redisConn.Send("ZADD", getProductReviewsKeyName(review.ProductId, ReviewPending), review.CreatedAt, review.Id)
+	_, err = redisConn.Do("EXEC")
+	return err
+}
+
+func getReviewById(productId int, reviewId int, redisConn redis.Conn) (Review, error) {
+	review := Review{}
+	values, err := redis.Values(redisConn.Do("HGETALL", getReviewKeyName(reviewId)))
+	if err != nil {
+		return review, err
+	}
+	if len(values) == 0 {
+		return review, &notFoundError
+	}
+	err = redis.ScanStruct(values, &review)
+	if err != nil {
+		return review, err
+	}
+	// Reviews can only be reached through their product
+	if review.ProductId != productId {
+		return Review{}, &notFoundError
+	}
+	return review, nil
+}
+
+// Newest reviews first
+func getProductReviews(productId int, status string, page int, redisConn redis.Conn) ([]Review, error) {
+	reviews := make([]Review, 0)
+
+	fromPosition := (page - 1) * config.ResultsPerPage
+	toPosition := fromPosition + config.ResultsPerPage - 1
+	reviewIds, err := redis.Ints(redisConn.Do("ZREVRANGE", getProductReviewsKeyName(productId, status), fromPosition, toPosition))
+	if err != nil {
+		return reviews, err
+	}
+
+	for _, reviewId := range reviewIds {
+		err := redisConn.Send("HGETALL", getReviewKeyName(reviewId))
+		if err != nil {
+			return reviews, err
+		}
+	}
+	err = redisConn.Flush()
+	if err != nil {
+		return reviews, err
+	}
+	for range reviewIds {
+		values, err := redis.Values(redisConn.Receive())
+		if err != nil {
+			return reviews, err
+		}
+		review := Review{}
+		if err := redis.ScanStruct(values, &review); err != nil {
+			return reviews, err
+		}
+		reviews = append(reviews, review)
+	}
+	return reviews, nil
+}
+
+// Approves a pending review and adds its rating to the product's
+func approveReview(product *Product, review *Review, redisConn redis.Conn) error {
+	approvedAt := time.Now().Unix()
+	approved, err := redis.Int(approveReviewScript.Do(redisConn,
+		getReviewKeyName(review.Id), product.getKeyName(), config.KeyProductsByRating,
+		getProductReviewsKeyName(product.Id, ReviewApproved), getProductReviewsKeyName(product.Id, ReviewPending),
+		product.getLexName(), review.Id, approvedAt,
+	))
+	if err != nil {
+		return err
+	}
+	if approved == 0 {
+		return &ApiError{HttpStatus: 409, Title: "Already approved", Description: "The review has already been approved"}
+	}
+	review.Status = ReviewApproved
+	review.ApprovedAt = approvedAt
+	return nil
+}
+
+// Deletes a review, taking its rating out of the product's if it was approved
+func deleteReview(product *Product, reviewId int, redisConn redis.Conn) error {
+	deleted, err := redis.Int(deleteReviewScript.Do(redisConn,
+		getReviewKeyName(reviewId), product.getKeyName(), config.KeyProductsByRating,
+		getProductReviewsKeyName(product.Id, ReviewApproved), getProductReviewsKeyName(product.Id, ReviewPending),
+		product.getLexName(), reviewId,
+	))
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return &notFoundError
+	}
+	return nil
+}
+
+// Sets the rating from the aggregates kept in the product hash
+func (product *Product) setRating(values []interface{}) error {
+	aggregates := struct {
+		RatingSum   int64 `redis:"rating_sum"`
+		ReviewCount int   `redis:"review_count"`
+	}{}
+	err := redis.ScanStruct(values, &aggregates)
+	if err != nil {
+		return err
+	}
+
+	product.Rating = &ProductRating{Count: aggregates.ReviewCount}
+	if aggregates.ReviewCount > 0 {
+		average := float64(aggregates.RatingSum) / float64(aggregates.ReviewCount)
+		product.Rating.Average = math.Round(average*100) / 100
+	}
+	return nil
+}
+
+// Queues the commands deleting all reviews of a product in the caller's transaction
+func sendProductReviewsDelete(product *Product, reviewIds []int, redisConn redis.Conn) {
+	for _, reviewId := range reviewIds {
+		_ = redisConn.Send("DEL", getReviewKeyName(reviewId))
+	}
+	for _, status := range reviewStatuses {
+		_ = redisConn.Send("DEL", getProductReviewsKeyName(product.Id, status))
+	}
+	_ = redisConn.Send("ZREM", config.KeyProductsByRating, product.getLexName())
+}
+
+func getAllProductReviewIds(productId int, redisConn redis.Conn) ([]int, error) {
+	reviewIds := make([]int, 0)
+	for _, status := range reviewStatuses {
+		ids, err := redis.Ints(redisConn.Do("ZRANGE", getProductReviewsKeyName(productId, status), 0, -1))
+		if err != nil {
+			return reviewIds, err
+		}
+		reviewIds = append(reviewIds, ids...)
+	}
+	return reviewIds, nil
+}
+
+// Returns the listing filter of products with an average rating of at least `minRating`
+func getMinRatingFilter(minRating float64) IndexFilter {
+	return IndexFilter{Ranges: []ScoreRange{
+		{Key: config.KeyProductsByRating, Min: formatScore(minRating), Max: "+inf"},
+	}}
+}
+
+// Copies a listing into a short lived key where the products are sorted by their average rating,
+// the best rated first. Products without reviews come last, sorted by name.
+func sortProductIndexByRating(keyName string, redisConn redis.Conn) (string, error) {
+	destination := getTemporaryKeyName()
+	_, err := redisConn.Do("MULTI")
+	if err != nil {
+		return "", err
+	}
+	// The listing has a score of 0, so the score of its products becomes the negated rating
+	_ = redisConn.Send("ZUNIONSTORE", destination, 2, keyName, config.KeyProductsByRating, "WEIGHTS", 1, -1)
+	// which leaves the rated products that aren't in the listing to be taken out
+	_ = redisConn.Send("ZINTERSTORE", destination, 2, destination, keyName, "WEIGHTS", 1, 0)
+	_ = redisConn.Send("EXPIRE", destination, config.TemporaryKeyTtl)
+	_, err = redisConn.Do("EXEC")
+	if err != nil {
+		return "", err
+	}
+	return destination, nil
+}
+
+// Helper functions
+func getReviewKeyName(reviewId int) string {
+	return fmt.Sprintf(config.KeyReview, reviewId)
+}
+func getProductReviewsKeyName(productId int, status string) string {
+	return fmt.Sprintf(config.KeyProductReviews, productId, status)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"github.com/rafaeljusto/redigomock"
+	"gotest.tools/assert"
+	"testing"
+)
+
+func TestReview_validate(t *testing.T) {
+	review := Review{Author: "Amos", Rating: 5, Body: "She's a good ship"}
+	assert.Equal(t, 0, len(review.validate()))
+
+	review = Review{Author: " ", Rating: 6}
+	assert.Equal(t, 2, len(review.validate()))
+}
+
+func TestProduct_setRating(t *testing.T) {
+	product := Product{}
+	err := product.setRating(stringMapToValues(map[string]string{"rating_sum": "14", "review_count": "3"}))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, &ProductRating{Average: 4.67, Count: 3}, product.Rating)
+
+	err = product.setRating(stringMapToValues(map[string]string{"name": "Rocinante"}))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, &ProductRating{Average: 0, Count: 0}, product.Rating)
+}
+
+func TestSaveNewReview(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("INCR", config.KeyReviewCounter).Expect(int64(12))
+	conn.Command("MULTI").Expect("OK")
+	hset := conn.GenericCommand("HSET").Expect(int64(9))
+	zadd := conn.GenericCommand("ZADD").Expect(int64(1))
+	conn.Command("EXEC").Expect([]interface{}{})
+
+	review := Review{ProductId: 7, Author: "Amos", Rating: 5, Status: ReviewApproved}
+	err := saveNewReview(&review, conn)
+	assert.NilError(t, err)
+
+	assert.Equal(t, 12, review.Id)
+	assert.Equal(t, ReviewPending, review.Status, "New reviews need to be moderated")
+	assert.Equal(t, 1, conn.Stats(hset))
+	assert.Equal(t, 1, conn.Stats(zadd))
+}
+
+func TestApproveReview(t *testing.T) {
+	product := Product{Id: 7, Name: "Rocinante"}
+
+	conn := redigomock.NewConn()
+	conn.GenericCommand("EVALSHA").Expect(int64(1))
+	review := Review{Id: 12, ProductId: 7, Status: ReviewPending}
+	assert.NilError(t, approveReview(&product, &review, conn))
+	assert.Equal(t, ReviewApproved, review.Status)
+	assert.Assert(t, review.ApprovedAt > 0)
+
+	conn = redigomock.NewConn()
+	conn.GenericCommand("EVALSHA").Expect(int64(0))
+	err := approveReview(&product, &Review{Id: 12, ProductId: 7}, conn)
+	assert.ErrorContains(t, err, "already been approved")
+}
+
+func TestGetReviewById_otherProduct(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("HGETALL", getReviewKeyName(12)).ExpectMap(map[string]string{"id": "12", "product_id": "8"})
+
+	_, err := getReviewById(7, 12, conn)
+	assert.Equal(t, err, &notFoundError)
+}
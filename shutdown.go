@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"github.com/labstack/echo"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Background workers get a context that's cancelled when the service shuts down
+var (
+	workersContext, stopWorkers = context.WithCancel(context.Background())
+	workers                     sync.WaitGroup
+)
+
+func startWorker(name string, run func(ctx context.Context)) {
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		logger.Info("Starting background worker", Fields{"worker": name})
+		run(workersContext)
+	}()
+}
+
+func waitForWorkers(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Blocks until the process receives SIGINT or SIGTERM and then shuts everything down in order:
+// stop accepting new requests, wait for in-flight handlers to finish their work and return their
+// connections to the pool, stop the background workers, close the pool and flush the error reports.
+func waitForShutdown(e *echo.Echo) {
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	<-quit
+
+	logger.Info("Shutting down")
+	timeout := time.Duration(config.ShutdownTimeout) * time.Second
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := e.Shutdown(ctx); err != nil {
+		logger.Error("Some requests didn't finish in time", Fields{"error": err})
+	}
+
+	stopWorkers()
+	if !waitForWorkers(timeout) {
+		logger.Error("Some background workers didn't stop in time")
+	}
+
+	_ = redisConn.Close()
+	_ = pool.Close()
+
+	if !flushErrorReports(timeout) {
+		logger.Error("Some error reports couldn't be delivered before exiting")
+	}
+	logger.Info("Shutdown complete")
+}
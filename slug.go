@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const maxSlugLength = 80
+
+//////////////////////
+// PRODUCT SLUGS
+// Every product gets a slug generated from its name, suffixed with a number if the slug is taken (ex. "rocinante-2").
+// The slugs are claimed in a hash of slug -> product id. When a product is renamed its old slugs stay in the hash,
+// so the old URLs can be redirected to the new one. They're only freed when the product is purged.
+//////////////////////
+
+func slugify(name string) string {
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	slug := []rune(strings.Join(words, "-"))
+	if len(slug) > maxSlugLength {
+		slug = slug[:maxSlugLength]
+	}
+	if len(slug) == 0 {
+		return "product"
+	}
+	return strings.TrimSuffix(string(slug), "-")
+}
+
+var slugSuffixPattern = regexp.MustCompile(`^-[0-9]+$`)
+
+// Whether the slug was generated from the name, with or without a collision suffix
+func isSlugOfName(slug string, name string) bool {
+	base := slugify(name)
+	if !strings.HasPrefix(slug, base) {
+		return false
+	}
+	return slug == base || slugSuffixPattern.MatchString(slug[len(base):])
+}
+
+// Gives the product a slug generated from its name, unless its current slug already is one.
+// Called before the product is saved, with the slug the product had until now (or an empty string).
+func (product *Product) updateSlug(currentSlug string, redisConn redis.Conn) error {
+	if currentSlug != "" && isSlugOfName(currentSlug, product.Name) {
+		ownerId, err := getProductIdBySlug(currentSlug, redisConn)
+		if err == nil && ownerId == product.Id {
+			product.Slug = currentSlug
+			return nil
+		}
+	}
+
+	slug, err := claimSlug(slugify(product.Name), product.Id, redisConn)
+	if err != nil {
+		return err
+	}
+	product.Slug = slug
+	return nil
+}
+
+// Claims the first free slug out of "base", "base-2", "base-3"... A slug the product claimed before is reused.
+func claimSlug(base string, productId int, redisConn redis.Conn) (string, error) {
+	for n := 1; ; n++ {
+		slug := base
+		if n > 1 {
+			slug = fmt.Sprintf("%s-%v", base, n)
+		}
+
+		claimed, err := redis.Bool(redisConn.Do("HSETNX", config.KeySlugs, slug, productId))
+		if err != nil {
+			return "", err
+		}
+		if claimed {
+			_, err = redisConn.Do("SADD", getProductSlugsKeyName(productId), slug)
+			return slug, err
+		}
+
+		ownerId, err := redis.Int(redisConn.Do("HGET", config.KeySlugs, slug))
+		if err != nil && err != redis.ErrNil {
+			return "", err
+		}
+		if ownerId == productId {
+			return slug, nil
+		}
+	}
+}
+
+// KEYS[1] is the hash of all slugs, KEYS[2] the set of the product's slugs.
+// Frees the slug in ARGV[1], as long as it still belongs to the product with the id in ARGV[2].
+var releaseSlugScript = redis.NewScript(2, `
+if redis.call('HGET', KEYS[1], ARGV[1]) == ARGV[2] then
+	redis.call('SREM', KEYS[2], ARGV[1])
+	return redis.call('HDEL', KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+// Frees a slug that was claimed for a product that couldn't be saved
+func releaseSlug(slug string, productId int, redisConn redis.Conn) error {
+	_, err := releaseSlugScript.Do(redisConn, config.KeySlugs, getProductSlugsKeyName(productId), slug, productId)
+	return err
+}
+
+func getProductIdBySlug(slug string, redisConn redis.Conn) (int, error) {
+	productId, err := redis.Int(redisConn.Do("HGET", config.KeySlugs, slug))
+	if err == redis.ErrNil {
+		return 0, &notFoundError
+	}
+	return productId, err
+}
+
+// Queues the release of all the slugs of a product that's being purged
+func sendProductSlugsDelete(productId int, slugs []string, redisConn redis.Conn) {
+	if len(slugs) > 0 {
+		_ = redisConn.Send("HDEL", redis.Args{config.KeySlugs}.AddFlat(slugs)...)
+	}
+	_ = redisConn.Send("DEL", getProductSlugsKeyName(productId))
+}
+
+// Gives a slug to the products created before slugs existed, including the ones in the trash
+func migrateProductSlugs(redisConn redis.Conn) (int, error) {
+	done, err := redis.Bool(redisConn.Do("EXISTS", config.KeySlugMigration))
+	if err != nil || done {
+		return 0, err
+	}
+
+	lastId, err := redis.Int(redisConn.Do("GET", config.KeyProductCounter))
+	if err != nil && err != redis.ErrNil {
+		return 0, err
+	}
+
+	migrated := 0
+	for id := 1; id <= lastId; id++ {
+		values, err := redis.Strings(redisConn.Do("HMGET", getProductNameById(id), "id", "name", "slug"))
+		if err != nil {
+			return migrated, err
+		}
+		if values[0] == "" || values[2] != "" {
+			continue
+		}
+
+		product := Product{Id: id, Name: values[1]}
+		err = product.updateSlug("", redisConn)
+		if err != nil {
+			return migrated, err
+		}
+		_, err = redisConn.Do("HSET", product.getKeyName(), "slug", product.Slug)
+		if err != nil {
+			return migrated, err
+		}
+		migrated++
+	}
+
+	_, err = redisConn.Do("SET", config.KeySlugMigration, 1)
+	return migrated, err
+}
+
+// Helper functions
+func getProductSlugsKeyName(productId int) string {
+	return fmt.Sprintf(config.KeyProductSlugs, strconv.Itoa(productId))
+}
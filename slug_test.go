@@ -0,0 +1,73 @@
+package main
+
+import (
+	"github.com/rafaeljusto/redigomock"
+	"gotest.tools/assert"
+	"strings"
+	"testing"
+)
+
+func TestSlugify(t *testing.T) {
+	testCases := []struct {
+		arg  string
+		want string
+	}{
+		{"Rocinante", "rocinante"},
+		{"  MCRN Donnager (Battleship) ", "mcrn-donnager-battleship"},
+		{"Nauvoo / Behemoth -- Medina", "nauvoo-behemoth-medina"},
+		{"Größe 2", "größe-2"},
+		{"!!!", "product"},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.want, slugify(tc.arg))
+	}
+	assert.Equal(t, maxSlugLength, len(slugify(strings.Repeat("a", 100))))
+}
+
+func TestIsSlugOfName(t *testing.T) {
+	assert.Assert(t, isSlugOfName("rocinante", "Rocinante"))
+	assert.Assert(t, isSlugOfName("rocinante-3", "Rocinante"))
+	assert.Assert(t, !isSlugOfName("rocinante-ii", "Rocinante"))
+	assert.Assert(t, !isSlugOfName("tachi", "Rocinante"))
+	assert.Assert(t, !isSlugOfName("rocinante-", "Rocinante"))
+}
+
+func TestClaimSlug(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("HSETNX", config.KeySlugs, "rocinante", 7).Expect(int64(0))
+	conn.Command("HGET", config.KeySlugs, "rocinante").Expect([]byte("3"))
+	conn.Command("HSETNX", config.KeySlugs, "rocinante-2", 7).Expect(int64(1))
+	sadd := conn.Command("SADD", getProductSlugsKeyName(7), "rocinante-2").Expect(int64(1))
+
+	slug, err := claimSlug("rocinante", 7, conn)
+	assert.NilError(t, err)
+	assert.Equal(t, "rocinante-2", slug)
+	assert.Equal(t, 1, conn.Stats(sadd))
+}
+
+func TestReleaseSlug(t *testing.T) {
+	conn := redigomock.NewConn()
+	release := conn.Command("EVALSHA", releaseSlugScript.Hash(), 2, config.KeySlugs, getProductSlugsKeyName(7), "rocinante-2", 7).
+		Expect(int64(1))
+
+	assert.NilError(t, releaseSlug("rocinante-2", 7, conn))
+	assert.Equal(t, 1, conn.Stats(release))
+}
+
+func TestProduct_updateSlug(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("HGET", config.KeySlugs, "rocinante-2").Expect([]byte("7"))
+
+	// The slug is kept as long as the name doesn't change
+	product := Product{Id: 7, Name: "Rocinante"}
+	assert.NilError(t, product.updateSlug("rocinante-2", conn))
+	assert.Equal(t, "rocinante-2", product.Slug)
+
+	// A renamed product claims a new slug (or one it had before)
+	conn.Command("HSETNX", config.KeySlugs, "tachi", 7).Expect(int64(0))
+	conn.Command("HGET", config.KeySlugs, "tachi").Expect([]byte("7"))
+	product = Product{Id: 7, Name: "Tachi"}
+	assert.NilError(t, product.updateSlug("rocinante-2", conn))
+	assert.Equal(t, "tachi", product.Slug)
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"github.com/labstack/echo"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//////////////////////
+// LIVE EVENTS
+// Every event transaction also PUBLISHes a notification. Each instance runs one hub that listens
+// for those notifications, reads the new entries from the event stream and fans them out to
+// the SSE connections it holds. Reading from the stream (instead of sending the events through
+// Pub/Sub) gives us the stream ids, which clients use to resume with `Last-Event-ID`.
+// Every tenant has its own stream, so clients only get the events of their tenant's namespace.
+//////////////////////
+type EventHub struct {
+	mu          sync.Mutex
+	subscribers map[chan CatalogueEvent]string // the namespace of every subscriber
+	lastIds     map[string]string              // the last id we've broadcast from the stream of every namespace
+	closed      bool
+}
+
+var eventHub = newEventHub()
+
+// Missed events are read from the stream in pages of this size
+const eventsPageSize = 1000
+
+// How many product categories a stream's filter remembers
+const eventFilterCacheSize = 1000
+
+func newEventHub() *EventHub {
+	return &EventHub{subscribers: make(map[chan CatalogueEvent]string), lastIds: make(map[string]string)}
+}
+
+func (hub *EventHub) subscribe(namespace string) chan CatalogueEvent {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	ch := make(chan CatalogueEvent, 100)
+	if hub.closed {
+		close(ch)
+		return ch
+	}
+	hub.subscribers[ch] = namespace
+	return ch
+}
+
+func (hub *EventHub) unsubscribe(ch chan CatalogueEvent) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	if _, ok := hub.subscribers[ch]; ok {
+		delete(hub.subscribers, ch)
+		close(ch)
+	}
+}
+
+func (hub *EventHub) broadcast(namespace string, event CatalogueEvent) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	for ch, subscriberNamespace := range hub.subscribers {
+		if subscriberNamespace != namespace {
+			continue
+		}
+		select {
+		case ch <- event:
+		default:
+			// The client can't keep up. Disconnect it, it will resume from its last event id.
+			delete(hub.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Disconnects all clients, so the web server doesn't wait for them when shutting down
+func (hub *EventHub) close() {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	hub.closed = true
+	for ch := range hub.subscribers {
+		delete(hub.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Reads all stream entries of the connection's namespace after the last one we've broadcast.
+// The streams of tenants provisioned after we've subscribed are read from the start.
+func (hub *EventHub) fetchNewEvents(redisConn redis.Conn) error {
+	namespace := getKeyPrefix(redisConn)
+	lastId, ok := hub.lastIds[namespace]
+	if !ok {
+		lastId = "0-0"
+	}
+	for {
+		events, err := getEventsAfter(lastId, eventsPageSize, redisConn)
+		if err != nil {
+			return err
+		}
+		for _, event := range events {
+			hub.broadcast(namespace, event)
+			hub.lastIds[namespace] = event.Id
+			lastId = event.Id
+		}
+		if len(events) < eventsPageSize {
+			return nil
+		}
+	}
+}
+
+func runEventHub(ctx context.Context) {
+	runSubscriber(ctx, config.EventsChannel, func() error {
+		conn := pool.Get()
+		defer conn.Close()
+
+		// Start from the end of the streams. Clients that have missed events catch up on their own.
+		return forEachNamespace(conn, func(namespacedConn redis.Conn) error {
+			namespace := getKeyPrefix(namespacedConn)
+			if _, ok := eventHub.lastIds[namespace]; ok {
+				return nil
+			}
+			lastId, err := getLastEventId(namespacedConn)
+			if err != nil {
+				return err
+			}
+			eventHub.lastIds[namespace] = lastId
+			return nil
+		})
+	}, func(message redis.Message) error {
+		conn := pool.Get()
+		defer conn.Close()
+		return eventHub.fetchNewEvents(namespaceConn(conn, getChannelNamespace(message, config.EventsChannel)))
+	})
+}
+
+func getLastEventId(redisConn redis.Conn) (string, error) {
+	entries, err := redis.Values(redisConn.Do("XREVRANGE", config.KeyEventStream, "+", "-", "COUNT", 1))
+	if err != nil {
+		return "", err
+	}
+	if len(entries) == 0 {
+		return "0-0", nil
+	}
+	entry, err := redis.Values(entries[0], nil)
+	if err != nil {
+		return "", err
+	}
+	return redis.String(entry[0], nil)
+}
+
+func getEventsAfter(lastId string, count int, redisConn redis.Conn) ([]CatalogueEvent, error) {
+	events := make([]CatalogueEvent, 0)
+	entries, err := redis.Values(redisConn.Do("XRANGE", config.KeyEventStream, nextStreamId(lastId), "+", "COUNT", count))
+	if err != nil {
+		return events, err
+	}
+	for _, entry := range entries {
+		entryValues, err := redis.Values(entry, nil)
+		if err != nil {
+			return events, err
+		}
+		event, err := parseStreamEntry(entryValues)
+		if err != nil {
+			return events, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// Stream ids have the format <milliseconds>-<sequence>. XRANGE is inclusive, so to read
+// everything after an id we start from the id that immediately follows it.
+func nextStreamId(id string) string {
+	ms, seq := parseStreamId(id)
+	return fmt.Sprintf("%d-%d", ms, seq+1)
+}
+
+func parseStreamId(id string) (uint64, uint64) {
+	parts := strings.SplitN(id, "-", 2)
+	ms, _ := strconv.ParseUint(parts[0], 10, 64)
+	var seq uint64
+	if len(parts) == 2 {
+		seq, _ = strconv.ParseUint(parts[1], 10, 64)
+	}
+	return ms, seq
+}
+
+func streamIdAfter(id string, other string) bool {
+	ms, seq := parseStreamId(id)
+	otherMs, otherSeq := parseStreamId(other)
+	return ms > otherMs || (ms == otherMs && seq > otherSeq)
+}
+
+//////////////////////
+// FILTERS
+//////////////////////
+type EventFilter struct {
+	ProductId  int
+	CategoryId int
+
+	// Image events don't carry the category, so we look it up (once per product, until the cache fills up)
+	productCategories map[int]int
+}
+
+func (filter *EventFilter) matches(event CatalogueEvent, redisConn redis.Conn) bool {
+	if filter.ProductId != 0 && event.ProductId != filter.ProductId {
+		return false
+	}
+	if filter.CategoryId == 0 {
+		return true
+	}
+
+	categoryId := event.CategoryId
+	if categoryId == 0 {
+		var ok bool
+		categoryId, ok = filter.productCategories[event.ProductId]
+		if !ok {
+			categoryId, _ = redis.Int(redisConn.Do("HGET", getProductNameById(event.ProductId), "main_category_id"))
+			// Streams can stay open for days, so the cache starts over instead of growing with every product
+			if len(filter.productCategories) >= eventFilterCacheSize {
+				filter.productCategories = make(map[int]int)
+			}
+			filter.productCategories[event.ProductId] = categoryId
+		}
+	}
+	return categoryId == filter.CategoryId
+}
+
+func eventsStream(c echo.Context) error {
+	filter := EventFilter{productCategories: make(map[int]int)}
+	filter.ProductId, _ = strconv.Atoi(c.QueryParam("product_id"))
+	filter.CategoryId, _ = strconv.Atoi(c.QueryParam("main_category_id"))
+
+	// Browsers send the header when reconnecting. The query parameter is for the first connection.
+	lastEventId := c.Request().Header.Get("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = c.QueryParam("last_event_id")
+	}
+
+	conn := getRedisConn(c)
+
+	// Subscribe before catching up, so no event falls through the gap
+	events := eventHub.subscribe(getKeyPrefix(conn))
+	defer eventHub.unsubscribe(events)
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("Connection", "keep-alive")
+	res.WriteHeader(http.StatusOK)
+	res.Flush()
+
+	// Catch up page by page, until a page isn't full
+	for lastEventId != "" {
+		missed, err := getEventsAfter(lastEventId, eventsPageSize, conn)
+		if err != nil {
+			requestLogger(c).Error("Unable to read missed events", Fields{"error": err})
+		}
+		for _, event := range missed {
+			if filter.matches(event, conn) {
+				writeServerSentEvent(res, event)
+			}
+			lastEventId = event.Id
+		}
+		if err != nil || len(missed) < eventsPageSize {
+			break
+		}
+	}
+
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case <-keepAlive.C:
+			_, _ = fmt.Fprint(res, ": keep-alive\n\n")
+			res.Flush()
+		case event, ok := <-events:
+			if !ok {
+				return nil
+			}
+			// Skip events we've already sent while catching up
+			if lastEventId != "" && !streamIdAfter(event.Id, lastEventId) {
+				continue
+			}
+			if filter.matches(event, conn) {
+				writeServerSentEvent(res, event)
+			}
+		}
+	}
+}
+
+func writeServerSentEvent(res *echo.Response, event CatalogueEvent) {
+	data, _ := json.Marshal(event)
+	_, _ = fmt.Fprintf(res, "id: %s\nevent: %s\ndata: %s\n\n", event.Id, event.Type, data)
+	res.Flush()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"github.com/labstack/echo"
+	"github.com/rafaeljusto/redigomock"
+	"gotest.tools/assert"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNextStreamId(t *testing.T) {
+	assert.Equal(t, "1567332000000-1", nextStreamId("1567332000000-0"))
+	assert.Equal(t, "0-1", nextStreamId("0-0"))
+	assert.Equal(t, "1567332000000-1", nextStreamId("1567332000000"))
+}
+
+func TestStreamIdAfter(t *testing.T) {
+	assert.Assert(t, streamIdAfter("1567332000000-1", "1567332000000-0"))
+	assert.Assert(t, streamIdAfter("1567332000001-0", "1567332000000-5"))
+	assert.Assert(t, !streamIdAfter("1567332000000-0", "1567332000000-0"))
+	// Sequences need to be compared as numbers, not strings
+	assert.Assert(t, streamIdAfter("1567332000000-10", "1567332000000-9"))
+}
+
+func TestEventHub_disconnectsSlowSubscribers(t *testing.T) {
+	hub := newEventHub()
+	slow := hub.subscribe("")
+
+	for i := 0; i <= cap(slow); i++ {
+		hub.broadcast("", CatalogueEvent{Type: EventProductCreated})
+	}
+
+	// The buffered events can still be read, and then the channel is closed
+	received := 0
+	for range slow {
+		received++
+	}
+	assert.Equal(t, cap(slow), received)
+	assert.Equal(t, 0, len(hub.subscribers))
+}
+
+func TestEventHub_broadcastsToTheNamespace(t *testing.T) {
+	hub := newEventHub()
+	acme := hub.subscribe("tenant:acme:")
+	other := hub.subscribe("")
+
+	hub.broadcast("tenant:acme:", CatalogueEvent{Type: EventProductCreated})
+	assert.Equal(t, 1, len(acme))
+	assert.Equal(t, 0, len(other), "Clients shouldn't get the events of other tenants")
+}
+
+func TestEventHub_fetchNewEventsPages(t *testing.T) {
+	entry := func(id string) interface{} {
+		return []interface{}{[]byte(id), []interface{}{[]byte("type"), []byte(EventProductUpdated)}}
+	}
+	page := make([]interface{}, 0, eventsPageSize)
+	for i := 1; i <= eventsPageSize; i++ {
+		page = append(page, entry(fmt.Sprintf("%d-0", i)))
+	}
+
+	conn := redigomock.NewConn()
+	conn.Command("XRANGE", config.KeyEventStream, "0-1", "+", "COUNT", eventsPageSize).Expect(page)
+	last := conn.Command("XRANGE", config.KeyEventStream, fmt.Sprintf("%d-1", eventsPageSize), "+", "COUNT", eventsPageSize).
+		Expect([]interface{}{entry("2000-0")})
+
+	hub := newEventHub()
+	assert.NilError(t, hub.fetchNewEvents(conn))
+
+	// A full page means there could be more, so the next one is read
+	assert.Equal(t, 1, conn.Stats(last))
+	assert.Equal(t, "2000-0", hub.lastIds[""])
+}
+
+func TestEventHub_close(t *testing.T) {
+	hub := newEventHub()
+	ch := hub.subscribe("")
+	hub.close()
+
+	_, ok := <-ch
+	assert.Assert(t, !ok)
+
+	// Nobody can subscribe after the hub is closed
+	_, ok = <-hub.subscribe("")
+	assert.Assert(t, !ok)
+}
+
+func TestEventFilter_matches(t *testing.T) {
+	conn := redigomock.NewConn()
+	lookup := conn.Command("HGET", getProductNameById(8), "main_category_id").Expect([]byte("2"))
+
+	filter := EventFilter{CategoryId: 2, productCategories: make(map[int]int)}
+	assert.Assert(t, filter.matches(CatalogueEvent{ProductId: 7, CategoryId: 2}, conn))
+	assert.Assert(t, !filter.matches(CatalogueEvent{ProductId: 7, CategoryId: 3}, conn))
+
+	// Image events don't have a category, so it's looked up once per product
+	assert.Assert(t, filter.matches(CatalogueEvent{Type: EventImageAdded, ProductId: 8}, conn))
+	assert.Assert(t, filter.matches(CatalogueEvent{Type: EventImageDeleted, ProductId: 8}, conn))
+	assert.Equal(t, 1, conn.Stats(lookup))
+
+	// The cache starts over once it's full
+	conn.GenericCommand("HGET").Expect([]byte("3"))
+	for id := 100; id < 100+eventFilterCacheSize; id++ {
+		filter.matches(CatalogueEvent{Type: EventImageAdded, ProductId: id}, conn)
+	}
+	assert.Equal(t, 1, len(filter.productCategories))
+
+	filter = EventFilter{ProductId: 7}
+	assert.Assert(t, filter.matches(CatalogueEvent{ProductId: 7}, conn))
+	assert.Assert(t, !filter.matches(CatalogueEvent{ProductId: 8}, conn))
+}
+
+func TestWriteServerSentEvent(t *testing.T) {
+	rec := httptest.NewRecorder()
+	res := echo.NewResponse(rec, echo.New())
+
+	writeServerSentEvent(res, CatalogueEvent{Id: "1567332000000-0", Type: EventImageAdded, ProductId: 7, ImageId: 3})
+
+	assert.Equal(t, "id: 1567332000000-0\nevent: image.added\n"+
+		`data: {"id":"1567332000000-0","type":"image.added","product_id":7,"image_id":3,"timestamp":"0001-01-01T00:00:00Z"}`+"\n\n",
+		rec.Body.String())
+}
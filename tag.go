@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"sort"
+	"strings"
+)
+
+const (
+	TagsMatchAll = "all"
+	TagsMatchAny = "any"
+)
+
+const (
+	maxTagsPerProduct = 20
+	maxTagLength      = 50
+)
+
+//////////////////////
+// TAGS
+// Tags are free-form labels (ex. "limited edition") stored in the product hash as a comma separated list.
+// Every tag has a set of the lex names of its products, so listings can be filtered by intersecting them,
+// and all tags ever used are kept in a set, so they can be listed with their product counts.
+//////////////////////
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+func normaliseTag(tag string) string {
+	return strings.Join(strings.Fields(strings.ToLower(tag)), " ")
+}
+
+// Normalises the tags sent by the API consumer, returning a list of validation errors
+func (product *Product) setTagsFromInput() []string {
+	errs := make([]string, 0)
+	tags := make([]string, 0, len(product.Tags))
+	for _, tag := range product.Tags {
+		tag = normaliseTag(tag)
+		switch {
+		case tag == "":
+			errs = append(errs, "Tags can't be empty")
+		case strings.Contains(tag, ","):
+			errs = append(errs, fmt.Sprintf("The tag %q can't contain commas", tag))
+		case len([]rune(tag)) > maxTagLength:
+			errs = append(errs, fmt.Sprintf("The tag %q is longer than %v characters", tag, maxTagLength))
+		case !stringInSlice(tag, tags):
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > maxTagsPerProduct {
+		errs = append(errs, fmt.Sprintf("A product can't have more than %v tags", maxTagsPerProduct))
+	}
+
+	product.Tags = tags
+	product.TagsList = strings.Join(tags, ",")
+	return errs
+}
+
+func (product *Product) setTags() {
+	product.Tags = make([]string, 0)
+	if product.TagsList != "" {
+		product.Tags = strings.Split(product.TagsList, ",")
+	}
+}
+
+func sendTagIndexAdd(product *Product, redisConn redis.Conn) {
+	for _, tag := range product.Tags {
+		_ = redisConn.Send("SADD", getProductsByTagKeyName(tag), product.getLexName())
+		_ = redisConn.Send("SADD", config.KeyTags, tag)
+	}
+}
+
+// The tags stay in the set of all tags, they're cleared out once they have no products (see `getTagCounts`)
+func sendTagIndexRemove(product *Product, redisConn redis.Conn) {
+	for _, tag := range product.Tags {
+		_ = redisConn.Send("SREM", getProductsByTagKeyName(tag), product.getLexName())
+	}
+}
+
+// Builds the listing filter of the `tags=` query parameter (a comma separated list).
+// The products need to have all the tags, or any of them if `match` is "any". Invalid filters return an ApiError.
+func getTagFilter(tagsParam string, match string, redisConn redis.Conn) (IndexFilter, error) {
+	keys := redis.Args{}
+	for _, tag := range strings.Split(tagsParam, ",") {
+		tag = normaliseTag(tag)
+		if tag != "" {
+			keys = keys.Add(getProductsByTagKeyName(tag))
+		}
+	}
+	if len(keys) == 0 {
+		return IndexFilter{}, &ApiError{HttpStatus: 422, Title: "Invalid tag filter", Description: "At least one tag is needed"}
+	}
+	if match != TagsMatchAll && match != TagsMatchAny {
+		return IndexFilter{}, &ApiError{HttpStatus: 422, Title: "Invalid tag filter", Description: fmt.Sprintf("The tags can match %s or %s", TagsMatchAll, TagsMatchAny)}
+	}
+	if len(keys) == 1 {
+		return IndexFilter{Key: keys[0].(string)}, nil
+	}
+
+	command := "SINTERSTORE"
+	if match == TagsMatchAny {
+		command = "SUNIONSTORE"
+	}
+	destination := getTemporaryKeyName()
+	_, err := redisConn.Do("MULTI")
+	if err != nil {
+		return IndexFilter{}, err
+	}
+	_ = redisConn.Send(command, redis.Args{destination}.Add(keys...)...)
+	_ = redisConn.Send("EXPIRE", destination, config.TemporaryKeyTtl)
+	_, err = redisConn.Do("EXEC")
+	if err != nil {
+		return IndexFilter{}, err
+	}
+	return IndexFilter{Key: destination}, nil
+}
+
+// Counts the products of every tag, the most used tags first. Tags without products are cleared out.
+func getTagCounts(redisConn redis.Conn) ([]TagCount, error) {
+	counts := make([]TagCount, 0)
+	tags, err := redis.Strings(redisConn.Do("SMEMBERS", config.KeyTags))
+	if err != nil {
+		return counts, err
+	}
+
+	for _, tag := range tags {
+		err := redisConn.Send("SCARD", getProductsByTagKeyName(tag))
+		if err != nil {
+			return counts, err
+		}
+	}
+	err = redisConn.Flush()
+	if err != nil {
+		return counts, err
+	}
+	unused := make([]string, 0)
+	for _, tag := range tags {
+		count, err := redis.Int(redisConn.Receive())
+		if err != nil {
+			return counts, err
+		}
+		if count == 0 {
+			unused = append(unused, tag)
+			continue
+		}
+		counts = append(counts, TagCount{Tag: tag, Count: count})
+	}
+
+	// A product could have been tagged since we counted, so we only remove the tags that are still unused
+	for _, tag := range unused {
+		_, err = removeUnusedTagScript.Do(redisConn, config.KeyTags, getProductsByTagKeyName(tag), tag)
+		if err != nil {
+			return counts, err
+		}
+	}
+
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Tag < counts[j].Tag
+	})
+	return counts, nil
+}
+
+// KEYS[1] is the set of all tags, KEYS[2] the set of products of the tag in ARGV[1]
+var removeUnusedTagScript = redis.NewScript(2, `
+if redis.call('SCARD', KEYS[2]) == 0 then
+	return redis.call('SREM', KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+// Helper functions
+func getProductsByTagKeyName(tag string) string {
+	return fmt.Sprintf(config.KeyProductsByTag, tag)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"github.com/rafaeljusto/redigomock"
+	"gotest.tools/assert"
+	"strings"
+	"testing"
+)
+
+func TestProduct_setTagsFromInput(t *testing.T) {
+	product := Product{Tags: []string{" Limited  Edition", "refurbished", "limited edition"}}
+	assert.Equal(t, 0, len(product.setTagsFromInput()))
+	assert.DeepEqual(t, []string{"limited edition", "refurbished"}, product.Tags)
+	assert.Equal(t, "limited edition,refurbished", product.TagsList)
+
+	product = Product{Tags: []string{"", "a,b", strings.Repeat("x", maxTagLength+1)}}
+	assert.Equal(t, 3, len(product.setTagsFromInput()))
+}
+
+func TestProduct_setTags(t *testing.T) {
+	product := Product{TagsList: "limited edition,refurbished"}
+	product.setTags()
+	assert.DeepEqual(t, []string{"limited edition", "refurbished"}, product.Tags)
+
+	product = Product{}
+	product.setTags()
+	assert.Equal(t, 0, len(product.Tags))
+}
+
+func TestGetTagFilter(t *testing.T) {
+	conn := redigomock.NewConn()
+
+	filter, err := getTagFilter("Refurbished", TagsMatchAll, conn)
+	assert.NilError(t, err)
+	assert.Equal(t, getProductsByTagKeyName("refurbished"), filter.Key)
+
+	conn.Command("MULTI").Expect("OK")
+	union := conn.GenericCommand("SUNIONSTORE").Expect(int64(3))
+	conn.GenericCommand("EXPIRE").Expect(int64(1))
+	conn.Command("EXEC").Expect([]interface{}{})
+
+	filter, err = getTagFilter("refurbished,limited edition", TagsMatchAny, conn)
+	assert.NilError(t, err)
+	assert.Equal(t, 1, conn.Stats(union))
+
+	_, err = getTagFilter("refurbished", "some", conn)
+	assert.ErrorContains(t, err, "The tags can match")
+}
+
+func TestGetTagCounts(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("SMEMBERS", config.KeyTags).Expect([]interface{}{[]byte("refurbished"), []byte("limited edition")})
+	conn.Command("SCARD", getProductsByTagKeyName("refurbished")).Expect(int64(2))
+	conn.Command("SCARD", getProductsByTagKeyName("limited edition")).Expect(int64(5))
+
+	counts, err := getTagCounts(conn)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []TagCount{{"limited edition", 5}, {"refurbished", 2}}, counts)
+}
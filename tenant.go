@@ -0,0 +1,464 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"github.com/labstack/echo"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	TenantFromHeader    = "header"
+	TenantFromSubdomain = "subdomain"
+	TenantFromApiKey    = "api_key"
+)
+
+var tenantResolutions = []string{TenantFromHeader, TenantFromSubdomain, TenantFromApiKey}
+
+const (
+	tenantContextKey      = "tenant"
+	redisConnContextKey   = "redis"
+	tenantDeleteBatchSize = 1000
+)
+
+// Tenant ids end up in subdomains and key names, so they're kept to lower case letters, digits and dashes
+var tenantIdPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+//////////////////////
+// TENANTS
+// One service can host the catalogues of several brands. Every tenant gets its own namespace: all the keys of its
+// catalogue (products, categories, id counters, events...) are prefixed with the tenant's prefix (ex. "tenant:acme:").
+// Requests are resolved to a tenant by the methods listed in the `tenant_resolution` setting, and get a connection
+// that prefixes the keys of every command, so the models don't need to know about tenants at all.
+// Without any resolution methods the service hosts a single catalogue, with the keys as they are.
+// The tenants themselves are kept outside of any namespace.
+//////////////////////
+type Tenant struct {
+	Id        string `redis:"id" json:"id"`
+	Name      string `redis:"name" json:"name"`
+	ApiKey    string `redis:"api_key" json:"api_key,omitempty"`
+	CreatedAt int64  `redis:"created_at" json:"created_at"`
+}
+
+var tenantNotFoundError = ApiError{
+	HttpStatus:  404,
+	Title:       "Unknown tenant",
+	Description: "The request couldn't be matched to a tenant. Please send the X-Tenant-Id or X-Api-Key header, or use the tenant's subdomain.",
+}
+
+// Returns a list of validation errors, or an empty list if the tenant is valid
+func (tenant *Tenant) validate() []string {
+	errs := make([]string, 0)
+	if !tenantIdPattern.MatchString(tenant.Id) {
+		errs = append(errs, "The id needs to be made of lower case letters, digits and dashes (ex. acme-ships), and can't start or end with a dash")
+	}
+	if strings.TrimSpace(tenant.Name) == "" {
+		errs = append(errs, "The name field is required")
+	}
+	return errs
+}
+
+// Registers the tenant and seeds its catalogue. Returns a 409 ApiError if the id is taken.
+func provisionTenant(tenant *Tenant, redisConn redis.Conn) error {
+	added, err := redis.Int(redisConn.Do("SADD", config.KeyTenants, tenant.Id))
+	if err != nil {
+		return err
+	}
+	if added == 0 {
+		return &ApiError{HttpStatus: 409, Title: "Tenant exists", Description: fmt.Sprintf("There already is a tenant with the id %q", tenant.Id)}
+	}
+
+	tenant.CreatedAt = time.Now().Unix()
+	tenant.ApiKey = generateRequestId()
+	_, err = redisConn.Do("MULTI")
+	if err != nil {
+		return err
+	}
+	_ = redisConn.Send("HSET", redis.Args{getTenantKeyName(tenant.Id)}.AddFlat(tenant)...)
+	_ = redisConn.Send("HSET", config.KeyTenantApiKeys, tenant.Id, tenant.ApiKey)
+	_, err = redisConn.Do("EXEC")
+	if err != nil {
+		return err
+	}
+
+	// New catalogues are created in the current format, so they don't need any of the migrations
+	tenantConn := namespaceConn(redisConn, getTenantKeyPrefix(tenant.Id))
+	if err := seedCategories(tenantConn); err != nil {
+		return err
+	}
+	return createWebhookConsumerGroup(tenantConn)
+}
+
+func getTenantById(id string, redisConn redis.Conn) (Tenant, error) {
+	tenant := Tenant{}
+	values, err := redis.Values(redisConn.Do("HGETALL", getTenantKeyName(id)))
+	if err != nil {
+		return tenant, err
+	}
+	if len(values) == 0 {
+		return tenant, &notFoundError
+	}
+	err = redis.ScanStruct(values, &tenant)
+	return tenant, err
+}
+
+// All tenants sorted by id, without their api keys
+func getTenants(redisConn redis.Conn) ([]Tenant, error) {
+	tenants := make([]Tenant, 0)
+	ids, err := redis.Strings(redisConn.Do("SORT", config.KeyTenants, "ALPHA"))
+	if err != nil {
+		return tenants, err
+	}
+	for _, id := range ids {
+		tenant, err := getTenantById(id, redisConn)
+		if err == &notFoundError {
+			continue
+		}
+		if err != nil {
+			return tenants, err
+		}
+		tenant.ApiKey = ""
+		tenants = append(tenants, tenant)
+	}
+	return tenants, nil
+}
+
+func tenantExists(id string, redisConn redis.Conn) (bool, error) {
+	return redis.Bool(redisConn.Do("SISMEMBER", config.KeyTenants, id))
+}
+
+// Deletes the tenant along with all the keys of its catalogue
+func deleteTenant(id string, redisConn redis.Conn) error {
+	removed, err := redis.Int(redisConn.Do("SREM", config.KeyTenants, id))
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return &notFoundError
+	}
+	_, err = redisConn.Do("DEL", getTenantKeyName(id))
+	if err != nil {
+		return err
+	}
+	_, err = redisConn.Do("HDEL", config.KeyTenantApiKeys, id)
+	if err != nil {
+		return err
+	}
+
+	// The tenant can't be resolved anymore, so nothing writes to its keys while we delete them
+	cursor := 0
+	pattern := getTenantKeyPrefix(id) + "*"
+	for {
+		values, err := redis.Values(redisConn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", tenantDeleteBatchSize))
+		if err != nil {
+			return err
+		}
+		cursor, _ = redis.Int(values[0], nil)
+		keys, _ := redis.Strings(values[1], nil)
+		if len(keys) > 0 {
+			_, err = redisConn.Do("DEL", redis.Args{}.AddFlat(keys)...)
+			if err != nil {
+				return err
+			}
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+
+	categoryCache.invalidate(getTenantKeyPrefix(id))
+	return nil
+}
+
+// Finds the tenant of the request with the configured resolution methods, in their order
+func resolveTenant(c echo.Context, redisConn redis.Conn) (string, error) {
+	for _, method := range config.TenantResolution {
+		var id string
+		switch method {
+		case TenantFromHeader:
+			id = c.Request().Header.Get("X-Tenant-Id")
+		case TenantFromSubdomain:
+			id = getSubdomain(c.Request().Host, config.TenantBaseDomain)
+		case TenantFromApiKey:
+			apiKey := c.Request().Header.Get("X-Api-Key")
+			if apiKey == "" {
+				continue
+			}
+			tenantId, err := getTenantIdByApiKey(apiKey, redisConn)
+			if err != nil {
+				return "", err
+			}
+			id = tenantId
+		}
+		if id == "" {
+			continue
+		}
+
+		exists, err := tenantExists(id, redisConn)
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			return id, nil
+		}
+	}
+	return "", &tenantNotFoundError
+}
+
+// API keys are few and rarely change, so we look them up by scanning the hash of tenant id -> key.
+// The comparison is done in constant time, so the keys can't be guessed by timing the requests.
+func getTenantIdByApiKey(apiKey string, redisConn redis.Conn) (string, error) {
+	apiKeys, err := redis.StringMap(redisConn.Do("HGETALL", config.KeyTenantApiKeys))
+	if err != nil {
+		return "", err
+	}
+	for tenantId, key := range apiKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(apiKey)) == 1 {
+			return tenantId, nil
+		}
+	}
+	return "", nil
+}
+
+// Returns "acme" for "acme.catalogue.example.com" if the base domain is "catalogue.example.com"
+func getSubdomain(host string, baseDomain string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	if baseDomain == "" || !strings.HasSuffix(host, "."+baseDomain) {
+		return ""
+	}
+	subdomain := strings.TrimSuffix(host, "."+baseDomain)
+	if strings.Contains(subdomain, ".") {
+		return ""
+	}
+	return subdomain
+}
+
+// Hands every API request a connection of its own: the MULTI/EXEC blocks and pipelines of concurrent requests
+// would interleave on a shared one. On the catalogue endpoints it also resolves the tenant and puts the
+// connection in the tenant's namespace.
+func tenantMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !strings.HasPrefix(c.Path(), "/api/") && c.Path() != "/graphql" {
+			return next(c)
+		}
+
+		conn := pool.Get()
+		defer conn.Close()
+		c.Set(redisConnContextKey, conn)
+
+		if len(config.TenantResolution) == 0 || !isTenantPath(c.Path()) {
+			return next(c)
+		}
+
+		tenantId, err := resolveTenant(c, conn)
+		if err != nil {
+			return errorResponse(c, err)
+		}
+		c.Set(tenantContextKey, tenantId)
+		c.Set(redisConnContextKey, namespaceConn(conn, getTenantKeyPrefix(tenantId)))
+		c.Set(loggerContextKey, requestLogger(c).With(Fields{"tenant": tenantId}))
+		return next(c)
+	}
+}
+
+// The REST and GraphQL endpoints of the catalogue, apart from the tenant provisioning ones
+func isTenantPath(path string) bool {
+	if path == "/graphql" {
+		return true
+	}
+	return strings.HasPrefix(path, "/api/") && !strings.HasPrefix(path, "/api/tenants")
+}
+
+// The tenant provisioning endpoints are only open to the holders of the admin key
+func tenantAdminMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if config.TenantAdminKey == "" {
+			return c.JSON(http.StatusForbidden, ApiError{Title: "Forbidden", Description: "Tenant provisioning isn't enabled on this service"})
+		}
+		adminKey := c.Request().Header.Get("X-Admin-Key")
+		if subtle.ConstantTimeCompare([]byte(adminKey), []byte(config.TenantAdminKey)) != 1 {
+			return c.JSON(http.StatusUnauthorized, ApiError{Title: "Unauthorized", Description: "The X-Admin-Key header is missing or wrong"})
+		}
+		return next(c)
+	}
+}
+
+// The request's own connection, in the namespace of its tenant. Outside of the middleware (ex. in tests)
+// it's the shared connection.
+func getRedisConn(c echo.Context) redis.Conn {
+	if conn, ok := c.Get(redisConnContextKey).(redis.Conn); ok {
+		return conn
+	}
+	return redisConn
+}
+
+// The key prefixes of the default catalogue and of every tenant, for the background workers
+func getNamespaces(redisConn redis.Conn) ([]string, error) {
+	namespaces := []string{""}
+	ids, err := redis.Strings(redisConn.Do("SMEMBERS", config.KeyTenants))
+	if err != nil {
+		return namespaces, err
+	}
+	for _, id := range ids {
+		namespaces = append(namespaces, getTenantKeyPrefix(id))
+	}
+	return namespaces, nil
+}
+
+// Runs `fn` with a connection in every namespace, stopping at the first error
+func forEachNamespace(redisConn redis.Conn, fn func(conn redis.Conn) error) error {
+	namespaces, err := getNamespaces(redisConn)
+	if err != nil {
+		return err
+	}
+	for _, namespace := range namespaces {
+		if err := fn(namespaceConn(redisConn, namespace)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//////////////////////
+// NAMESPACED CONNECTIONS
+//////////////////////
+type namespacedConn struct {
+	redis.Conn
+	prefix string
+}
+
+// Wraps the connection so the keys of every command are prefixed. An empty prefix leaves the connection as it is.
+func namespaceConn(redisConn redis.Conn, prefix string) redis.Conn {
+	if prefix == "" {
+		return redisConn
+	}
+	if conn, ok := redisConn.(namespacedConn); ok {
+		redisConn = conn.Conn
+	}
+	return namespacedConn{Conn: redisConn, prefix: prefix}
+}
+
+// Returns the key prefix of the connection's namespace, an empty string for the default one
+func getKeyPrefix(redisConn redis.Conn) string {
+	if conn, ok := redisConn.(namespacedConn); ok {
+		return conn.prefix
+	}
+	return ""
+}
+
+func (conn namespacedConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	args, err := conn.namespaceArgs(commandName, args)
+	if err != nil {
+		return nil, err
+	}
+	return conn.Conn.Do(commandName, args...)
+}
+
+func (conn namespacedConn) Send(commandName string, args ...interface{}) error {
+	args, err := conn.namespaceArgs(commandName, args)
+	if err != nil {
+		return err
+	}
+	return conn.Conn.Send(commandName, args...)
+}
+
+// The commands whose only key is their first argument
+var singleKeyCommands = toSet(
+	"GET", "SET", "SETNX", "INCR", "INCRBY", "DECR", "EXPIRE", "TTL", "TYPE",
+	"HSET", "HSETNX", "HGET", "HMGET", "HGETALL", "HDEL", "HLEN", "HEXISTS", "HINCRBY", "HKEYS", "HVALS",
+	"LPUSH", "RPUSH", "LPOP", "RPOP", "LRANGE", "LINDEX", "LTRIM", "LLEN", "LREM",
+	"SADD", "SREM", "SMEMBERS", "SISMEMBER", "SCARD",
+	"ZADD", "ZREM", "ZCARD", "ZSCORE", "ZINCRBY", "ZRANK", "ZREVRANK", "ZCOUNT", "ZLEXCOUNT",
+	"ZRANGE", "ZREVRANGE", "ZRANGEBYSCORE", "ZREVRANGEBYSCORE", "ZRANGEBYLEX", "ZREVRANGEBYLEX",
+	"ZREMRANGEBYSCORE", "ZREMRANGEBYRANK",
+	"XADD", "XRANGE", "XREVRANGE", "XACK", "XLEN", "XDEL", "XTRIM", "XPENDING", "XCLAIM",
+	// Pub/Sub channels are namespaced like keys
+	"PUBLISH",
+)
+
+// The commands whose arguments are all keys
+var allKeysCommands = toSet("DEL", "EXISTS", "UNLINK", "WATCH", "MGET", "SINTER", "SUNION", "SINTERSTORE", "SUNIONSTORE", "SDIFFSTORE")
+
+var keylessCommands = toSet("", "MULTI", "EXEC", "DISCARD", "UNWATCH", "PING", "SCRIPT")
+
+// Prefixes the key arguments of the command. Commands we don't know the keys of are refused,
+// so a new command can't read or write another tenant's keys by mistake.
+func (conn namespacedConn) namespaceArgs(commandName string, args []interface{}) ([]interface{}, error) {
+	command := strings.ToUpper(commandName)
+	namespaced := make([]interface{}, len(args))
+	copy(namespaced, args)
+	prefix := func(from int, to int) {
+		for i := from; i < to && i < len(args); i++ {
+			namespaced[i] = conn.prefix + redisArgString(args[i])
+		}
+	}
+
+	switch {
+	case keylessCommands[command]:
+	case singleKeyCommands[command]:
+		prefix(0, 1)
+	case allKeysCommands[command]:
+		prefix(0, len(args))
+	case command == "ZINTERSTORE" || command == "ZUNIONSTORE":
+		// destination numkeys key [key ...]
+		prefix(0, 1)
+		prefix(2, 2+redisArgInt(args, 1))
+	case command == "EVAL" || command == "EVALSHA":
+		// script numkeys key [key ...] arg [arg ...]
+		prefix(2, 2+redisArgInt(args, 1))
+	case command == "XGROUP":
+		// subcommand key ...
+		prefix(1, 2)
+	case command == "XREADGROUP" || command == "XREAD":
+		// ... STREAMS key [key ...] id [id ...]
+		for i, arg := range args {
+			if strings.ToUpper(redisArgString(arg)) == "STREAMS" {
+				prefix(i+1, i+1+(len(args)-i-1)/2)
+				break
+			}
+		}
+	default:
+		return nil, fmt.Errorf("the keys of the %s command can't be namespaced", command)
+	}
+	return namespaced, nil
+}
+
+func redisArgString(arg interface{}) string {
+	if b, ok := arg.([]byte); ok {
+		return string(b)
+	}
+	return fmt.Sprint(arg)
+}
+
+func redisArgInt(args []interface{}, i int) int {
+	if i >= len(args) {
+		return 0
+	}
+	n, _ := strconv.Atoi(redisArgString(args[i]))
+	return n
+}
+
+func toSet(items ...string) map[string]bool {
+	set := make(map[string]bool, len(items))
+	for _, item := range items {
+		set[item] = true
+	}
+	return set
+}
+
+// Helper functions
+func getTenantKeyName(id string) string {
+	return fmt.Sprintf(config.KeyTenant, id)
+}
+func getTenantKeyPrefix(id string) string {
+	return fmt.Sprintf(config.KeyTenantPrefix, id)
+}
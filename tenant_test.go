@@ -0,0 +1,160 @@
+package main
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"github.com/labstack/echo"
+	"github.com/rafaeljusto/redigomock"
+	"gotest.tools/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTenant_validate(t *testing.T) {
+	tenant := Tenant{Id: "acme-ships", Name: "Acme Ships"}
+	assert.Equal(t, 0, len(tenant.validate()))
+
+	tenant = Tenant{Id: "Acme Ships", Name: " "}
+	assert.Equal(t, 2, len(tenant.validate()))
+
+	tenant = Tenant{Id: "acme-", Name: "Acme Ships"}
+	assert.Equal(t, 1, len(tenant.validate()))
+}
+
+func TestNamespacedConn_namespaceArgs(t *testing.T) {
+	conn := namespacedConn{prefix: "tenant:acme:"}
+
+	cases := []struct {
+		command  string
+		args     []interface{}
+		expected []interface{}
+	}{
+		{"HGETALL", []interface{}{"product:7"}, []interface{}{"tenant:acme:product:7"}},
+		{"ZADD", []interface{}{"products", 0, "rocinante:7"}, []interface{}{"tenant:acme:products", 0, "rocinante:7"}},
+		{"DEL", []interface{}{"product:7", "product:7:images"}, []interface{}{"tenant:acme:product:7", "tenant:acme:product:7:images"}},
+		{"ZINTERSTORE", []interface{}{"tmp:1", 2, "products", "products:price", "WEIGHTS", 1, 0},
+			[]interface{}{"tenant:acme:tmp:1", 2, "tenant:acme:products", "tenant:acme:products:price", "WEIGHTS", 1, 0}},
+		{"EVALSHA", []interface{}{"sha", 1, "stock:7", "on_hand"}, []interface{}{"sha", 1, "tenant:acme:stock:7", "on_hand"}},
+		{"XREADGROUP", []interface{}{"GROUP", "webhooks", "host-1", "COUNT", 20, "STREAMS", "catalogue:events", ">"},
+			[]interface{}{"GROUP", "webhooks", "host-1", "COUNT", 20, "STREAMS", "tenant:acme:catalogue:events", ">"}},
+		{"XGROUP", []interface{}{"CREATE", "catalogue:events", "webhooks", "$"}, []interface{}{"CREATE", "tenant:acme:catalogue:events", "webhooks", "$"}},
+		{"MULTI", []interface{}{}, []interface{}{}},
+	}
+	for _, tc := range cases {
+		args, err := conn.namespaceArgs(tc.command, tc.args)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, tc.expected, args)
+	}
+
+	// Commands we don't know the keys of could reach other tenants' keys
+	_, err := conn.namespaceArgs("KEYS", []interface{}{"*"})
+	assert.ErrorContains(t, err, "can't be namespaced")
+}
+
+func TestNamespaceConn(t *testing.T) {
+	conn := redigomock.NewConn()
+	assert.Equal(t, "", getKeyPrefix(namespaceConn(conn, "")))
+
+	// Namespaces don't stack
+	namespaced := namespaceConn(namespaceConn(conn, "tenant:acme:"), "tenant:other:")
+	assert.Equal(t, "tenant:other:", getKeyPrefix(namespaced))
+
+	get := conn.Command("HGETALL", "tenant:other:product:7").ExpectMap(map[string]string{"id": "7"})
+	_, err := namespaced.Do("HGETALL", "product:7")
+	assert.NilError(t, err)
+	assert.Equal(t, 1, conn.Stats(get))
+}
+
+func TestGetSubdomain(t *testing.T) {
+	assert.Equal(t, "acme", getSubdomain("acme.catalogue.example.com", "catalogue.example.com"))
+	assert.Equal(t, "acme", getSubdomain("ACME.catalogue.example.com:8080", "catalogue.example.com"))
+	assert.Equal(t, "", getSubdomain("catalogue.example.com", "catalogue.example.com"))
+	assert.Equal(t, "", getSubdomain("www.acme.catalogue.example.com", "catalogue.example.com"))
+	assert.Equal(t, "", getSubdomain("acme.catalogue.example.com", ""))
+}
+
+func TestTenantMiddleware(t *testing.T) {
+	defaultPool, defaultResolution := pool, config.TenantResolution
+	defer func() { pool, config.TenantResolution = defaultPool, defaultResolution }()
+
+	conn := redigomock.NewConn()
+	conn.Command("HGETALL", config.KeyTenantApiKeys).ExpectMap(map[string]string{"acme": "secret-key"})
+	conn.Command("SISMEMBER", config.KeyTenants, "acme").Expect(int64(1))
+	conn.Command("SISMEMBER", config.KeyTenants, "unknown").Expect(int64(0))
+	// Every tenant request takes a connection from the pool
+	dials := 0
+	pool = &redis.Pool{Dial: func() (redis.Conn, error) {
+		dials++
+		return conn, nil
+	}}
+	config.TenantResolution = []string{TenantFromApiKey, TenantFromHeader}
+
+	e := echo.New()
+	handler := tenantMiddleware(func(c echo.Context) error {
+		return c.String(http.StatusOK, getKeyPrefix(getRedisConn(c)))
+	})
+	request := func(path string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetPath(path)
+		assert.NilError(t, handler(c))
+		return rec
+	}
+
+	rec := request("/api/products", map[string]string{"X-Api-Key": "secret-key"})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "tenant:acme:", rec.Body.String())
+
+	// Falls through to the next method when the api key is unknown
+	rec = request("/api/products", map[string]string{"X-Api-Key": "wrong-key", "X-Tenant-Id": "acme"})
+	assert.Equal(t, "tenant:acme:", rec.Body.String())
+
+	rec = request("/api/products", map[string]string{"X-Tenant-Id": "unknown"})
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	// The tenant endpoints aren't in any tenant's namespace
+	rec = request("/api/tenants", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "", rec.Body.String())
+
+	rec = request("/graphql", map[string]string{"X-Tenant-Id": "acme"})
+	assert.Equal(t, "tenant:acme:", rec.Body.String())
+
+	// With a single catalogue the requests still get connections of their own
+	config.TenantResolution = []string{}
+	rec = request("/api/products", nil)
+	assert.Equal(t, "", rec.Body.String())
+	assert.Equal(t, 6, dials)
+	assert.Equal(t, 0, pool.ActiveCount(), "The connections should be returned to the pool")
+}
+
+func TestProvisionTenant_exists(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("SADD", config.KeyTenants, "acme").Expect(int64(0))
+
+	err := provisionTenant(&Tenant{Id: "acme", Name: "Acme Ships"}, conn)
+	assert.Equal(t, 409, err.(*ApiError).HttpStatus)
+}
+
+func TestDeleteTenant(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("SREM", config.KeyTenants, "acme").Expect(int64(1))
+	conn.Command("DEL", getTenantKeyName("acme")).Expect(int64(1))
+	conn.Command("HDEL", config.KeyTenantApiKeys, "acme").Expect(int64(1))
+	conn.Command("SCAN", 0, "MATCH", "tenant:acme:*", "COUNT", tenantDeleteBatchSize).Expect([]interface{}{
+		[]byte("0"),
+		[]interface{}{[]byte("tenant:acme:product:7"), []byte("tenant:acme:products")},
+	})
+	del := conn.Command("DEL", "tenant:acme:product:7", "tenant:acme:products").Expect(int64(2))
+
+	assert.NilError(t, deleteTenant("acme", conn))
+	assert.Equal(t, 1, conn.Stats(del))
+
+	conn = redigomock.NewConn()
+	conn.Command("SREM", config.KeyTenants, "acme").Expect(int64(0))
+	assert.Equal(t, &notFoundError, deleteTenant("acme", conn))
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"github.com/labstack/echo"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var localePattern = regexp.MustCompile(`^[a-z]{2,3}(-[A-Z]{2})?$`)
+
+//////////////////////
+// PRODUCT TRANSLATIONS
+// The name and description of a product are in the default locale. Their translations are kept
+// next to the product hash, in a hash keyed by locale holding the translation as json.
+// Every locale has its own prefix search index of the translated names, built like the product listings.
+//////////////////////
+type Translation struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// Normalises a language tag to the format the translations are stored under (ex. "de_at" to "de-AT")
+func normaliseLocale(s string) string {
+	parts := strings.SplitN(strings.Replace(strings.TrimSpace(s), "_", "-", -1), "-", 2)
+	locale := strings.ToLower(parts[0])
+	if len(parts) == 2 {
+		locale += "-" + strings.ToUpper(parts[1])
+	}
+	return locale
+}
+
+// Whether products can be translated to the locale. If no locales are configured, all of them can.
+func isValidLocale(locale string) bool {
+	if !localePattern.MatchString(locale) || locale == config.DefaultLocale {
+		return false
+	}
+	return len(config.Locales) == 0 || stringInSlice(locale, config.Locales)
+}
+
+// Returns the language tags of an Accept-Language header, the most preferred first
+func parseAcceptLanguage(header string) []string {
+	type weightedTag struct {
+		tag    string
+		weight float64
+	}
+	tags := make([]weightedTag, 0)
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.TrimSpace(fields[0])
+		if tag == "" || tag == "*" {
+			continue
+		}
+		weight := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				weight, _ = strconv.ParseFloat(param[2:], 64)
+			}
+		}
+		if weight > 0 {
+			tags = append(tags, weightedTag{tag, weight})
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].weight > tags[j].weight })
+
+	result := make([]string, 0, len(tags))
+	for _, t := range tags {
+		result = append(result, t.tag)
+	}
+	return result
+}
+
+// Builds the fallback chain of the requested locales: every locale is followed by its language (ex. "de-AT", "de").
+// The chain stops at the default locale, since the product itself is in it, and leaves out the locales we don't support.
+func getLocaleChain(requested []string) []string {
+	chain := make([]string, 0)
+	for _, tag := range requested {
+		locale := normaliseLocale(tag)
+		candidates := []string{locale}
+		if i := strings.Index(locale, "-"); i > 0 {
+			candidates = append(candidates, locale[:i])
+		}
+		for _, candidate := range candidates {
+			if candidate == config.DefaultLocale {
+				return chain
+			}
+			if isValidLocale(candidate) && !stringInSlice(candidate, chain) {
+				chain = append(chain, candidate)
+			}
+		}
+	}
+	return chain
+}
+
+// Negotiates the locales to show products in. The `locale` query parameter (a comma separated list) takes
+// precedence over the Accept-Language header. An empty chain means the products are shown in the default locale.
+func getRequestedLocales(c echo.Context) []string {
+	if c.QueryParam("locale") != "" {
+		return getLocaleChain(strings.Split(c.QueryParam("locale"), ","))
+	}
+	return getLocaleChain(parseAcceptLanguage(c.Request().Header.Get("Accept-Language")))
+}
+
+// Replaces the name and description with the first translation in the chain.
+// A translation without a description keeps the description of the default locale.
+func (product *Product) localise(translations map[string]Translation, chain []string) {
+	for _, locale := range chain {
+		translation, ok := translations[locale]
+		if !ok {
+			continue
+		}
+		product.Name = translation.Name
+		if translation.Description != "" {
+			product.Description = translation.Description
+		}
+		product.Locale = locale
+		return
+	}
+}
+
+func getProductTranslations(productId int, redisConn redis.Conn) (map[string]Translation, error) {
+	translations := make(map[string]Translation)
+	values, err := getHashAsStringMap(getProductTranslationsKeyName(productId), redisConn)
+	if err != nil {
+		return translations, err
+	}
+	for locale, encoded := range values {
+		translation := Translation{}
+		if err := json.Unmarshal([]byte(encoded), &translation); err != nil {
+			return translations, err
+		}
+		translations[locale] = translation
+	}
+	return translations, nil
+}
+
+// Localises a list of products, fetching only the translations of the chain in a pipeline
+func localiseProducts(products []Product, chain []string, redisConn redis.Conn) error {
+	if len(chain) == 0 || len(products) == 0 {
+		return nil
+	}
+
+	for _, product := range products {
+		err := redisConn.Send("HMGET", redis.Args{getProductTranslationsKeyName(product.Id)}.AddFlat(chain)...)
+		if err != nil {
+			return err
+		}
+	}
+	err := redisConn.Flush()
+	if err != nil {
+		return err
+	}
+
+	for i := range products {
+		values, err := redis.Strings(redisConn.Receive())
+		if err != nil {
+			return err
+		}
+		translations := make(map[string]Translation)
+		for j, encoded := range values {
+			if encoded == "" {
+				continue
+			}
+			translation := Translation{}
+			if err := json.Unmarshal([]byte(encoded), &translation); err != nil {
+				return err
+			}
+			translations[chain[j]] = translation
+		}
+		products[i].localise(translations, chain)
+	}
+	return nil
+}
+
+func (translation *Translation) validate() []string {
+	errs := make([]string, 0)
+	if strings.TrimSpace(translation.Name) == "" {
+		errs = append(errs, "The name field is required")
+	}
+	return errs
+}
+
+// Saves the translation and moves the product to its new place in the search index of the locale
+func saveProductTranslation(product *Product, locale string, translation Translation, actor string, redisConn redis.Conn) error {
+	translations, err := getProductTranslations(product.Id, redisConn)
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(translation)
+	if err != nil {
+		return err
+	}
+
+	_, err = redisConn.Do("MULTI")
+	if err != nil {
+		return err
+	}
+
+	_ = redisConn.Send("HSET", getProductTranslationsKeyName(product.Id), locale, encoded)
+	if oldTranslation, ok := translations[locale]; ok {
+		_ = redisConn.Send("ZREM", getProductsInLocaleKeyName(locale), getLocalisedLexName(oldTranslation.Name, product.Id))
+	}
+	// Products that aren't published are added to the locale indexes once they are
+	if product.isPublished() {
+		_ = redisConn.Send("ZADD", getProductsInLocaleKeyName(locale), 0, getLocalisedLexName(translation.Name, product.Id))
+	}
+	_ = sendTranslationEvent(EventTranslationUpdated, product, locale, &translation, actor, redisConn)
+
+	_, err = redisConn.Do("EXEC")
+	return err
+}
+
+func deleteProductTranslation(product *Product, locale string, actor string, redisConn redis.Conn) error {
+	translations, err := getProductTranslations(product.Id, redisConn)
+	if err != nil {
+		return err
+	}
+	translation, ok := translations[locale]
+	if !ok {
+		return &notFoundError
+	}
+
+	_, err = redisConn.Do("MULTI")
+	if err != nil {
+		return err
+	}
+
+	_ = redisConn.Send("HDEL", getProductTranslationsKeyName(product.Id), locale)
+	_ = redisConn.Send("ZREM", getProductsInLocaleKeyName(locale), getLocalisedLexName(translation.Name, product.Id))
+	_ = sendTranslationEvent(EventTranslationDeleted, product, locale, &translation, actor, redisConn)
+
+	_, err = redisConn.Do("EXEC")
+	return err
+}
+
+func sendTranslationEvent(eventType string, product *Product, locale string, translation *Translation, actor string, redisConn redis.Conn) error {
+	return sendEvent(CatalogueEvent{
+		Type:       eventType,
+		ProductId:  product.Id,
+		CategoryId: product.MainCategoryId,
+		Actor:      actor,
+		Data: map[string]interface{}{
+			"locale":      locale,
+			"name":        translation.Name,
+			"description": translation.Description,
+		},
+	}, redisConn)
+}
+
+// Queues the removal of the product from the search indexes of its translations (ex. when it's moved to the trash)
+func sendTranslationIndexRemove(productId int, translations map[string]Translation, redisConn redis.Conn) {
+	for locale, translation := range translations {
+		_ = redisConn.Send("ZREM", getProductsInLocaleKeyName(locale), getLocalisedLexName(translation.Name, productId))
+	}
+}
+
+func sendTranslationIndexAdd(productId int, translations map[string]Translation, redisConn redis.Conn) {
+	for locale, translation := range translations {
+		_ = redisConn.Send("ZADD", getProductsInLocaleKeyName(locale), 0, getLocalisedLexName(translation.Name, productId))
+	}
+}
+
+type localisedMatch struct {
+	productId int
+	lexName   string // the lex name the product matched with, used for sorting
+	priority  int    // the position of the locale in the chain, the untranslated names come last
+}
+
+// Prefix searches the translated names of every locale in the chain, along with the untranslated names,
+// and returns a page of the matching product ids. Only products in the `keyName` listing are returned.
+// Since a product can match in several locales, the matches are merged here instead of paging through an index.
+func searchLocalisedProducts(search string, chain []string, keyName string, page int, redisConn redis.Conn) ([]int, error) {
+	searchString := normaliseSearchString(search)
+	indexes := make([]string, 0, len(chain)+1)
+	for _, locale := range chain {
+		indexes = append(indexes, getProductsInLocaleKeyName(locale))
+	}
+	indexes = append(indexes, config.KeyAllProducts)
+
+	// Everything up to the requested page fits in the first `needed` names of every index, unless some
+	// of them are duplicates or aren't in the listing. Then we read further, twice as many names at a time.
+	needed := page * config.ResultsPerPage
+	for limit := needed; ; limit *= 2 {
+		matches, complete, err := findLocalisedMatches(searchString, indexes, limit, redisConn)
+		if err != nil {
+			return nil, err
+		}
+		if keyName != config.KeyAllProducts {
+			matches, err = filterLocalisedMatches(matches, keyName, redisConn)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if !complete && len(matches) < needed {
+			continue
+		}
+
+		productIds := make([]int, 0, config.ResultsPerPage)
+		fromPosition := (page - 1) * config.ResultsPerPage
+		for i := fromPosition; i < len(matches) && i < fromPosition+config.ResultsPerPage; i++ {
+			productIds = append(productIds, matches[i].productId)
+		}
+		return productIds, nil
+	}
+}
+
+// Reads up to `limit` names starting with the search string from every index and merges them, sorted.
+// When an index has more names than that, only the matches that sort before its last name read are
+// returned (the rest could be preceded by names we haven't read), and `complete` is false.
+func findLocalisedMatches(searchString string, indexes []string, limit int, redisConn redis.Conn) ([]localisedMatch, bool, error) {
+	for _, index := range indexes {
+		err := redisConn.Send("ZRANGEBYLEX", index, "["+searchString, "["+searchString+"\xff", "LIMIT", 0, limit)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	err := redisConn.Flush()
+	if err != nil {
+		return nil, false, err
+	}
+
+	matches := make([]localisedMatch, 0)
+	seen := make(map[int]bool)
+	complete := true
+	cutoff := ""
+	for priority := range indexes {
+		lexNames, err := redis.Strings(redisConn.Receive())
+		if err != nil {
+			return nil, false, err
+		}
+		if len(lexNames) == limit {
+			lastName := lexNames[len(lexNames)-1]
+			if complete || lastName < cutoff {
+				cutoff = lastName
+			}
+			complete = false
+		}
+		for _, lexName := range lexNames {
+			productId := getIdFromLexName(lexName)
+			if seen[productId] {
+				continue
+			}
+			seen[productId] = true
+			matches = append(matches, localisedMatch{productId, lexName, priority})
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].lexName != matches[j].lexName {
+			return matches[i].lexName < matches[j].lexName
+		}
+		return matches[i].priority < matches[j].priority
+	})
+	if !complete {
+		certain := sort.Search(len(matches), func(i int) bool { return matches[i].lexName > cutoff })
+		matches = matches[:certain]
+	}
+	return matches, complete, nil
+}
+
+// Keeps the matches that are members of the listing. The listings hold the lex names of the default locale,
+// so the untranslated names are fetched first.
+func filterLocalisedMatches(matches []localisedMatch, keyName string, redisConn redis.Conn) ([]localisedMatch, error) {
+	for _, match := range matches {
+		err := redisConn.Send("HGET", getProductNameById(match.productId), "name")
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := redisConn.Flush()
+	if err != nil {
+		return nil, err
+	}
+	lexNames := make([]string, 0, len(matches))
+	for _, match := range matches {
+		name, _ := redis.String(redisConn.Receive())
+		product := Product{Id: match.productId, Name: name}
+		lexNames = append(lexNames, product.getLexName())
+	}
+
+	for _, lexName := range lexNames {
+		err := redisConn.Send("ZSCORE", keyName, lexName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = redisConn.Flush()
+	if err != nil {
+		return nil, err
+	}
+	filtered := make([]localisedMatch, 0, len(matches))
+	for _, match := range matches {
+		score, err := redisConn.Receive()
+		if err != nil {
+			return nil, err
+		}
+		if score != nil {
+			filtered = append(filtered, match)
+		}
+	}
+	return filtered, nil
+}
+
+// Helper functions
+func getProductTranslationsKeyName(productId int) string {
+	return fmt.Sprintf(config.KeyProductTranslations, productId)
+}
+func getProductsInLocaleKeyName(locale string) string {
+	return fmt.Sprintf(config.KeyProductsInLocale, locale)
+}
+func getLocalisedLexName(name string, productId int) string {
+	return fmt.Sprintf("%s::%v", normaliseSearchString(name), productId)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"github.com/rafaeljusto/redigomock"
+	"gotest.tools/assert"
+	"testing"
+)
+
+func TestNormaliseLocale(t *testing.T) {
+	assert.Equal(t, "de-AT", normaliseLocale("de_at"))
+	assert.Equal(t, "de-AT", normaliseLocale(" DE-at "))
+	assert.Equal(t, "fr", normaliseLocale("FR"))
+}
+
+func TestParseAcceptLanguage(t *testing.T) {
+	tags := parseAcceptLanguage("fr;q=0.5, de-AT, en;q=0.8, *;q=0.1, es;q=0")
+	assert.DeepEqual(t, []string{"de-AT", "en", "fr"}, tags)
+
+	assert.Equal(t, 0, len(parseAcceptLanguage("")))
+}
+
+func TestGetLocaleChain(t *testing.T) {
+	defer func(locales []string) { config.Locales = locales }(config.Locales)
+	config.Locales = []string{"de", "de-AT", "fr"}
+
+	assert.DeepEqual(t, []string{"de-AT", "de", "fr"}, getLocaleChain([]string{"de_at", "fr", "de"}))
+
+	// The chain stops at the default locale, since the products themselves are in it
+	assert.DeepEqual(t, []string{"fr"}, getLocaleChain([]string{"fr", "en-GB", "de"}))
+
+	// Unsupported locales fall back to their language
+	assert.DeepEqual(t, []string{"de"}, getLocaleChain([]string{"de-CH", "ja"}))
+}
+
+func TestProduct_localise(t *testing.T) {
+	translations := map[string]Translation{
+		"de": {Name: "Rosinante"},
+		"fr": {Name: "Rossinante", Description: "Une frégate"},
+	}
+
+	product := Product{Name: "Rocinante", Description: "A frigate"}
+	product.localise(translations, []string{"de-AT", "de", "fr"})
+	assert.Equal(t, "Rosinante", product.Name)
+	assert.Equal(t, "A frigate", product.Description, "A translation without a description should keep the original")
+	assert.Equal(t, "de", product.Locale)
+
+	product = Product{Name: "Rocinante", Description: "A frigate"}
+	product.localise(translations, []string{"ja"})
+	assert.Equal(t, "Rocinante", product.Name)
+	assert.Equal(t, "", product.Locale)
+}
+
+func TestSaveProductTranslation(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("HGETALL", getProductTranslationsKeyName(7)).ExpectMap(map[string]string{
+		"de": `{"name":"Rosinante","description":""}`,
+	})
+	conn.Command("MULTI").Expect("OK")
+	hset := conn.Command("HSET", getProductTranslationsKeyName(7), "de", []byte(`{"name":"Rosinante II","description":""}`)).Expect(int64(0))
+	zrem := conn.Command("ZREM", getProductsInLocaleKeyName("de"), "rosinante::7").Expect(int64(1))
+	zadd := conn.Command("ZADD", getProductsInLocaleKeyName("de"), 0, "rosinante ii::7").Expect(int64(1))
+	event := conn.GenericCommand("XADD").Expect("1567332000000-0")
+	conn.GenericCommand("PUBLISH").Expect(int64(0))
+	conn.Command("EXEC").Expect([]interface{}{})
+
+	product := Product{Id: 7, Name: "Rocinante"}
+	err := saveProductTranslation(&product, "de", Translation{Name: "Rosinante II"}, "naomi", conn)
+	assert.NilError(t, err)
+
+	assert.Equal(t, 1, conn.Stats(hset))
+	assert.Equal(t, 1, conn.Stats(zrem))
+	assert.Equal(t, 1, conn.Stats(zadd))
+	assert.Equal(t, 1, conn.Stats(event))
+}
+
+func TestDeleteProductTranslation_notFound(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("HGETALL", getProductTranslationsKeyName(7)).ExpectMap(map[string]string{})
+
+	product := Product{Id: 7}
+	err := deleteProductTranslation(&product, "de", "naomi", conn)
+	assert.Equal(t, err, &notFoundError)
+}
+
+func TestSearchLocalisedProducts(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("ZRANGEBYLEX", getProductsInLocaleKeyName("de"), "[ro", "[ro\xff", "LIMIT", 0, config.ResultsPerPage).Expect([]interface{}{
+		[]byte("rosinante::7"),
+	})
+	conn.Command("ZRANGEBYLEX", config.KeyAllProducts, "[ro", "[ro\xff", "LIMIT", 0, config.ResultsPerPage).Expect([]interface{}{
+		[]byte("rocinante::7"),
+		[]byte("roci's shuttle::9"),
+	})
+
+	// Products matching in several locales are only shown once, sorted by the name they matched with
+	productIds, err := searchLocalisedProducts("Ro", []string{"de"}, config.KeyAllProducts, 1, conn)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []int{9, 7}, productIds)
+}
+
+func TestSearchLocalisedProducts_readsFurtherForListings(t *testing.T) {
+	defaultResultsPerPage := config.ResultsPerPage
+	defer func() { config.ResultsPerPage = defaultResultsPerPage }()
+	config.ResultsPerPage = 1
+
+	rocinante := Product{Id: 7, Name: "Rocinante"}
+	tachi := Product{Id: 9, Name: "Tachi"}
+	conn := redigomock.NewConn()
+	conn.Command("ZRANGEBYLEX", config.KeyAllProducts, "[r", "[r\xff", "LIMIT", 0, 1).Expect([]interface{}{
+		[]byte("rocinante::7"),
+	})
+	conn.Command("ZRANGEBYLEX", config.KeyAllProducts, "[r", "[r\xff", "LIMIT", 0, 2).Expect([]interface{}{
+		[]byte("rocinante::7"),
+		[]byte("rosinante::9"),
+	})
+	conn.Command("HGET", getProductNameById(7), "name").Expect([]byte(rocinante.Name))
+	conn.Command("HGET", getProductNameById(9), "name").Expect([]byte(tachi.Name))
+	conn.Command("ZSCORE", "products:in-category:2", rocinante.getLexName()).Expect(nil)
+	conn.Command("ZSCORE", "products:in-category:2", tachi.getLexName()).Expect([]byte("0"))
+
+	// The first name isn't in the listing, so the page is filled from the next ones
+	productIds, err := searchLocalisedProducts("R", []string{}, "products:in-category:2", 1, conn)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []int{9}, productIds)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"github.com/gomodule/redigo/redis"
+	"time"
+)
+
+//////////////////////
+// TRASH
+// Deleted products are taken out of the listing indexes, but their hash and images are kept
+// until they're restored or purged by the sweeper. The trash is a sorted set of product ids scored by the deletion time.
+//////////////////////
+
+func (product *Product) trash(actor string, redisConn redis.Conn) error {
+	oldProduct, err := getProductById(product.Id, redisConn)
+	if err != nil {
+		return err
+	}
+	*product = oldProduct
+	product.DeletedAt = time.Now().Unix()
+
+	translations, err := getProductTranslations(product.Id, redisConn)
+	if err != nil {
+		return err
+	}
+
+	collectionIds, err := getProductCollectionIds(product.Id, redisConn)
+	if err != nil {
+		return err
+	}
+
+	// Start a transaction and send all commands in a pipeline
+	_, err = redisConn.Do("MULTI")
+	if err != nil {
+		return err
+	}
+
+	_ = redisConn.Send("HSET", product.getKeyName(), "deleted_at", product.DeletedAt)
+
+	// Remove from the listing indexes and the publishing schedules, and add it to the trash
+	sendListingIndexRemove(product, translations, redisConn)
+	sendPublishingScheduleDelete(product.Id, redisConn)
+	_ = redisConn.Send("ZADD", config.KeyTrashedProducts, product.DeletedAt, product.Id)
+
+	// Collections are curated, so a restored product isn't put back in them
+	sendCollectionMembershipsRemove(product.Id, collectionIds, redisConn)
+
+	_ = sendProductVersion(product, ProductDeleted, actor, redisConn)
+	_ = sendProductEvent(EventProductDeleted, product, actor, redisConn)
+
+	_, err = redisConn.Do("EXEC")
+	return err
+}
+
+// Takes a product out of the trash and puts it back in the product indexes
+func restoreFromTrash(id int, actor string, redisConn redis.Conn) (Product, error) {
+	product, err := getTrashedProductById(id, redisConn)
+	if err != nil {
+		return Product{}, err
+	}
+	product.DeletedAt = 0
+
+	translations, err := getProductTranslations(product.Id, redisConn)
+	if err != nil {
+		return Product{}, err
+	}
+
+	_, err = redisConn.Do("MULTI")
+	if err != nil {
+		return Product{}, err
+	}
+
+	_ = redisConn.Send("HSET", product.getKeyName(), "deleted_at", 0)
+	_ = redisConn.Send("ZREM", config.KeyTrashedProducts, product.Id)
+	sendListingIndexAdd(&product, translations, redisConn)
+	sendPublishingScheduleUpdate(&product, redisConn)
+
+	_ = sendProductVersion(&product, ProductRestored, actor, redisConn)
+	_ = sendProductEvent(EventProductRestored, &product, actor, redisConn)
+
+	_, err = redisConn.Do("EXEC")
+	if err != nil {
+		return Product{}, err
+	}
+
+	return product, nil
+}
+
+func getTrashedProductById(id int, redisConn redis.Conn) (Product, error) {
+	product := Product{}
+	values, err := redis.Values(redisConn.Do("HGETALL", getProductNameById(id)))
+	if err != nil {
+		return Product{}, err
+	}
+	if len(values) == 0 {
+		return Product{}, &notFoundError
+	}
+	err = scanProduct(values, &product)
+	if err != nil {
+		return Product{}, err
+	}
+	if product.DeletedAt == 0 {
+		return Product{}, &notFoundError
+	}
+	return product, nil
+}
+
+// Newest deletions first
+func getTrashedProducts(page int, categories map[int]Category, redisConn redis.Conn) ([]Product, error) {
+	fromPosition := (page - 1) * config.ResultsPerPage
+	toPosition := fromPosition + config.ResultsPerPage - 1
+
+	productIds, err := redis.Ints(redisConn.Do("ZREVRANGE", config.KeyTrashedProducts, fromPosition, toPosition))
+	if err != nil {
+		return make([]Product, 0), err
+	}
+	return fetchProductsByIds(productIds, categories, redisConn)
+}
+
+// Permanently deletes all products that have been in the trash for longer than the configured period
+func purgeExpiredProducts(now time.Time, redisConn redis.Conn) (int, error) {
+	deadline := now.Add(-time.Duration(config.TrashPurgeAfter) * time.Hour).Unix()
+	productIds, err := redis.Ints(redisConn.Do("ZRANGEBYSCORE", config.KeyTrashedProducts, "-inf", deadline))
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, productId := range productIds {
+		// The product could have been restored since we read the trash
+		product, err := getTrashedProductById(productId, redisConn)
+		if err == &notFoundError {
+			_, _ = redisConn.Do("ZREM", config.KeyTrashedProducts, productId)
+			continue
+		}
+		if err != nil {
+			return purged, err
+		}
+
+		err = product.delete("trash-sweeper", redisConn)
+		if err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+func runTrashSweeper(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(config.TrashSweepInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			conn := pool.Get()
+			err := forEachNamespace(conn, func(namespacedConn redis.Conn) error {
+				purged, err := purgeExpiredProducts(time.Now(), namespacedConn)
+				if err != nil {
+					logger.Error("Unable to purge the trash", Fields{"error": err, "namespace": getKeyPrefix(namespacedConn)})
+				} else if purged > 0 {
+					logger.Info("Purged products from the trash", Fields{"count": purged, "namespace": getKeyPrefix(namespacedConn)})
+				}
+				// One tenant's failure shouldn't hold back the others
+				return nil
+			})
+			_ = conn.Close()
+
+			if err != nil {
+				logger.Error("Unable to list the tenants", Fields{"error": err})
+			}
+		}
+	}
+}
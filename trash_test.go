@@ -0,0 +1,107 @@
+package main
+
+import (
+	"github.com/rafaeljusto/redigomock"
+	"gotest.tools/assert"
+	"testing"
+	"time"
+)
+
+func TestProduct_trash(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("HGETALL", getProductNameById(7)).ExpectMap(map[string]string{
+		"id":               "7",
+		"name":             "Rocinante",
+		"main_category_id": "2",
+		"price_minor":      "1999",
+		"currency":         "EUR",
+	})
+	conn.Command("HGETALL", getProductTranslationsKeyName(7)).ExpectMap(map[string]string{
+		"de": `{"name":"Rosinante","description":""}`,
+	})
+	conn.Command("SMEMBERS", getProductCollectionsKeyName(7)).Expect([]interface{}{[]byte("3")})
+	conn.Command("MULTI").Expect("OK")
+	hset := conn.GenericCommand("HSET").Expect(int64(0))
+	zremAll := conn.Command("ZREM", config.KeyAllProducts, "rocinante::7").Expect(int64(1))
+	zremCategory := conn.Command("ZREM", getProductsInCategoryKeyName(2), "rocinante::7").Expect(int64(1))
+	zremPrice := conn.Command("ZREM", getProductsByPriceKeyName("EUR"), "rocinante::7").Expect(int64(1))
+	zremLocale := conn.Command("ZREM", getProductsInLocaleKeyName("de"), "rosinante::7").Expect(int64(1))
+	zremCollection := conn.Command("ZREM", getCollectionProductsKeyName(3), 7).Expect(int64(1))
+	delCollections := conn.Command("DEL", getProductCollectionsKeyName(7)).Expect(int64(1))
+	zremSchedule := conn.Command("ZREM", config.KeyPublishSchedule, 7).Expect(int64(0))
+	conn.Command("ZREM", config.KeyUnpublishSchedule, 7).Expect(int64(0))
+	srem := conn.Command("SREM", getProductsByTokenKeyName("rocinante"), "rocinante::7").Expect(int64(1))
+	zadd := conn.GenericCommand("ZADD").Expect(int64(1))
+	conn.GenericCommand("RPUSH").Expect(int64(2))
+	event := conn.GenericCommand("XADD").Expect("1567332000000-0")
+	conn.GenericCommand("PUBLISH").Expect(int64(0))
+	conn.Command("EXEC").Expect([]interface{}{})
+
+	product := Product{Id: 7}
+	err := product.trash("naomi", conn)
+	assert.NilError(t, err)
+
+	assert.Assert(t, product.DeletedAt > 0)
+	assert.Equal(t, 1, conn.Stats(hset))
+	assert.Equal(t, 1, conn.Stats(zremAll))
+	assert.Equal(t, 1, conn.Stats(zremCategory))
+	assert.Equal(t, 1, conn.Stats(zremPrice))
+	assert.Equal(t, 1, conn.Stats(zremLocale))
+	assert.Equal(t, 1, conn.Stats(srem))
+	assert.Equal(t, 1, conn.Stats(zremCollection))
+	assert.Equal(t, 1, conn.Stats(delCollections))
+	assert.Equal(t, 1, conn.Stats(zremSchedule))
+	assert.Equal(t, 1, conn.Stats(zadd))
+	assert.Equal(t, 1, conn.Stats(event))
+}
+
+func TestGetTrashedProductById(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("HGETALL", getProductNameById(7)).ExpectMap(map[string]string{
+		"id":         "7",
+		"name":       "Rocinante",
+		"deleted_at": "1567332000",
+	})
+	conn.Command("HGETALL", getProductNameById(8)).ExpectMap(map[string]string{
+		"id":         "8",
+		"name":       "Canterbury",
+		"deleted_at": "0",
+	})
+
+	product, err := getTrashedProductById(7, conn)
+	assert.NilError(t, err)
+	assert.Equal(t, int64(1567332000), product.DeletedAt)
+
+	// Products that aren't in the trash can't be found there
+	_, err = getTrashedProductById(8, conn)
+	assert.Equal(t, err, &notFoundError)
+}
+
+func TestPurgeExpiredProducts_skipsRestoredProducts(t *testing.T) {
+	now := time.Date(2019, 9, 1, 10, 0, 0, 0, time.UTC)
+	deadline := now.Add(-time.Duration(config.TrashPurgeAfter) * time.Hour).Unix()
+
+	conn := redigomock.NewConn()
+	conn.Command("ZRANGEBYSCORE", config.KeyTrashedProducts, "-inf", deadline).Expect([]interface{}{[]byte("8")})
+	conn.Command("HGETALL", getProductNameById(8)).ExpectMap(map[string]string{
+		"id":         "8",
+		"deleted_at": "0",
+	})
+	zrem := conn.Command("ZREM", config.KeyTrashedProducts, 8).Expect(int64(1))
+
+	purged, err := purgeExpiredProducts(now, conn)
+	assert.NilError(t, err)
+	assert.Equal(t, 0, purged)
+	assert.Equal(t, 1, conn.Stats(zrem))
+}
+
+func TestProductExists(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("HMGET", getProductNameById(1), "id", "deleted_at").Expect([]interface{}{[]byte("1"), []byte("0")})
+	conn.Command("HMGET", getProductNameById(2), "id", "deleted_at").Expect([]interface{}{[]byte("2"), []byte("1567332000")})
+	conn.Command("HMGET", getProductNameById(3), "id", "deleted_at").Expect([]interface{}{nil, nil})
+
+	assert.Assert(t, productExists(1, conn))
+	assert.Assert(t, !productExists(2, conn), "Trashed products shouldn't exist")
+	assert.Assert(t, !productExists(3, conn))
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//////////////////////
+// VARIANT MODEL
+// A configuration of a product (ex. a hull colour and an armament package) with its own SKU.
+// Variants without a price of their own cost the same as their product.
+//////////////////////
+type Variant struct {
+	Id             int               `redis:"id" json:"id"`
+	ProductId      int               `redis:"product_id" json:"product_id"`
+	Sku            string            `redis:"sku" json:"sku"`
+	Options        map[string]string `redis:"-" json:"options"`
+	Price          Price             `redis:"-" json:"price"`
+	PriceMinor     int64             `redis:"price_minor" json:"-"`
+	Currency       string            `redis:"currency" json:"-"` // empty if the variant uses the product price
+	ConvertedPrice *Price            `redis:"-" json:"converted_price,omitempty"`
+	ImageIds       []int             `redis:"-" json:"image_ids"`
+	Images         []Image           `redis:"-" json:"images"`
+
+	// Options are stored in the hash as json and image ids as a comma separated list
+	OptionsJson  string `redis:"options" json:"-"`
+	ImageIdsList string `redis:"image_ids" json:"-"`
+}
+
+type VariantCollection struct {
+	OptionAxes map[string][]string `json:"option_axes"`
+	Data       []Variant           `json:"data"`
+}
+
+var skuPattern = regexp.MustCompile(`^[A-Z0-9][A-Z0-9._-]{0,63}$`)
+
+func normaliseSku(sku string) string {
+	return strings.ToUpper(strings.TrimSpace(sku))
+}
+
+// Returns a list of validation errors, or an empty list if the variant can be saved alongside the other variants of the product
+func (variant *Variant) validate(siblings []Variant, productImageIds []int) []string {
+	errs := make([]string, 0)
+
+	variant.Sku = normaliseSku(variant.Sku)
+	if !skuPattern.MatchString(variant.Sku) {
+		errs = append(errs, "The sku needs to be up to 64 letters, digits, dots, dashes or underscores")
+	}
+
+	if len(variant.Options) == 0 {
+		errs = append(errs, "A variant needs at least one option (ex. {\"hull colour\": \"red\"})")
+	}
+	for axis, value := range variant.Options {
+		if strings.TrimSpace(axis) == "" || strings.TrimSpace(value) == "" {
+			errs = append(errs, "Option names and values can't be empty")
+			break
+		}
+	}
+
+	// All variants of a product share the same option axes, and no two of them can have the same combination of values
+	for _, sibling := range siblings {
+		if sibling.Id == variant.Id {
+			continue
+		}
+		if !sameKeys(sibling.Options, variant.Options) {
+			errs = append(errs, fmt.Sprintf("The options need to be %s, like the other variants of the product", strings.Join(getSortedKeys(sibling.Options), ", ")))
+			break
+		}
+		if sameValues(sibling.Options, variant.Options) {
+			errs = append(errs, fmt.Sprintf("Variant %v already has these options", sibling.Id))
+			break
+		}
+	}
+
+	for _, imageId := range variant.ImageIds {
+		if !intInSlice(imageId, productImageIds) {
+			errs = append(errs, fmt.Sprintf("Image %v doesn't belong to the product", imageId))
+		}
+	}
+
+	return errs
+}
+
+// Prices sent without a currency are in the currency of the product
+func (variant *Variant) setPriceFromInput(productCurrency string) error {
+	minorUnits, currency, err := parsePriceInput(variant.Price, productCurrency)
+	if err != nil {
+		return err
+	}
+	if variant.Price.Amount == "" {
+		currency = ""
+	}
+	variant.PriceMinor = minorUnits
+	variant.Currency = currency
+	return nil
+}
+
+// Sets the price shown to API consumers, falling back to the product price
+func (variant *Variant) setPrice(product *Product) {
+	if variant.Currency == "" {
+		variant.Price = product.Price
+		return
+	}
+	variant.Price = Price{
+		Amount:   formatMinorUnits(variant.PriceMinor, getCurrencyExponent(variant.Currency)),
+		Currency: variant.Currency,
+	}
+}
+
+// Like the product's, the converted price is left unset when the variant's price can't be converted
+func (variant *Variant) setConvertedPrice(currency string, rates ExchangeRates) {
+	minorUnits, err := parseMinorUnits(variant.Price.Amount, getCurrencyExponent(variant.Price.Currency))
+	if err != nil {
+		return
+	}
+	price, err := rates.convertPrice(minorUnits, variant.Price.Currency, currency, config.PriceRounding)
+	if err != nil {
+		return
+	}
+	variant.ConvertedPrice = &price
+}
+
+// Keeps only the images that still belong to the product (images can be deleted after the variant was saved)
+func (variant *Variant) setImages(productImageIds []int) {
+	imageIds := make([]int, 0, len(variant.ImageIds))
+	variant.Images = make([]Image, 0, len(variant.ImageIds))
+	for _, imageId := range variant.ImageIds {
+		if !intInSlice(imageId, productImageIds) {
+			continue
+		}
+		image := Image{Id: imageId}
+		image.setUrl()
+		imageIds = append(imageIds, imageId)
+		variant.Images = append(variant.Images, image)
+	}
+	variant.ImageIds = imageIds
+}
+
+func (variant *Variant) getKeyName() string {
+	return getVariantKeyName(variant.Id)
+}
+
+// Serialises the fields that can't be stored in the hash as they are
+func (variant *Variant) prepareForSave() {
+	options, _ := json.Marshal(variant.Options)
+	variant.OptionsJson = string(options)
+
+	imageIds := make([]string, 0, len(variant.ImageIds))
+	for _, imageId := range variant.ImageIds {
+		imageIds = append(imageIds, strconv.Itoa(imageId))
+	}
+	variant.ImageIdsList = strings.Join(imageIds, ",")
+}
+
+func scanVariant(values []interface{}, variant *Variant) error {
+	err := redis.ScanStruct(values, variant)
+	if err != nil {
+		return err
+	}
+	variant.Options = make(map[string]string)
+	if variant.OptionsJson != "" {
+		_ = json.Unmarshal([]byte(variant.OptionsJson), &variant.Options)
+	}
+	variant.ImageIds = make([]int, 0)
+	for _, imageId := range strings.Split(variant.ImageIdsList, ",") {
+		if id, err := strconv.Atoi(imageId); err == nil {
+			variant.ImageIds = append(variant.ImageIds, id)
+		}
+	}
+	return nil
+}
+
+func saveNewVariant(variant *Variant, actor string, redisConn redis.Conn) error {
+	id, err := redis.Int(redisConn.Do("INCR", config.KeyVariantCounter))
+	if err != nil {
+		return err
+	}
+	variant.Id = id
+
+	// Claim the sku first, so two variants can never end up with the same one
+	err = claimSku(variant.Sku, variant.Id, redisConn)
+	if err != nil {
+		return err
+	}
+
+	variant.prepareForSave()
+
+	_, err = redisConn.Do("MULTI")
+	if err != nil {
+		return err
+	}
+	_ = redisConn.Send("HSET", redis.Args{variant.getKeyName()}.AddFlat(variant)...)
+	_ = redisConn.Send("ZADD", getProductVariantsKeyName(variant.ProductId), variant.Id, variant.Id)
+	_ = sendVariantEvent(EventVariantCreated, variant, actor, redisConn)
+	_, err = redisConn.Do("EXEC")
+	if err != nil {
+		_, _ = redisConn.Do("HDEL", config.KeySkus, variant.Sku)
+		return err
+	}
+
+	return nil
+}
+
+func updateVariant(variant *Variant, oldVariant *Variant, actor string, redisConn redis.Conn) error {
+	skuChanged := variant.Sku != oldVariant.Sku
+	if skuChanged {
+		err := claimSku(variant.Sku, variant.Id, redisConn)
+		if err != nil {
+			return err
+		}
+	}
+
+	variant.prepareForSave()
+
+	_, err := redisConn.Do("MULTI")
+	if err != nil {
+		return err
+	}
+	// Replace the whole hash, so a price that was removed doesn't linger
+	_ = redisConn.Send("DEL", variant.getKeyName())
+	_ = redisConn.Send("HSET", redis.Args{variant.getKeyName()}.AddFlat(variant)...)
+	if skuChanged {
+		_ = redisConn.Send("HDEL", config.KeySkus, oldVariant.Sku)
+	}
+	_ = sendVariantEvent(EventVariantUpdated, variant, actor, redisConn)
+	_, err = redisConn.Do("EXEC")
+	if err != nil && skuChanged {
+		_, _ = redisConn.Do("HDEL", config.KeySkus, variant.Sku)
+	}
+	return err
+}
+
+func (variant *Variant) delete(product *Product, actor string, redisConn redis.Conn) error {
+	_, err := redisConn.Do("MULTI")
+	if err != nil {
+		return err
+	}
+	_ = redisConn.Send("DEL", variant.getKeyName())
+	_ = redisConn.Send("ZREM", getProductVariantsKeyName(variant.ProductId), variant.Id)
+	_ = redisConn.Send("HDEL", config.KeySkus, variant.Sku)
+	_ = removeStockUnitScript.Send(redisConn, getStockKeyName(product.Id), config.KeyInStockProducts, getStockUnitPrefix(variant.Id), product.getLexName())
+	_ = sendVariantEvent(EventVariantDeleted, variant, actor, redisConn)
+	_, err = redisConn.Do("EXEC")
+	return err
+}
+
+// Queues the commands deleting all variants of a product (and freeing their skus) in the caller's transaction.
+// The variants need to be fetched before the transaction starts.
+func sendProductVariantsDelete(productId int, variants []Variant, redisConn redis.Conn) {
+	for _, variant := range variants {
+		_ = redisConn.Send("DEL", variant.getKeyName())
+		_ = redisConn.Send("HDEL", config.KeySkus, variant.Sku)
+	}
+	_ = redisConn.Send("DEL", getProductVariantsKeyName(productId))
+}
+
+// Reserves the sku for the variant, failing with a conflict if another variant already has it
+func claimSku(sku string, variantId int, redisConn redis.Conn) error {
+	claimed, err := redis.Bool(redisConn.Do("HSETNX", config.KeySkus, sku, variantId))
+	if err != nil {
+		return err
+	}
+	if claimed {
+		return nil
+	}
+	ownerId, err := redis.Int(redisConn.Do("HGET", config.KeySkus, sku))
+	if err != nil && err != redis.ErrNil {
+		return err
+	}
+	if ownerId == variantId {
+		return nil
+	}
+	return &ApiError{
+		HttpStatus:  409,
+		Title:       "Duplicate sku",
+		Description: fmt.Sprintf("The sku %s is already used by another variant", sku),
+	}
+}
+
+func getVariantById(productId int, id int, redisConn redis.Conn) (Variant, error) {
+	values, err := redis.Values(redisConn.Do("HGETALL", getVariantKeyName(id)))
+	if err != nil {
+		return Variant{}, err
+	}
+	if len(values) == 0 {
+		return Variant{}, &notFoundError
+	}
+
+	variant := Variant{}
+	err = scanVariant(values, &variant)
+	if err != nil {
+		return Variant{}, err
+	}
+	// Variants are only reachable through their own product
+	if variant.ProductId != productId {
+		return Variant{}, &notFoundError
+	}
+	return variant, nil
+}
+
+// Fetches all variants of a product in a pipeline, in the order they were created
+func getProductVariants(productId int, redisConn redis.Conn) ([]Variant, error) {
+	variants := make([]Variant, 0)
+
+	ids, err := redis.Ints(redisConn.Do("ZRANGE", getProductVariantsKeyName(productId), 0, -1))
+	if err != nil || len(ids) == 0 {
+		return variants, err
+	}
+
+	for _, id := range ids {
+		_ = redisConn.Send("HGETALL", getVariantKeyName(id))
+	}
+	_ = redisConn.Flush()
+
+	for range ids {
+		values, err := redis.Values(redisConn.Receive())
+		if err != nil {
+			return variants, err
+		}
+		if len(values) == 0 {
+			continue
+		}
+		variant := Variant{}
+		if err := scanVariant(values, &variant); err != nil {
+			return variants, err
+		}
+		variants = append(variants, variant)
+	}
+	return variants, nil
+}
+
+// Sets the prices and images of the variants for display
+func prepareVariants(variants []Variant, product *Product, redisConn redis.Conn) {
+	productImageIds, _ := redis.Ints(redisConn.Do("SMEMBERS", getProductImagesKeyName(product.Id)))
+	for i := range variants {
+		variants[i].setPrice(product)
+		variants[i].setImages(productImageIds)
+	}
+}
+
+// The option axes of a product and the values its variants use for each of them
+func getOptionAxes(variants []Variant) map[string][]string {
+	axes := make(map[string][]string)
+	for _, variant := range variants {
+		for axis, value := range variant.Options {
+			if !stringInSlice(value, axes[axis]) {
+				axes[axis] = append(axes[axis], value)
+			}
+		}
+	}
+	for axis := range axes {
+		sort.Strings(axes[axis])
+	}
+	return axes
+}
+
+//////////////////////
+// SKU LOOKUP
+//////////////////////
+type SkuLookup struct {
+	Sku     string  `json:"sku"`
+	Variant Variant `json:"variant"`
+	Product Product `json:"product"`
+}
+
+func getVariantIdBySku(sku string, redisConn redis.Conn) (int, error) {
+	id, err := redis.Int(redisConn.Do("HGET", config.KeySkus, normaliseSku(sku)))
+	if err == redis.ErrNil {
+		return 0, &notFoundError
+	}
+	return id, err
+}
+
+func sendVariantEvent(eventType string, variant *Variant, actor string, redisConn redis.Conn) error {
+	return sendEvent(CatalogueEvent{
+		Type:      eventType,
+		ProductId: variant.ProductId,
+		Actor:     actor,
+		Data:      variant,
+	}, redisConn)
+}
+
+// Helper functions
+func getVariantKeyName(id int) string {
+	return fmt.Sprintf(config.KeyVariant, id)
+}
+func getProductVariantsKeyName(productId int) string {
+	return fmt.Sprintf(config.KeyProductVariants, productId)
+}
+
+func sameKeys(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key := range a {
+		if _, ok := b[key]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func sameValues(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if b[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+func getSortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
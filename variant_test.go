@@ -0,0 +1,137 @@
+package main
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+	"gotest.tools/assert"
+	"testing"
+)
+
+func TestVariant_validate(t *testing.T) {
+	siblings := []Variant{
+		{Id: 1, Options: map[string]string{"hull colour": "black", "armament": "standard"}},
+		{Id: 2, Options: map[string]string{"hull colour": "red", "armament": "standard"}},
+	}
+
+	variant := Variant{Sku: " roci-blk-hvy ", Options: map[string]string{"hull colour": "black", "armament": "heavy"}, ImageIds: []int{5}}
+	assert.Equal(t, 0, len(variant.validate(siblings, []int{5, 6})))
+	assert.Equal(t, "ROCI-BLK-HVY", variant.Sku)
+
+	// The same options as another variant
+	variant = Variant{Sku: "ROCI-RED", Options: map[string]string{"hull colour": "red", "armament": "standard"}}
+	assert.DeepEqual(t, []string{"Variant 2 already has these options"}, variant.validate(siblings, nil))
+
+	// A variant can keep its own options when it's updated
+	variant.Id = 2
+	assert.Equal(t, 0, len(variant.validate(siblings, nil)))
+
+	// Different option axes than the other variants
+	variant = Variant{Sku: "ROCI-BIG", Options: map[string]string{"size": "big"}}
+	assert.DeepEqual(t, []string{"The options need to be armament, hull colour, like the other variants of the product"}, variant.validate(siblings, nil))
+
+	variant = Variant{Sku: "ROCI RED", Options: map[string]string{}, ImageIds: []int{7}}
+	assert.Equal(t, 3, len(variant.validate(nil, []int{5})))
+}
+
+func TestVariant_setPrice(t *testing.T) {
+	product := Product{PriceMinor: 1999, Currency: "EUR"}
+	product.setPrice()
+
+	variant := Variant{}
+	assert.NilError(t, variant.setPriceFromInput(product.Currency))
+	variant.setPrice(&product)
+	assert.Equal(t, Price{Amount: "19.99", Currency: "EUR"}, variant.Price)
+
+	variant = Variant{Price: Price{Amount: "24.5"}}
+	assert.NilError(t, variant.setPriceFromInput(product.Currency))
+	variant.setPrice(&product)
+	assert.Equal(t, Price{Amount: "24.50", Currency: "EUR"}, variant.Price)
+
+	variant = Variant{Price: Price{Amount: "3000", Currency: "JPY"}}
+	assert.NilError(t, variant.setPriceFromInput(product.Currency))
+	variant.setPrice(&product)
+	assert.Equal(t, Price{Amount: "3000", Currency: "JPY"}, variant.Price)
+}
+
+func TestSaveNewVariant(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("INCR", config.KeyVariantCounter).Expect(int64(3))
+	claim := conn.Command("HSETNX", config.KeySkus, "ROCI-RED", 3).Expect(int64(1))
+	conn.Command("MULTI").Expect("OK")
+	hset := conn.GenericCommand("HSET").Expect(int64(4))
+	zadd := conn.Command("ZADD", getProductVariantsKeyName(7), 3, 3).Expect(int64(1))
+	event := conn.GenericCommand("XADD").Expect("1567332000000-0")
+	conn.GenericCommand("PUBLISH").Expect(int64(0))
+	conn.Command("EXEC").Expect([]interface{}{})
+
+	variant := Variant{ProductId: 7, Sku: "ROCI-RED", Options: map[string]string{"hull colour": "red"}, ImageIds: []int{5, 6}}
+	err := saveNewVariant(&variant, "naomi", conn)
+	assert.NilError(t, err)
+
+	assert.Equal(t, 3, variant.Id)
+	assert.Equal(t, `{"hull colour":"red"}`, variant.OptionsJson)
+	assert.Equal(t, "5,6", variant.ImageIdsList)
+	assert.Equal(t, 1, conn.Stats(claim))
+	assert.Equal(t, 1, conn.Stats(hset))
+	assert.Equal(t, 1, conn.Stats(zadd))
+	assert.Equal(t, 1, conn.Stats(event))
+}
+
+func TestSaveNewVariant_duplicateSku(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("INCR", config.KeyVariantCounter).Expect(int64(3))
+	conn.Command("HSETNX", config.KeySkus, "ROCI-RED", 3).Expect(int64(0))
+	conn.Command("HGET", config.KeySkus, "ROCI-RED").Expect([]byte("1"))
+	multi := conn.Command("MULTI").Expect("OK")
+
+	variant := Variant{ProductId: 7, Sku: "ROCI-RED"}
+	err := saveNewVariant(&variant, "naomi", conn)
+	apiError, ok := err.(*ApiError)
+	assert.Assert(t, ok)
+	assert.Equal(t, 409, apiError.HttpStatus)
+	assert.Equal(t, 0, conn.Stats(multi))
+}
+
+func TestGetProductVariants(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("ZRANGE", getProductVariantsKeyName(7), 0, -1).Expect([]interface{}{[]byte("3"), []byte("4")})
+	conn.Command("HGETALL", getVariantKeyName(3)).ExpectMap(map[string]string{
+		"id":         "3",
+		"product_id": "7",
+		"sku":        "ROCI-RED",
+		"options":    `{"hull colour":"red"}`,
+		"image_ids":  "5",
+	})
+	conn.Command("HGETALL", getVariantKeyName(4)).ExpectMap(map[string]string{
+		"id":          "4",
+		"product_id":  "7",
+		"sku":         "ROCI-BLK",
+		"options":     `{"hull colour":"black"}`,
+		"price_minor": "2499",
+		"currency":    "EUR",
+		"image_ids":   "",
+	})
+
+	variants, err := getProductVariants(7, conn)
+	assert.NilError(t, err)
+	assert.Equal(t, 2, len(variants))
+	assert.Equal(t, "ROCI-RED", variants[0].Sku)
+	assert.DeepEqual(t, []int{5}, variants[0].ImageIds)
+	assert.DeepEqual(t, []int{}, variants[1].ImageIds)
+	assert.Equal(t, int64(2499), variants[1].PriceMinor)
+
+	assert.DeepEqual(t, map[string][]string{"hull colour": {"black", "red"}}, getOptionAxes(variants))
+}
+
+func TestGetVariantIdBySku(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("HGET", config.KeySkus, "ROCI-RED").Expect([]byte("3"))
+	conn.Command("HGET", config.KeySkus, "ROCI-BLUE").ExpectError(redis.ErrNil)
+
+	id, err := getVariantIdBySku("roci-red", conn)
+	assert.NilError(t, err)
+	assert.Equal(t, 3, id)
+
+	_, err = getVariantIdBySku("roci-blue", conn)
+	assert.Equal(t, err, &notFoundError)
+}
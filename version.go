@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"sort"
+	"time"
+)
+
+const (
+	ProductCreated  = "created"
+	ProductUpdated  = "updated"
+	ProductDeleted  = "deleted"
+	ProductRestored = "restored"
+	ProductPurged   = "purged"
+)
+
+//////////////////////
+// PRODUCT VERSION MODEL
+// Every change to a product is appended to a per-product list and never modified afterwards.
+// The version number is the (1-based) position in that list.
+//////////////////////
+type ProductVersion struct {
+	Version   int               `json:"version"`
+	Action    string            `json:"action"`
+	Actor     string            `json:"actor"`
+	Timestamp time.Time         `json:"timestamp"`
+	Data      map[string]string `json:"data"`
+}
+
+type FieldChange struct {
+	Field string `json:"field"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+}
+
+type ProductVersionDiff struct {
+	From    int           `json:"from"`
+	To      int           `json:"to"`
+	Changes []FieldChange `json:"changes"`
+}
+
+type PaginatedVersionCollection struct {
+	Data           []ProductVersion `json:"data"`
+	CurrentPage    int              `json:"current_page"`
+	ResultsPerPage int              `json:"per_page"`
+}
+
+// Takes a snapshot of the product as it's stored in its hash
+func getProductSnapshot(product *Product) map[string]string {
+	snapshot := make(map[string]string)
+	fields := redis.Args{}.AddFlat(product)
+	for i := 0; i < len(fields); i += 2 {
+		snapshot[fmt.Sprint(fields[i])] = fmt.Sprint(fields[i+1])
+	}
+	return snapshot
+}
+
+// Queues the RPUSH of a new version on the connection, so it's executed as a part of the caller's transaction
+func sendProductVersion(product *Product, action string, actor string, redisConn redis.Conn) error {
+	version := ProductVersion{
+		Action:    action,
+		Actor:     actor,
+		Timestamp: time.Now().UTC(),
+		Data:      getProductSnapshot(product),
+	}
+	encoded, err := json.Marshal(version)
+	if err != nil {
+		return err
+	}
+	return redisConn.Send("RPUSH", getProductVersionsKeyName(product.Id), encoded)
+}
+
+func decodeProductVersion(data []byte, number int) (ProductVersion, error) {
+	version := ProductVersion{}
+	err := json.Unmarshal(data, &version)
+	version.Version = number
+	return version, err
+}
+
+func getProductVersions(productId int, page int, redisConn redis.Conn) ([]ProductVersion, error) {
+	versions := make([]ProductVersion, 0)
+
+	fromPosition := (page - 1) * config.ResultsPerPage
+	toPosition := fromPosition + config.ResultsPerPage - 1
+	values, err := redis.ByteSlices(redisConn.Do("LRANGE", getProductVersionsKeyName(productId), fromPosition, toPosition))
+	if err != nil {
+		return versions, err
+	}
+
+	for i, value := range values {
+		version, err := decodeProductVersion(value, fromPosition+i+1)
+		if err != nil {
+			return versions, err
+		}
+		versions = append(versions, version)
+	}
+	return versions, nil
+}
+
+func getProductVersion(productId int, number int, redisConn redis.Conn) (ProductVersion, error) {
+	if number < 1 {
+		return ProductVersion{}, &notFoundError
+	}
+	value, err := redis.Bytes(redisConn.Do("LINDEX", getProductVersionsKeyName(productId), number-1))
+	if err == redis.ErrNil {
+		return ProductVersion{}, &notFoundError
+	}
+	if err != nil {
+		return ProductVersion{}, err
+	}
+	return decodeProductVersion(value, number)
+}
+
+// Lists the fields that have a different value in the two versions
+func diffProductVersions(from ProductVersion, to ProductVersion) ProductVersionDiff {
+	return ProductVersionDiff{
+		From:    from.Version,
+		To:      to.Version,
+		Changes: diffSnapshots(from.Data, to.Data),
+	}
+}
+
+func diffSnapshots(from map[string]string, to map[string]string) []FieldChange {
+	changes := make([]FieldChange, 0)
+
+	fields := make(map[string]bool)
+	for field := range from {
+		fields[field] = true
+	}
+	for field := range to {
+		fields[field] = true
+	}
+	sortedFields := make([]string, 0, len(fields))
+	for field := range fields {
+		sortedFields = append(sortedFields, field)
+	}
+	sort.Strings(sortedFields)
+
+	for _, field := range sortedFields {
+		if from[field] != to[field] {
+			changes = append(changes, FieldChange{
+				Field: field,
+				From:  from[field],
+				To:    to[field],
+			})
+		}
+	}
+	return changes
+}
+
+// Brings the product back to the state it had in the given version.
+// If the product has been deleted in the meantime it's recreated under the same id.
+func restoreProductVersion(productId int, number int, actor string, redisConn redis.Conn) (Product, error) {
+	version, err := getProductVersion(productId, number, redisConn)
+	if err != nil {
+		return Product{}, err
+	}
+
+	product := Product{}
+	err = scanProduct(stringMapToValues(version.Data), &product)
+	if err != nil {
+		return Product{}, err
+	}
+	// Versions recorded before prices were stored in minor units have the price as a decimal
+	if legacyPrice, ok := version.Data["price"]; ok && version.Data["price_minor"] == "" {
+		product.PriceMinor, _ = roundToMinorUnits(legacyPrice, getCurrencyExponent(product.Currency))
+		product.setPrice()
+	}
+	product.Id = productId
+	// Restoring the version that was recorded on deletion shouldn't put the product back in the trash
+	product.DeletedAt = 0
+
+	categoryName, err := getCategoryNameById(product.MainCategoryId, redisConn)
+	if err != nil {
+		return Product{}, &ApiError{
+			HttpStatus:  422,
+			Title:       "Category doesn't exist",
+			Description: "The category of this version doesn't exist in our system anymore",
+		}
+	}
+	product.MainCategoryName = categoryName
+
+	oldProduct, err := getProductById(productId, redisConn)
+	if err == &notFoundError {
+		// The slug of the version could have been freed and claimed by another product since
+		err = product.updateSlug(product.Slug, redisConn)
+		if err == nil {
+			err = insertProduct(&product, ProductRestored, actor, redisConn)
+		}
+	} else if err == nil {
+		err = product.updateSlug(oldProduct.Slug, redisConn)
+		if err == nil {
+			err = saveProductChanges(&product, &oldProduct, ProductRestored, actor, redisConn)
+		}
+	}
+	if err != nil {
+		return Product{}, err
+	}
+
+	return product, nil
+}
+
+func getProductVersionsKeyName(productId int) string {
+	return fmt.Sprintf(config.KeyProductVersions, productId)
+}
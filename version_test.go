@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/rafaeljusto/redigomock"
+	"gotest.tools/assert"
+	"testing"
+	"time"
+)
+
+func TestGetProductSnapshot(t *testing.T) {
+	product := Product{
+		Id:             7,
+		Name:           "Rocinante",
+		PriceMinor:     1999,
+		Currency:       "EUR",
+		MainCategoryId: 2,
+	}
+
+	snapshot := getProductSnapshot(&product)
+
+	assert.Equal(t, "7", snapshot["id"])
+	assert.Equal(t, "Rocinante", snapshot["name"])
+	assert.Equal(t, "1999", snapshot["price_minor"])
+	assert.Equal(t, "2", snapshot["main_category_id"])
+	_, ok := snapshot["main_category"]
+	assert.Assert(t, !ok, "Fields that aren't stored in the hash shouldn't be a part of the snapshot")
+}
+
+func TestDiffProductVersions(t *testing.T) {
+	from := ProductVersion{Version: 1, Data: map[string]string{"name": "Rocinante", "price": "10", "vendor": "MCRN"}}
+	to := ProductVersion{Version: 3, Data: map[string]string{"name": "Rocinante", "price": "12", "vendor": "OPA"}}
+
+	diff := diffProductVersions(from, to)
+
+	assert.DeepEqual(t, diff, ProductVersionDiff{
+		From: 1,
+		To:   3,
+		Changes: []FieldChange{
+			{Field: "price", From: "10", To: "12"},
+			{Field: "vendor", From: "MCRN", To: "OPA"},
+		},
+	})
+}
+
+func TestGetProductVersion(t *testing.T) {
+	stored, _ := json.Marshal(ProductVersion{
+		Action:    ProductUpdated,
+		Actor:     "naomi",
+		Timestamp: time.Date(2019, 9, 1, 10, 0, 0, 0, time.UTC),
+		Data:      map[string]string{"name": "Rocinante"},
+	})
+
+	conn := redigomock.NewConn()
+	conn.Command("LINDEX", getProductVersionsKeyName(7), 1).Expect(stored)
+	conn.Command("LINDEX", getProductVersionsKeyName(7), 5).Expect(nil)
+
+	version, err := getProductVersion(7, 2, conn)
+	assert.NilError(t, err)
+	assert.Equal(t, 2, version.Version)
+	assert.Equal(t, "naomi", version.Actor)
+	assert.Equal(t, "Rocinante", version.Data["name"])
+
+	_, err = getProductVersion(7, 6, conn)
+	assert.Equal(t, err, &notFoundError)
+
+	_, err = getProductVersion(7, 0, conn)
+	assert.Equal(t, err, &notFoundError)
+}
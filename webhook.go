@@ -0,0 +1,665 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// Events another consumer has had pending for this long are taken over, the consumer has most likely died
+const webhookClaimAfter = time.Minute
+
+// How long we remember which deliveries were created for an event, well past the time it can stay unacknowledged
+const webhookDispatchMarkerTtl = 24 * time.Hour
+
+var knownEventTypes = []string{
+	EventProductCreated,
+	EventProductUpdated,
+	EventProductDeleted,
+	EventProductRestored,
+	EventProductPurged,
+	EventImageAdded,
+	EventImageDeleted,
+	EventVariantCreated,
+	EventVariantUpdated,
+	EventVariantDeleted,
+	EventTranslationUpdated,
+	EventTranslationDeleted,
+}
+
+//////////////////////
+// WEBHOOK MODEL
+//////////////////////
+type Webhook struct {
+	Id         int      `redis:"id" json:"id"`
+	Url        string   `redis:"url" json:"url"`
+	EventTypes []string `redis:"-" json:"event_types"`
+	Secret     string   `redis:"secret" json:"secret,omitempty"`
+	CreatedAt  int64    `redis:"created_at" json:"created_at"`
+
+	// Event types are stored in the hash as a comma separated list
+	EventTypesList string `redis:"event_types" json:"-"`
+}
+
+type WebhookDelivery struct {
+	Id             int    `redis:"id" json:"id"`
+	WebhookId      int    `redis:"webhook_id" json:"webhook_id"`
+	EventId        string `redis:"event_id" json:"event_id"`
+	EventType      string `redis:"event_type" json:"event_type"`
+	Payload        string `redis:"payload" json:"-"`
+	Status         string `redis:"status" json:"status"`
+	Attempts       int    `redis:"attempts" json:"attempts"`
+	LastStatusCode int    `redis:"last_status_code" json:"last_status_code,omitempty"`
+	LastError      string `redis:"last_error" json:"last_error,omitempty"`
+	NextAttemptAt  int64  `redis:"next_attempt_at" json:"next_attempt_at,omitempty"`
+	CreatedAt      int64  `redis:"created_at" json:"created_at"`
+	UpdatedAt      int64  `redis:"updated_at" json:"updated_at"`
+}
+
+// Returns a list of validation errors, or an empty list if the webhook is valid
+func (webhook *Webhook) validate() []string {
+	errs := make([]string, 0)
+
+	u, err := url.Parse(webhook.Url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, "The url needs to be a valid http or https url")
+	}
+	for _, eventType := range webhook.EventTypes {
+		if !stringInSlice(eventType, knownEventTypes) {
+			errs = append(errs, fmt.Sprintf("Unknown event type %q", eventType))
+		}
+	}
+	return errs
+}
+
+// A webhook without event types gets all events
+func (webhook *Webhook) wantsEvent(eventType string) bool {
+	return len(webhook.EventTypes) == 0 || stringInSlice(eventType, webhook.EventTypes)
+}
+
+func saveNewWebhook(webhook *Webhook, redisConn redis.Conn) error {
+	id, err := redis.Int(redisConn.Do("INCR", config.KeyWebhookCounter))
+	if err != nil {
+		return err
+	}
+	webhook.Id = id
+	webhook.CreatedAt = time.Now().Unix()
+	webhook.EventTypesList = strings.Join(webhook.EventTypes, ",")
+	if webhook.Secret == "" {
+		webhook.Secret = generateRequestId()
+	}
+
+	_, err = redisConn.Do("MULTI")
+	if err != nil {
+		return err
+	}
+	_ = redisConn.Send("HSET", redis.Args{getWebhookKeyName(webhook.Id)}.AddFlat(webhook)...)
+	_ = redisConn.Send("SADD", config.KeyWebhooks, webhook.Id)
+	_, err = redisConn.Do("EXEC")
+	return err
+}
+
+func getWebhookById(id int, redisConn redis.Conn) (Webhook, error) {
+	values, err := redis.Values(redisConn.Do("HGETALL", getWebhookKeyName(id)))
+	if err != nil {
+		return Webhook{}, err
+	}
+	if len(values) == 0 {
+		return Webhook{}, &notFoundError
+	}
+
+	webhook := Webhook{}
+	err = redis.ScanStruct(values, &webhook)
+	if err != nil {
+		return Webhook{}, err
+	}
+	webhook.EventTypes = make([]string, 0)
+	if webhook.EventTypesList != "" {
+		webhook.EventTypes = strings.Split(webhook.EventTypesList, ",")
+	}
+	return webhook, nil
+}
+
+func getWebhooks(redisConn redis.Conn) ([]Webhook, error) {
+	webhooks := make([]Webhook, 0)
+	ids, err := redis.Ints(redisConn.Do("SMEMBERS", config.KeyWebhooks))
+	if err != nil {
+		return webhooks, err
+	}
+	for _, id := range ids {
+		webhook, err := getWebhookById(id, redisConn)
+		if err == &notFoundError {
+			continue
+		}
+		if err != nil {
+			return webhooks, err
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, nil
+}
+
+func deleteWebhook(id int, redisConn redis.Conn) error {
+	removed, err := redis.Int(redisConn.Do("SREM", config.KeyWebhooks, id))
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return &notFoundError
+	}
+	_, err = redisConn.Do("DEL", getWebhookKeyName(id), getWebhookDeliveriesKeyName(id))
+	return err
+}
+
+// The most recent deliveries of a webhook, newest first
+func getWebhookDeliveries(webhookId int, redisConn redis.Conn) ([]WebhookDelivery, error) {
+	ids, err := redis.Ints(redisConn.Do("LRANGE", getWebhookDeliveriesKeyName(webhookId), 0, config.ResultsPerPage-1))
+	if err != nil {
+		return make([]WebhookDelivery, 0), err
+	}
+	return getDeliveriesByIds(ids, redisConn)
+}
+
+func getDeadLetterDeliveries(redisConn redis.Conn) ([]WebhookDelivery, error) {
+	ids, err := redis.Ints(redisConn.Do("LRANGE", config.KeyWebhookDeadLetter, 0, config.ResultsPerPage-1))
+	if err != nil {
+		return make([]WebhookDelivery, 0), err
+	}
+	return getDeliveriesByIds(ids, redisConn)
+}
+
+func getDeliveriesByIds(ids []int, redisConn redis.Conn) ([]WebhookDelivery, error) {
+	deliveries := make([]WebhookDelivery, 0)
+	for _, id := range ids {
+		delivery, err := getDeliveryById(id, redisConn)
+		if err == &notFoundError {
+			// Old deliveries expire
+			continue
+		}
+		if err != nil {
+			return deliveries, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
+
+func getDeliveryById(id int, redisConn redis.Conn) (WebhookDelivery, error) {
+	values, err := redis.Values(redisConn.Do("HGETALL", getWebhookDeliveryKeyName(id)))
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+	if len(values) == 0 {
+		return WebhookDelivery{}, &notFoundError
+	}
+	delivery := WebhookDelivery{}
+	err = redis.ScanStruct(values, &delivery)
+	return delivery, err
+}
+
+//////////////////////
+// DELIVERY
+//////////////////////
+
+// Signs the body with the webhook's secret, so receivers can verify the request came from us
+func signWebhookPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Exponential backoff: base, 2*base, 4*base... capped at one day
+func webhookBackoff(attempts int) time.Duration {
+	delay := time.Duration(config.WebhookRetryBaseDelay) * time.Second
+	for i := 1; i < attempts && delay < 24*time.Hour; i++ {
+		delay *= 2
+	}
+	if delay > 24*time.Hour {
+		delay = 24 * time.Hour
+	}
+	return delay
+}
+
+func sendWebhookRequest(client *http.Client, webhook *Webhook, delivery *WebhookDelivery) (int, error) {
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequest(http.MethodPost, webhook.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "product-catalogue-webhooks/1.0")
+	req.Header.Set("X-Webhook-Event", delivery.EventType)
+	req.Header.Set("X-Webhook-Delivery", strconv.Itoa(delivery.Id))
+	req.Header.Set("X-Webhook-Signature", signWebhookPayload(webhook.Secret, body))
+
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("the receiver responded with status %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+// Creates a delivery of the event for every webhook that subscribed to it. The first attempt is
+// scheduled right away and made by the delivery workers, like every retry.
+func dispatchEvent(event CatalogueEvent, redisConn redis.Conn) error {
+	webhooks, err := getWebhooks(redisConn)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	for _, webhook := range webhooks {
+		if !webhook.wantsEvent(event.Type) {
+			continue
+		}
+
+		id, err := redis.Int(redisConn.Do("INCR", config.KeyWebhookDeliveryCounter))
+		if err != nil {
+			return err
+		}
+		// An event is dispatched again when storing its deliveries failed partway, so every webhook gets its
+		// delivery id reserved once and the delivery is only stored if it isn't there yet
+		markerKey := getWebhookEventDeliveriesKeyName(event.Id)
+		reserved, err := redis.Bool(redisConn.Do("HSETNX", markerKey, webhook.Id, id))
+		if err != nil {
+			return err
+		}
+		if !reserved {
+			id, err = redis.Int(redisConn.Do("HGET", markerKey, webhook.Id))
+			if err != nil {
+				return err
+			}
+			stored, err := redis.Bool(redisConn.Do("EXISTS", getWebhookDeliveryKeyName(id)))
+			if err != nil {
+				return err
+			}
+			if stored {
+				continue
+			}
+		}
+		now := time.Now().Unix()
+		delivery := WebhookDelivery{
+			Id:            id,
+			WebhookId:     webhook.Id,
+			EventId:       event.Id,
+			EventType:     event.Type,
+			Payload:       string(payload),
+			Status:        DeliveryPending,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+			UpdatedAt:     now,
+		}
+
+		_, err = redisConn.Do("MULTI")
+		if err != nil {
+			return err
+		}
+		_ = redisConn.Send("HSET", redis.Args{getWebhookDeliveryKeyName(delivery.Id)}.AddFlat(&delivery)...)
+		_ = redisConn.Send("LPUSH", getWebhookDeliveriesKeyName(webhook.Id), delivery.Id)
+		_ = redisConn.Send("LTRIM", getWebhookDeliveriesKeyName(webhook.Id), 0, 99)
+		_ = redisConn.Send("ZADD", config.KeyWebhookRetries, delivery.NextAttemptAt, delivery.Id)
+		_ = redisConn.Send("EXPIRE", markerKey, int(webhookDispatchMarkerTtl/time.Second))
+		_, err = redisConn.Do("EXEC")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Makes one attempt at delivering and records the outcome: delivered, scheduled for a retry, or moved to the dead letter list
+func attemptDelivery(webhook *Webhook, delivery *WebhookDelivery, client *http.Client, redisConn redis.Conn) error {
+	statusCode, sendErr := sendWebhookRequest(client, webhook, delivery)
+
+	delivery.Attempts++
+	delivery.LastStatusCode = statusCode
+	delivery.UpdatedAt = time.Now().Unix()
+	delivery.LastError = ""
+	delivery.NextAttemptAt = 0
+	if sendErr == nil {
+		delivery.Status = DeliveryDelivered
+	} else if delivery.Attempts >= config.WebhookMaxAttempts {
+		delivery.Status = DeliveryFailed
+		delivery.LastError = sendErr.Error()
+	} else {
+		delivery.Status = DeliveryPending
+		delivery.LastError = sendErr.Error()
+		delivery.NextAttemptAt = time.Now().Add(webhookBackoff(delivery.Attempts)).Unix()
+	}
+
+	_, err := redisConn.Do("MULTI")
+	if err != nil {
+		return err
+	}
+	deliveryKeyName := getWebhookDeliveryKeyName(delivery.Id)
+	_ = redisConn.Send("HSET", redis.Args{deliveryKeyName}.AddFlat(delivery)...)
+	_ = redisConn.Send("EXPIRE", deliveryKeyName, config.WebhookDeliveryRetention*3600)
+	switch delivery.Status {
+	case DeliveryPending:
+		_ = redisConn.Send("ZADD", config.KeyWebhookRetries, delivery.NextAttemptAt, delivery.Id)
+	case DeliveryFailed:
+		_ = redisConn.Send("ZREM", config.KeyWebhookRetries, delivery.Id)
+		_ = redisConn.Send("LPUSH", config.KeyWebhookDeadLetter, delivery.Id)
+		_ = redisConn.Send("LTRIM", config.KeyWebhookDeadLetter, 0, 99)
+	default:
+		_ = redisConn.Send("ZREM", config.KeyWebhookRetries, delivery.Id)
+	}
+	_, err = redisConn.Do("EXEC")
+	return err
+}
+
+// A delivery attempt handed to the delivery workers, with the key prefix of the catalogue it belongs to
+type deliveryJob struct {
+	keyPrefix string
+	webhook   Webhook
+	delivery  WebhookDelivery
+}
+
+// KEYS: delivery schedule. ARGV: delivery id, now, lease expiry timestamp.
+// Moves a due delivery's next attempt to the end of the lease. Returns 0 if it isn't due, ex. because another instance leased it.
+var leaseDeliveryScript = redis.NewScript(1, `
+local due = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if not due or tonumber(due) > tonumber(ARGV[2]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[3], ARGV[1])
+return 1
+`)
+
+// Leases the deliveries whose next attempt is due and queues them for the delivery workers. A delivery stays on the
+// schedule until its attempt is recorded, so if we die before that it's due again once the lease runs out.
+// It stops when the queue is full, and the remaining deliveries stay due for the next pass.
+func queueDueDeliveries(now time.Time, jobs chan<- deliveryJob, redisConn redis.Conn) error {
+	// A job can wait in the queue for about as long as an attempt takes, the lease covers both with room to spare
+	lease := 3 * time.Duration(config.WebhookTimeout) * time.Second
+
+	ids, err := redis.Ints(redisConn.Do("ZRANGEBYSCORE", config.KeyWebhookRetries, "-inf", now.Unix(), "LIMIT", 0, 50))
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		// The dispatcher is the only one queueing jobs, so the send below can't block
+		if len(jobs) == cap(jobs) {
+			return nil
+		}
+
+		// Only one instance gets the lease on the delivery, and that one attempts it
+		leased, err := redis.Int(leaseDeliveryScript.Do(redisConn, config.KeyWebhookRetries, id, now.Unix(), now.Add(lease).Unix()))
+		if err != nil {
+			return err
+		}
+		if leased == 0 {
+			continue
+		}
+
+		delivery, err := getDeliveryById(id, redisConn)
+		if err == &notFoundError {
+			_, err = redisConn.Do("ZREM", config.KeyWebhookRetries, id)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		webhook, err := getWebhookById(delivery.WebhookId, redisConn)
+		if err == &notFoundError {
+			// The webhook was deleted in the meantime
+			_, err = redisConn.Do("ZREM", config.KeyWebhookRetries, id)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		jobs <- deliveryJob{keyPrefix: getKeyPrefix(redisConn), webhook: webhook, delivery: delivery}
+	}
+	return nil
+}
+
+// Makes the queued delivery attempts, each with its own connection, so a slow receiver only holds up one worker
+func runDeliveryWorker(jobs <-chan deliveryJob, client *http.Client) {
+	for job := range jobs {
+		conn := namespaceConn(pool.Get(), job.keyPrefix)
+		err := attemptDelivery(&job.webhook, &job.delivery, client, conn)
+		if err != nil {
+			logger.Error("Unable to record a webhook delivery attempt", Fields{"error": err, "delivery": job.delivery.Id})
+		}
+		_ = conn.Close()
+	}
+}
+
+// Reads new events from the event stream through a consumer group (so every event is handled
+// by only one instance of the service), turns them into deliveries and queues the due ones
+// for the delivery workers.
+func runWebhookDispatcher(ctx context.Context) {
+	client := &http.Client{Timeout: time.Duration(config.WebhookTimeout) * time.Second}
+	hostname, _ := os.Hostname()
+	consumer := fmt.Sprintf("%s-%d", hostname, os.Getpid())
+
+	jobs := make(chan deliveryJob, config.WebhookConcurrency)
+	var deliveryWorkers sync.WaitGroup
+	for i := 0; i < config.WebhookConcurrency; i++ {
+		deliveryWorkers.Add(1)
+		go func() {
+			defer deliveryWorkers.Done()
+			runDeliveryWorker(jobs, client)
+		}()
+	}
+	// Attempts in flight are finished before we stop
+	defer func() {
+		close(jobs)
+		deliveryWorkers.Wait()
+	}()
+
+	// Tenants get their consumer group when they're provisioned
+	conn := pool.Get()
+	if err := createWebhookConsumerGroup(conn); err != nil {
+		logger.Error("Unable to create the webhooks consumer group", Fields{"error": err})
+	}
+	_ = conn.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		conn := pool.Get()
+		namespaces, err := getNamespaces(conn)
+		failedNamespace := ""
+		if err == nil {
+			// With a single catalogue we can wait for its events, otherwise we go through all the streams once per second
+			block := len(namespaces) == 1
+			for _, namespace := range namespaces {
+				namespacedConn := namespaceConn(conn, namespace)
+				err = processEventBatch(consumer, block, namespacedConn)
+				if err == nil {
+					err = queueDueDeliveries(time.Now(), jobs, namespacedConn)
+				}
+				if err != nil {
+					failedNamespace = namespace
+					break
+				}
+			}
+			if err == nil && !block {
+				select {
+				case <-ctx.Done():
+				case <-time.After(time.Second):
+				}
+			}
+		}
+		_ = conn.Close()
+
+		if err != nil {
+			logger.Error("Webhook dispatcher error", Fields{"error": err, "namespace": failedNamespace})
+			// Don't spin if Redis is unavailable
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(5 * time.Second):
+			}
+		}
+	}
+}
+
+func createWebhookConsumerGroup(redisConn redis.Conn) error {
+	_, err := redisConn.Do("XGROUP", "CREATE", config.KeyEventStream, config.WebhookConsumerGroup, "$", "MKSTREAM")
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	return nil
+}
+
+// Events that were read but never acknowledged, because dispatching them failed or the instance that
+// read them died, are dispatched before any new ones. An event is only acknowledged once its deliveries are stored.
+func processEventBatch(consumer string, block bool, redisConn redis.Conn) error {
+	err := claimStaleEvents(consumer, redisConn)
+	if err != nil {
+		return err
+	}
+	events, err := readEventGroup(consumer, "0", false, redisConn)
+	if err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		events, err = readEventGroup(consumer, ">", block, redisConn)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, event := range events {
+		if err := dispatchEvent(event, redisConn); err != nil {
+			return err
+		}
+		_, _ = redisConn.Do("XACK", config.KeyEventStream, config.WebhookConsumerGroup, event.Id)
+	}
+	return nil
+}
+
+// Moves the events other consumers have left unacknowledged for too long to this consumer's pending list
+func claimStaleEvents(consumer string, redisConn redis.Conn) error {
+	pending, err := redis.Values(redisConn.Do("XPENDING", config.KeyEventStream, config.WebhookConsumerGroup, "-", "+", 20))
+	if err != nil {
+		return err
+	}
+
+	ids := make([]interface{}, 0)
+	for _, entry := range pending {
+		// Every entry is an [id, consumer, idle milliseconds, delivery count] list
+		values, err := redis.Values(entry, nil)
+		if err != nil || len(values) != 4 {
+			return errInvalidStreamEntry
+		}
+		owner, _ := redis.String(values[1], nil)
+		idle, _ := redis.Int64(values[2], nil)
+		if owner != consumer && time.Duration(idle)*time.Millisecond >= webhookClaimAfter {
+			ids = append(ids, values[0])
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	minIdle := int64(webhookClaimAfter / time.Millisecond)
+	args := redis.Args{config.KeyEventStream, config.WebhookConsumerGroup, consumer, minIdle}.Add(ids...).Add("JUSTID")
+	_, err = redisConn.Do("XCLAIM", args...)
+	return err
+}
+
+// Reads a batch of events through the consumer group: id ">" returns new events, "0" the ones that were
+// read by this consumer before but not acknowledged
+func readEventGroup(consumer string, id string, block bool, redisConn redis.Conn) ([]CatalogueEvent, error) {
+	events := make([]CatalogueEvent, 0)
+
+	args := redis.Args{"GROUP", config.WebhookConsumerGroup, consumer, "COUNT", 20}
+	if block {
+		// Block for a second at most, so we get to check for due retries and shutdowns regularly
+		args = args.Add("BLOCK", 1000)
+	}
+	reply, err := redisConn.Do("XREADGROUP", args.Add("STREAMS", config.KeyEventStream, id)...)
+	if err != nil || reply == nil {
+		return events, err
+	}
+
+	streams, err := redis.Values(reply, nil)
+	if err != nil {
+		return events, err
+	}
+	for _, stream := range streams {
+		// Every stream is a [name, entries] pair
+		streamValues, err := redis.Values(stream, nil)
+		if err != nil || len(streamValues) != 2 {
+			return events, errInvalidStreamEntry
+		}
+		entries, err := redis.Values(streamValues[1], nil)
+		if err != nil {
+			return events, err
+		}
+
+		for _, entry := range entries {
+			entryValues, err := redis.Values(entry, nil)
+			if err != nil {
+				return events, err
+			}
+			if len(entryValues) == 2 && entryValues[1] == nil {
+				// A pending event that has been trimmed from the stream since, there's nothing left to dispatch
+				_, _ = redisConn.Do("XACK", config.KeyEventStream, config.WebhookConsumerGroup, entryValues[0])
+				continue
+			}
+			event, err := parseStreamEntry(entryValues)
+			if err != nil {
+				return events, err
+			}
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+func getWebhookKeyName(id int) string {
+	return fmt.Sprintf(config.KeyWebhook, id)
+}
+func getWebhookDeliveriesKeyName(webhookId int) string {
+	return fmt.Sprintf(config.KeyWebhookDeliveries, webhookId)
+}
+func getWebhookDeliveryKeyName(id int) string {
+	return fmt.Sprintf(config.KeyWebhookDelivery, id)
+}
+func getWebhookEventDeliveriesKeyName(eventId string) string {
+	return fmt.Sprintf(config.KeyWebhookEventDeliveries, eventId)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/rafaeljusto/redigomock"
+	"gotest.tools/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhook_validate(t *testing.T) {
+	webhook := Webhook{Url: "https://partner.example.com/hooks", EventTypes: []string{EventProductCreated}}
+	assert.Equal(t, 0, len(webhook.validate()))
+
+	webhook = Webhook{Url: "ftp://partner.example.com", EventTypes: []string{"product.exploded"}}
+	assert.DeepEqual(t, webhook.validate(), []string{
+		"The url needs to be a valid http or https url",
+		`Unknown event type "product.exploded"`,
+	})
+}
+
+func TestWebhook_wantsEvent(t *testing.T) {
+	all := Webhook{}
+	assert.Assert(t, all.wantsEvent(EventImageAdded))
+
+	some := Webhook{EventTypes: []string{EventProductCreated}}
+	assert.Assert(t, some.wantsEvent(EventProductCreated))
+	assert.Assert(t, !some.wantsEvent(EventImageAdded))
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	base := time.Duration(config.WebhookRetryBaseDelay) * time.Second
+	assert.Equal(t, base, webhookBackoff(1))
+	assert.Equal(t, 2*base, webhookBackoff(2))
+	assert.Equal(t, 8*base, webhookBackoff(4))
+	assert.Equal(t, 24*time.Hour, webhookBackoff(50))
+}
+
+func TestSendWebhookRequest_signsPayload(t *testing.T) {
+	var signature, eventType string
+	var body []byte
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signature = r.Header.Get("X-Webhook-Signature")
+		eventType = r.Header.Get("X-Webhook-Event")
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer receiver.Close()
+
+	webhook := Webhook{Url: receiver.URL, Secret: "s3cret"}
+	delivery := WebhookDelivery{Id: 1, EventType: EventProductCreated, Payload: `{"type":"product.created"}`}
+
+	status, err := sendWebhookRequest(receiver.Client(), &webhook, &delivery)
+	assert.NilError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, EventProductCreated, eventType)
+	assert.Equal(t, delivery.Payload, string(body))
+
+	// The receiver should be able to verify the signature with the shared secret
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(body)
+	assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), signature)
+}
+
+func TestAttemptDelivery_schedulesRetry(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer receiver.Close()
+
+	conn := redigomock.NewConn()
+	conn.Command("MULTI").Expect("OK")
+	conn.GenericCommand("HSET").Expect(int64(1))
+	conn.GenericCommand("EXPIRE").Expect(int64(1))
+	retry := conn.GenericCommand("ZADD").Expect(int64(1))
+	conn.Command("EXEC").Expect([]interface{}{})
+
+	webhook := Webhook{Id: 1, Url: receiver.URL, Secret: "s3cret"}
+	delivery := WebhookDelivery{Id: 5, WebhookId: 1, Status: DeliveryPending}
+
+	err := attemptDelivery(&webhook, &delivery, receiver.Client(), conn)
+	assert.NilError(t, err)
+
+	assert.Equal(t, DeliveryPending, delivery.Status)
+	assert.Equal(t, 1, delivery.Attempts)
+	assert.Equal(t, http.StatusServiceUnavailable, delivery.LastStatusCode)
+	assert.Assert(t, delivery.NextAttemptAt > time.Now().Unix())
+	assert.Equal(t, 1, conn.Stats(retry))
+}
+
+func TestAttemptDelivery_movesToDeadLetter(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	conn := redigomock.NewConn()
+	conn.Command("MULTI").Expect("OK")
+	conn.GenericCommand("HSET").Expect(int64(1))
+	conn.GenericCommand("EXPIRE").Expect(int64(1))
+	unscheduled := conn.Command("ZREM", config.KeyWebhookRetries, 5).Expect(int64(1))
+	deadLetter := conn.Command("LPUSH", config.KeyWebhookDeadLetter, 5).Expect(int64(1))
+	trim := conn.Command("LTRIM", config.KeyWebhookDeadLetter, 0, 99).Expect("OK")
+	conn.Command("EXEC").Expect([]interface{}{})
+
+	webhook := Webhook{Id: 1, Url: receiver.URL}
+	delivery := WebhookDelivery{Id: 5, WebhookId: 1, Attempts: config.WebhookMaxAttempts - 1}
+
+	err := attemptDelivery(&webhook, &delivery, receiver.Client(), conn)
+	assert.NilError(t, err)
+
+	assert.Equal(t, DeliveryFailed, delivery.Status)
+	assert.Equal(t, 1, conn.Stats(unscheduled))
+	assert.Equal(t, 1, conn.Stats(deadLetter))
+	assert.Equal(t, 1, conn.Stats(trim))
+}
+
+func TestQueueDueDeliveries_leasesDeliveries(t *testing.T) {
+	now := time.Unix(1000, 0)
+	leaseEnd := now.Add(3 * time.Duration(config.WebhookTimeout) * time.Second).Unix()
+
+	conn := redigomock.NewConn()
+	conn.Command("ZRANGEBYSCORE", config.KeyWebhookRetries, "-inf", int64(1000), "LIMIT", 0, 50).Expect([]interface{}{[]byte("5"), []byte("6")})
+	// Another instance leased the second delivery in the meantime
+	conn.Command("EVALSHA", leaseDeliveryScript.Hash(), 1, config.KeyWebhookRetries, 5, int64(1000), leaseEnd).Expect(int64(1))
+	conn.Command("EVALSHA", leaseDeliveryScript.Hash(), 1, config.KeyWebhookRetries, 6, int64(1000), leaseEnd).Expect(int64(0))
+	conn.Command("HGETALL", getWebhookDeliveryKeyName(5)).ExpectMap(map[string]string{"id": "5", "webhook_id": "1", "status": DeliveryPending})
+	conn.Command("HGETALL", getWebhookKeyName(1)).ExpectMap(map[string]string{"id": "1", "url": "https://one.example.com"})
+	unscheduled := conn.GenericCommand("ZREM").Expect(int64(1))
+
+	jobs := make(chan deliveryJob, 2)
+	assert.NilError(t, queueDueDeliveries(now, jobs, conn))
+
+	// The leased delivery stays on the schedule until its attempt is recorded
+	assert.Equal(t, 1, len(jobs))
+	assert.Equal(t, 5, (<-jobs).delivery.Id)
+	assert.Equal(t, 0, conn.Stats(unscheduled))
+}
+
+func TestAttemptDelivery_unschedulesDelivered(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer receiver.Close()
+
+	conn := redigomock.NewConn()
+	conn.Command("MULTI").Expect("OK")
+	conn.GenericCommand("HSET").Expect(int64(1))
+	conn.GenericCommand("EXPIRE").Expect(int64(1))
+	unscheduled := conn.Command("ZREM", config.KeyWebhookRetries, 5).Expect(int64(1))
+	conn.Command("EXEC").Expect([]interface{}{})
+
+	webhook := Webhook{Id: 1, Url: receiver.URL}
+	delivery := WebhookDelivery{Id: 5, WebhookId: 1, Status: DeliveryPending}
+
+	err := attemptDelivery(&webhook, &delivery, receiver.Client(), conn)
+	assert.NilError(t, err)
+
+	assert.Equal(t, DeliveryDelivered, delivery.Status)
+	assert.Equal(t, 1, conn.Stats(unscheduled))
+}
+
+func TestProcessEventBatch_recoversPendingEvents(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("XPENDING", config.KeyEventStream, config.WebhookConsumerGroup, "-", "+", 20).Expect([]interface{}{
+		[]interface{}{[]byte("1-0"), []byte("host-1"), int64(1000), int64(1)},
+		[]interface{}{[]byte("2-0"), []byte("host-2"), int64(120000), int64(1)},
+	})
+	claim := conn.Command("XCLAIM", config.KeyEventStream, config.WebhookConsumerGroup, "host-1", int64(60000), []byte("2-0"), "JUSTID").
+		Expect([]interface{}{[]byte("2-0")})
+	conn.Command("XREADGROUP", "GROUP", config.WebhookConsumerGroup, "host-1", "COUNT", 20, "STREAMS", config.KeyEventStream, "0").Expect([]interface{}{
+		[]interface{}{[]byte(config.KeyEventStream), []interface{}{
+			[]interface{}{[]byte("1-0"), []interface{}{[]byte("type"), []byte(EventProductCreated), []byte("product_id"), []byte("7")}},
+			[]interface{}{[]byte("2-0"), nil},
+		}},
+	})
+	newEvents := conn.Command("XREADGROUP", "GROUP", config.WebhookConsumerGroup, "host-1", "COUNT", 20, "STREAMS", config.KeyEventStream, ">").Expect(nil)
+	conn.Command("SMEMBERS", config.KeyWebhooks).Expect([]interface{}{})
+	ackDispatched := conn.Command("XACK", config.KeyEventStream, config.WebhookConsumerGroup, "1-0").Expect(int64(1))
+	ackTrimmed := conn.Command("XACK", config.KeyEventStream, config.WebhookConsumerGroup, []byte("2-0")).Expect(int64(1))
+
+	assert.NilError(t, processEventBatch("host-1", true, conn))
+
+	// Only the other consumer's stale event is claimed, and no new events are read while old ones are pending
+	assert.Equal(t, 1, conn.Stats(claim))
+	assert.Equal(t, 0, conn.Stats(newEvents))
+	assert.Equal(t, 1, conn.Stats(ackDispatched))
+	assert.Equal(t, 1, conn.Stats(ackTrimmed))
+}
+
+func TestDispatchEvent_skipsStoredDeliveries(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("SMEMBERS", config.KeyWebhooks).Expect([]interface{}{[]byte("1"), []byte("2")})
+	conn.Command("HGETALL", getWebhookKeyName(1)).ExpectMap(map[string]string{"id": "1", "url": "https://one.example.com"})
+	conn.Command("HGETALL", getWebhookKeyName(2)).ExpectMap(map[string]string{"id": "2", "url": "https://two.example.com"})
+	conn.Command("INCR", config.KeyWebhookDeliveryCounter).Expect(int64(9))
+
+	// An earlier dispatch of the event stored the delivery for the first webhook before it failed
+	markerKey := getWebhookEventDeliveriesKeyName("1-0")
+	conn.Command("HSETNX", markerKey, 1, 9).Expect(int64(0))
+	conn.Command("HGET", markerKey, 1).Expect([]byte("4"))
+	conn.Command("EXISTS", getWebhookDeliveryKeyName(4)).Expect(int64(1))
+	conn.Command("HSETNX", markerKey, 2, 9).Expect(int64(1))
+
+	conn.Command("MULTI").Expect("OK")
+	stored := conn.GenericCommand("HSET").Expect(int64(1))
+	conn.GenericCommand("LPUSH").Expect(int64(1))
+	conn.GenericCommand("LTRIM").Expect("OK")
+	scheduled := conn.GenericCommand("ZADD").Expect(int64(1))
+	conn.Command("EXPIRE", markerKey, 86400).Expect(int64(1))
+	conn.Command("EXEC").Expect([]interface{}{})
+
+	err := dispatchEvent(CatalogueEvent{Id: "1-0", Type: EventProductCreated, ProductId: 7}, conn)
+	assert.NilError(t, err)
+
+	// Only the second webhook gets a delivery
+	assert.Equal(t, 1, conn.Stats(stored))
+	assert.Equal(t, 1, conn.Stats(scheduled))
+}